@@ -0,0 +1,275 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	natpmp "github.com/jackpal/go-nat-pmp"
+)
+
+// UpstreamDiscovery finds the upstream gateway of a double NAT, given the
+// private external IP reported by the local gateway.
+type UpstreamDiscovery func(ctx context.Context, innerExternalIP net.IP) (PortMapper, error)
+
+// CascadedMapper maps ports through two NAT layers: the local gateway
+// forwards the port to the host, and the upstream gateway forwards the
+// local gateway's external port to the local gateway's external address.
+// The external IP and port reported to the caller are the upstream ones.
+type CascadedMapper struct {
+	inner           PortMapper
+	upstream        PortMapper
+	innerExternalIP string
+
+	mu sync.Mutex
+	// innerPorts records the local gateway's external port for each mapping,
+	// keyed by the protocol and the upstream external port.
+	innerPorts map[multiMappingKey]int
+}
+
+// Ensure CascadedMapper reports granted lease lifetimes, supports contexts
+// and can map for a specific address.
+var (
+	_ LeasePortMapper     = (*CascadedMapper)(nil)
+	_ ContextPortMapper   = (*CascadedMapper)(nil)
+	_ LocalAddrPortMapper = (*CascadedMapper)(nil)
+)
+
+// NewCascadedMapper creates a mapper that maps ports on inner, the local
+// gateway, and then on upstream, the gateway in front of it.
+func NewCascadedMapper(inner, upstream PortMapper) *CascadedMapper {
+	innerExternalIP, _ := inner.GetExternalIP()
+	return newCascadedMapper(inner, upstream, innerExternalIP)
+}
+
+// newCascadedMapper creates a CascadedMapper from the already known external
+// IP of the local gateway.
+func newCascadedMapper(inner, upstream PortMapper, innerExternalIP string) *CascadedMapper {
+	return &CascadedMapper{
+		inner:           inner,
+		upstream:        upstream,
+		innerExternalIP: innerExternalIP,
+		innerPorts:      make(map[multiMappingKey]int),
+	}
+}
+
+// Inner returns the mapper for the local gateway.
+func (c *CascadedMapper) Inner() PortMapper {
+	return c.inner
+}
+
+// Upstream returns the mapper for the upstream gateway.
+func (c *CascadedMapper) Upstream() PortMapper {
+	return c.upstream
+}
+
+// MapPort maps the port on both gateways. See MapPortWithLease.
+func (c *CascadedMapper) MapPort(protocol string, internalPort int, duration time.Duration) (int, error) {
+	result, err := c.MapPortWithLease(protocol, internalPort, duration)
+	if err != nil {
+		return 0, err
+	}
+	return result.ExternalPort, nil
+}
+
+// MapPortWithLease maps internalPort on the local gateway, then maps the
+// resulting external port on the upstream gateway. The lifetime is the
+// shorter of the two leases. If the upstream mapping fails, the local
+// mapping is removed and the error is returned.
+func (c *CascadedMapper) MapPortWithLease(protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	return c.MapPortContext(context.Background(), protocol, internalPort, duration)
+}
+
+// MapPortContext maps the port on both gateways as MapPortWithLease does,
+// giving up when ctx is done.
+func (c *CascadedMapper) MapPortContext(ctx context.Context, protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	inner, err := mapPortContext(ctx, c.inner, protocol, internalPort, duration)
+	if err != nil {
+		return MapPortResult{}, fmt.Errorf("local gateway mapping failed: %w", err)
+	}
+
+	outer, err := mapPortContext(ctx, c.upstream, protocol, inner.ExternalPort, duration)
+	if err != nil {
+		// ctx may be done already, so the undo gets its own bound
+		undoCtx, cancel := context.WithTimeout(context.Background(), closeUnmapTimeout)
+		defer cancel()
+		if undoErr := unmapContext(undoCtx, c.inner, protocol, inner.ExternalPort); undoErr != nil {
+			log.WithError(undoErr).WithFields(Fields{
+				"protocol":     protocol,
+				"externalPort": inner.ExternalPort,
+			}).Warn("failed to remove local gateway mapping after upstream failure")
+		}
+		return MapPortResult{}, fmt.Errorf("upstream gateway mapping failed: %w", err)
+	}
+
+	result := outer
+	if inner.Lifetime > 0 && (result.Lifetime == 0 || inner.Lifetime < result.Lifetime) {
+		result.Lifetime = inner.Lifetime
+	}
+
+	c.mu.Lock()
+	c.innerPorts[multiMappingKey{protocol, outer.ExternalPort}] = inner.ExternalPort
+	c.mu.Unlock()
+
+	log.WithFields(Fields{
+		"protocol":          protocol,
+		"internalPort":      internalPort,
+		"innerExternalPort": inner.ExternalPort,
+		"externalPort":      outer.ExternalPort,
+	}).Debug("port mapped on local and upstream gateway")
+	return result, nil
+}
+
+// UnmapPort removes the mapping from the upstream and the local gateway.
+func (c *CascadedMapper) UnmapPort(protocol string, externalPort int) error {
+	return c.UnmapPortContext(context.Background(), protocol, externalPort)
+}
+
+// UnmapPortContext removes the mapping from the upstream and the local
+// gateway, giving up when ctx is done.
+func (c *CascadedMapper) UnmapPortContext(ctx context.Context, protocol string, externalPort int) error {
+	key := multiMappingKey{protocol, externalPort}
+	c.mu.Lock()
+	innerPort, ok := c.innerPorts[key]
+	delete(c.innerPorts, key)
+	c.mu.Unlock()
+
+	if !ok {
+		innerPort = externalPort
+	}
+	return errors.Join(
+		unmapContext(ctx, c.upstream, protocol, externalPort),
+		unmapContext(ctx, c.inner, protocol, innerPort),
+	)
+}
+
+// GetExternalIP returns the external IP of the upstream gateway.
+func (c *CascadedMapper) GetExternalIP() (string, error) {
+	return c.upstream.GetExternalIP()
+}
+
+// GetExternalIPContext returns the external IP of the upstream gateway,
+// giving up when ctx is done.
+func (c *CascadedMapper) GetExternalIPContext(ctx context.Context) (string, error) {
+	return externalIPContext(ctx, c.upstream)
+}
+
+// ForLocalAddr returns a cascaded mapper whose local gateway maps for ip.
+// The upstream gateway is unchanged since it only sees the local gateway.
+func (c *CascadedMapper) ForLocalAddr(ip net.IP) (PortMapper, error) {
+	inner, err := mapperForLocalAddr(c.inner, ip)
+	if err != nil {
+		return nil, err
+	}
+	return newCascadedMapper(inner, c.upstream, c.innerExternalIP), nil
+}
+
+// cascadeIfDoubleNAT checks the external IP reported by mapper. If it is
+// private, the upstream gateway is discovered with discover and a
+// CascadedMapper over both gateways is returned. Otherwise, or if the
+// upstream gateway cannot be found, mapper is returned unchanged.
+func cascadeIfDoubleNAT(ctx context.Context, mapper PortMapper, discover UpstreamDiscovery) PortMapper {
+	externalIP, err := externalIPContext(ctx, mapper)
+	if err != nil {
+		return mapper
+	}
+	ip := net.ParseIP(externalIP)
+	if ClassifyIP(ip) != IPClassPrivate {
+		return mapper
+	}
+
+	if discover == nil {
+		discover = discoverUpstreamGateway
+	}
+	upstream, err := discover(ctx, ip)
+	if err != nil {
+		log.WithError(err).WithField("innerExternalIP", externalIP).Warn("double NAT detected but no upstream gateway found, mapping on local gateway only")
+		return mapper
+	}
+
+	log.WithField("innerExternalIP", externalIP).Info("double NAT detected, mapping ports on upstream gateway as well")
+	return newCascadedMapper(mapper, upstream, externalIP)
+}
+
+// discoverUpstreamGateway looks for a NAT-PMP gateway in front of the local
+// gateway. It probes the local gateway's own default route first, then the
+// first host address of the /24 network containing innerExternalIP, which is
+// where ISP modems and upstream routers are usually found. UPnP discovery
+// cannot be used because SSDP multicast does not cross the local gateway.
+func discoverUpstreamGateway(ctx context.Context, innerExternalIP net.IP) (PortMapper, error) {
+	if innerExternalIP.To4() == nil {
+		return nil, fmt.Errorf("upstream gateway discovery requires an IPv4 address, got %s", innerExternalIP)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, upstreamDiscoveryTimeout)
+	defer cancel()
+
+	candidates := upstreamGatewayCandidates(ctx, innerExternalIP)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no upstream gateway candidate for %s", innerExternalIP)
+	}
+
+	var errs []error
+	for i, gateway := range candidates {
+		// Share the remaining time so the last guess is still probed
+		deadline, _ := ctx.Deadline()
+		timeout := time.Until(deadline) / time.Duration(len(candidates)-i)
+		if timeout <= 0 {
+			errs = append(errs, ctx.Err())
+			break
+		}
+
+		log.WithField("gateway", gateway.String()).Debug("probing upstream gateway via NAT-PMP")
+		client := natpmp.NewClientWithTimeout(gateway, timeout)
+		if _, err := client.GetExternalAddress(); err != nil {
+			errs = append(errs, fmt.Errorf("upstream NAT-PMP gateway %s not responding: %w", gateway, err))
+			continue
+		}
+		return &NATPMPMapper{client: client, gateway: gateway}, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// upstreamHop finds the router a number of hops away on the path to an
+// address. It is a variable so tests can inject a route.
+var upstreamHop = traceHop
+
+// upstreamGatewayCandidates returns the addresses to probe for the upstream
+// gateway, most likely first: the local gateway's default route, found as the
+// second hop towards the internet, and the .1 address of the /24 network
+// containing innerExternalIP as a last guess.
+func upstreamGatewayCandidates(ctx context.Context, innerExternalIP net.IP) []net.IP {
+	ip4 := innerExternalIP.To4()
+	var candidates []net.IP
+	add := func(ip net.IP) {
+		if ip == nil || ip.Equal(ip4) {
+			return
+		}
+		for _, c := range candidates {
+			if c.Equal(ip) {
+				return
+			}
+		}
+		candidates = append(candidates, ip)
+	}
+
+	traceCtx, cancel := context.WithTimeout(ctx, upstreamTraceTimeout)
+	hop, err := upstreamHop(traceCtx, net.IPv4(8, 8, 8, 8), 2)
+	cancel()
+	switch {
+	case err != nil:
+		log.WithError(err).Debug("failed to trace the local gateway's default route")
+	case ClassifyIP(hop) == IPClassPublic:
+		// The local gateway routes straight to the internet; the upstream
+		// gateway, if any, does not answer traces
+		log.WithField("hop", hop.String()).Debug("second hop is public, not an upstream gateway")
+	default:
+		add(hop)
+	}
+
+	add(net.IPv4(ip4[0], ip4[1], ip4[2], 1))
+	return candidates
+}
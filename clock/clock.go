@@ -0,0 +1,56 @@
+// Package clock provides an injectable source of time for port mapping
+// renewal, so renewal schedules can be driven deterministically in tests.
+// Use clocktest.Fake in tests and Real in production code.
+package clock
+
+import "time"
+
+// Clock tells the time and creates timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a Timer that sends the current time on its channel after d.
+	NewTimer(d time.Duration) Timer
+	// AfterFunc waits for d and then calls f in its own goroutine.
+	// The returned Timer's C method returns nil.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a single event timer, like *time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing and reports whether it was active.
+	Stop() bool
+	// Reset changes the timer to expire after d and reports whether it was active.
+	Reset(d time.Duration) bool
+}
+
+// Real returns a Clock backed by the time package.
+func Real() Clock {
+	return realClock{}
+}
+
+// realClock implements Clock using the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+// realTimer adapts *time.Timer to the Timer interface.
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
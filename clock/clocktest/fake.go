@@ -0,0 +1,190 @@
+// Package clocktest provides a manually driven clock.Clock for tests.
+package clocktest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-i2p/go-nat-listener/clock"
+)
+
+// Fake is a clock.Clock whose time only moves when the test says so.
+//
+// Advance moves time forward and fires every timer that becomes due, which
+// drives renewals, retries and lease expiry without real waiting. Jump moves
+// the wall clock without firing timers, simulating a system suspend or a
+// clock step. BlockUntil lets a test wait until the code under test has armed
+// its timers before advancing.
+type Fake struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+var _ clock.Clock = (*Fake)(nil)
+
+// NewFake creates a fake clock set to start. A zero start uses a fixed date.
+func NewFake(start time.Time) *Fake {
+	if start.IsZero() {
+		start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	f := &Fake{now: start}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now returns the fake current time.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTimer creates a timer that fires once the fake time reaches now+d.
+func (f *Fake) NewTimer(d time.Duration) clock.Timer {
+	return f.addTimer(d, nil)
+}
+
+// AfterFunc calls fn in its own goroutine once the fake time reaches now+d.
+func (f *Fake) AfterFunc(d time.Duration, fn func()) clock.Timer {
+	return f.addTimer(d, fn)
+}
+
+func (f *Fake) addTimer(d time.Duration, fn func()) *fakeTimer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTimer{fake: f, fn: fn}
+	if fn == nil {
+		t.ch = make(chan time.Time, 1)
+	}
+	f.timers = append(f.timers, t)
+	t.armLocked(d)
+	return t
+}
+
+// Advance moves the fake time forward by d and fires every timer that is due,
+// in deadline order.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+
+	var due []*fakeTimer
+	for _, t := range f.timers {
+		if t.active && !t.deadline.After(f.now) {
+			due = append(due, t)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].deadline.Before(due[j].deadline)
+	})
+
+	for _, t := range due {
+		t.active = false
+		if t.fn != nil {
+			go t.fn()
+			continue
+		}
+		select {
+		case t.ch <- t.deadline:
+		default:
+		}
+	}
+	f.cond.Broadcast()
+}
+
+// Jump moves the wall clock forward by d without firing any timer. Pending
+// timers are shifted by d, as monotonic time does not advance while a system
+// is suspended.
+func (f *Fake) Jump(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+	for _, t := range f.timers {
+		t.deadline = t.deadline.Add(d)
+	}
+}
+
+// Timers returns the number of armed timers.
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.activeLocked()
+}
+
+// BlockUntil blocks until exactly n timers are armed.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for f.activeLocked() != n {
+		f.cond.Wait()
+	}
+}
+
+func (f *Fake) activeLocked() int {
+	active := 0
+	for _, t := range f.timers {
+		if t.active {
+			active++
+		}
+	}
+	return active
+}
+
+// fakeTimer implements clock.Timer for Fake. Like *time.Timer since Go 1.23,
+// Stop and Reset discard a fired but unreceived value.
+type fakeTimer struct {
+	fake     *Fake
+	ch       chan time.Time
+	fn       func()
+	deadline time.Time
+	active   bool
+}
+
+// armLocked schedules the timer d from now. Must be called with fake.mu held.
+func (t *fakeTimer) armLocked(d time.Duration) {
+	t.deadline = t.fake.now.Add(d)
+	t.active = true
+	t.fake.cond.Broadcast()
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.fake.mu.Lock()
+	defer t.fake.mu.Unlock()
+
+	wasActive := t.active
+	t.active = false
+	t.drainLocked()
+	t.fake.cond.Broadcast()
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.fake.mu.Lock()
+	defer t.fake.mu.Unlock()
+
+	wasActive := t.active
+	t.drainLocked()
+	t.armLocked(d)
+	return wasActive
+}
+
+// drainLocked discards a pending value. Must be called with fake.mu held.
+func (t *fakeTimer) drainLocked() {
+	if t.ch == nil {
+		return
+	}
+	select {
+	case <-t.ch:
+	default:
+	}
+}
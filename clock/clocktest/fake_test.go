@@ -0,0 +1,100 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeAdvanceFiresDueTimers(t *testing.T) {
+	f := NewFake(time.Time{})
+	start := f.Now()
+
+	early := f.NewTimer(time.Second)
+	late := f.NewTimer(time.Minute)
+
+	f.Advance(2 * time.Second)
+
+	select {
+	case got := <-early.C():
+		if want := start.Add(time.Second); !got.Equal(want) {
+			t.Errorf("Expected timer to deliver %v, got %v", want, got)
+		}
+	default:
+		t.Fatal("Expected due timer to fire")
+	}
+	select {
+	case <-late.C():
+		t.Fatal("Timer fired before its deadline")
+	default:
+	}
+	if n := f.Timers(); n != 1 {
+		t.Errorf("Expected 1 armed timer, got %d", n)
+	}
+}
+
+func TestFakeJumpDoesNotFireTimers(t *testing.T) {
+	f := NewFake(time.Time{})
+	start := f.Now()
+	timer := f.NewTimer(time.Minute)
+
+	f.Jump(time.Hour)
+	if got := f.Now().Sub(start); got != time.Hour {
+		t.Errorf("Expected wall clock to move by 1h, got %v", got)
+	}
+	f.Advance(30 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("Timer fired after a jump")
+	default:
+	}
+
+	f.Advance(30 * time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatal("Expected timer to fire after its remaining duration")
+	}
+}
+
+func TestFakeStopAndReset(t *testing.T) {
+	f := NewFake(time.Time{})
+	timer := f.NewTimer(time.Second)
+	f.Advance(time.Second)
+
+	// Reset discards the unreceived value, like *time.Timer
+	if timer.Reset(time.Second) {
+		t.Error("Expected Reset of a fired timer to report inactive")
+	}
+	select {
+	case <-timer.C():
+		t.Fatal("Expected stale value to be discarded by Reset")
+	default:
+	}
+
+	if !timer.Stop() {
+		t.Error("Expected Stop of an armed timer to report active")
+	}
+	f.Advance(time.Hour)
+	select {
+	case <-timer.C():
+		t.Fatal("Stopped timer fired")
+	default:
+	}
+}
+
+func TestFakeAfterFuncAndBlockUntil(t *testing.T) {
+	f := NewFake(time.Time{})
+	called := make(chan struct{})
+
+	go func() {
+		f.AfterFunc(time.Second, func() { close(called) })
+	}()
+	f.BlockUntil(1)
+	f.Advance(time.Second)
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("Expected AfterFunc callback to run")
+	}
+}
@@ -0,0 +1,724 @@
+// Command natctl inspects and manages port mappings on the local gateway.
+//
+// It discovers the gateway and maps ports exactly as applications using the
+// nattraversal package do, so it can be used to debug a router without
+// writing Go:
+//
+//	natctl discover
+//	natctl map tcp 8080 -lease 1h
+//	natctl unmap tcp 8080
+//	natctl list
+//	natctl external-ip
+//	natctl diagnose -json
+//	natctl watch udp 9000
+//	natctl cleanup
+//
+// Flags may come before or after the arguments.
+// Set DEBUG_I2P=debug to see the library's log messages.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	nattraversal "github.com/go-i2p/go-nat-listener"
+)
+
+// Exit codes
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// defaultTimeout bounds gateway discovery and requests.
+const defaultTimeout = 30 * time.Second
+
+// defaultLease matches the lease requested by listeners.
+const defaultLease = 90 * time.Minute
+
+// discover finds the port mapper. It is a variable so tests can inject a mock.
+var discover = nattraversal.NewPortMapperContext
+
+// discoverGateway finds the gateway's port mapper, bypassing a natd daemon.
+// It is a variable so tests can inject a mock.
+var discoverGateway = nattraversal.NewGatewayPortMapperContext
+
+// interfaceAddrs lists the local addresses. It is a variable so tests can
+// inject addresses.
+var interfaceAddrs = net.InterfaceAddrs
+
+// command is a natctl subcommand.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(c *cmdContext, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"discover", "[-timeout d]", "discover the gateway's port mapping protocol", runDiscover},
+		{"map", "[-lease d] [-hold] [-timeout d] <tcp|udp> <port>", "map a port on the gateway", runMap},
+		{"unmap", "[-timeout d] <tcp|udp> <external-port>", "remove a port mapping", runUnmap},
+		{"list", "[-timeout d]", "list the gateway's port mappings (UPnP only)", runList},
+		{"external-ip", "[-timeout d]", "print the external IP and NAT topology", runExternalIP},
+		{"diagnose", "[-json] [-timeout d]", "run a full NAT diagnosis", runDiagnose},
+		{"watch", "[-timeout d] <tcp|udp> <port>", "listen on a port and stream mapping events", runWatch},
+		{"cleanup", "[-dry-run] [-all] [-timeout d]", "remove stale mappings created by this host", runCleanup},
+	}
+}
+
+// usageError is returned for invalid command lines.
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+// usagef returns a usageError.
+func usagef(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// cmdContext holds the state shared by a subcommand's implementation.
+type cmdContext struct {
+	ctx    context.Context // canceled on SIGINT or SIGTERM
+	stdout io.Writer
+	stderr io.Writer
+	flags  *flag.FlagSet
+	args   []string // positional arguments, set by parse
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command line and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage(stderr)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(stderr, "natctl: unknown command %q\n\n", args[0])
+		printUsage(stderr)
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	flags := flag.NewFlagSet("natctl "+cmd.name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: natctl %s %s\n", cmd.name, cmd.args)
+		flags.PrintDefaults()
+	}
+	c := &cmdContext{ctx: ctx, stdout: stdout, stderr: stderr, flags: flags}
+
+	err := cmd.run(c, args[1:])
+	var usage *usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &usage):
+		fmt.Fprintf(stderr, "natctl %s: %v\n", cmd.name, err)
+		flags.Usage()
+		return exitUsage
+	case isFlagError(err):
+		// The flag package has already printed the error and usage
+		return exitUsage
+	default:
+		fmt.Fprintf(stderr, "natctl %s: %v\n", cmd.name, err)
+		return exitFailure
+	}
+}
+
+// flagError marks errors returned by flag parsing.
+type flagError struct {
+	err error
+}
+
+func (e *flagError) Error() string {
+	return e.err.Error()
+}
+
+func (e *flagError) Unwrap() error {
+	return e.err
+}
+
+func isFlagError(err error) bool {
+	var fe *flagError
+	return errors.As(err, &fe)
+}
+
+// findCommand returns the subcommand called name, or nil.
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// printUsage writes the list of subcommands.
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: natctl <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'natctl <command> -h' for the flags of a command.")
+}
+
+// parse parses the flags and checks the number of positional arguments.
+// Flags may follow the positional arguments, as in "map tcp 8080 -lease 1h";
+// everything after "--" is positional.
+// It adds the -timeout flag shared by every subcommand and returns its value.
+func (c *cmdContext) parse(args []string, positional int) (*time.Duration, error) {
+	timeout := c.flags.Duration("timeout", defaultTimeout, "bound on gateway discovery and requests")
+	c.args = nil
+	for {
+		if err := c.flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, &flagError{err: err}
+		}
+		rest := c.flags.Args()
+		if len(rest) == 0 {
+			break
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			c.args = append(c.args, rest...)
+			break
+		}
+		// The flag package stops at the first positional argument
+		c.args = append(c.args, rest[0])
+		args = rest[1:]
+	}
+	if len(c.args) != positional {
+		return nil, usagef("expected %d arguments, got %d", positional, len(c.args))
+	}
+	return timeout, nil
+}
+
+// discoverMapper discovers the port mapper within timeout.
+func (c *cmdContext) discoverMapper(timeout time.Duration) (nattraversal.PortMapper, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, timeout)
+	defer cancel()
+	mapper, err := discover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("no port mapper found: %w", err)
+	}
+	return mapper, nil
+}
+
+// parseProtocol validates a protocol argument and returns it in the form the
+// library uses.
+func parseProtocol(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "tcp":
+		return "TCP", nil
+	case "udp":
+		return "UDP", nil
+	default:
+		return "", usagef("invalid protocol %q, expected tcp or udp", s)
+	}
+}
+
+// parsePort validates a port argument.
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, usagef("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// parseMapping parses the <tcp|udp> <port> arguments.
+func (c *cmdContext) parseMapping() (string, int, error) {
+	protocol, err := parseProtocol(c.args[0])
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := parsePort(c.args[1])
+	if err != nil {
+		return "", 0, err
+	}
+	return protocol, port, nil
+}
+
+// formatLease formats a lease lifetime, zero meaning no expiry.
+func formatLease(lease time.Duration) string {
+	if lease <= 0 {
+		return "permanent"
+	}
+	return lease.String()
+}
+
+func runDiscover(c *cmdContext, args []string) error {
+	timeout, err := c.parse(args, 0)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	mapper, err := c.discoverMapper(*timeout)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "mapper:      %s (%s)\n", nattraversal.MapperName(mapper), time.Since(start).Round(time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(c.ctx, *timeout)
+	defer cancel()
+	externalIP, err := nattraversal.AsContextPortMapper(mapper).GetExternalIPContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get external IP: %w", err)
+	}
+	fmt.Fprintf(c.stdout, "external ip: %s\n", externalIP)
+	return nil
+}
+
+func runMap(c *cmdContext, args []string) error {
+	lease := c.flags.Duration("lease", defaultLease, "requested lease lifetime")
+	hold := c.flags.Bool("hold", false, "keep renewing the mapping until interrupted, then remove it")
+	timeout, err := c.parse(args, 2)
+	if err != nil {
+		return err
+	}
+	protocol, port, err := c.parseMapping()
+	if err != nil {
+		return err
+	}
+	if *lease <= 0 {
+		return usagef("lease must be positive")
+	}
+
+	mapper, err := c.discoverMapper(*timeout)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelRequests := context.WithTimeout(c.ctx, *timeout)
+	defer cancelRequests()
+	cm := nattraversal.AsContextPortMapper(mapper)
+	result, err := cm.MapPortContext(ctx, protocol, port, *lease)
+	if err != nil {
+		return fmt.Errorf("failed to map %s port %d: %w", protocol, port, err)
+	}
+
+	externalIP, err := cm.GetExternalIPContext(ctx)
+	if err != nil {
+		externalIP = "unknown"
+	}
+	fmt.Fprintf(c.stdout, "mapped %s %d -> %s via %s (lease %s)\n",
+		protocol, port, net.JoinHostPort(externalIP, strconv.Itoa(result.ExternalPort)),
+		nattraversal.MapperName(mapper), formatLease(result.Lifetime))
+
+	if !*hold {
+		return nil
+	}
+
+	events, cancel := nattraversal.Subscribe(64)
+	defer cancel()
+
+	renewal := nattraversal.NewRenewalManager(mapper, protocol, port, result.ExternalPort)
+	renewal.SetLeaseLifetime(result.Lifetime)
+	renewal.Start()
+	fmt.Fprintln(c.stdout, "renewing until interrupted")
+
+	watchEvents(c, events, nil, func(e nattraversal.Event) bool {
+		return e.InternalPort == port && e.Protocol == protocol
+	})
+
+	// c.ctx is canceled by now, so the unmap gets its own timeout
+	stopCtx, cancelStop := context.WithTimeout(context.Background(), *timeout)
+	defer cancelStop()
+	if err := renewal.StopContext(stopCtx); err != nil {
+		return fmt.Errorf("failed to unmap %s port %d: %w", protocol, renewal.ExternalPort(), err)
+	}
+	fmt.Fprintf(c.stdout, "unmapped %s %d\n", protocol, renewal.ExternalPort())
+	return nil
+}
+
+func runUnmap(c *cmdContext, args []string) error {
+	timeout, err := c.parse(args, 2)
+	if err != nil {
+		return err
+	}
+	protocol, port, err := c.parseMapping()
+	if err != nil {
+		return err
+	}
+
+	mapper, err := c.discoverMapper(*timeout)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, *timeout)
+	defer cancel()
+	if err := nattraversal.AsContextPortMapper(mapper).UnmapPortContext(ctx, protocol, port); err != nil {
+		return fmt.Errorf("failed to unmap %s port %d: %w", protocol, port, err)
+	}
+	fmt.Fprintf(c.stdout, "unmapped %s %d\n", protocol, port)
+	return nil
+}
+
+// discoverLister discovers a port mapper that can list the gateway's
+// mappings. A natd daemon only lists its own mappings, so the gateway is
+// then discovered directly.
+func (c *cmdContext) discoverLister(timeout time.Duration) (nattraversal.PortMapper, error) {
+	mapper, err := c.discoverMapper(timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := mapper.(*nattraversal.DaemonMapper); !ok {
+		return mapper, nil
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, timeout)
+	defer cancel()
+	gateway, err := discoverGateway(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("no gateway port mapper found: %w", err)
+	}
+	return gateway, nil
+}
+
+// listMappings returns the gateway's mappings sorted by protocol and port.
+func listMappings(mapper nattraversal.PortMapper) ([]nattraversal.MappingEntry, error) {
+	lister, ok := mapper.(nattraversal.MappingLister)
+	if !ok {
+		return nil, fmt.Errorf("%s mapper cannot list mappings", nattraversal.MapperName(mapper))
+	}
+	entries, err := lister.ListMappings()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Protocol != entries[j].Protocol {
+			return entries[i].Protocol < entries[j].Protocol
+		}
+		return entries[i].ExternalPort < entries[j].ExternalPort
+	})
+	return entries, nil
+}
+
+func runList(c *cmdContext, args []string) error {
+	timeout, err := c.parse(args, 0)
+	if err != nil {
+		return err
+	}
+	mapper, err := c.discoverLister(*timeout)
+	if err != nil {
+		return err
+	}
+	entries, err := listMappings(mapper)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(c.stdout, "no port mappings")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROTO\tEXTERNAL\tINTERNAL\tLEASE\tENABLED\tDESCRIPTION")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%t\t%s\n",
+			e.Protocol, e.ExternalPort, net.JoinHostPort(e.InternalClient, strconv.Itoa(e.InternalPort)),
+			formatLease(e.Lease), e.Enabled, e.Description)
+	}
+	return tw.Flush()
+}
+
+func runExternalIP(c *cmdContext, args []string) error {
+	timeout, err := c.parse(args, 0)
+	if err != nil {
+		return err
+	}
+	mapper, err := c.discoverMapper(*timeout)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, *timeout)
+	defer cancel()
+	externalIP, err := nattraversal.AsContextPortMapper(mapper).GetExternalIPContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get external IP: %w", err)
+	}
+
+	status := nattraversal.ClassifyNAT(mapper, externalIP)
+	fmt.Fprintln(c.stdout, externalIP)
+	fmt.Fprintf(c.stdout, "class:    %s\n", status.ExternalIPClass)
+	fmt.Fprintf(c.stdout, "topology: %s\n", status.Topology)
+	if advice := status.Advice(); advice != "" {
+		fmt.Fprintf(c.stdout, "advice:   %s\n", advice)
+	}
+	return nil
+}
+
+func runDiagnose(c *cmdContext, args []string) error {
+	asJSON := c.flags.Bool("json", false, "print the report as JSON")
+	timeout, err := c.parse(args, 0)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, *timeout)
+	defer cancel()
+	report, diagErr := nattraversal.Diagnose(ctx)
+
+	// A canceled diagnosis still returns the partial report
+	if *asJSON {
+		data, err := report.JSON()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.stdout, string(data))
+	} else if err := report.WriteText(c.stdout); err != nil {
+		return err
+	}
+	return diagErr
+}
+
+func runWatch(c *cmdContext, args []string) error {
+	timeout, err := c.parse(args, 2)
+	if err != nil {
+		return err
+	}
+	protocol, port, err := c.parseMapping()
+	if err != nil {
+		return err
+	}
+
+	// Subscribe first so the discovery and mapping events are printed
+	events, cancel := nattraversal.Subscribe(64)
+	defer cancel()
+
+	ctx, cancelListen := context.WithTimeout(c.ctx, *timeout)
+	defer cancelListen()
+	lc := &nattraversal.ListenConfig{}
+
+	var reachability <-chan nattraversal.Reachability
+	var closer io.Closer
+	if protocol == "TCP" {
+		listener, err := lc.ListenWithFallback(ctx, port)
+		if err != nil {
+			return err
+		}
+		ch, stop := listener.SubscribeReachability()
+		defer stop()
+		reachability, closer = ch, listener
+		printReachability(c.stdout, listener.Reachability())
+	} else {
+		listener, err := lc.ListenPacketWithFallback(ctx, port)
+		if err != nil {
+			return err
+		}
+		ch, stop := listener.SubscribeReachability()
+		defer stop()
+		reachability, closer = ch, listener
+		printReachability(c.stdout, listener.Reachability())
+	}
+	defer closer.Close()
+
+	watchEvents(c, events, reachability, nil)
+	return nil
+}
+
+// watchEvents prints events accepted by filter (all if nil) and reachability
+// updates until the command is interrupted.
+func watchEvents(c *cmdContext, events <-chan nattraversal.Event, reachability <-chan nattraversal.Reachability, filter func(nattraversal.Event) bool) {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if filter == nil || filter(e) {
+				printEvent(c.stdout, e)
+			}
+		case r, ok := <-reachability:
+			if !ok {
+				reachability = nil
+				continue
+			}
+			printReachability(c.stdout, r)
+		}
+	}
+}
+
+// printEvent writes e on one line.
+func printEvent(w io.Writer, e nattraversal.Event) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-17s", e.Time.Format("15:04:05.000"), e.Kind)
+	if e.Mapper != "" {
+		fmt.Fprintf(&b, " mapper=%s", e.Mapper)
+	}
+	if e.Protocol != "" {
+		fmt.Fprintf(&b, " proto=%s", e.Protocol)
+	}
+	if e.InternalPort != 0 {
+		fmt.Fprintf(&b, " port=%d", e.InternalPort)
+	}
+	if e.OldExternalPort != 0 {
+		fmt.Fprintf(&b, " external=%d->%d", e.OldExternalPort, e.ExternalPort)
+	} else if e.ExternalPort != 0 {
+		fmt.Fprintf(&b, " external=%d", e.ExternalPort)
+	}
+	if e.OldExternalIP != "" {
+		fmt.Fprintf(&b, " ip=%s->%s", e.OldExternalIP, e.ExternalIP)
+	} else if e.ExternalIP != "" {
+		fmt.Fprintf(&b, " ip=%s", e.ExternalIP)
+	}
+	if e.Lifetime != 0 {
+		fmt.Fprintf(&b, " lease=%s", e.Lifetime)
+	}
+	if e.Duration != 0 {
+		fmt.Fprintf(&b, " took=%s", e.Duration.Round(time.Millisecond))
+	}
+	if e.Err != nil {
+		fmt.Fprintf(&b, " error=%q", e.Err.Error())
+	}
+	fmt.Fprintln(w, b.String())
+}
+
+// printReachability writes r on one line.
+func printReachability(w io.Writer, r nattraversal.Reachability) {
+	fmt.Fprintf(w, "%s reachability      status=%s mapper=%s external=%s topology=%s mapping=%s\n",
+		time.Now().Format("15:04:05.000"), r.Status, r.Mapper, r.ExternalAddr, r.Topology, r.MappingState)
+}
+
+// isLocalAddress reports whether ip is assigned to a local interface.
+func isLocalAddress(ip string) (bool, error) {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return false, fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+	parsed := net.ParseIP(ip)
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(parsed) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// portInUse reports whether a local socket is bound to port on ip. A port
+// that cannot be bound for another reason, such as a privileged port, is
+// assumed to be in use. It is a variable so tests can fake bound ports.
+var portInUse = func(protocol, ip string, port int) bool {
+	address := net.JoinHostPort(ip, strconv.Itoa(port))
+	var err error
+	if protocol == "UDP" {
+		var conn net.PacketConn
+		if conn, err = net.ListenPacket("udp4", address); err == nil {
+			conn.Close()
+		}
+	} else {
+		var listener net.Listener
+		if listener, err = net.Listen("tcp4", address); err == nil {
+			listener.Close()
+		}
+	}
+	return err != nil
+}
+
+func runCleanup(c *cmdContext, args []string) error {
+	dryRun := c.flags.Bool("dry-run", false, "only print the mappings that would be removed")
+	all := c.flags.Bool("all", false, "also remove mappings whose internal port is in use by a running application")
+	timeout, err := c.parse(args, 0)
+	if err != nil {
+		return err
+	}
+	mapper, err := c.discoverLister(*timeout)
+	if err != nil {
+		return err
+	}
+	entries, err := listMappings(mapper)
+	if err != nil {
+		return err
+	}
+
+	// Only mappings created by this package for this host are removed, and
+	// unless -all is given only those whose internal port nothing listens on,
+	// since the others belong to running listeners or natd sessions.
+	removed, failed, kept := 0, 0, 0
+	for _, e := range entries {
+		if e.Description != nattraversal.MappingDescription {
+			continue
+		}
+		local, err := isLocalAddress(e.InternalClient)
+		if err != nil {
+			return err
+		}
+		if !local {
+			continue
+		}
+		if !*all && portInUse(e.Protocol, e.InternalClient, e.InternalPort) {
+			kept++
+			continue
+		}
+
+		target := fmt.Sprintf("%s %d -> %s", e.Protocol, e.ExternalPort, net.JoinHostPort(e.InternalClient, strconv.Itoa(e.InternalPort)))
+		if *dryRun {
+			fmt.Fprintf(c.stdout, "would remove %s\n", target)
+			removed++
+			continue
+		}
+		ctx, cancel := context.WithTimeout(c.ctx, *timeout)
+		err = nattraversal.AsContextPortMapper(mapper).UnmapPortContext(ctx, e.Protocol, e.ExternalPort)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(c.stderr, "failed to remove %s: %v\n", target, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(c.stdout, "removed %s\n", target)
+		removed++
+	}
+
+	if removed == 0 && failed == 0 {
+		fmt.Fprintln(c.stdout, "no stale mappings")
+	}
+	if kept > 0 {
+		fmt.Fprintf(c.stdout, "kept %d mappings in use, run with -all to remove them\n", kept)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to remove %d of %d mappings", failed, removed+failed)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	nattraversal "github.com/go-i2p/go-nat-listener"
+)
+
+// useMapper makes discovery return mapper for the duration of the test.
+func useMapper(t *testing.T, mapper nattraversal.PortMapper, err error) {
+	t.Helper()
+	orig := discover
+	discover = func(context.Context) (nattraversal.PortMapper, error) {
+		return mapper, err
+	}
+	t.Cleanup(func() { discover = orig })
+}
+
+// runCommand runs natctl with args and returns its exit code and output.
+func runCommand(args ...string) (int, string, string) {
+	var stdout, stderr strings.Builder
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestUsage(t *testing.T) {
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{nil, exitUsage},
+		{[]string{"help"}, exitOK},
+		{[]string{"bogus"}, exitUsage},
+		{[]string{"map", "tcp"}, exitUsage},
+		{[]string{"map", "sctp", "80"}, exitUsage},
+		{[]string{"map", "tcp", "70000"}, exitUsage},
+		{[]string{"map", "-lease", "0s", "tcp", "80"}, exitUsage},
+		{[]string{"map", "tcp", "80", "--lease", "0s"}, exitUsage},
+		{[]string{"map", "tcp", "80", "extra"}, exitUsage},
+		{[]string{"list", "extra"}, exitUsage},
+		{[]string{"unmap", "-bogus", "tcp", "80"}, exitUsage},
+		{[]string{"diagnose", "-h"}, exitOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			code, _, stderr := runCommand(tt.args...)
+			if code != tt.code {
+				t.Errorf("Expected exit code %d, got %d: %s", tt.code, code, stderr)
+			}
+			if !strings.Contains(stderr, "usage: natctl") {
+				t.Errorf("Expected usage on stderr, got %q", stderr)
+			}
+		})
+	}
+}
+
+func TestMapListUnmap(t *testing.T) {
+	mapper := nattraversal.NewMockPortMapper()
+	mapper.SetNATType(nattraversal.FullConeNAT)
+	useMapper(t, mapper, nil)
+
+	code, stdout, stderr := runCommand("map", "-lease", "1h", "tcp", "8080")
+	if code != exitOK {
+		t.Fatalf("map failed with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "mapped TCP 8080 -> 203.0.113.100:8080") {
+		t.Errorf("Unexpected map output: %q", stdout)
+	}
+
+	code, stdout, stderr = runCommand("list")
+	if code != exitOK {
+		t.Fatalf("list failed with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "TCP    8080      127.0.0.1:8080") {
+		t.Errorf("Mapping not listed: %q", stdout)
+	}
+
+	if code, _, stderr := runCommand("unmap", "tcp", "8080"); code != exitOK {
+		t.Fatalf("unmap failed with %d: %s", code, stderr)
+	}
+	if len(mapper.GetActiveMappings()) != 0 {
+		t.Error("Mapping still active after unmap")
+	}
+
+	mapper.SetFailureRate(1.0)
+	if code, _, _ := runCommand("unmap", "tcp", "8080"); code != exitFailure {
+		t.Errorf("Expected exit code %d for a failed unmap, got %d", exitFailure, code)
+	}
+}
+
+// TestMapFlagsAfterArguments tests that flags may follow the arguments
+func TestMapFlagsAfterArguments(t *testing.T) {
+	mapper := nattraversal.NewMockPortMapper()
+	useMapper(t, mapper, nil)
+
+	code, stdout, stderr := runCommand("map", "tcp", "8080", "--lease", "1h")
+	if code != exitOK {
+		t.Fatalf("map failed with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "mapped TCP 8080") || !strings.Contains(stdout, "(lease 1h0m0s)") {
+		t.Errorf("Unexpected map output: %q", stdout)
+	}
+}
+
+func TestExternalIP(t *testing.T) {
+	mapper := nattraversal.NewMockPortMapper()
+	mapper.SetExternalIP("100.64.1.2")
+	useMapper(t, mapper, nil)
+
+	code, stdout, stderr := runCommand("external-ip")
+	if code != exitOK {
+		t.Fatalf("external-ip failed with %d: %s", code, stderr)
+	}
+	for _, want := range []string{"100.64.1.2\n", "class:    cgnat", "topology: cgnat", "advice:"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("Expected %q in %q", want, stdout)
+		}
+	}
+}
+
+func TestDiscoveryFailure(t *testing.T) {
+	useMapper(t, nil, errors.New("no gateway"))
+
+	code, _, stderr := runCommand("discover", "-timeout", "1s")
+	if code != exitFailure {
+		t.Errorf("Expected exit code %d, got %d", exitFailure, code)
+	}
+	if !strings.Contains(stderr, "no port mapper found: no gateway") {
+		t.Errorf("Unexpected error output: %q", stderr)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	mapper := nattraversal.NewMockPortMapper()
+	useMapper(t, mapper, nil)
+	if _, err := mapper.MapPort("UDP", 9000, time.Hour); err != nil {
+		t.Fatalf("MapPort failed: %v", err)
+	}
+	inUse := false
+	origInUse := portInUse
+	t.Cleanup(func() { portInUse = origInUse })
+	portInUse = func(string, string, int) bool { return inUse }
+
+	// Mappings for other hosts are kept
+	orig := interfaceAddrs
+	t.Cleanup(func() { interfaceAddrs = orig })
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("192.168.1.2"), Mask: net.CIDRMask(24, 32)}}, nil
+	}
+	code, stdout, _ := runCommand("cleanup")
+	if code != exitOK || !strings.Contains(stdout, "no stale mappings") || len(mapper.GetActiveMappings()) != 1 {
+		t.Errorf("Expected no mappings removed, got %d: %q", code, stdout)
+	}
+
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)}}, nil
+	}
+
+	// Mappings of running listeners are kept unless -all is given
+	inUse = true
+	code, stdout, _ = runCommand("cleanup")
+	if code != exitOK || !strings.Contains(stdout, "kept 1 mappings in use") || len(mapper.GetActiveMappings()) != 1 {
+		t.Errorf("Expected the mapping in use kept, got %d: %q", code, stdout)
+	}
+	code, stdout, _ = runCommand("cleanup", "-all", "-dry-run")
+	if code != exitOK || !strings.Contains(stdout, "would remove UDP") {
+		t.Errorf("Expected -all to include the mapping in use, got %d: %q", code, stdout)
+	}
+	inUse = false
+
+	code, stdout, _ = runCommand("cleanup", "-dry-run")
+	if code != exitOK || !strings.Contains(stdout, "would remove UDP") || len(mapper.GetActiveMappings()) != 1 {
+		t.Errorf("Dry run changed mappings or printed nothing, got %d: %q", code, stdout)
+	}
+
+	code, stdout, _ = runCommand("cleanup")
+	if code != exitOK || !strings.Contains(stdout, "removed UDP") || len(mapper.GetActiveMappings()) != 0 {
+		t.Errorf("Expected the mapping removed, got %d: %q", code, stdout)
+	}
+}
+
+// TestListThroughDaemon tests that list bypasses a natd daemon, which cannot
+// list the gateway's mappings
+func TestListThroughDaemon(t *testing.T) {
+	gateway := nattraversal.NewMockPortMapper()
+	if _, err := gateway.MapPort("TCP", 8080, time.Hour); err != nil {
+		t.Fatalf("MapPort failed: %v", err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "natd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", socket, err)
+	}
+	daemon := nattraversal.NewDaemonServer(gateway)
+	server := &http.Server{Handler: daemon}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		daemon.Close()
+		server.Close()
+	})
+
+	client, err := nattraversal.NewDaemonMapper(socket)
+	if err != nil {
+		t.Fatalf("NewDaemonMapper failed: %v", err)
+	}
+	defer client.Close()
+	useMapper(t, client, nil)
+	orig := discoverGateway
+	discoverGateway = func(context.Context) (nattraversal.PortMapper, error) { return gateway, nil }
+	t.Cleanup(func() { discoverGateway = orig })
+
+	code, stdout, stderr := runCommand("list")
+	if code != exitOK {
+		t.Fatalf("list failed with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "TCP    8080") {
+		t.Errorf("Gateway mapping not listed: %q", stdout)
+	}
+}
@@ -0,0 +1,152 @@
+// Command natd owns the port mappings of every process on a host.
+//
+// Processes that each run their own discovery and renewal conflict on the
+// gateway. natd discovers the gateway once and serves the DaemonServer API
+// on a Unix socket; listeners created with the nattraversal package that opt
+// in delegate their mappings to it through a DaemonMapper. Mappings
+// are released when the process that requested them disconnects.
+//
+//	natd [-socket path] [-mode 0600] [-timeout 30s]
+//
+// The socket defaults to $NATD_SOCKET, natd.sock in $XDG_RUNTIME_DIR, or
+// /run/natd/natd.sock. Processes delegate to natd only if they set
+// $NATD_SOCKET or ListenConfig.DaemonSocket, and only if natd runs as root or
+// as their own user. Set DEBUG_I2P=debug to see the library's log messages.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	nattraversal "github.com/go-i2p/go-nat-listener"
+)
+
+// shutdownTimeout bounds the wait for in-flight requests on exit.
+const shutdownTimeout = 10 * time.Second
+
+// discover finds the gateway. It is a variable so tests can inject a mock.
+var discover = nattraversal.NewGatewayPortMapperContext
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stderr, nil))
+}
+
+// run starts the daemon and serves until ctx is done. ready, if not nil,
+// receives the socket path once the daemon is listening.
+func run(ctx context.Context, args []string, stderr io.Writer, ready chan<- string) int {
+	flags := flag.NewFlagSet("natd", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	socket := flags.String("socket", nattraversal.DefaultDaemonSocket(), "path of the Unix socket")
+	mode := flags.String("mode", "0600", "permissions of the socket")
+	timeout := flags.Duration("timeout", 30*time.Second, "bound on gateway discovery")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	perm, err := strconv.ParseUint(*mode, 8, 32)
+	if err != nil || flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	if err := serve(ctx, *socket, fs.FileMode(perm), *timeout, ready); err != nil {
+		fmt.Fprintf(stderr, "natd: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// serve discovers the gateway and serves the daemon on socket until ctx is done.
+func serve(ctx context.Context, socket string, perm fs.FileMode, timeout time.Duration, ready chan<- string) error {
+	if err := checkSocket(socket); err != nil {
+		return err
+	}
+
+	discoverCtx, cancel := context.WithTimeout(ctx, timeout)
+	mapper, err := discover(discoverCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("no port mapper found: %w", err)
+	}
+
+	listener, err := listenSocket(socket, perm)
+	if err != nil {
+		return err
+	}
+
+	daemon := nattraversal.NewDaemonServer(mapper)
+	server := &http.Server{
+		Handler:           daemon,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	if ready != nil {
+		ready <- socket
+	}
+
+	select {
+	case <-ctx.Done():
+	case err := <-served:
+		daemon.Close()
+		return fmt.Errorf("server failed: %w", err)
+	}
+
+	// Closing the daemon ends the subscribe streams so the server can drain
+	daemon.Close()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	return server.Shutdown(shutdownCtx)
+}
+
+// checkSocket fails if another daemon is listening on socket, and removes
+// a stale socket file left by a daemon that did not exit cleanly.
+func checkSocket(socket string) error {
+	if _, err := os.Stat(socket); err != nil {
+		return nil
+	}
+	if conn, err := net.DialTimeout("unix", socket, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("another daemon is listening on %s", socket)
+	}
+	if err := os.Remove(socket); err != nil {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+	return nil
+}
+
+// listenSocket listens on the Unix socket with the given permissions,
+// creating its directory if needed. The socket file is removed when the
+// listener is closed.
+func listenSocket(socket string, perm fs.FileMode) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, perm); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return listener, nil
+}
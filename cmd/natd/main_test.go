@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	nattraversal "github.com/go-i2p/go-nat-listener"
+)
+
+func TestServe(t *testing.T) {
+	mock := nattraversal.NewMockPortMapper()
+	orig := discover
+	discover = func(context.Context) (nattraversal.PortMapper, error) { return mock, nil }
+	t.Cleanup(func() { discover = orig })
+
+	socket := filepath.Join(t.TempDir(), "natd.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan string, 1)
+	exited := make(chan int, 1)
+	var stderr strings.Builder
+	go func() {
+		exited <- run(ctx, []string{"-socket", socket, "-mode", "0600"}, &stderr, ready)
+	}()
+
+	select {
+	case <-ready:
+	case code := <-exited:
+		t.Fatalf("natd exited with %d: %s", code, stderr.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("natd did not start")
+	}
+
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Unexpected socket permissions: %v, %v", info, err)
+	}
+
+	// A second daemon refuses to replace the running one
+	if code := run(context.Background(), []string{"-socket", socket}, &strings.Builder{}, nil); code != 1 {
+		t.Errorf("Expected the second daemon to fail, got %d", code)
+	}
+
+	client, err := nattraversal.NewDaemonMapper(socket)
+	if err != nil {
+		t.Fatalf("NewDaemonMapper failed: %v", err)
+	}
+	if _, err := client.MapPort("TCP", 8080, time.Hour); err != nil {
+		t.Fatalf("MapPort failed: %v", err)
+	}
+
+	// Shutting down releases the mappings and removes the socket
+	cancel()
+	select {
+	case code := <-exited:
+		if code != 0 {
+			t.Errorf("natd exited with %d: %s", code, stderr.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("natd did not shut down")
+	}
+	if n := len(mock.GetActiveMappings()); n != 0 {
+		t.Errorf("Expected mappings released on shutdown, got %d", n)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Socket not removed: %v", err)
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "natd.sock")
+	if err := os.WriteFile(socket, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSocket(socket); err != nil {
+		t.Fatalf("checkSocket failed: %v", err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Error("Stale socket not removed")
+	}
+}
@@ -76,6 +76,200 @@ func TestRenewalManagerFailures(t *testing.T) {
 	})
 }
 
+// leaseClampingMapper wraps MockPortMapper to simulate a gateway that grants
+// shorter leases than requested.
+type leaseClampingMapper struct {
+	*MockPortMapper
+	maxLease time.Duration
+}
+
+func (m *leaseClampingMapper) MapPortWithLease(protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	externalPort, err := m.MockPortMapper.MapPort(protocol, internalPort, duration)
+	if err != nil {
+		return MapPortResult{}, err
+	}
+	lifetime := duration
+	if lifetime > m.maxLease {
+		lifetime = m.maxLease
+	}
+	return MapPortResult{ExternalPort: externalPort, Lifetime: lifetime}, nil
+}
+
+// TestRenewalDelay tests renewal scheduling relative to the granted lease
+func TestRenewalDelay(t *testing.T) {
+	t.Run("Long lease renews at the fixed interval", func(t *testing.T) {
+		delay := renewalDelay(mappingDuration, 0.5)
+		if delay != renewalInterval {
+			t.Errorf("Expected %v without jitter, got %v", renewalInterval, delay)
+		}
+	})
+
+	t.Run("Short lease renews at half its lifetime", func(t *testing.T) {
+		delay := renewalDelay(10*time.Minute, 0.5)
+		if delay != 5*time.Minute {
+			t.Errorf("Expected 5m, got %v", delay)
+		}
+	})
+
+	t.Run("Jitter stays within bounds", func(t *testing.T) {
+		low := renewalDelay(time.Hour, 0)
+		high := renewalDelay(time.Hour, 0.999999)
+		if low < 27*time.Minute || high > 33*time.Minute || low >= high {
+			t.Errorf("Expected jittered delays within 30m±10%%, got %v and %v", low, high)
+		}
+	})
+
+	t.Run("Non-expiring lease uses the fixed interval", func(t *testing.T) {
+		if delay := renewalDelay(0, 0.5); delay != renewalInterval {
+			t.Errorf("Expected %v, got %v", renewalInterval, delay)
+		}
+	})
+
+	t.Run("Very short lease is floored", func(t *testing.T) {
+		if delay := renewalDelay(time.Second, 0); delay != minRenewalDelay {
+			t.Errorf("Expected %v, got %v", minRenewalDelay, delay)
+		}
+	})
+}
+
+// TestRenewalManagerLeaseLifetime tests that the granted lease is honoured
+func TestRenewalManagerLeaseLifetime(t *testing.T) {
+	t.Run("Renewal records clamped lifetime", func(t *testing.T) {
+		mapper := &leaseClampingMapper{MockPortMapper: NewMockPortMapper(), maxLease: time.Hour}
+		renewal := NewRenewalManager(mapper, "TCP", 8080, 8080)
+
+		if renewal.LeaseLifetime() != mappingDuration {
+			t.Errorf("Expected default lifetime %v, got %v", mappingDuration, renewal.LeaseLifetime())
+		}
+
+		renewal.renew()
+
+		if renewal.LeaseLifetime() != time.Hour {
+			t.Errorf("Expected granted lifetime 1h, got %v", renewal.LeaseLifetime())
+		}
+	})
+
+	t.Run("Plain PortMapper is assumed to grant the requested duration", func(t *testing.T) {
+		result, err := mapPortWithLease(&portChangingMockMapper{
+			MockPortMapper: NewMockPortMapper(),
+			ports:          []int{8080},
+			callCount:      new(int),
+		}, "TCP", 8080, 20*time.Minute)
+		if err != nil {
+			t.Fatalf("mapPortWithLease failed: %v", err)
+		}
+		if result.ExternalPort != 8080 || result.Lifetime != 20*time.Minute {
+			t.Errorf("Expected port 8080 with 20m lifetime, got %+v", result)
+		}
+	})
+
+	t.Run("Short lease triggers prompt renewal", func(t *testing.T) {
+		mapper := &leaseClampingMapper{MockPortMapper: NewMockPortMapper(), maxLease: 2 * minRenewalDelay}
+		renewal := NewRenewalManager(mapper, "TCP", 8080, 8080)
+		renewal.SetLeaseLifetime(2 * minRenewalDelay)
+
+		if delay := renewal.nextRenewalDelay(); delay > 2*minRenewalDelay {
+			t.Errorf("Expected renewal well before the %v lease expires, got %v", 2*minRenewalDelay, delay)
+		}
+	})
+}
+
+// TestRetryDelay tests the capped exponential backoff for failed renewals
+func TestRetryDelay(t *testing.T) {
+	t.Run("Backoff doubles from the base delay", func(t *testing.T) {
+		for failures, expected := range map[int]time.Duration{
+			1: renewalRetryBase,
+			2: 2 * renewalRetryBase,
+			3: 4 * renewalRetryBase,
+		} {
+			if delay := retryDelay(failures, 0, 0.5); delay != expected {
+				t.Errorf("retryDelay(%d) = %v, expected %v", failures, delay, expected)
+			}
+		}
+	})
+
+	t.Run("Backoff is capped", func(t *testing.T) {
+		if delay := retryDelay(100, 0, 0.5); delay != renewalRetryMax {
+			t.Errorf("Expected cap %v, got %v", renewalRetryMax, delay)
+		}
+	})
+
+	t.Run("Retry happens before the lease expires", func(t *testing.T) {
+		if delay := retryDelay(10, 30*time.Second, 0.5); delay != 30*time.Second {
+			t.Errorf("Expected retry at lease expiry (30s), got %v", delay)
+		}
+	})
+}
+
+// TestRenewalManagerStateMachine tests Active, Degraded and Lost transitions
+func TestRenewalManagerStateMachine(t *testing.T) {
+	t.Run("Failure before expiry degrades, success recovers", func(t *testing.T) {
+		mock := NewMockPortMapper()
+		renewal := NewRenewalManager(mock, "TCP", 8080, 8080)
+
+		var transitions []string
+		renewal.SetStateChangeCallback(func(oldState, newState MappingState) {
+			transitions = append(transitions, oldState.String()+"->"+newState.String())
+		})
+
+		if renewal.State() != MappingActive {
+			t.Fatalf("Expected initial state active, got %v", renewal.State())
+		}
+
+		mock.SetFailureRate(1.0)
+		if err := renewal.renew(); err == nil {
+			t.Fatal("Expected renewal to fail")
+		}
+		if renewal.State() != MappingDegraded {
+			t.Errorf("Expected degraded after failure, got %v", renewal.State())
+		}
+
+		mock.SetFailureRate(0)
+		if err := renewal.renew(); err != nil {
+			t.Fatalf("Expected renewal to succeed: %v", err)
+		}
+		if renewal.State() != MappingActive {
+			t.Errorf("Expected active after recovery, got %v", renewal.State())
+		}
+
+		expected := []string{"active->degraded", "degraded->active"}
+		if len(transitions) != len(expected) {
+			t.Fatalf("Expected transitions %v, got %v", expected, transitions)
+		}
+		for i := range expected {
+			if transitions[i] != expected[i] {
+				t.Errorf("Expected transition %s, got %s", expected[i], transitions[i])
+			}
+		}
+	})
+
+	t.Run("Failure after lease expiry marks mapping lost", func(t *testing.T) {
+		mock := NewMockPortMapper()
+		mock.SetFailureRate(1.0)
+		renewal := NewRenewalManager(mock, "TCP", 8080, 8080)
+
+		renewal.mu.Lock()
+		renewal.leaseExpiry = time.Now().Add(-time.Second)
+		renewal.mu.Unlock()
+
+		renewal.renew()
+		if renewal.State() != MappingLost {
+			t.Errorf("Expected lost after lease expiry, got %v", renewal.State())
+		}
+	})
+
+	t.Run("Failures schedule retries instead of full interval", func(t *testing.T) {
+		mock := NewMockPortMapper()
+		mock.SetFailureRate(1.0)
+		renewal := NewRenewalManager(mock, "TCP", 8080, 8080)
+
+		renewal.renew()
+		if delay := renewal.nextDelay(); delay > renewalRetryBase*2 {
+			t.Errorf("Expected a short retry delay after failure, got %v", delay)
+		}
+	})
+}
+
 // TestListenerFunctionality tests NAT listener operations
 func TestListenerFunctionality(t *testing.T) {
 	t.Run("NAT address properties", func(t *testing.T) {
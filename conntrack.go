@@ -0,0 +1,291 @@
+package nattraversal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnLimits enables tracking of the connections accepted by a NATListener
+// and bounds them. The zero value tracks connections without limits.
+type ConnLimits struct {
+	// MaxConns caps the connections open at once. While the cap is reached,
+	// Accept waits and new connections wait in the listen backlog.
+	// Zero means no limit.
+	MaxConns int
+	// MaxConnsPerIP caps the connections open at once from one remote IP.
+	// Further connections from the IP are closed as soon as they are
+	// accepted. Zero means no limit.
+	MaxConnsPerIP int
+	// IdleTimeout closes connections without reads or writes for this long.
+	// Zero means connections are never closed for being idle.
+	IdleTimeout time.Duration
+}
+
+// ConnInfo describes an open connection tracked by a NATListener.
+type ConnInfo struct {
+	RemoteAddr   string    `json:"remote_addr"`
+	Accepted     time.Time `json:"accepted"`
+	LastActivity time.Time `json:"last_activity"`
+	BytesRead    int64     `json:"bytes_read"`
+	BytesWritten int64     `json:"bytes_written"`
+}
+
+// ConnStats counts the connections tracked by a NATListener.
+type ConnStats struct {
+	// Active is the number of open connections.
+	Active int `json:"active"`
+	// Accepted counts the connections handed out by Accept.
+	Accepted uint64 `json:"accepted"`
+	// RejectedPerIP counts the connections closed on accept because their
+	// remote IP reached MaxConnsPerIP.
+	RejectedPerIP uint64 `json:"rejected_per_ip"`
+	// ClosedIdle counts the connections closed after IdleTimeout.
+	ClosedIdle uint64 `json:"closed_idle"`
+}
+
+// connTable tracks the open connections of a listener and enforces its
+// ConnLimits.
+type connTable struct {
+	limits ConnLimits
+	slots  chan struct{} // holds a token per open connection if MaxConns is set
+	open   connTracker   // lets Shutdown wait for the connections to be closed
+	log    logEntry
+
+	mu         sync.Mutex
+	conns      map[*trackedConn]struct{}
+	perIP      map[string]int
+	accepted   uint64
+	rejected   uint64
+	idleClosed uint64
+}
+
+// newConnTable creates a table enforcing limits, or returns nil if limits is
+// nil and connections are not tracked.
+func newConnTable(limits *ConnLimits, log logEntry) *connTable {
+	if limits == nil {
+		return nil
+	}
+	t := &connTable{
+		limits: *limits,
+		log:    log,
+		conns:  make(map[*trackedConn]struct{}),
+		perIP:  make(map[string]int),
+	}
+	if limits.MaxConns > 0 {
+		t.slots = make(chan struct{}, limits.MaxConns)
+	}
+	return t
+}
+
+// acquire waits until a connection may be accepted under MaxConns. It
+// returns ctx.Err() if ctx is done first, or an error if stop is closed.
+func (t *connTable) acquire(ctx context.Context, stop <-chan struct{}) error {
+	if t.slots == nil {
+		return nil
+	}
+	select {
+	case t.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	t.log.WithField("maxConns", t.limits.MaxConns).Debug("connection limit reached, pausing accept")
+	select {
+	case t.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stop:
+		return fmt.Errorf("listener closed")
+	}
+}
+
+// release frees a slot taken by acquire.
+func (t *connTable) release() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// track starts tracking conn, which holds a slot taken by acquire. It
+// returns nil if the remote IP of conn reached MaxConnsPerIP; the caller
+// then closes conn and releases the slot.
+func (t *connTable) track(conn net.Conn) *trackedConn {
+	ip := remoteIP(conn)
+	now := time.Now()
+
+	t.mu.Lock()
+	if t.limits.MaxConnsPerIP > 0 && t.perIP[ip] >= t.limits.MaxConnsPerIP {
+		t.rejected++
+		t.mu.Unlock()
+		return nil
+	}
+	tc := &trackedConn{Conn: conn, table: t, ip: ip, accepted: now}
+	tc.lastActivity.Store(now.UnixNano())
+	t.conns[tc] = struct{}{}
+	t.perIP[ip]++
+	t.accepted++
+	t.open.add()
+	t.mu.Unlock()
+
+	if t.limits.IdleTimeout > 0 {
+		// The timer is set under tc.mu, which checkIdle takes before using it
+		tc.mu.Lock()
+		tc.idleTimer = time.AfterFunc(t.limits.IdleTimeout, tc.checkIdle)
+		tc.mu.Unlock()
+	}
+	return tc
+}
+
+// untrack stops tracking tc once it is closed.
+func (t *connTable) untrack(tc *trackedConn) {
+	t.mu.Lock()
+	delete(t.conns, tc)
+	if t.perIP[tc.ip]--; t.perIP[tc.ip] <= 0 {
+		delete(t.perIP, tc.ip)
+	}
+	t.mu.Unlock()
+
+	t.open.done()
+	t.release()
+}
+
+// snapshot describes the open connections, oldest first.
+func (t *connTable) snapshot() []ConnInfo {
+	t.mu.Lock()
+	infos := make([]ConnInfo, 0, len(t.conns))
+	for tc := range t.conns {
+		infos = append(infos, tc.info())
+	}
+	t.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Accepted.Before(infos[j].Accepted)
+	})
+	return infos
+}
+
+// stats returns the connection counts.
+func (t *connTable) stats() ConnStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return ConnStats{
+		Active:        len(t.conns),
+		Accepted:      t.accepted,
+		RejectedPerIP: t.rejected,
+		ClosedIdle:    t.idleClosed,
+	}
+}
+
+// trackedConn counts the traffic of a tracked connection and closes it once
+// it has been idle for the IdleTimeout of its table.
+type trackedConn struct {
+	net.Conn
+	table    *connTable
+	ip       string
+	accepted time.Time
+
+	lastActivity atomic.Int64 // Unix nanoseconds of the last read or write
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+
+	mu        sync.Mutex
+	idleTimer *time.Timer // nil without an IdleTimeout
+	closed    bool
+	closeErr  error
+}
+
+// Read reads from the connection and records the activity.
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.bytesRead.Add(int64(n))
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Write writes to the connection and records the activity.
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.bytesWritten.Add(int64(n))
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Close closes the connection and stops tracking it. It is idempotent.
+func (c *trackedConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return c.closeErr
+	}
+	c.closed = true
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	c.closeErr = c.Conn.Close()
+	err := c.closeErr
+	c.mu.Unlock()
+
+	c.table.untrack(c)
+	return err
+}
+
+// checkIdle closes the connection if it has been idle for the IdleTimeout,
+// and otherwise waits for the rest of it.
+func (c *trackedConn) checkIdle() {
+	timeout := c.table.limits.IdleTimeout
+	idle := time.Since(time.Unix(0, c.lastActivity.Load()))
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	if idle < timeout {
+		c.idleTimer.Reset(timeout - idle)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	c.table.mu.Lock()
+	c.table.idleClosed++
+	c.table.mu.Unlock()
+	c.table.log.WithFields(Fields{
+		"remoteAddr": c.RemoteAddr().String(),
+		"idle":       idle.String(),
+	}).Debug("closing idle TCP connection")
+	c.Close()
+}
+
+// info describes the connection.
+func (c *trackedConn) info() ConnInfo {
+	return ConnInfo{
+		RemoteAddr:   c.RemoteAddr().String(),
+		Accepted:     c.accepted,
+		LastActivity: time.Unix(0, c.lastActivity.Load()),
+		BytesRead:    c.bytesRead.Load(),
+		BytesWritten: c.bytesWritten.Load(),
+	}
+}
+
+// remoteIP returns the IP of the remote address of conn.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -0,0 +1,203 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// newTrackingListener creates a listener mapped through a mock mapper that
+// tracks its connections under limits.
+func newTrackingListener(t *testing.T, limits ConnLimits) *NATListener {
+	t.Helper()
+	useMockPortMapper(t, NewMockPortMapper())
+	lc := &ListenConfig{Connections: &limits}
+	listener, err := lc.Listen(context.Background(), freePorts(t, 1)[0])
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// TestConnLimitsMaxConns tests that Accept waits while MaxConns connections are open
+func TestConnLimitsMaxConns(t *testing.T) {
+	listener := newTrackingListener(t, ConnLimits{MaxConns: 1})
+
+	dial(t, listener)
+	first, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	dial(t, listener)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := listener.AcceptContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected Accept to wait at the limit, got %v", err)
+	}
+
+	first.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	second, err := listener.AcceptContext(ctx)
+	if err != nil {
+		t.Fatalf("Accept after a connection closed failed: %v", err)
+	}
+	defer second.Close()
+
+	if stats := listener.ConnStats(); stats.Active != 1 || stats.Accepted != 2 {
+		t.Errorf("Expected 1 active and 2 accepted connections, got %+v", stats)
+	}
+}
+
+// TestConnLimitsPerIP tests that connections over MaxConnsPerIP are closed on accept
+func TestConnLimitsPerIP(t *testing.T) {
+	listener := newTrackingListener(t, ConnLimits{MaxConnsPerIP: 1})
+
+	dial(t, listener)
+	first, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer first.Close()
+
+	rejected := dial(t, listener)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := listener.AcceptContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the connection to be rejected, got %v", err)
+	}
+
+	// The rejected connection was closed by the listener
+	rejected.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF on the rejected connection, got %v", err)
+	}
+	if stats := listener.ConnStats(); stats.RejectedPerIP != 1 || stats.Active != 1 {
+		t.Errorf("Expected 1 rejected and 1 active connection, got %+v", stats)
+	}
+}
+
+// TestConnLimitsIdleTimeout tests that idle connections are closed while active ones stay open
+func TestConnLimitsIdleTimeout(t *testing.T) {
+	listener := newTrackingListener(t, ConnLimits{IdleTimeout: 100 * time.Millisecond})
+
+	client := dial(t, listener)
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Activity postpones the timeout
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := conn.Write([]byte("x")); err != nil {
+			t.Fatalf("Write on an active connection failed: %v", err)
+		}
+	}
+	if stats := listener.ConnStats(); stats.ClosedIdle != 0 {
+		t.Fatalf("Active connection closed as idle: %+v", stats)
+	}
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(client); err != nil {
+		t.Fatalf("Expected the idle connection to be closed, got %v", err)
+	}
+	if stats := listener.ConnStats(); stats.ClosedIdle != 1 || stats.Active != 0 {
+		t.Errorf("Expected 1 idle-closed and no active connection, got %+v", stats)
+	}
+}
+
+// TestConnections tests the enumeration of open connections and their byte counters
+func TestConnections(t *testing.T) {
+	listener := newTrackingListener(t, ConnLimits{})
+
+	client := dial(t, listener)
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	conn.Write([]byte("hi"))
+
+	conns := listener.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(conns))
+	}
+	info := conns[0]
+	if info.RemoteAddr != client.LocalAddr().String() {
+		t.Errorf("Expected remote address %s, got %s", client.LocalAddr(), info.RemoteAddr)
+	}
+	if info.BytesRead != 5 || info.BytesWritten != 2 {
+		t.Errorf("Expected 5 bytes read and 2 written, got %d and %d", info.BytesRead, info.BytesWritten)
+	}
+	if info.LastActivity.Before(info.Accepted) {
+		t.Errorf("Last activity %v before accept %v", info.LastActivity, info.Accepted)
+	}
+
+	conn.Close()
+	conn.Close()
+	if conns := listener.Connections(); len(conns) != 0 {
+		t.Errorf("Expected no connections after Close, got %d", len(conns))
+	}
+	if stats := listener.ConnStats(); stats.Active != 0 || stats.Accepted != 1 {
+		t.Errorf("Unexpected stats after Close: %+v", stats)
+	}
+}
+
+// TestConnectionsUntracked tests that listeners without ConnLimits do not track connections
+func TestConnectionsUntracked(t *testing.T) {
+	listener := newServeListener(t)
+
+	dial(t, listener)
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer conn.Close()
+
+	if conns := listener.Connections(); conns != nil {
+		t.Errorf("Expected nil connections, got %v", conns)
+	}
+	if stats := listener.ConnStats(); stats != (ConnStats{}) {
+		t.Errorf("Expected zero stats, got %+v", stats)
+	}
+}
+
+// TestShutdownWaitsForTrackedConns tests that Shutdown waits for tracked connections to close
+func TestShutdownWaitsForTrackedConns(t *testing.T) {
+	listener := newTrackingListener(t, ConnLimits{})
+
+	dial(t, listener)
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- listener.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned with a connection open: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Shutdown failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return after the connection closed")
+	}
+}
@@ -6,4 +6,73 @@ import "time"
 const (
 	renewalInterval = 45 * time.Minute
 	mappingDuration = 90 * time.Minute // double the interval for safety
+
+	renewalLeaseFraction = 0.5             // renew at half of the granted lease lifetime
+	renewalJitter        = 0.1             // ±10% jitter on renewal delays
+	minRenewalDelay      = 5 * time.Second // floor for very short leases
+
+	renewalRequestTimeout = 30 * time.Second // bound on a single renewal request to the gateway
+
+	renewalRetryBase = 10 * time.Second // first retry delay after a failed renewal
+	renewalRetryMax  = 5 * time.Minute  // cap on the exponential retry backoff
+	minRetryDelay    = time.Second      // floor for retries close to lease expiry
+)
+
+// Constants for network change monitoring
+const (
+	networkChangeDebounce = 2 * time.Second  // quiet period before acting on OS network events
+	remapTimeout          = 30 * time.Second // bound on rediscovery and re-mapping after a change
+)
+
+// Constants for suspend and clock jump detection in the renewal loop
+const (
+	suspendCheckInterval = time.Minute      // how often the renewal loop compares wall and timer time
+	suspendTolerance     = 30 * time.Second // wall clock drift beyond this is treated as a suspend or jump
+)
+
+// defaultMaxConcurrentRenewals caps concurrent gateway requests made by a RenewalScheduler
+const defaultMaxConcurrentRenewals = 4
+
+// Constants for gateway discovery for a specific local address
+const (
+	localAddrDiscoveryTimeout = 30 * time.Second // bound on discovery from DirectPortMapper.ForLocalAddr without a context
+	localAddrNATPMPTimeout    = 3 * time.Second  // bound on the NAT-PMP probe of a gateway candidate
+)
+
+// Constants for upstream gateway discovery behind a double NAT
+const (
+	upstreamDiscoveryTimeout = 2 * time.Second        // bound on tracing and probing upstream gateway candidates
+	upstreamTraceTimeout     = 500 * time.Millisecond // bound on tracing the local gateway's default route
+)
+
+// Constants for reachability verification
+const (
+	hairpinTimeout       = 2 * time.Second        // bound on the hairpin connect or datagram check
+	hairpinDetectTimeout = time.Second            // bound on hairpin detection while creating a listener
+	probeTimeout         = 10 * time.Second       // bound on an external probe
+	probeAttempts        = 4                      // datagrams sent per UDP probe
+	probeInterval        = 250 * time.Millisecond // spacing between probe datagrams
+	probePeekTimeout     = 250 * time.Millisecond // wait for a probe payload on a connection accepted during a TCP probe
+)
+
+// Constants for Diagnose
+const (
+	diagnoseNATPMPTimeout   = 3 * time.Second // bound on the NAT-PMP probe, which otherwise retries for minutes
+	diagnoseMappingDuration = time.Minute     // lease requested for the test mapping
+)
+
+// daemonRequestTimeout bounds requests from a DaemonMapper to the natd daemon
+const daemonRequestTimeout = 10 * time.Second
+
+// closeUnmapTimeout bounds how long Close waits for the gateway to remove the port mapping
+const closeUnmapTimeout = 5 * time.Second
+
+// Defaults for NATListener.Serve
+const (
+	defaultServeWorkers      = 256              // connections served at once
+	defaultServeDrainTimeout = 30 * time.Second // wait for connections once accepting stops
+
+	serveAcceptRetryBase = 5 * time.Millisecond // first delay after a failed accept
+	serveAcceptRetryMax  = time.Second          // cap on the accept retry delay
+	serveCancelGrace     = time.Second          // wait after cancelling, then after closing, connections still being served
 )
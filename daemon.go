@@ -0,0 +1,641 @@
+package nattraversal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DaemonSocketEnv names the environment variable that sets the path of the
+// natd socket. Setting it also opts the process into delegating its
+// mappings to the daemon, see NewPortMapperContext.
+const DaemonSocketEnv = "NATD_SOCKET"
+
+// DefaultDaemonSocket returns the path of the natd socket: $NATD_SOCKET if
+// set, natd.sock in $XDG_RUNTIME_DIR if that is set, /run/natd/natd.sock
+// otherwise. Unlike the temporary directory, none of these can be written by
+// other users, who could otherwise bind the path first.
+func DefaultDaemonSocket() string {
+	if path := os.Getenv(DaemonSocketEnv); path != "" {
+		return path
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "natd.sock")
+	}
+	return "/run/natd/natd.sock"
+}
+
+// DaemonMapping is a port mapping held by a natd daemon on behalf of a
+// client session.
+type DaemonMapping struct {
+	Session      string `json:"session"`
+	Protocol     string `json:"protocol"`
+	InternalPort int    `json:"internal_port"`
+	ExternalPort int    `json:"external_port"`
+	// LocalIP is the internal client the mapping forwards to, if the session
+	// requested a specific local address.
+	LocalIP string `json:"local_ip,omitempty"`
+	// Lifetime is the lease granted by the gateway, which the daemon renews
+	// for as long as the session lasts.
+	Lifetime time.Duration `json:"lifetime,omitempty"`
+	State    string        `json:"state"`
+}
+
+// DaemonStatus describes a natd daemon.
+type DaemonStatus struct {
+	// Mapper names the daemon's port mapper, see MapperName.
+	Mapper          string `json:"mapper"`
+	ExternalIP      string `json:"external_ip,omitempty"`
+	ExternalIPError string `json:"external_ip_error,omitempty"`
+	Sessions        int    `json:"sessions"`
+	Mappings        int    `json:"mappings"`
+}
+
+// daemonMapRequest is the body of a mapping request.
+type daemonMapRequest struct {
+	Session      string `json:"session"`
+	Protocol     string `json:"protocol"`
+	InternalPort int    `json:"internal_port"`
+	// LocalIP, if set, is the local address the mapping forwards to instead
+	// of the address of the daemon's default route.
+	LocalIP string `json:"local_ip,omitempty"`
+}
+
+// daemonMessage is a line of the subscribe stream. The first line carries
+// the session ID, the following ones an event.
+type daemonMessage struct {
+	Session string       `json:"session,omitempty"`
+	Event   *daemonEvent `json:"event,omitempty"`
+}
+
+// daemonEvent is the JSON form of an Event.
+type daemonEvent struct {
+	Kind            string        `json:"kind"`
+	Time            time.Time     `json:"time"`
+	Mapper          string        `json:"mapper,omitempty"`
+	Protocol        string        `json:"protocol,omitempty"`
+	InternalPort    int           `json:"internal_port,omitempty"`
+	ExternalPort    int           `json:"external_port,omitempty"`
+	OldExternalPort int           `json:"old_external_port,omitempty"`
+	ExternalIP      string        `json:"external_ip,omitempty"`
+	OldExternalIP   string        `json:"old_external_ip,omitempty"`
+	Duration        time.Duration `json:"duration,omitempty"`
+	Lifetime        time.Duration `json:"lifetime,omitempty"`
+	Error           string        `json:"error,omitempty"`
+}
+
+// newDaemonEvent converts e to its JSON form.
+func newDaemonEvent(e Event) *daemonEvent {
+	de := &daemonEvent{
+		Kind:            e.Kind.String(),
+		Time:            e.Time,
+		Mapper:          e.Mapper,
+		Protocol:        e.Protocol,
+		InternalPort:    e.InternalPort,
+		ExternalPort:    e.ExternalPort,
+		OldExternalPort: e.OldExternalPort,
+		ExternalIP:      e.ExternalIP,
+		OldExternalIP:   e.OldExternalIP,
+		Duration:        e.Duration,
+		Lifetime:        e.Lifetime,
+	}
+	if e.Err != nil {
+		de.Error = e.Err.Error()
+	}
+	return de
+}
+
+// daemonErrorBody is the body of an error response.
+type daemonErrorBody struct {
+	Error string `json:"error"`
+}
+
+// DaemonServer owns the port mappings of the processes on a host, so that
+// they do not each run discovery and renewal and conflict on the gateway.
+// It serves an HTTP and JSON API, meant to be exposed on a Unix socket:
+//
+//	GET    /v1/subscribe                      open a session, then stream events (NDJSON)
+//	POST   /v1/mappings                       request a mapping for a session, optionally for a local IP
+//	DELETE /v1/mappings/{protocol}/{port}     release a mapping by external port
+//	GET    /v1/mappings                       list the mappings
+//	GET    /v1/status                         mapper and external IP
+//
+// A mapping belongs to the session it was requested in, and is released when
+// the subscribe stream that opened the session ends, for example because
+// the client process exited.
+type DaemonServer struct {
+	mapper   PortMapper
+	discover mapperDiscovery // rediscovers the port mapper after a network change
+	monitor  *NetworkMonitor
+	mux      *http.ServeMux
+
+	mu       sync.Mutex
+	sessions map[string]*daemonSession
+	leases   map[string]*daemonLease // keyed by protocol and internal port
+	closed   bool
+	done     chan struct{}
+}
+
+// daemonSession is a client connection and the mappings it owns.
+type daemonSession struct {
+	id     string
+	leases map[string]*daemonLease
+}
+
+// daemonLease is a mapping held for a session and renewed by the daemon.
+type daemonLease struct {
+	session      *daemonSession
+	protocol     string
+	internalPort int
+	localIP      net.IP // nil for the address of the default route
+	// renewal is nil while the gateway mapping is being created; ready is
+	// closed once that attempt ends.
+	renewal *RenewalManager
+	ready   chan struct{}
+}
+
+// Ensure DaemonServer is an http.Handler.
+var _ http.Handler = (*DaemonServer)(nil)
+
+// NewDaemonServer creates a daemon that maps ports through mapper, which
+// should come from NewGatewayPortMapperContext so that the daemon does not
+// delegate to itself. On platforms that report network changes, the daemon
+// rediscovers the gateway and re-creates its mappings when the network
+// changes. Close releases every mapping.
+func NewDaemonServer(mapper PortMapper) *DaemonServer {
+	s := &DaemonServer{
+		mapper:   mapper,
+		discover: NewGatewayPortMapperContext,
+		mux:      http.NewServeMux(),
+		sessions: make(map[string]*daemonSession),
+		leases:   make(map[string]*daemonLease),
+		done:     make(chan struct{}),
+	}
+	s.mux.HandleFunc("GET /v1/subscribe", s.handleSubscribe)
+	s.mux.HandleFunc("POST /v1/mappings", s.handleMap)
+	s.mux.HandleFunc("DELETE /v1/mappings/{protocol}/{port}", s.handleRelease)
+	s.mux.HandleFunc("GET /v1/mappings", s.handleList)
+	s.mux.HandleFunc("GET /v1/status", s.handleStatus)
+	s.monitor = startNetworkMonitor(s.handleNetworkChange)
+
+	log.WithField("mapper", MapperName(mapper)).Info("natd daemon server created")
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *DaemonServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close ends every session and releases its mappings. Subscribe streams
+// return, so an http.Server serving the daemon can then shut down.
+func (s *DaemonServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	renewals := leaseRenewals(s.leases)
+	s.leases = make(map[string]*daemonLease)
+	s.sessions = make(map[string]*daemonSession)
+	monitor := s.monitor
+	s.mu.Unlock()
+
+	if monitor != nil {
+		monitor.Stop()
+	}
+	for _, renewal := range renewals {
+		renewal.Stop()
+	}
+	log.WithField("mappings", len(renewals)).Info("natd daemon server closed")
+	return nil
+}
+
+// leaseRenewals returns the renewal managers of the leases whose mapping was
+// created. Pending mappings are removed by mapLease once it notices the
+// lease was dropped. The caller holds the server lock.
+func leaseRenewals(leases map[string]*daemonLease) []*RenewalManager {
+	renewals := make([]*RenewalManager, 0, len(leases))
+	for _, lease := range leases {
+		if lease.renewal != nil {
+			renewals = append(renewals, lease.renewal)
+		}
+	}
+	return renewals
+}
+
+// leaseKey identifies the mapping of an internal port.
+func leaseKey(protocol string, internalPort int) string {
+	return fmt.Sprintf("%s:%d", protocol, internalPort)
+}
+
+// newSessionID returns a random session ID.
+func newSessionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// openSession registers a new session.
+func (s *DaemonServer) openSession() (*daemonSession, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("daemon is shutting down")
+	}
+	session := &daemonSession{id: id, leases: make(map[string]*daemonLease)}
+	s.sessions[id] = session
+	log.WithField("session", id).Debug("natd session opened")
+	return session, nil
+}
+
+// closeSession releases the mappings of a session whose stream ended.
+func (s *DaemonServer) closeSession(session *daemonSession) {
+	s.mu.Lock()
+	if s.sessions[session.id] != session {
+		// Already released by Close
+		s.mu.Unlock()
+		return
+	}
+	delete(s.sessions, session.id)
+	renewals := leaseRenewals(session.leases)
+	for key := range session.leases {
+		delete(s.leases, key)
+	}
+	s.mu.Unlock()
+
+	for _, renewal := range renewals {
+		renewal.Stop()
+	}
+	log.WithFields(Fields{
+		"session":  session.id,
+		"released": len(renewals),
+	}).Debug("natd session closed")
+}
+
+// handleSubscribe opens a session and streams events until the client
+// disconnects or the daemon closes.
+func (s *DaemonServer) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	session, err := s.openSession()
+	if err != nil {
+		writeDaemonError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer s.closeSession(session)
+
+	events, cancel := Subscribe(64)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(daemonMessage{Session: session.id}); err != nil {
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		log.WithError(err).Debug("natd subscribe stream cannot be flushed")
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(daemonMessage{Event: newDaemonEvent(e)}); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleMap creates a mapping for a session, or returns the session's
+// existing mapping of the same port. A port mapped by another session is a
+// conflict.
+func (s *DaemonServer) handleMap(w http.ResponseWriter, r *http.Request) {
+	var req daemonMapRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDaemonError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	protocol := strings.ToUpper(req.Protocol)
+	if protocol != "TCP" && protocol != "UDP" {
+		writeDaemonError(w, http.StatusBadRequest, fmt.Errorf("unsupported protocol %q", req.Protocol))
+		return
+	}
+	if req.InternalPort < 1 || req.InternalPort > 65535 {
+		writeDaemonError(w, http.StatusBadRequest, fmt.Errorf("invalid port number: %d (must be 1-65535)", req.InternalPort))
+		return
+	}
+	var localIP net.IP
+	if req.LocalIP != "" {
+		if localIP = net.ParseIP(req.LocalIP).To4(); localIP == nil {
+			writeDaemonError(w, http.StatusBadRequest, fmt.Errorf("invalid local IPv4 address %q", req.LocalIP))
+			return
+		}
+	}
+
+	// Only the reservation of the port is made under the lock. The gateway
+	// request can take as long as a SOAP timeout, during which other sessions
+	// must still be served.
+	key := leaseKey(protocol, req.InternalPort)
+	var lease *daemonLease
+	var mapper PortMapper
+	for lease == nil {
+		s.mu.Lock()
+		session := s.sessions[req.Session]
+		if session == nil {
+			s.mu.Unlock()
+			writeDaemonError(w, http.StatusNotFound, fmt.Errorf("unknown session %q", req.Session))
+			return
+		}
+		existing := s.leases[key]
+		if existing == nil {
+			lease = &daemonLease{session: session, protocol: protocol, internalPort: req.InternalPort, localIP: localIP, ready: make(chan struct{})}
+			s.leases[key] = lease
+			session.leases[key] = lease
+			mapper = s.mapper
+			s.mu.Unlock()
+			break
+		}
+		if existing.session != session {
+			s.mu.Unlock()
+			writeDaemonError(w, http.StatusConflict, fmt.Errorf("%s port %d is mapped by another session", protocol, req.InternalPort))
+			return
+		}
+		if !existing.localIP.Equal(localIP) {
+			s.mu.Unlock()
+			writeDaemonError(w, http.StatusConflict, fmt.Errorf("%s port %d is mapped for another local address", protocol, req.InternalPort))
+			return
+		}
+		if existing.renewal != nil {
+			mapping := existing.mapping()
+			s.mu.Unlock()
+			writeDaemonJSON(w, http.StatusOK, mapping)
+			return
+		}
+
+		// Another request of the session is mapping the port
+		ready := existing.ready
+		s.mu.Unlock()
+		select {
+		case <-ready:
+		case <-r.Context().Done():
+			writeDaemonError(w, http.StatusServiceUnavailable, r.Context().Err())
+			return
+		}
+	}
+
+	mapping, status, err := s.mapLease(r.Context(), lease, mapper)
+	if err != nil {
+		writeDaemonError(w, status, err)
+		return
+	}
+	log.WithFields(Fields{
+		"session":      mapping.Session,
+		"protocol":     protocol,
+		"internalPort": req.InternalPort,
+		"externalPort": mapping.ExternalPort,
+		"localIP":      req.LocalIP,
+	}).Info("natd mapping created")
+	writeDaemonJSON(w, http.StatusOK, mapping)
+}
+
+// mapLease creates the gateway mapping of a reserved lease through mapper
+// and starts renewing it. The lease is dropped if the mapping fails, and the
+// mapping is removed if the session or the daemon closed in the meantime.
+func (s *DaemonServer) mapLease(ctx context.Context, lease *daemonLease, mapper PortMapper) (DaemonMapping, int, error) {
+	defer close(lease.ready)
+	key := leaseKey(lease.protocol, lease.internalPort)
+
+	mapper, err := daemonMapperFor(ctx, mapper, lease.localIP)
+	var result MapPortResult
+	if err == nil {
+		result, err = mapListenerPort(ctx, mapper, lease.protocol, lease.internalPort)
+	}
+
+	s.mu.Lock()
+	current := s.leases[key] == lease
+	if err != nil || !current {
+		if current {
+			delete(s.leases, key)
+			delete(lease.session.leases, key)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return DaemonMapping{}, http.StatusBadGateway, err
+		}
+
+		unmapCtx, cancel := context.WithTimeout(context.Background(), closeUnmapTimeout)
+		defer cancel()
+		if err := unmapContext(unmapCtx, mapper, lease.protocol, result.ExternalPort); err != nil {
+			log.WithError(err).WithFields(Fields{
+				"protocol":     lease.protocol,
+				"externalPort": result.ExternalPort,
+			}).Warn("natd failed to remove mapping of a closed session")
+		}
+		return DaemonMapping{}, http.StatusNotFound, fmt.Errorf("session %q ended while the port was being mapped", lease.session.id)
+	}
+
+	renewal := NewRenewalManager(mapper, lease.protocol, lease.internalPort, result.ExternalPort)
+	renewal.SetLeaseLifetime(result.Lifetime)
+	renewal.Start()
+	lease.renewal = renewal
+	mapping := lease.mapping()
+	s.mu.Unlock()
+	return mapping, http.StatusOK, nil
+}
+
+// handleRelease releases a session's mapping by protocol and external port.
+func (s *DaemonServer) handleRelease(w http.ResponseWriter, r *http.Request) {
+	protocol := strings.ToUpper(r.PathValue("protocol"))
+	port, err := strconv.Atoi(r.PathValue("port"))
+	if err != nil {
+		writeDaemonError(w, http.StatusBadRequest, fmt.Errorf("invalid port %q", r.PathValue("port")))
+		return
+	}
+	sessionID := r.URL.Query().Get("session")
+
+	s.mu.Lock()
+	session := s.sessions[sessionID]
+	if session == nil {
+		s.mu.Unlock()
+		writeDaemonError(w, http.StatusNotFound, fmt.Errorf("unknown session %q", sessionID))
+		return
+	}
+	var found *daemonLease
+	for key, lease := range session.leases {
+		if lease.renewal != nil && lease.protocol == protocol && lease.renewal.ExternalPort() == port {
+			found = lease
+			delete(session.leases, key)
+			delete(s.leases, key)
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if found == nil {
+		writeDaemonError(w, http.StatusNotFound, fmt.Errorf("no %s mapping of external port %d in session", protocol, port))
+		return
+	}
+	found.renewal.Stop()
+	log.WithFields(Fields{
+		"session":      sessionID,
+		"protocol":     protocol,
+		"externalPort": port,
+	}).Info("natd mapping released")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleList returns every mapping, sorted by protocol and internal port.
+func (s *DaemonServer) handleList(w http.ResponseWriter, _ *http.Request) {
+	writeDaemonJSON(w, http.StatusOK, s.Mappings())
+}
+
+// handleStatus reports the mapper and external IP.
+func (s *DaemonServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	mapper := s.mapper
+	status := DaemonStatus{
+		Mapper:   MapperName(mapper),
+		Sessions: len(s.sessions),
+		Mappings: len(s.leases),
+	}
+	s.mu.Unlock()
+
+	externalIP, err := externalIPContext(r.Context(), mapper)
+	if err != nil {
+		status.ExternalIPError = err.Error()
+	}
+	status.ExternalIP = externalIP
+	writeDaemonJSON(w, http.StatusOK, status)
+}
+
+// Mappings returns the mappings held by the daemon, sorted by protocol and
+// internal port.
+func (s *DaemonServer) Mappings() []DaemonMapping {
+	s.mu.Lock()
+	mappings := make([]DaemonMapping, 0, len(s.leases))
+	for _, lease := range s.leases {
+		if lease.renewal != nil {
+			mappings = append(mappings, lease.mapping())
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(mappings, func(i, j int) bool {
+		if mappings[i].Protocol != mappings[j].Protocol {
+			return mappings[i].Protocol < mappings[j].Protocol
+		}
+		return mappings[i].InternalPort < mappings[j].InternalPort
+	})
+	return mappings
+}
+
+// mapping describes the lease.
+func (l *daemonLease) mapping() DaemonMapping {
+	m := DaemonMapping{
+		Session:      l.session.id,
+		Protocol:     l.protocol,
+		InternalPort: l.internalPort,
+		ExternalPort: l.renewal.ExternalPort(),
+		Lifetime:     l.renewal.LeaseLifetime(),
+		State:        l.renewal.State().String(),
+	}
+	if l.localIP != nil {
+		m.LocalIP = l.localIP.String()
+	}
+	return m
+}
+
+// daemonMapperFor returns mapper, or the mapper it derives for localIP if
+// that is set, discovering a gateway reachable from localIP under ctx if
+// mapper cannot map for it.
+func daemonMapperFor(ctx context.Context, mapper PortMapper, localIP net.IP) (PortMapper, error) {
+	if localIP == nil {
+		return mapper, nil
+	}
+	return localAddrMapper(ctx, mapper, localIP)
+}
+
+// handleNetworkChange rediscovers the gateway and re-creates every mapping
+// after the default gateway or local address changed.
+func (s *DaemonServer) handleNetworkChange(_, _ NetworkState) {
+	ctx, cancel := context.WithTimeout(context.Background(), remapTimeout)
+	defer cancel()
+
+	mapper, err := s.discover(ctx)
+	if err != nil {
+		log.WithError(err).Warn("natd failed to rediscover the gateway after network change")
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.mapper = mapper
+	leases := make([]*daemonLease, 0, len(s.leases))
+	for _, lease := range s.leases {
+		if lease.renewal != nil {
+			leases = append(leases, lease)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, lease := range leases {
+		leaseMapper, err := daemonMapperFor(ctx, mapper, lease.localIP)
+		if err == nil {
+			_, _, err = remapWithMapper(ctx, lease.renewal, leaseMapper)
+		}
+		if err != nil {
+			log.WithError(err).WithFields(Fields{
+				"protocol":     lease.protocol,
+				"internalPort": lease.internalPort,
+			}).Warn("natd failed to re-map port after network change")
+		}
+	}
+}
+
+// writeDaemonJSON writes v as the JSON response body.
+func writeDaemonJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Debug("failed to write natd response")
+	}
+}
+
+// writeDaemonError writes err as a JSON error response.
+func writeDaemonError(w http.ResponseWriter, status int, err error) {
+	writeDaemonJSON(w, status, daemonErrorBody{Error: err.Error()})
+}
@@ -0,0 +1,313 @@
+package nattraversal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startDaemon serves a DaemonServer for mapper on a Unix socket.
+func startDaemon(t *testing.T, mapper PortMapper) (string, *DaemonServer) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "natd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", socket, err)
+	}
+
+	daemon := NewDaemonServer(mapper)
+	server := &http.Server{Handler: daemon}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		daemon.Close()
+		server.Close()
+	})
+	return socket, daemon
+}
+
+// waitForMappings waits until mapper has n active mappings.
+func waitForMappings(t *testing.T, mapper *MockPortMapper, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mapper.GetActiveMappings()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d active mappings, got %d", n, len(mapper.GetActiveMappings()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestDaemonMapper tests mapping through the daemon and lease ownership
+func TestDaemonMapper(t *testing.T) {
+	mock := NewMockPortMapper()
+	socket, daemon := startDaemon(t, mock)
+
+	a, err := NewDaemonMapper(socket)
+	if err != nil {
+		t.Fatalf("NewDaemonMapper failed: %v", err)
+	}
+	defer a.Close()
+	b, err := NewDaemonMapper(socket)
+	if err != nil {
+		t.Fatalf("NewDaemonMapper failed: %v", err)
+	}
+	defer b.Close()
+
+	port, err := a.MapPort("TCP", 8080, time.Hour)
+	if err != nil {
+		t.Fatalf("MapPort failed: %v", err)
+	}
+	// Mapping again in the same session returns the daemon's mapping
+	if again, err := a.MapPort("TCP", 8080, time.Hour); err != nil || again != port {
+		t.Errorf("Expected the existing mapping %d, got %d, %v", port, again, err)
+	}
+	if len(mock.GetActiveMappings()) != 1 {
+		t.Errorf("Expected one gateway mapping, got %d", len(mock.GetActiveMappings()))
+	}
+
+	// Another session cannot take the port
+	if _, err := b.MapPort("TCP", 8080, time.Hour); err == nil {
+		t.Error("Expected a conflict for a port mapped by another session")
+	}
+	udpPort, err := b.MapPort("UDP", 9000, time.Hour)
+	if err != nil {
+		t.Fatalf("MapPort failed: %v", err)
+	}
+
+	mappings, err := a.Mappings()
+	if err != nil || len(mappings) != 2 || mappings[0].Protocol != "TCP" || mappings[1].ExternalPort != udpPort {
+		t.Errorf("Unexpected mappings: %+v, %v", mappings, err)
+	}
+	if ip, err := a.GetExternalIP(); err != nil || ip != "203.0.113.100" {
+		t.Errorf("Unexpected external IP %q, %v", ip, err)
+	}
+
+	// Only the owner can release a mapping
+	if err := a.UnmapPort("UDP", udpPort); err == nil {
+		t.Error("Expected an error releasing another session's mapping")
+	}
+	if err := b.UnmapPort("UDP", udpPort); err != nil {
+		t.Errorf("UnmapPort failed: %v", err)
+	}
+	waitForMappings(t, mock, 1)
+
+	// Ending the session releases its mappings
+	a.Close()
+	waitForMappings(t, mock, 0)
+	if n := len(daemon.Mappings()); n != 0 {
+		t.Errorf("Expected no daemon mappings, got %d", n)
+	}
+
+	// The mapper opens a new session when used again
+	if _, err := a.MapPort("TCP", 8080, time.Hour); err != nil {
+		t.Errorf("MapPort after Close failed: %v", err)
+	}
+}
+
+// blockingMapper is a MockPortMapper whose mappings of port block until
+// release is closed, like a gateway that does not answer.
+type blockingMapper struct {
+	*MockPortMapper
+	port    int
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingMapper) MapPort(protocol string, internalPort int, duration time.Duration) (int, error) {
+	if internalPort == m.port {
+		select {
+		case m.entered <- struct{}{}:
+		default:
+		}
+		<-m.release
+	}
+	return m.MockPortMapper.MapPort(protocol, internalPort, duration)
+}
+
+// TestDaemonSlowGateway tests that a slow gateway request does not stall
+// other sessions, and that its mapping is removed if the daemon closed
+// in the meantime
+func TestDaemonSlowGateway(t *testing.T) {
+	mock := &blockingMapper{
+		MockPortMapper: NewMockPortMapper(),
+		port:           8080,
+		entered:        make(chan struct{}, 1),
+		release:        make(chan struct{}),
+	}
+	socket, daemon := startDaemon(t, mock)
+
+	a, err := NewDaemonMapper(socket)
+	if err != nil {
+		t.Fatalf("NewDaemonMapper failed: %v", err)
+	}
+	defer a.Close()
+	b, err := NewDaemonMapper(socket)
+	if err != nil {
+		t.Fatalf("NewDaemonMapper failed: %v", err)
+	}
+	defer b.Close()
+
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := a.MapPort("TCP", 8080, time.Hour)
+		blocked <- err
+	}()
+	select {
+	case <-mock.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Mapping request did not reach the gateway")
+	}
+
+	// Other requests are served while the gateway is busy
+	if _, err := b.MapPort("UDP", 9000, time.Hour); err != nil {
+		t.Errorf("MapPort during a slow gateway request failed: %v", err)
+	}
+	if _, err := b.Status(context.Background()); err != nil {
+		t.Errorf("Status during a slow gateway request failed: %v", err)
+	}
+	// The pending port is reserved for its session
+	if _, err := b.MapPort("TCP", 8080, time.Hour); err == nil {
+		t.Error("Expected a conflict for a port being mapped by another session")
+	}
+	if n := len(daemon.Mappings()); n != 1 {
+		t.Errorf("Expected the pending mapping to be unlisted, got %d mappings", n)
+	}
+
+	// The mapping created after Close is removed
+	daemon.Close()
+	close(mock.release)
+	select {
+	case err := <-blocked:
+		if err == nil {
+			t.Error("Expected the mapping request to fail once the daemon closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Mapping request did not return")
+	}
+	waitForMappings(t, mock.MockPortMapper, 0)
+}
+
+// TestDaemonDelegation tests that listeners delegate to a running daemon
+func TestDaemonDelegation(t *testing.T) {
+	mock := NewMockPortMapper()
+	socket, daemon := startDaemon(t, mock)
+	t.Setenv(DaemonSocketEnv, socket)
+
+	mapper, err := NewPortMapperContext(context.Background())
+	if err != nil {
+		t.Fatalf("NewPortMapperContext failed: %v", err)
+	}
+	if _, ok := mapper.(*DaemonMapper); !ok {
+		t.Fatalf("Expected a DaemonMapper, got %T", mapper)
+	}
+
+	listener, err := Listen(freePorts(t, 1)[0])
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if listener.IsFallback() || listener.Reachability().Mapper != "daemon" {
+		t.Fatalf("Expected the listener to map through the daemon, got %+v", listener.Reachability())
+	}
+	if n := len(daemon.Mappings()); n != 1 {
+		t.Errorf("Expected one daemon mapping, got %d", n)
+	}
+
+	listener.Close()
+	waitForMappings(t, mock, 0)
+}
+
+// TestDaemonListenAddr tests that a listener bound to a specific address
+// maps through the daemon for that address
+func TestDaemonListenAddr(t *testing.T) {
+	mock := &localAddrMockMapper{MockPortMapper: NewMockPortMapper()}
+	socket, daemon := startDaemon(t, mock)
+
+	lc := &ListenConfig{DaemonSocket: socket}
+	port := freePorts(t, 1)[0]
+	listener, err := lc.ListenAddr(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("ListenAddr failed: %v", err)
+	}
+	if listener.Reachability().Mapper != "daemon" {
+		t.Fatalf("Expected the listener to map through the daemon, got %+v", listener.Reachability())
+	}
+
+	mappings := daemon.Mappings()
+	if len(mappings) != 1 || mappings[0].LocalIP != "127.0.0.1" || mappings[0].InternalPort != port {
+		t.Errorf("Expected a daemon mapping of port %d for 127.0.0.1, got %+v", port, mappings)
+	}
+
+	listener.Close()
+	waitForMappings(t, mock.MockPortMapper, 0)
+}
+
+// TestDaemonListenAddrDiscovery tests that the daemon discovers a gateway
+// for an address its own mapper cannot map for
+func TestDaemonListenAddrDiscovery(t *testing.T) {
+	mock := NewMockPortMapper()
+	socket, daemon := startDaemon(t, mock)
+	discovered := &localAddrMockMapper{MockPortMapper: NewMockPortMapper()}
+	useLocalAddrDiscovery(t, func(ctx context.Context, ip net.IP) (PortMapper, error) {
+		return discovered.ForLocalAddr(ip)
+	})
+
+	lc := &ListenConfig{DaemonSocket: socket}
+	port := freePorts(t, 1)[0]
+	listener, err := lc.ListenAddr(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("ListenAddr failed: %v", err)
+	}
+	defer listener.Close()
+
+	if mappings := daemon.Mappings(); len(mappings) != 1 || mappings[0].LocalIP != "127.0.0.1" {
+		t.Errorf("Expected a daemon mapping for 127.0.0.1, got %+v", mappings)
+	}
+	if active := len(discovered.GetActiveMappings()); active != 1 {
+		t.Errorf("Expected 1 mapping on the discovered gateway, got %d", active)
+	}
+	if active := len(mock.GetActiveMappings()); active != 0 {
+		t.Errorf("Expected no mappings on the daemon's mapper, got %d", active)
+	}
+}
+
+// TestDaemonUnavailable tests discovery without a daemon
+func TestDaemonUnavailable(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewDaemonMapper(filepath.Join(dir, "missing.sock")); err == nil {
+		t.Error("Expected an error for a missing socket")
+	}
+
+	// A file that is not a socket is not a daemon
+	file := filepath.Join(dir, "file.sock")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDaemonMapper(file); err == nil {
+		t.Error("Expected an error for a regular file")
+	}
+}
+
+// TestDefaultDaemonSocket tests that the default socket is not in a
+// world-writable directory
+func TestDefaultDaemonSocket(t *testing.T) {
+	t.Setenv(DaemonSocketEnv, "")
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if got := DefaultDaemonSocket(); got != filepath.Join("/run/user/1000", "natd.sock") {
+		t.Errorf("Unexpected socket with XDG_RUNTIME_DIR: %s", got)
+	}
+
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	if got := DefaultDaemonSocket(); got != "/run/natd/natd.sock" {
+		t.Errorf("Unexpected default socket: %s", got)
+	}
+
+	t.Setenv(DaemonSocketEnv, "/tmp/custom.sock")
+	if got := DefaultDaemonSocket(); got != "/tmp/custom.sock" {
+		t.Errorf("Expected $%s to override the socket, got %s", DaemonSocketEnv, got)
+	}
+}
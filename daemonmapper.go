@@ -0,0 +1,419 @@
+package nattraversal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// daemonURL is the base URL of requests to the daemon. The host is ignored
+// since requests are sent over the Unix socket.
+const daemonURL = "http://natd"
+
+// DaemonMapper is a PortMapper that delegates to a natd daemon, which owns
+// the port mappings of every process on the host and renews them.
+// Mappings belong to a session that the mapper opens on first use and keeps
+// open until Close or the end of the process; the daemon releases them when
+// the session ends.
+type DaemonMapper struct {
+	socket  string
+	localIP net.IP // internal client of the mappings, nil for the daemon's default
+	conn    *daemonConn
+}
+
+// daemonConn is the connection to the daemon and the session, shared by a
+// DaemonMapper and the mappers ForLocalAddr derives from it.
+type daemonConn struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	session string
+	stop    context.CancelFunc // ends the session stream
+}
+
+// Ensure DaemonMapper reports granted lease lifetimes, supports contexts and
+// maps ports for specific local addresses.
+var (
+	_ LeasePortMapper     = (*DaemonMapper)(nil)
+	_ ContextPortMapper   = (*DaemonMapper)(nil)
+	_ LocalAddrPortMapper = (*DaemonMapper)(nil)
+)
+
+// daemonError is an error response from the daemon.
+type daemonError struct {
+	status int
+	msg    string
+}
+
+func (e *daemonError) Error() string {
+	return "natd: " + e.msg
+}
+
+// NewDaemonMapper connects to the natd daemon listening on socket, or on
+// DefaultDaemonSocket if socket is empty.
+// This is a convenience wrapper around NewDaemonMapperContext using context.Background().
+func NewDaemonMapper(socket string) (*DaemonMapper, error) {
+	return NewDaemonMapperContext(context.Background(), socket)
+}
+
+// NewDaemonMapperContext connects to the natd daemon listening on socket, or
+// on DefaultDaemonSocket if socket is empty, and checks that it responds.
+// The socket must be owned by root or the current user, and on Linux so must
+// the process serving it.
+func NewDaemonMapperContext(ctx context.Context, socket string) (*DaemonMapper, error) {
+	if socket == "" {
+		socket = DefaultDaemonSocket()
+	}
+	info, err := os.Lstat(socket)
+	if err != nil {
+		return nil, fmt.Errorf("natd socket unavailable: %w", err)
+	}
+	if err := checkDaemonSocketOwner(info); err != nil {
+		return nil, err
+	}
+
+	d := &DaemonMapper{socket: socket, conn: &daemonConn{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					conn, err := dialer.DialContext(ctx, "unix", socket)
+					if err != nil {
+						return nil, err
+					}
+					if err := checkDaemonPeer(conn); err != nil {
+						conn.Close()
+						return nil, err
+					}
+					return conn, nil
+				},
+			},
+		},
+	}}
+	if _, err := d.Status(ctx); err != nil {
+		d.conn.client.CloseIdleConnections()
+		return nil, err
+	}
+
+	log.WithField("socket", socket).Debug("connected to natd daemon")
+	return d, nil
+}
+
+// daemonMappers holds the mapper used by discovery for each socket, so that
+// the listeners of a process share one session. A port re-mapped after a
+// network change then stays owned by the same session.
+var daemonMappers struct {
+	mu       sync.Mutex
+	bySocket map[string]*DaemonMapper
+}
+
+// sharedDaemonMapper returns the shared mapper for socket if the daemon
+// responds.
+func sharedDaemonMapper(ctx context.Context, socket string) (*DaemonMapper, error) {
+	daemonMappers.mu.Lock()
+	d := daemonMappers.bySocket[socket]
+	daemonMappers.mu.Unlock()
+
+	if d != nil {
+		if _, err := d.Status(ctx); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	d, err := NewDaemonMapperContext(ctx, socket)
+	if err != nil {
+		return nil, err
+	}
+
+	daemonMappers.mu.Lock()
+	defer daemonMappers.mu.Unlock()
+	if existing := daemonMappers.bySocket[socket]; existing != nil {
+		d.conn.client.CloseIdleConnections()
+		return existing, nil
+	}
+	if daemonMappers.bySocket == nil {
+		daemonMappers.bySocket = make(map[string]*DaemonMapper)
+	}
+	daemonMappers.bySocket[socket] = d
+	return d, nil
+}
+
+// MapPort implements the PortMapper interface.
+func (d *DaemonMapper) MapPort(protocol string, internalPort int, duration time.Duration) (int, error) {
+	result, err := d.MapPortWithLease(protocol, internalPort, duration)
+	return result.ExternalPort, err
+}
+
+// MapPortWithLease asks the daemon to map the port for the session, or
+// returns the session's existing mapping of the port. The requested duration
+// is ignored and the returned lifetime is zero since the daemon renews the
+// mapping for as long as the session lasts.
+func (d *DaemonMapper) MapPortWithLease(protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	return d.MapPortContext(context.Background(), protocol, internalPort, duration)
+}
+
+// MapPortContext maps the port as MapPortWithLease does, giving up when ctx
+// is done.
+func (d *DaemonMapper) MapPortContext(ctx context.Context, protocol string, internalPort int, _ time.Duration) (MapPortResult, error) {
+	// A session that ended since it was opened is replaced once
+	for attempt := 0; ; attempt++ {
+		session, err := d.conn.openSession(ctx)
+		if err != nil {
+			return MapPortResult{}, err
+		}
+
+		var mapping DaemonMapping
+		req := daemonMapRequest{Session: session, Protocol: protocol, InternalPort: internalPort}
+		if d.localIP != nil {
+			req.LocalIP = d.localIP.String()
+		}
+		err = d.do(ctx, http.MethodPost, "/v1/mappings", req, &mapping)
+
+		var de *daemonError
+		if attempt == 0 && errors.As(err, &de) && de.status == http.StatusNotFound {
+			d.conn.endSession(session)
+			continue
+		}
+		if err != nil {
+			return MapPortResult{}, fmt.Errorf("natd port mapping failed: %w", err)
+		}
+
+		log.WithFields(Fields{
+			"protocol":     protocol,
+			"internalPort": internalPort,
+			"externalPort": mapping.ExternalPort,
+		}).Debug("natd port mapping created")
+		return MapPortResult{ExternalPort: mapping.ExternalPort}, nil
+	}
+}
+
+// ForLocalAddr returns a mapper whose mappings the daemon forwards to ip. It
+// shares the session of d, so closing either ends the mappings of both.
+// Whether the daemon's gateway is reachable from ip is checked when a port
+// is mapped.
+func (d *DaemonMapper) ForLocalAddr(ip net.IP) (PortMapper, error) {
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("natd maps ports for IPv4 addresses only, not %s", ip)
+	}
+	return &DaemonMapper{socket: d.socket, localIP: ip.To4(), conn: d.conn}, nil
+}
+
+// UnmapPort implements the PortMapper interface by releasing the session's
+// mapping of externalPort.
+func (d *DaemonMapper) UnmapPort(protocol string, externalPort int) error {
+	return d.UnmapPortContext(context.Background(), protocol, externalPort)
+}
+
+// UnmapPortContext releases the session's mapping of externalPort, giving up
+// when ctx is done.
+func (d *DaemonMapper) UnmapPortContext(ctx context.Context, protocol string, externalPort int) error {
+	d.conn.mu.Lock()
+	session := d.conn.session
+	d.conn.mu.Unlock()
+
+	if session == "" {
+		// The daemon released the mappings when the session ended
+		return nil
+	}
+	path := fmt.Sprintf("/v1/mappings/%s/%d?session=%s", strings.ToUpper(protocol), externalPort, session)
+	if err := d.do(ctx, http.MethodDelete, path, nil, nil); err != nil {
+		return fmt.Errorf("natd port unmapping failed: %w", err)
+	}
+	return nil
+}
+
+// GetExternalIP implements the PortMapper interface.
+func (d *DaemonMapper) GetExternalIP() (string, error) {
+	return d.GetExternalIPContext(context.Background())
+}
+
+// GetExternalIPContext returns the external IP reported by the daemon,
+// giving up when ctx is done.
+func (d *DaemonMapper) GetExternalIPContext(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, daemonRequestTimeout)
+	defer cancel()
+	status, err := d.Status(ctx)
+	if err != nil {
+		return "", err
+	}
+	if status.ExternalIPError != "" {
+		return "", fmt.Errorf("natd failed to get external IP: %s", status.ExternalIPError)
+	}
+	return status.ExternalIP, nil
+}
+
+// Status returns the daemon's status.
+func (d *DaemonMapper) Status(ctx context.Context) (DaemonStatus, error) {
+	var status DaemonStatus
+	if err := d.doContext(ctx, http.MethodGet, "/v1/status", nil, &status); err != nil {
+		return DaemonStatus{}, fmt.Errorf("natd status request failed: %w", err)
+	}
+	return status, nil
+}
+
+// Mappings returns the mappings held by the daemon for every session.
+func (d *DaemonMapper) Mappings() ([]DaemonMapping, error) {
+	var mappings []DaemonMapping
+	if err := d.do(context.Background(), http.MethodGet, "/v1/mappings", nil, &mappings); err != nil {
+		return nil, fmt.Errorf("natd mapping listing failed: %w", err)
+	}
+	return mappings, nil
+}
+
+// Close ends the session, so the daemon releases its mappings. The mapper
+// opens a new session if it is used again.
+func (d *DaemonMapper) Close() error {
+	d.conn.mu.Lock()
+	stop := d.conn.stop
+	d.conn.session, d.conn.stop = "", nil
+	d.conn.mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+	d.conn.client.CloseIdleConnections()
+	return nil
+}
+
+// openSession returns the current session, opening one if needed. ctx
+// bounds waiting for the daemon's greeting.
+func (c *daemonConn) openSession(greetCtx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != "" {
+		return c.session, nil
+	}
+
+	// The stream outlives the request timeout and greetCtx, which only bound
+	// the greeting
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(daemonRequestTimeout, cancel)
+	defer timer.Stop()
+	stopGreeting := context.AfterFunc(greetCtx, cancel)
+	defer stopGreeting()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, daemonURL+"/v1/subscribe", nil)
+	if err != nil {
+		cancel()
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		cancel()
+		return "", fmt.Errorf("natd session failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := readDaemonError(resp)
+		resp.Body.Close()
+		cancel()
+		return "", fmt.Errorf("natd session failed: %w", err)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	var greeting daemonMessage
+	if err := dec.Decode(&greeting); err != nil || greeting.Session == "" {
+		resp.Body.Close()
+		cancel()
+		return "", fmt.Errorf("natd session failed: invalid greeting: %v", err)
+	}
+	if !timer.Stop() || !stopGreeting() {
+		// A bound ran out just after the greeting and ended the stream
+		resp.Body.Close()
+		cancel()
+		return "", fmt.Errorf("natd session failed: greeting not received in time")
+	}
+
+	c.session, c.stop = greeting.Session, cancel
+	go c.readSession(greeting.Session, dec, resp.Body, cancel)
+
+	log.WithField("session", greeting.Session).Debug("natd session opened")
+	return greeting.Session, nil
+}
+
+// readSession drains the session stream until it ends.
+func (c *daemonConn) readSession(session string, dec *json.Decoder, body io.Closer, cancel context.CancelFunc) {
+	defer cancel()
+	defer body.Close()
+
+	var err error
+	for err == nil {
+		var msg daemonMessage
+		err = dec.Decode(&msg)
+	}
+
+	c.endSession(session)
+	log.WithError(err).WithField("session", session).Debug("natd session ended")
+}
+
+// endSession forgets session if it is current.
+func (c *daemonConn) endSession(session string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != session {
+		return
+	}
+	if c.stop != nil {
+		c.stop()
+	}
+	c.session, c.stop = "", nil
+}
+
+// do sends a request bounded by ctx and daemonRequestTimeout.
+func (d *DaemonMapper) do(ctx context.Context, method, path string, body, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, daemonRequestTimeout)
+	defer cancel()
+	return d.doContext(ctx, method, path, body, out)
+}
+
+// doContext sends a request with body encoded as JSON, and decodes the
+// response into out if it is not nil.
+func (d *DaemonMapper) doContext(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, daemonURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := d.conn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return readDaemonError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// readDaemonError converts an error response to a daemonError.
+func readDaemonError(resp *http.Response) error {
+	var body daemonErrorBody
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+		body.Error = resp.Status
+	}
+	return &daemonError{status: resp.StatusCode, msg: body.Error}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package nattraversal
+
+import "os"
+
+// checkDaemonSocketOwner accepts any socket on platforms without Unix file
+// ownership. The socket's directory must not be writable by other users.
+func checkDaemonSocketOwner(_ os.FileInfo) error {
+	return nil
+}
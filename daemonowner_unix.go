@@ -0,0 +1,32 @@
+//go:build unix
+
+package nattraversal
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkDaemonSocketOwner checks that the natd socket is a socket owned by
+// root or the current user, so that another local user cannot impersonate
+// the daemon by binding its path first.
+func checkDaemonSocketOwner(info os.FileInfo) error {
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("natd socket %s is not a socket", info.Name())
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("cannot determine the owner of natd socket %s", info.Name())
+	}
+	if !trustedDaemonUID(uint32(st.Uid)) {
+		return fmt.Errorf("natd socket %s is owned by uid %d, not root or the current user", info.Name(), st.Uid)
+	}
+	return nil
+}
+
+// trustedDaemonUID reports whether a daemon running as uid may hold the
+// mappings of this process.
+func trustedDaemonUID(uid uint32) bool {
+	return uid == 0 || uid == uint32(os.Geteuid())
+}
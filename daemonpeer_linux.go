@@ -0,0 +1,38 @@
+//go:build linux
+
+package nattraversal
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// checkDaemonPeer checks with SO_PEERCRED that the process at the other end
+// of conn runs as root or the current user. This catches a socket replaced
+// after its owner was checked.
+func checkDaemonPeer(conn net.Conn) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("natd connection is not a Unix socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return err
+	}
+	if credErr != nil {
+		return fmt.Errorf("failed to read natd peer credentials: %w", credErr)
+	}
+	if !trustedDaemonUID(cred.Uid) {
+		return fmt.Errorf("natd peer runs as uid %d, not root or the current user", cred.Uid)
+	}
+	return nil
+}
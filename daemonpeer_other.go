@@ -0,0 +1,11 @@
+//go:build !linux
+
+package nattraversal
+
+import "net"
+
+// checkDaemonPeer accepts any peer on platforms without SO_PEERCRED, which
+// rely on the socket owner check.
+func checkDaemonPeer(_ net.Conn) error {
+	return nil
+}
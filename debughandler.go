@@ -0,0 +1,111 @@
+package nattraversal
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// debugPage is the data shown by DebugHandler.
+type debugPage struct {
+	Time      time.Time      `json:"time"`
+	Listeners []ListenerInfo `json:"listeners"`
+}
+
+// debugTemplate renders debugPage as HTML.
+var debugTemplate = template.Must(template.New("debug").Funcs(template.FuncMap{
+	"when": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	},
+	"lease": func(d time.Duration) string {
+		if d == 0 {
+			return "-"
+		}
+		return d.String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>NAT listeners</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #eee; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>NAT listeners</h1>
+<p>{{len .Listeners}} open at {{when .Time}}. <a href="?format=json">JSON</a></p>
+{{if .Listeners}}
+<table>
+<tr>
+<th>Network</th><th>Internal</th><th>External</th><th>Mapper</th><th>Reachability</th><th>Mapping</th>
+<th>Lease</th><th>Lease expiry</th><th>Last renewal</th><th>External IP history</th><th>Created</th>
+</tr>
+{{range .Listeners}}
+<tr>
+<td>{{.Network}}</td>
+<td>{{.InternalAddr}}</td>
+<td>{{.ExternalAddr}}</td>
+<td>{{.Mapper}}{{if .Fallback}} (fallback){{end}}</td>
+<td>{{.Reachability}}</td>
+<td>{{if .MappingState}}{{.MappingState}}{{else}}-{{end}}</td>
+<td>{{lease .LeaseLifetime}}</td>
+<td>{{when .LeaseExpiry}}</td>
+<td>{{when .LastRenewal}}{{if .LastRenewalError}}<br><span class="error">{{.LastRenewalError}}</span>{{end}}</td>
+<td>{{range .ExternalIPHistory}}{{.IP}} since {{when .Time}}<br>{{else}}-{{end}}</td>
+<td>{{when .Created}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+// DebugHandler returns an http.Handler showing every open listener: its
+// addresses, mapper, lease, last renewal, external IP history and fallback
+// state. It serves HTML, or JSON if the request has ?format=json or accepts
+// application/json. It does not depend on the request path, so it can be
+// mounted anywhere, for example:
+//
+//	mux.Handle("/debug/nat", nattraversal.DebugHandler())
+func DebugHandler() http.Handler {
+	return http.HandlerFunc(serveDebug)
+}
+
+// serveDebug renders the listeners in the requested format.
+func serveDebug(w http.ResponseWriter, r *http.Request) {
+	page := debugPage{Time: time.Now(), Listeners: Listeners()}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(page); err != nil {
+			log.WithError(err).Debug("failed to write debug page")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugTemplate.Execute(w, page); err != nil {
+		log.WithError(err).Debug("failed to write debug page")
+	}
+}
+
+// wantsJSON reports whether the request asks for JSON.
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
@@ -0,0 +1,105 @@
+package nattraversal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// findListener returns the info of the listener on port.
+func findListener(infos []ListenerInfo, network string, port int) (ListenerInfo, bool) {
+	for _, info := range infos {
+		if info.Network == network && strings.HasSuffix(info.InternalAddr, ":"+strconv.Itoa(port)) {
+			return info, true
+		}
+	}
+	return ListenerInfo{}, false
+}
+
+// TestListenersRegistry tests that open listeners are registered with their state
+func TestListenersRegistry(t *testing.T) {
+	mapper := NewMockPortMapper()
+	useMockPortMapper(t, mapper)
+	ports := freePorts(t, 2)
+	lc := &ListenConfig{}
+
+	tcp, err := lc.Listen(context.Background(), ports[0])
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer tcp.Close()
+	udp, err := lc.ListenPacket(context.Background(), ports[1])
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+
+	mapper.SetFailureRate(1.0)
+	tcp.renewal.renew()
+	tcp.updateExternalAddr("203.0.113.200", tcp.ExternalPort())
+
+	tcpPort, udpPort := ports[0], ports[1]
+	info, ok := findListener(Listeners(), "tcp", tcpPort)
+	if !ok {
+		t.Fatal("TCP listener not registered")
+	}
+	if info.ExternalAddr != tcp.Addr().String() || info.Fallback || info.MappingState != MappingDegraded.String() {
+		t.Errorf("Unexpected TCP listener info: %+v", info)
+	}
+	if info.LastRenewal.IsZero() || info.LastRenewalError == "" {
+		t.Errorf("Expected the failed renewal, got %v %q", info.LastRenewal, info.LastRenewalError)
+	}
+	if len(info.ExternalIPHistory) != 2 || info.ExternalIPHistory[1].IP != "203.0.113.200" {
+		t.Errorf("Unexpected external IP history: %+v", info.ExternalIPHistory)
+	}
+	if _, ok := findListener(Listeners(), "udp", udpPort); !ok {
+		t.Error("UDP listener not registered")
+	}
+
+	udp.Close()
+	if _, ok := findListener(Listeners(), "udp", udpPort); ok {
+		t.Error("Closed UDP listener still registered")
+	}
+}
+
+// TestDebugHandler tests the HTML and JSON views
+func TestDebugHandler(t *testing.T) {
+	useMockPortMapper(t, NewMockPortMapper())
+	port := freePorts(t, 1)[0]
+	listener, err := Listen(port)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	handler := DebugHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/nat?format=json", nil))
+	var page debugPage
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Invalid JSON: %v\n%s", err, rec.Body.String())
+	}
+	if info, ok := findListener(page.Listeners, "tcp", port); !ok || info.Mapper != "*nattraversal.MockPortMapper" {
+		t.Errorf("Listener missing from JSON view: %+v", page.Listeners)
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/debug/nat", nil)
+	req.Header.Set("Accept", "application/json")
+	handler.ServeHTTP(rec, req)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON for Accept: application/json, got %q", ct)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/nat", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Expected HTML by default, got %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), listener.Addr().String()) {
+		t.Errorf("Listener missing from HTML view:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,415 @@
+package nattraversal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	natpmp "github.com/jackpal/go-nat-pmp"
+)
+
+// Report is the result of Diagnose. It can be serialised with
+// encoding/json or printed with WriteText. Durations are in nanoseconds in
+// JSON; errors are recorded as strings.
+type Report struct {
+	Time       time.Time        `json:"time"`
+	Duration   time.Duration    `json:"duration"`
+	Interfaces []InterfaceInfo  `json:"interfaces"`
+	Gateway    GatewayReport    `json:"gateway"`
+	Discovery  []DiscoveryProbe `json:"discovery"`
+	// Mapper names the mapper NewPortMapperContext would select, see
+	// MapperName. It is "none" if every discovery attempt failed.
+	Mapper          string `json:"mapper"`
+	ExternalIP      string `json:"external_ip,omitempty"`
+	ExternalIPError string `json:"external_ip_error,omitempty"`
+	ExternalIPClass string `json:"external_ip_class"`
+	Topology        string `json:"topology"`
+	// Advice explains how to fix a topology that prevents inbound connections.
+	Advice      string       `json:"advice,omitempty"`
+	TestMapping *MappingTest `json:"test_mapping,omitempty"`
+	// Error is set if Diagnose was interrupted by its context.
+	Error string `json:"error,omitempty"`
+}
+
+// InterfaceInfo describes a network interface.
+type InterfaceInfo struct {
+	Name  string   `json:"name"`
+	Index int      `json:"index"`
+	MTU   int      `json:"mtu"`
+	Flags string   `json:"flags"`
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+// GatewayReport compares the default gateway read from the routing table
+// with the one guessed by the fallback heuristic (the .1 address of the
+// local subnet), which NAT-PMP uses if the routing table cannot be read.
+type GatewayReport struct {
+	RoutingTable      string `json:"routing_table,omitempty"`
+	RoutingTableError string `json:"routing_table_error,omitempty"`
+	Fallback          string `json:"fallback,omitempty"`
+	FallbackError     string `json:"fallback_error,omitempty"`
+	// Selected is the gateway NAT-PMP uses.
+	Selected string `json:"selected,omitempty"`
+	LocalIP  string `json:"local_ip,omitempty"`
+}
+
+// DiscoveryProbe is one port mapper discovery attempt.
+type DiscoveryProbe struct {
+	// Protocol is "daemon", "direct", "upnp" or "nat-pmp".
+	Protocol string `json:"protocol"`
+	// Service is the UPnP service type tried, empty for other protocols.
+	Service  string        `json:"service,omitempty"`
+	Found    bool          `json:"found"`
+	Gateway  string        `json:"gateway,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// MappingTest is the outcome of mapping and unmapping a test port.
+type MappingTest struct {
+	Protocol     string        `json:"protocol"`
+	InternalPort int           `json:"internal_port"`
+	ExternalPort int           `json:"external_port,omitempty"`
+	Lifetime     time.Duration `json:"lifetime,omitempty"`
+	Duration     time.Duration `json:"duration"`
+	MapError     string        `json:"map_error,omitempty"`
+	UnmapError   string        `json:"unmap_error,omitempty"`
+}
+
+// OK reports whether the test port was mapped and unmapped.
+func (m *MappingTest) OK() bool {
+	return m.MapError == "" && m.UnmapError == ""
+}
+
+// discoveryProbe tries one way of finding a port mapper for Diagnose.
+type discoveryProbe struct {
+	protocol string
+	service  string
+	discover func(ctx context.Context, gateway net.IP) (PortMapper, error)
+}
+
+// discoveryProbes are tried in the order NewPortMapperContext uses. It is a
+// variable so tests can diagnose mock gateways.
+var discoveryProbes = []discoveryProbe{
+	{"daemon", "", func(ctx context.Context, _ net.IP) (PortMapper, error) {
+		socket := os.Getenv(DaemonSocketEnv)
+		if socket == "" {
+			return nil, fmt.Errorf("natd delegation not enabled, $%s is not set", DaemonSocketEnv)
+		}
+		return NewDaemonMapperContext(ctx, socket)
+	}},
+	{"direct", "", func(ctx context.Context, _ net.IP) (PortMapper, error) {
+		return newDirectPortMapper()
+	}},
+	{"upnp", "WANIPConnection2", upnpProbe(discoverWANIPConnection2Ctx)},
+	{"upnp", "WANIPConnection1", upnpProbe(discoverWANIPConnection1Ctx)},
+	{"upnp", "WANPPPConnection1", upnpProbe(discoverWANPPPConnection1Ctx)},
+	{"nat-pmp", "", natpmpProbe},
+}
+
+// upnpProbe adapts a UPnP service discovery function to a probe.
+func upnpProbe(discover func(context.Context) (upnpClient, error)) func(context.Context, net.IP) (PortMapper, error) {
+	return func(ctx context.Context, _ net.IP) (PortMapper, error) {
+		client, err := discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &UPnPMapper{client: client}, nil
+	}
+}
+
+// natpmpProbe asks gateway for its external address over NAT-PMP, with a
+// short timeout unlike NewNATPMPMapper.
+func natpmpProbe(ctx context.Context, gateway net.IP) (PortMapper, error) {
+	if gateway == nil {
+		return nil, fmt.Errorf("no gateway to probe")
+	}
+	timeout := diagnoseNATPMPTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("context deadline exceeded")
+	}
+	client := natpmp.NewClientWithTimeout(gateway, timeout)
+	if _, err := client.GetExternalAddress(); err != nil {
+		return nil, err
+	}
+	return &NATPMPMapper{client: client, gateway: gateway}, nil
+}
+
+// Diagnose collects what is needed to troubleshoot NAT traversal: the
+// network interfaces, the default gateway, every discovery attempt with its
+// timing and error, the external IP with a double NAT or CGNAT verdict, and
+// the outcome of mapping and unmapping a test TCP port on the selected mapper.
+//
+// All discovery attempts are made, even after a mapper is found, so this is
+// slower than NewPortMapperContext. If ctx is done before the report is
+// complete, the partial report is returned with the context's error.
+func Diagnose(ctx context.Context) (*Report, error) {
+	start := time.Now()
+	report := &Report{Time: start, Mapper: MapperName(nil)}
+	defer func() { report.Duration = time.Since(start) }()
+
+	report.Interfaces = diagnoseInterfaces()
+	gateway := report.Gateway.diagnose()
+
+	var mapper PortMapper
+	for _, probe := range discoveryProbes {
+		if err := ctx.Err(); err != nil {
+			report.Error = err.Error()
+			return report, err
+		}
+		found, result := runDiscoveryProbe(ctx, probe, gateway)
+		report.Discovery = append(report.Discovery, result)
+		if mapper == nil && found != nil {
+			mapper = found
+		}
+	}
+	if mapper == nil {
+		report.ExternalIPClass = IPClassUnknown.String()
+		report.Topology = TopologyUnknown.String()
+		return report, nil
+	}
+	report.Mapper = MapperName(mapper)
+	if daemon, ok := mapper.(*DaemonMapper); ok {
+		// End the session opened by the test mapping
+		defer daemon.Close()
+	}
+
+	externalIP, err := externalIPContext(ctx, mapper)
+	if err != nil {
+		report.ExternalIPError = err.Error()
+	}
+	status := ClassifyNAT(mapper, externalIP)
+	report.ExternalIP = externalIP
+	report.ExternalIPClass = status.ExternalIPClass.String()
+	report.Topology = status.Topology.String()
+	report.Advice = status.Advice()
+
+	if err := ctx.Err(); err != nil {
+		report.Error = err.Error()
+		return report, err
+	}
+	report.TestMapping = testMapping(ctx, mapper)
+
+	log.WithFields(Fields{
+		"mapper":   report.Mapper,
+		"topology": report.Topology,
+		"duration": time.Since(start).String(),
+	}).Debug("NAT diagnosis complete")
+	return report, nil
+}
+
+// diagnoseInterfaces lists the network interfaces and their addresses.
+func diagnoseInterfaces() []InterfaceInfo {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.WithError(err).Debug("failed to list interfaces for diagnosis")
+		return nil
+	}
+
+	infos := make([]InterfaceInfo, 0, len(ifaces))
+	for _, iface := range ifaces {
+		info := InterfaceInfo{
+			Name:  iface.Name,
+			Index: iface.Index,
+			MTU:   iface.MTU,
+			Flags: iface.Flags.String(),
+		}
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				info.Addrs = append(info.Addrs, addr.String())
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// diagnose fills in the gateway report and returns the gateway NAT-PMP uses.
+func (g *GatewayReport) diagnose() net.IP {
+	var selected net.IP
+
+	routed, err := readDefaultGateway()
+	switch {
+	case err != nil:
+		g.RoutingTableError = err.Error()
+	case routed == nil:
+		g.RoutingTableError = "no default route"
+	default:
+		g.RoutingTable = routed.String()
+		selected = routed
+	}
+
+	fallback, err := discoverGatewayFallback()
+	if err != nil {
+		g.FallbackError = err.Error()
+	} else {
+		g.Fallback = fallback.String()
+		if selected == nil {
+			selected = fallback
+		}
+	}
+
+	if selected != nil {
+		g.Selected = selected.String()
+	}
+	if localIP, err := discoverLocalIP(); err == nil {
+		g.LocalIP = localIP.String()
+	}
+	return selected
+}
+
+// runDiscoveryProbe runs probe and records its outcome.
+func runDiscoveryProbe(ctx context.Context, probe discoveryProbe, gateway net.IP) (PortMapper, DiscoveryProbe) {
+	result := DiscoveryProbe{Protocol: probe.protocol, Service: probe.service}
+
+	start := time.Now()
+	mapper, err := probe.discover(ctx, gateway)
+	result.Duration = time.Since(start)
+	if err != nil {
+		result.Error = err.Error()
+		return nil, result
+	}
+
+	result.Found = true
+	switch m := mapper.(type) {
+	case *UPnPMapper:
+		if ip := upnpGatewayIP(m.client); ip != nil {
+			result.Gateway = ip.String()
+		}
+	case *NATPMPMapper:
+		result.Gateway = m.gateway.String()
+	}
+	return mapper, result
+}
+
+// testMapping maps a free TCP port through mapper and removes the mapping.
+func testMapping(ctx context.Context, mapper PortMapper) *MappingTest {
+	test := &MappingTest{Protocol: "TCP"}
+
+	// Reserve a free port so the mapping cannot forward to another service
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		test.MapError = fmt.Sprintf("no free port to test: %v", err)
+		return test
+	}
+	defer l.Close()
+	test.InternalPort = l.Addr().(*net.TCPAddr).Port
+
+	start := time.Now()
+	defer func() { test.Duration = time.Since(start) }()
+
+	result, err := mapPortContext(ctx, mapper, test.Protocol, test.InternalPort, diagnoseMappingDuration)
+	if err != nil {
+		test.MapError = err.Error()
+		return test
+	}
+	test.ExternalPort = result.ExternalPort
+	test.Lifetime = result.Lifetime
+
+	if err := mapper.UnmapPort(test.Protocol, result.ExternalPort); err != nil {
+		test.UnmapError = err.Error()
+	}
+	return test
+}
+
+// JSON returns the report as indented JSON.
+func (r *Report) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// WriteText writes the report in a human-readable form.
+func (r *Report) WriteText(w io.Writer) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "NAT diagnosis at %s (took %s)\n", r.Time.Format(time.RFC3339), r.Duration.Round(time.Millisecond))
+	if r.Error != "" {
+		fmt.Fprintf(&b, "Incomplete: %s\n", r.Error)
+	}
+
+	b.WriteString("\nInterfaces:\n")
+	for _, iface := range r.Interfaces {
+		fmt.Fprintf(&b, "  %-12s mtu %-5d %s\n", iface.Name, iface.MTU, iface.Flags)
+		for _, addr := range iface.Addrs {
+			fmt.Fprintf(&b, "    %s\n", addr)
+		}
+	}
+
+	b.WriteString("\nGateway:\n")
+	fmt.Fprintf(&b, "  routing table: %s\n", valueOrError(r.Gateway.RoutingTable, r.Gateway.RoutingTableError))
+	fmt.Fprintf(&b, "  fallback:      %s\n", valueOrError(r.Gateway.Fallback, r.Gateway.FallbackError))
+	fmt.Fprintf(&b, "  selected:      %s\n", valueOr(r.Gateway.Selected, "none"))
+	fmt.Fprintf(&b, "  local IP:      %s\n", valueOr(r.Gateway.LocalIP, "unknown"))
+
+	b.WriteString("\nDiscovery:\n")
+	for _, probe := range r.Discovery {
+		name := probe.Protocol
+		if probe.Service != "" {
+			name += " " + probe.Service
+		}
+		outcome := "found"
+		if probe.Gateway != "" {
+			outcome += " at " + probe.Gateway
+		}
+		if !probe.Found {
+			outcome = "failed: " + probe.Error
+		}
+		fmt.Fprintf(&b, "  %-22s %8s  %s\n", name, probe.Duration.Round(time.Millisecond), outcome)
+	}
+
+	b.WriteString("\nResult:\n")
+	fmt.Fprintf(&b, "  mapper:      %s\n", r.Mapper)
+	fmt.Fprintf(&b, "  external IP: %s\n", valueOr(valueOrError(r.ExternalIP, r.ExternalIPError), "unknown"))
+	fmt.Fprintf(&b, "  IP class:    %s\n", r.ExternalIPClass)
+	fmt.Fprintf(&b, "  topology:    %s\n", r.Topology)
+	if r.Advice != "" {
+		fmt.Fprintf(&b, "  advice:      %s\n", r.Advice)
+	}
+	if t := r.TestMapping; t != nil {
+		switch {
+		case t.MapError != "":
+			fmt.Fprintf(&b, "  test map:    failed: %s\n", t.MapError)
+		default:
+			lease := "no expiry"
+			if t.Lifetime > 0 {
+				lease = "lease " + t.Lifetime.String()
+			}
+			fmt.Fprintf(&b, "  test map:    %s %d -> %d, %s\n", t.Protocol, t.InternalPort, t.ExternalPort, lease)
+			fmt.Fprintf(&b, "  test unmap:  %s\n", valueOrError("ok", t.UnmapError))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// String returns the report in the form written by WriteText.
+func (r *Report) String() string {
+	var b strings.Builder
+	r.WriteText(&b)
+	return b.String()
+}
+
+// valueOr returns value, or fallback if value is empty.
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// valueOrError returns "error: " followed by msg if msg is set, and value
+// otherwise.
+func valueOrError(value, msg string) string {
+	if msg != "" {
+		return "error: " + msg
+	}
+	return value
+}
@@ -0,0 +1,109 @@
+package nattraversal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// useDiscoveryProbes replaces the probes run by Diagnose for the test.
+func useDiscoveryProbes(t *testing.T, probes ...discoveryProbe) {
+	t.Helper()
+	original := discoveryProbes
+	discoveryProbes = probes
+	t.Cleanup(func() { discoveryProbes = original })
+}
+
+// TestDiagnose tests the diagnosis report with mock discovery
+func TestDiagnose(t *testing.T) {
+	mapper := NewMockPortMapper()
+	mapper.SetExternalIP("100.64.3.4")
+	var probedGateway net.IP
+	useDiscoveryProbes(t,
+		discoveryProbe{"direct", "", func(ctx context.Context, _ net.IP) (PortMapper, error) {
+			return nil, errors.New("no public address")
+		}},
+		discoveryProbe{"upnp", "WANIPConnection1", func(ctx context.Context, gateway net.IP) (PortMapper, error) {
+			probedGateway = gateway
+			return mapper, nil
+		}},
+		discoveryProbe{"nat-pmp", "", func(ctx context.Context, _ net.IP) (PortMapper, error) {
+			return NewMockPortMapper(), nil
+		}},
+	)
+
+	report, err := Diagnose(context.Background())
+	if err != nil {
+		t.Fatalf("Diagnose failed: %v", err)
+	}
+
+	if len(report.Interfaces) == 0 {
+		t.Error("Expected at least the loopback interface")
+	}
+	if report.Gateway.Selected != "" && !probedGateway.Equal(net.ParseIP(report.Gateway.Selected)) {
+		t.Errorf("Probes got gateway %v, report selected %s", probedGateway, report.Gateway.Selected)
+	}
+	if len(report.Discovery) != 3 || report.Discovery[0].Found || report.Discovery[0].Error != "no public address" || !report.Discovery[1].Found || !report.Discovery[2].Found {
+		t.Errorf("Unexpected discovery attempts: %+v", report.Discovery)
+	}
+
+	// The first mapper found is used, as by NewPortMapperContext
+	if report.Mapper != "*nattraversal.MockPortMapper" || report.ExternalIP != "100.64.3.4" {
+		t.Errorf("Unexpected mapper or external IP: %s %s", report.Mapper, report.ExternalIP)
+	}
+	if report.Topology != TopologyCGNAT.String() || report.Advice == "" {
+		t.Errorf("Expected a CGNAT verdict with advice, got %s %q", report.Topology, report.Advice)
+	}
+
+	test := report.TestMapping
+	if test == nil || !test.OK() || test.ExternalPort != test.InternalPort {
+		t.Fatalf("Unexpected test mapping: %+v", test)
+	}
+	if len(mapper.GetActiveMappings()) != 0 {
+		t.Error("Expected the test mapping to be removed")
+	}
+
+	data, err := report.JSON()
+	if err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Report JSON does not round-trip: %v", err)
+	}
+	if decoded.Mapper != report.Mapper || decoded.TestMapping.InternalPort != test.InternalPort {
+		t.Errorf("Decoded report differs: %+v", decoded)
+	}
+
+	text := report.String()
+	for _, want := range []string{"Interfaces:", "Gateway:", "direct", "failed: no public address", "upnp WANIPConnection1", "topology:    cgnat", "test unmap:  ok"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Text report lacks %q:\n%s", want, text)
+		}
+	}
+}
+
+// TestDiagnoseNoMapper tests a report where every discovery attempt fails
+func TestDiagnoseNoMapper(t *testing.T) {
+	useDiscoveryProbes(t, discoveryProbe{"nat-pmp", "", func(ctx context.Context, _ net.IP) (PortMapper, error) {
+		return nil, errors.New("timeout")
+	}})
+
+	report, err := Diagnose(context.Background())
+	if err != nil {
+		t.Fatalf("Diagnose failed: %v", err)
+	}
+	if report.Mapper != "none" || report.TestMapping != nil || report.Topology != TopologyUnknown.String() {
+		t.Errorf("Unexpected report without mapper: %+v", report)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err = Diagnose(ctx)
+	if !errors.Is(err, context.Canceled) || report == nil || report.Error == "" {
+		t.Errorf("Expected a partial report with the context error, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package nattraversal
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"time"
@@ -17,8 +18,13 @@ type DirectPortMapper struct {
 	publicIP string
 }
 
-// Ensure DirectPortMapper satisfies the PortMapper interface.
-var _ PortMapper = (*DirectPortMapper)(nil)
+// Ensure DirectPortMapper satisfies the PortMapper and LeasePortMapper interfaces.
+var (
+	_ PortMapper          = (*DirectPortMapper)(nil)
+	_ LeasePortMapper     = (*DirectPortMapper)(nil)
+	_ ContextPortMapper   = (*DirectPortMapper)(nil)
+	_ LocalAddrPortMapper = (*DirectPortMapper)(nil)
+)
 
 func newDirectPortMapper() (*DirectPortMapper, error) {
 	ip, err := detectDirectPublicIP()
@@ -34,11 +40,55 @@ func (d *DirectPortMapper) MapPort(_ string, internalPort int, _ time.Duration)
 	return internalPort, nil
 }
 
+// MapPortWithLease is a no-op for direct connectivity. The returned lifetime
+// is zero because there is no lease to expire.
+func (d *DirectPortMapper) MapPortWithLease(_ string, internalPort int, _ time.Duration) (MapPortResult, error) {
+	return MapPortResult{ExternalPort: internalPort}, nil
+}
+
+// MapPortContext is a no-op for direct connectivity, see MapPortWithLease.
+func (d *DirectPortMapper) MapPortContext(_ context.Context, protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	return d.MapPortWithLease(protocol, internalPort, duration)
+}
+
+// ForLocalAddr returns a direct mapper for ip if it is publicly routable.
+// For a private address, such as a LAN address on a host that also has a
+// public one, a UPnP or NAT-PMP gateway reachable from ip is discovered,
+// for at most 30 seconds. Use ForLocalAddrContext to bound it with a context.
+func (d *DirectPortMapper) ForLocalAddr(ip net.IP) (PortMapper, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), localAddrDiscoveryTimeout)
+	defer cancel()
+	return d.ForLocalAddrContext(ctx, ip)
+}
+
+// ForLocalAddrContext is like ForLocalAddr, but discovery for a private
+// address is bounded by ctx.
+func (d *DirectPortMapper) ForLocalAddrContext(ctx context.Context, ip net.IP) (PortMapper, error) {
+	if isGloballyRoutableIP(ip) {
+		return &DirectPortMapper{publicIP: ip.String()}, nil
+	}
+	mapper, err := discoverForLocalAddr(ctx, ip)
+	if err != nil {
+		return nil, fmt.Errorf("address %s is not publicly routable: %w", ip, err)
+	}
+	return mapper, nil
+}
+
 // UnmapPort is a no-op for direct connectivity.
 func (d *DirectPortMapper) UnmapPort(_ string, _ int) error {
 	return nil
 }
 
+// UnmapPortContext is a no-op for direct connectivity.
+func (d *DirectPortMapper) UnmapPortContext(_ context.Context, _ string, _ int) error {
+	return nil
+}
+
+// GetExternalIPContext returns the detected directly-routable public IP.
+func (d *DirectPortMapper) GetExternalIPContext(_ context.Context) (string, error) {
+	return d.GetExternalIP()
+}
+
 // GetExternalIP returns the detected directly-routable public IP.
 func (d *DirectPortMapper) GetExternalIP() (string, error) {
 	if d.publicIP == "" {
@@ -0,0 +1,438 @@
+package nattraversal
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The echo protocol is line based over TCP. A client sends one request:
+//
+//	TCP <host:port> [<hex payload>]
+//	UDP <host:port> <hex payload>
+//
+// The server connects to the address and writes the payload if one was
+// given, or sends the payload to it in a few datagrams, and answers "OK" or "ERR <reason>" before closing the
+// connection.
+//
+// Over UDP, the server answers a "NATADDR" datagram with "NATADDR <host:port>",
+// the address it was received from. Comparing the answers of two servers
+// reveals whether the NAT is symmetric. Requests are padded with zero bytes
+// to echoAddrRequestLen and answers are never larger than the request, so
+// the server cannot be used to amplify traffic to a spoofed source.
+
+// Limits on echo requests
+const (
+	maxEchoPayload       = 64  // bytes in the payload of an echo request
+	maxEchoRequest       = 512 // bytes in a request line
+	echoAddrRequestLen   = 64  // minimum size of a UDP address request
+	defaultMaxEchoProbes = 64  // probes run at once
+)
+
+// echoAddrRequest is the UDP request for the observed source address.
+const echoAddrRequest = "NATADDR"
+
+// EchoServer runs reachability probes on behalf of EchoProber clients.
+// It must run outside the NAT being tested, for example on a VPS or a
+// peer's node. By default it only probes addresses on the IP the request
+// came from, so it cannot be used to send traffic to third parties.
+type EchoServer struct {
+	// AllowAnyTarget lets clients request probes to any address.
+	AllowAnyTarget bool
+	// Timeout bounds each probe. If zero, probeTimeout is used.
+	Timeout time.Duration
+	// MaxProbes caps the probes run at once; further connections wait to
+	// be accepted. If zero, defaultMaxEchoProbes is used.
+	MaxProbes int
+
+	mu          sync.Mutex
+	probes      chan struct{} // one slot per probe in progress
+	listeners   map[net.Listener]struct{}
+	packetConns map[net.PacketConn]struct{}
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+// ListenAndServe listens on the TCP address addr and serves echo requests.
+func (s *EchoServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts echo requests on l until l fails or the server is closed.
+// It always returns a non-nil error; after Close it returns net.ErrClosed.
+func (s *EchoServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	if s.probes == nil {
+		limit := s.MaxProbes
+		if limit <= 0 {
+			limit = defaultMaxEchoProbes
+		}
+		s.probes = make(chan struct{}, limit)
+	}
+	probes := s.probes
+	s.mu.Unlock()
+
+	log.WithField("addr", l.Addr().String()).Debug("echo server listening")
+	for {
+		// Wait for a free slot before accepting, so excess clients queue
+		// in the listen backlog instead of each holding a goroutine
+		probes <- struct{}{}
+		conn, err := l.Accept()
+		if err != nil {
+			<-probes
+			s.mu.Lock()
+			delete(s.listeners, l)
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			<-probes
+			continue
+		}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			defer func() { <-probes }()
+			s.handle(conn)
+		}()
+	}
+}
+
+// ServePacket answers address requests on conn until conn fails or the
+// server is closed. It always returns a non-nil error; after Close it
+// returns net.ErrClosed.
+func (s *EchoServer) ServePacket(conn net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	}
+	if s.packetConns == nil {
+		s.packetConns = make(map[net.PacketConn]struct{})
+	}
+	s.packetConns[conn] = struct{}{}
+	s.mu.Unlock()
+
+	log.WithField("addr", conn.LocalAddr().String()).Debug("echo server listening for address requests")
+	buf := make([]byte, echoAddrRequestLen)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			s.mu.Lock()
+			delete(s.packetConns, conn)
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			return err
+		}
+		if n < echoAddrRequestLen || !strings.HasPrefix(string(buf[:n]), echoAddrRequest) {
+			continue
+		}
+		answer := echoAddrRequest + " " + addr.String()
+		if len(answer) > n {
+			continue
+		}
+		conn.WriteTo([]byte(answer), addr)
+	}
+}
+
+// Close stops all listeners and waits for probes in progress to finish.
+func (s *EchoServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	var errs []error
+	for l := range s.listeners {
+		errs = append(errs, l.Close())
+	}
+	for c := range s.packetConns {
+		errs = append(errs, c.Close())
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// handle serves one echo request.
+func (s *EchoServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = probeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(2 * timeout))
+
+	line, err := bufio.NewReader(io.LimitReader(conn, maxEchoRequest)).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	err = s.probe(conn.RemoteAddr(), strings.Fields(line), timeout)
+	if err != nil {
+		log.WithError(err).WithField("client", conn.RemoteAddr().String()).Debug("echo probe failed")
+		fmt.Fprintf(conn, "ERR %s\n", err)
+		return
+	}
+	fmt.Fprint(conn, "OK\n")
+}
+
+// probe runs the request in fields for the client at remote.
+func (s *EchoServer) probe(remote net.Addr, fields []string, timeout time.Duration) error {
+	if len(fields) < 2 {
+		return errors.New("malformed request")
+	}
+	target := fields[1]
+	if err := s.checkTarget(remote, target); err != nil {
+		return err
+	}
+
+	switch {
+	case fields[0] == "TCP" && len(fields) == 2:
+		conn, err := net.DialTimeout("tcp", target, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case fields[0] == "TCP" && len(fields) == 3:
+		payload, err := decodeEchoPayload(fields[2])
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return sendTCPProbe(ctx, target, payload)
+	case fields[0] == "UDP" && len(fields) == 3:
+		payload, err := decodeEchoPayload(fields[2])
+		if err != nil {
+			return err
+		}
+		return sendProbeDatagrams(target, payload)
+	default:
+		return errors.New("malformed request")
+	}
+}
+
+// decodeEchoPayload decodes the hex payload of a request.
+func decodeEchoPayload(field string) ([]byte, error) {
+	payload, err := hex.DecodeString(field)
+	if err != nil || len(payload) == 0 || len(payload) > maxEchoPayload {
+		return nil, errors.New("invalid payload")
+	}
+	return payload, nil
+}
+
+// checkTarget rejects targets on other hosts than the client unless
+// AllowAnyTarget is set.
+func (s *EchoServer) checkTarget(remote net.Addr, target string) error {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("invalid target: %w", err)
+	}
+	if s.AllowAnyTarget {
+		return nil
+	}
+	client, ok := remote.(*net.TCPAddr)
+	if !ok || !client.IP.Equal(net.ParseIP(host)) {
+		return fmt.Errorf("target %s is not the client's address", host)
+	}
+	return nil
+}
+
+// sendProbeDatagrams sends payload to target probeAttempts times.
+func sendProbeDatagrams(target string, payload []byte) error {
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for i := 0; i < probeAttempts; i++ {
+		if _, err := conn.Write(payload); err != nil {
+			return err
+		}
+		time.Sleep(probeInterval)
+	}
+	return nil
+}
+
+// EchoProber is a ReachabilityProber that asks an EchoServer to probe
+// the listener's external address.
+type EchoProber struct {
+	// Server is the TCP address of the EchoServer.
+	Server string
+	// PacketServers are the UDP addresses of EchoServers answering address
+	// requests. At least two, on different IPs or ports, are needed to
+	// detect a symmetric NAT.
+	PacketServers []string
+}
+
+// Ensure EchoProber satisfies the prober interfaces.
+var (
+	_ ReachabilityProber = (*EchoProber)(nil)
+	_ TCPPayloadProber   = (*EchoProber)(nil)
+	_ SymmetricNATProber = (*EchoProber)(nil)
+)
+
+// NewEchoProber creates a prober that uses the EchoServer at server.
+func NewEchoProber(server string) *EchoProber {
+	return &EchoProber{Server: server}
+}
+
+// ProbeTCP asks the echo server to connect to addr.
+func (p *EchoProber) ProbeTCP(ctx context.Context, addr string) error {
+	return p.request(ctx, fmt.Sprintf("TCP %s\n", addr))
+}
+
+// ProbeTCPPayload asks the echo server to connect to addr and write payload.
+func (p *EchoProber) ProbeTCPPayload(ctx context.Context, addr string, payload []byte) error {
+	if len(payload) > maxEchoPayload {
+		return fmt.Errorf("probe payload too large: %d bytes", len(payload))
+	}
+	return p.request(ctx, fmt.Sprintf("TCP %s %s\n", addr, hex.EncodeToString(payload)))
+}
+
+// ProbeUDP asks the echo server to send payload to addr.
+func (p *EchoProber) ProbeUDP(ctx context.Context, addr string, payload []byte) error {
+	if len(payload) > maxEchoPayload {
+		return fmt.Errorf("probe payload too large: %d bytes", len(payload))
+	}
+	return p.request(ctx, fmt.Sprintf("UDP %s %s\n", addr, hex.EncodeToString(payload)))
+}
+
+// request sends one request to the echo server and reads its answer.
+func (p *EchoProber) request(ctx context.Context, request string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.Server)
+	if err != nil {
+		return fmt.Errorf("failed to connect to echo server: %w", err)
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return fmt.Errorf("failed to send echo request: %w", err)
+	}
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("failed to read echo response: %w", err)
+	}
+
+	answer = strings.TrimSpace(answer)
+	if answer == "OK" {
+		return nil
+	}
+	log.WithFields(Fields{
+		"server":   p.Server,
+		"response": answer,
+	}).Debug("echo server reported probe failure")
+	return fmt.Errorf("echo server: %s", strings.TrimPrefix(answer, "ERR "))
+}
+
+// ProbeSymmetricNAT asks each of the PacketServers for the address it sees
+// requests from, all sent from one local socket. The NAT is symmetric if
+// the servers see different addresses.
+func (p *EchoProber) ProbeSymmetricNAT(ctx context.Context) (bool, error) {
+	if len(p.PacketServers) < 2 {
+		return false, errors.New("symmetric NAT detection requires two packet servers")
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	var first string
+	for i, server := range p.PacketServers {
+		observed, err := observeUDPAddr(ctx, conn, server)
+		if err != nil {
+			return false, err
+		}
+		if i == 0 {
+			first = observed
+		} else if observed != first {
+			log.WithFields(Fields{
+				"first":    first,
+				"observed": observed,
+				"server":   server,
+			}).Debug("NAT maps destinations to different external addresses")
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// observeUDPAddr sends address requests to server from conn until it
+// answers, and returns the address the server observed.
+func observeUDPAddr(ctx context.Context, conn *net.UDPConn, server string) (string, error) {
+	raddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return "", err
+	}
+	request := make([]byte, echoAddrRequestLen)
+	copy(request, echoAddrRequest)
+	prefix := echoAddrRequest + " "
+	buf := make([]byte, 128)
+	for i := 0; i < probeAttempts; i++ {
+		if _, err := conn.WriteToUDP(request, raddr); err != nil {
+			return "", err
+		}
+		conn.SetReadDeadline(time.Now().Add(probeInterval))
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			answer := string(buf[:n])
+			if from.Port == raddr.Port && from.IP.Equal(raddr.IP) && strings.HasPrefix(answer, prefix) {
+				return strings.TrimPrefix(answer, prefix), nil
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no answer from echo server %s", server)
+}
@@ -0,0 +1,191 @@
+package nattraversal
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventKind identifies a port mapping lifecycle event.
+type EventKind int
+
+const (
+	// DiscoveryStarted is emitted when NewPortMapperContext starts looking
+	// for a port mapper.
+	DiscoveryStarted EventKind = iota
+	// MapperSelected is emitted when discovery finishes. Mapper names the
+	// selected mapper; if none was found, Mapper is "none" and Err is set.
+	MapperSelected
+	// Mapped is emitted when a listener creates a port mapping, including
+	// re-mapping after a network change. Err is set if mapping failed.
+	Mapped
+	// Renewed is emitted when a mapping was renewed.
+	Renewed
+	// RenewalFailed is emitted when a renewal attempt failed.
+	RenewalFailed
+	// PortChanged is emitted when the gateway assigned a different external
+	// port during renewal or re-mapping.
+	PortChanged
+	// ExternalIPChanged is emitted when a listener's external IP changed,
+	// for example after a network change.
+	ExternalIPChanged
+	// Unmapped is emitted when a mapping is removed as its listener closes.
+	// Err is set if the gateway rejected the removal.
+	Unmapped
+	// FallbackEngaged is emitted when a listener created with fallback could
+	// not map a port and listens without NAT traversal. Err is the reason.
+	FallbackEngaged
+)
+
+// String returns the name of the event kind.
+func (k EventKind) String() string {
+	switch k {
+	case DiscoveryStarted:
+		return "DiscoveryStarted"
+	case MapperSelected:
+		return "MapperSelected"
+	case Mapped:
+		return "Mapped"
+	case Renewed:
+		return "Renewed"
+	case RenewalFailed:
+		return "RenewalFailed"
+	case PortChanged:
+		return "PortChanged"
+	case ExternalIPChanged:
+		return "ExternalIPChanged"
+	case Unmapped:
+		return "Unmapped"
+	case FallbackEngaged:
+		return "FallbackEngaged"
+	default:
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+}
+
+// Event describes something the library did. Fields that do not apply to
+// the event kind are zero.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+	// Mapper names the port mapper involved, see MapperName.
+	Mapper       string
+	Protocol     string
+	InternalPort int
+	ExternalPort int
+	// OldExternalPort is the previous port of a PortChanged event.
+	OldExternalPort int
+	ExternalIP      string
+	// OldExternalIP is the previous IP of an ExternalIPChanged event.
+	OldExternalIP string
+	// Duration is how long the discovery, mapping or renewal took.
+	Duration time.Duration
+	// Lifetime is the lease granted for a Mapped or Renewed event.
+	Lifetime time.Duration
+	Err      error
+}
+
+// Observer receives events. OnEvent is called synchronously from the
+// goroutine doing the work, so it must return quickly and must not call
+// back into the listener that emitted the event.
+type Observer interface {
+	OnEvent(Event)
+}
+
+// ObserverFunc adapts a function to the Observer interface.
+type ObserverFunc func(Event)
+
+// OnEvent calls f(e).
+func (f ObserverFunc) OnEvent(e Event) {
+	f(e)
+}
+
+// eventBus fans events out to observers. The observer count is kept in an
+// atomic so emitting is cheap when nobody is listening.
+type eventBus struct {
+	mu        sync.Mutex
+	observers map[*Observer]struct{}
+	count     atomic.Int32
+}
+
+// events is the bus every component emits to.
+var events eventBus
+
+// Observe registers o to receive every event and returns a function that
+// unregisters it.
+func Observe(o Observer) (cancel func()) {
+	key := &o
+	events.mu.Lock()
+	if events.observers == nil {
+		events.observers = make(map[*Observer]struct{})
+	}
+	events.observers[key] = struct{}{}
+	events.count.Add(1)
+	events.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			events.mu.Lock()
+			delete(events.observers, key)
+			events.count.Add(-1)
+			events.mu.Unlock()
+		})
+	}
+}
+
+// Subscribe returns a channel that receives every event, buffered to hold
+// buffer events, and a function that ends the subscription and closes the
+// channel. Events are dropped while the buffer is full, so a slow receiver
+// never stalls port mapping.
+func Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	var mu sync.Mutex
+	closed := false
+
+	stop := Observe(ObserverFunc(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case ch <- e:
+		default:
+			log.WithField("kind", e.Kind.String()).Debug("event subscriber buffer full, dropping event")
+		}
+	}))
+
+	return ch, func() {
+		stop()
+		mu.Lock()
+		defer mu.Unlock()
+		if !closed {
+			closed = true
+			close(ch)
+		}
+	}
+}
+
+// emit delivers e to every observer, stamping it with the current time if
+// Time is zero.
+func emit(e Event) {
+	if events.count.Load() == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	events.mu.Lock()
+	observers := make([]Observer, 0, len(events.observers))
+	for o := range events.observers {
+		observers = append(observers, *o)
+	}
+	events.mu.Unlock()
+
+	for _, o := range observers {
+		o.OnEvent(e)
+	}
+}
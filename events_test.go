@@ -0,0 +1,191 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// eventRecorder collects the events concerning one internal port, so
+// renewals of listeners left over from other tests do not interfere.
+type eventRecorder struct {
+	mu     sync.Mutex
+	port   int
+	events []Event
+}
+
+func (r *eventRecorder) OnEvent(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e.InternalPort == r.port {
+		r.events = append(r.events, e)
+	}
+}
+
+// take returns the recorded events and resets the recorder.
+func (r *eventRecorder) take() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
+
+// kinds returns the kinds of events in order.
+func kinds(events []Event) []EventKind {
+	var k []EventKind
+	for _, e := range events {
+		k = append(k, e.Kind)
+	}
+	return k
+}
+
+// expectKinds fails the test unless events have exactly the expected kinds.
+func expectKinds(t *testing.T, events []Event, expected ...EventKind) {
+	t.Helper()
+	got := kinds(events)
+	if len(got) != len(expected) {
+		t.Fatalf("Expected events %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("Expected events %v, got %v", expected, got)
+		}
+	}
+}
+
+// TestListenerEvents tests the events emitted over a listener's lifetime
+func TestListenerEvents(t *testing.T) {
+	mapper := NewMockPortMapper()
+	mapper.SetNATType(RestrictedNAT)
+	useMockPortMapper(t, mapper)
+
+	port := freePorts(t, 1)[0]
+	recorder := &eventRecorder{port: port}
+	cancel := Observe(recorder)
+	defer cancel()
+
+	listener, err := (&ListenConfig{}).Listen(context.Background(), port)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	events := recorder.take()
+	expectKinds(t, events, Mapped)
+	mapped := events[0]
+	if mapped.Mapper != "*nattraversal.MockPortMapper" || mapped.Protocol != "TCP" || mapped.ExternalPort != port+1000 || mapped.Lifetime != mappingDuration || mapped.Err != nil {
+		t.Errorf("Unexpected Mapped event: %+v", mapped)
+	}
+	if mapped.Time.IsZero() {
+		t.Error("Expected event time to be set")
+	}
+
+	// A renewal that moves the external port
+	mapper.SetNATType(FullConeNAT)
+	if err := listener.renewal.renew(); err != nil {
+		t.Fatalf("renew failed: %v", err)
+	}
+	events = recorder.take()
+	expectKinds(t, events, Renewed, PortChanged)
+	if events[1].OldExternalPort != port+1000 || events[1].ExternalPort != port {
+		t.Errorf("Unexpected PortChanged event: %+v", events[1])
+	}
+
+	// A failed renewal
+	mapper.SetFailureRate(1.0)
+	listener.renewal.renew()
+	events = recorder.take()
+	expectKinds(t, events, RenewalFailed)
+	if events[0].Err == nil {
+		t.Error("Expected RenewalFailed to carry the error")
+	}
+	mapper.SetFailureRate(0)
+
+	listener.updateExternalAddr("198.51.100.4", port)
+	events = recorder.take()
+	expectKinds(t, events, ExternalIPChanged)
+	if events[0].OldExternalIP != "203.0.113.100" || events[0].ExternalIP != "198.51.100.4" {
+		t.Errorf("Unexpected ExternalIPChanged event: %+v", events[0])
+	}
+
+	// A port change alone does not change the IP
+	listener.updateExternalAddr("198.51.100.4", port+1)
+	expectKinds(t, recorder.take())
+
+	listener.Close()
+	events = recorder.take()
+	expectKinds(t, events, Unmapped)
+	if events[0].ExternalPort != port || events[0].Err != nil {
+		t.Errorf("Unexpected Unmapped event: %+v", events[0])
+	}
+}
+
+// TestFallbackEvent tests that listening without NAT traversal is reported
+func TestFallbackEvent(t *testing.T) {
+	original := newPortMapper
+	newPortMapper = func(ctx context.Context) (PortMapper, error) {
+		return nil, errors.New("no gateway")
+	}
+	defer func() { newPortMapper = original }()
+
+	port := freePorts(t, 1)[0]
+	recorder := &eventRecorder{port: port}
+	cancel := Observe(recorder)
+	defer cancel()
+
+	listener, err := (&ListenConfig{}).ListenPacketWithFallback(context.Background(), port)
+	if err != nil {
+		t.Fatalf("ListenPacketWithFallback failed: %v", err)
+	}
+	defer listener.Close()
+
+	events := recorder.take()
+	expectKinds(t, events, FallbackEngaged)
+	if events[0].Protocol != "UDP" || events[0].Mapper != "none" || events[0].Err == nil {
+		t.Errorf("Unexpected FallbackEngaged event: %+v", events[0])
+	}
+}
+
+// TestDiscoveryEvents tests the events emitted by NewPortMapperContext
+func TestDiscoveryEvents(t *testing.T) {
+	recorder := &eventRecorder{}
+	cancel := Observe(recorder)
+	defer cancel()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	cancelCtx()
+	if _, err := NewPortMapperContext(ctx); err == nil {
+		t.Fatal("Expected discovery to fail with a cancelled context")
+	}
+
+	events := recorder.take()
+	expectKinds(t, events, DiscoveryStarted, MapperSelected)
+	if events[1].Mapper != "none" || !errors.Is(events[1].Err, context.Canceled) {
+		t.Errorf("Unexpected MapperSelected event: %+v", events[1])
+	}
+}
+
+// TestSubscribe tests channel subscriptions
+func TestSubscribe(t *testing.T) {
+	ch, cancel := Subscribe(1)
+
+	emit(Event{Kind: Mapped, InternalPort: 1})
+	emit(Event{Kind: Renewed, InternalPort: 1}) // dropped, the buffer is full
+
+	if e := <-ch; e.Kind != Mapped {
+		t.Errorf("Expected Mapped, got %v", e.Kind)
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Error("Expected channel closed after cancel")
+	}
+	emit(Event{Kind: Unmapped, InternalPort: 1})
+
+	if EventKind(99).String() != "EventKind(99)" {
+		t.Errorf("Unexpected name for unknown kind: %s", EventKind(99))
+	}
+}
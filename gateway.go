@@ -3,8 +3,6 @@ package nattraversal
 import (
 	"fmt"
 	"net"
-
-	"github.com/go-i2p/logger"
 )
 
 // discoverGateway finds the default gateway for NAT-PMP.
@@ -41,28 +39,160 @@ func discoverGateway() (net.IP, error) {
 func discoverGatewayFallback() (net.IP, error) {
 	log.Debug("using fallback gateway discovery (assuming .1 gateway)")
 
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+	localIP, err := dialLocalIP()
 	if err != nil {
 		log.WithError(err).Error("failed to determine local IP for gateway fallback")
-		return nil, fmt.Errorf("failed to determine local IP: %w", err)
+		return nil, err
 	}
-	defer conn.Close()
-
-	// Use safe type assertion to prevent potential panic
-	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
-	if !ok {
-		return nil, fmt.Errorf("unexpected local address type: %T", conn.LocalAddr())
-	}
-	ip := localAddr.IP.To4()
+	ip := localIP.To4()
 	if ip == nil {
 		return nil, fmt.Errorf("not IPv4 address")
 	}
 
 	// Assume gateway is .1 in the same subnet (common convention)
 	gateway := net.IPv4(ip[0], ip[1], ip[2], 1)
-	log.WithFields(logger.Fields{
-		"localIP": localAddr.IP.String(),
+	log.WithFields(Fields{
+		"localIP": localIP.String(),
 		"gateway": gateway.String(),
 	}).Debug("fallback gateway determined")
 	return gateway, nil
 }
+
+// defaultRoute describes a default route read from the system routing table.
+// Fields that the platform cannot report are left at their zero value.
+type defaultRoute struct {
+	gateway net.IP
+	iface   string // outgoing interface name, empty if unknown
+	ifindex int    // outgoing interface index, 0 if unknown
+	src     net.IP // preferred source address, nil if unknown
+	metric  int
+	table   int // routing table ID, 0 if unknown
+}
+
+// selectDefaultRoute chooses the route used for NAT traversal from a set of
+// default routes. IPv4 routes are preferred because NAT-PMP and the local
+// address heuristics are IPv4-only, then routes in the main table, then the
+// lowest metric. Returns nil if routes is empty.
+func selectDefaultRoute(routes []defaultRoute) *defaultRoute {
+	var best *defaultRoute
+	for i := range routes {
+		r := &routes[i]
+		if r.gateway == nil {
+			continue
+		}
+		if best == nil || routeLess(r, best) {
+			best = r
+		}
+	}
+	return best
+}
+
+// routeLess reports whether route a should be preferred over route b.
+func routeLess(a, b *defaultRoute) bool {
+	aV4, bV4 := a.gateway.To4() != nil, b.gateway.To4() != nil
+	if aV4 != bV4 {
+		return aV4
+	}
+	aMain, bMain := isMainRouteTable(a.table), isMainRouteTable(b.table)
+	if aMain != bMain {
+		return aMain
+	}
+	return a.metric < b.metric
+}
+
+// isMainRouteTable reports whether table refers to the main routing table.
+// Table 0 means the platform did not report a table and is treated as main.
+func isMainRouteTable(table int) bool {
+	return table == 0 || table == routeTableMain
+}
+
+// routeTableMain is the ID of the main routing table (RT_TABLE_MAIN on Linux).
+const routeTableMain = 254
+
+// discoverLocalIP returns the local IPv4 address used to reach the default gateway.
+// It prefers the source address of the selected default route, then an address on
+// the route's outgoing interface, and finally the UDP dial heuristic.
+func discoverLocalIP() (net.IP, error) {
+	route, err := readDefaultRoute()
+	if err != nil {
+		log.WithError(err).Debug("default route lookup failed, using dial heuristic for local IP")
+	} else if route != nil {
+		if ip := localIPForRoute(route); ip != nil {
+			log.WithFields(Fields{
+				"localIP":   ip.String(),
+				"interface": route.iface,
+				"gateway":   route.gateway.String(),
+			}).Debug("local IP determined from default route")
+			return ip, nil
+		}
+	}
+
+	return dialLocalIP()
+}
+
+// localIPForRoute returns the IPv4 address the system would use for route,
+// or nil if it cannot be determined from the route and its interface.
+func localIPForRoute(route *defaultRoute) net.IP {
+	if ip := route.src.To4(); ip != nil {
+		return ip
+	}
+
+	var iface *net.Interface
+	var err error
+	switch {
+	case route.ifindex > 0:
+		iface, err = net.InterfaceByIndex(route.ifindex)
+	case route.iface != "":
+		iface, err = net.InterfaceByName(route.iface)
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+
+	// Prefer the address whose subnet contains the gateway.
+	var first net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		if ipNet.Contains(route.gateway) {
+			return ipNet.IP.To4()
+		}
+		if first == nil {
+			first = ipNet.IP.To4()
+		}
+	}
+	return first
+}
+
+// dialLocalIP determines the local IP by opening a UDP "connection" to a known
+// external IP and reading the local address chosen by the kernel.
+// No packets are actually sent.
+func dialLocalIP() (net.IP, error) {
+	return routeSourceIP(net.IPv4(8, 8, 8, 8))
+}
+
+// routeSourceIP returns the local address the kernel selects to reach dst,
+// by opening a UDP "connection" to it. No packets are actually sent.
+func routeSourceIP(dst net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 80})
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine local IP: %w", err)
+	}
+	defer conn.Close()
+
+	// Use safe type assertion to prevent potential panic
+	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected local address type: %T", conn.LocalAddr())
+	}
+	return localAddr.IP, nil
+}
@@ -6,15 +6,85 @@ import (
 	"bufio"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 )
 
-// readDefaultGateway reads the default gateway from /proc/net/route on Linux.
-// Returns nil, nil if the file doesn't exist or no default route is found.
-// Returns nil, error if the file exists but cannot be parsed.
+// procRouteFlagUp is the RTF_UP flag bit in /proc/net/route (see linux/route.h).
+const procRouteFlagUp = 0x1
+
+// readDefaultGateway returns the gateway of the preferred default route on Linux.
+// Returns nil, nil if no IPv4 default route is found.
+// Returns nil, error if the routing table exists but cannot be parsed.
 func readDefaultGateway() (net.IP, error) {
+	route, err := readDefaultRoute()
+	if err != nil || route == nil {
+		return nil, err
+	}
+	// NAT-PMP only works over IPv4
+	return route.gateway.To4(), nil
+}
+
+// readDefaultRoute returns the preferred default route on Linux.
+// The routing table is queried via netlink (RTM_GETROUTE), falling back to
+// /proc/net/route if netlink is unavailable or returns no IPv4 default route.
+// Returns nil, nil if no default route is found.
+func readDefaultRoute() (*defaultRoute, error) {
+	routes, err := readDefaultRoutesNetlink()
+	return chooseDefaultRoute(routes, err, readDefaultRoutesProc)
+}
+
+// chooseDefaultRoute selects the preferred route among the default routes
+// read via netlink, or, if reading them failed with netlinkErr or none of
+// them is IPv4, among those returned by readProc. An IPv6 route from netlink
+// is only returned if readProc finds no default route, since NAT-PMP and the
+// gateway heuristics need an IPv4 gateway.
+func chooseDefaultRoute(routes []defaultRoute, netlinkErr error, readProc func() ([]defaultRoute, error)) (*defaultRoute, error) {
+	var ipv6Route *defaultRoute
+	if netlinkErr != nil {
+		log.WithError(netlinkErr).Debug("netlink route dump failed, falling back to /proc/net/route")
+	} else if route := selectDefaultRoute(routes); route != nil && route.gateway.To4() != nil {
+		log.WithFields(Fields{
+			"gateway":   route.gateway.String(),
+			"interface": route.iface,
+			"metric":    route.metric,
+			"routes":    len(routes),
+		}).Debug("default route selected via netlink")
+		return route, nil
+	} else if route != nil {
+		ipv6Route = route
+		log.Debug("only IPv6 default routes found via netlink, falling back to /proc/net/route")
+	} else {
+		log.Debug("no default route found via netlink, falling back to /proc/net/route")
+	}
+
+	routes, err := readProc()
+	if err != nil {
+		if ipv6Route != nil {
+			return ipv6Route, nil
+		}
+		return nil, err
+	}
+	route := selectDefaultRoute(routes)
+	if route == nil {
+		log.Debug("no default gateway found in /proc/net/route")
+		return ipv6Route, nil // nil if no default gateway was found, use fallback
+	}
+
+	log.WithFields(Fields{
+		"gateway":   route.gateway.String(),
+		"interface": route.iface,
+		"metric":    route.metric,
+	}).Debug("default gateway found in routing table")
+	return route, nil
+}
+
+// readDefaultRoutesProc reads all IPv4 default routes from /proc/net/route.
+// Returns nil, nil if the file doesn't exist.
+func readDefaultRoutesProc() ([]defaultRoute, error) {
 	log.Debug("reading default gateway from /proc/net/route")
 
 	file, err := os.Open("/proc/net/route")
@@ -29,36 +99,61 @@ func readDefaultGateway() (net.IP, error) {
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	return parseProcNetRoute(file)
+}
+
+// parseProcNetRoute parses the contents of /proc/net/route and returns every
+// usable default route (destination and mask 00000000, non-zero gateway).
+// The columns are: Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+func parseProcNetRoute(r io.Reader) ([]defaultRoute, error) {
+	scanner := bufio.NewScanner(r)
 
 	// Skip header line
 	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading routing table: %w", err)
+		}
 		return nil, fmt.Errorf("empty routing table")
 	}
 
-	// Find the default route (Destination == 00000000)
+	var routes []defaultRoute
 	for scanner.Scan() {
 		fields := strings.Fields(scanner.Text())
 		if len(fields) < 3 {
 			continue
 		}
 
-		destination := fields[1]
+		// Default route has destination 00000000
+		if fields[1] != "00000000" {
+			continue
+		}
+		if len(fields) >= 8 && fields[7] != "00000000" {
+			continue
+		}
+
 		gatewayHex := fields[2]
+		gateway, err := parseHexIP(gatewayHex)
+		if err != nil {
+			log.WithError(err).WithField("hexGateway", gatewayHex).Error("failed to parse gateway from routing table")
+			return nil, fmt.Errorf("failed to parse gateway: %w", err)
+		}
+		// Skip if gateway is 0.0.0.0 (local route)
+		if gateway.Equal(net.IPv4zero) {
+			continue
+		}
 
-		// Default route has destination 00000000
-		if destination == "00000000" {
-			gateway, err := parseHexIP(gatewayHex)
-			if err != nil {
-				log.WithError(err).WithField("hexGateway", gatewayHex).Error("failed to parse gateway from routing table")
-				return nil, fmt.Errorf("failed to parse gateway: %w", err)
+		route := defaultRoute{gateway: gateway, iface: fields[0]}
+		if len(fields) >= 4 {
+			if flags, err := strconv.ParseUint(fields[3], 16, 32); err == nil && flags&procRouteFlagUp == 0 {
+				continue
 			}
-			// Skip if gateway is 0.0.0.0 (local route)
-			if !gateway.Equal(net.IPv4zero) {
-				log.WithField("gateway", gateway.String()).Debug("default gateway found in routing table")
-				return gateway, nil
+		}
+		if len(fields) >= 7 {
+			if metric, err := strconv.Atoi(fields[6]); err == nil {
+				route.metric = metric
 			}
 		}
+		routes = append(routes, route)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -66,8 +161,7 @@ func readDefaultGateway() (net.IP, error) {
 		return nil, fmt.Errorf("error reading routing table: %w", err)
 	}
 
-	log.Debug("no default gateway found in /proc/net/route")
-	return nil, nil // No default gateway found, use fallback
+	return routes, nil
 }
 
 // parseHexIP converts a hex-encoded IP address from /proc/net/route to net.IP.
@@ -3,7 +3,11 @@
 package nattraversal
 
 import (
+	"encoding/binary"
+	"errors"
 	"net"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -69,3 +73,214 @@ func TestReadDefaultGatewayLinux(t *testing.T) {
 		t.Log("No gateway found in routing table (may have no default route)")
 	}
 }
+
+func TestParseProcNetRoute(t *testing.T) {
+	const table = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+wlan0	00000000	0101A8C0	0003	0	0	600	00000000	0	0	0
+eth0	00000000	0100000A	0003	0	0	100	00000000	0	0	0
+eth0	0000000A	00000000	0001	0	0	100	00FFFFFF	0	0	0
+tun0	00000000	00000000	0001	0	0	50	00000000	0	0	0
+`
+	routes, err := parseProcNetRoute(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("parseProcNetRoute failed: %v", err)
+	}
+
+	if len(routes) != 2 {
+		t.Fatalf("Expected 2 default routes, got %d: %+v", len(routes), routes)
+	}
+
+	best := selectDefaultRoute(routes)
+	if best == nil {
+		t.Fatal("Expected a default route to be selected")
+	}
+	if !best.gateway.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("Expected lowest-metric gateway 10.0.0.1, got %v", best.gateway)
+	}
+	if best.iface != "eth0" || best.metric != 100 {
+		t.Errorf("Expected eth0 with metric 100, got %s with metric %d", best.iface, best.metric)
+	}
+}
+
+func TestParseProcNetRouteEmpty(t *testing.T) {
+	if _, err := parseProcNetRoute(strings.NewReader("")); err == nil {
+		t.Error("Expected error for empty routing table")
+	}
+}
+
+// netlinkRouteMessage builds an RTM_NEWROUTE message for parseNetlinkRoutes tests.
+func netlinkRouteMessage(family, dstLen, table uint8, attrs map[uint16][]byte) syscall.NetlinkMessage {
+	data := make([]byte, syscall.SizeofRtMsg)
+	data[0] = family
+	data[1] = dstLen
+	data[4] = table
+	data[7] = syscall.RTN_UNICAST
+
+	for typ, value := range attrs {
+		attrLen := syscall.SizeofRtAttr + len(value)
+		attr := make([]byte, (attrLen+syscall.RTA_ALIGNTO-1)&^(syscall.RTA_ALIGNTO-1))
+		binary.NativeEndian.PutUint16(attr[0:2], uint16(attrLen))
+		binary.NativeEndian.PutUint16(attr[2:4], typ)
+		copy(attr[syscall.SizeofRtAttr:], value)
+		data = append(data, attr...)
+	}
+
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{
+			Len:  uint32(syscall.NLMSG_HDRLEN + len(data)),
+			Type: syscall.RTM_NEWROUTE,
+		},
+		Data: data,
+	}
+}
+
+func nativeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return b
+}
+
+func TestParseNetlinkRoutes(t *testing.T) {
+	msgs := []syscall.NetlinkMessage{
+		// Default route via 192.168.1.1 on ifindex 3, metric 600
+		netlinkRouteMessage(syscall.AF_INET, 0, syscall.RT_TABLE_MAIN, map[uint16][]byte{
+			syscall.RTA_GATEWAY:  {192, 168, 1, 1},
+			syscall.RTA_OIF:      nativeUint32(3),
+			syscall.RTA_PRIORITY: nativeUint32(600),
+		}),
+		// Default route via 10.0.0.1 on ifindex 2, metric 100, with source
+		netlinkRouteMessage(syscall.AF_INET, 0, syscall.RT_TABLE_MAIN, map[uint16][]byte{
+			syscall.RTA_GATEWAY:  {10, 0, 0, 1},
+			syscall.RTA_OIF:      nativeUint32(2),
+			syscall.RTA_PRIORITY: nativeUint32(100),
+			syscall.RTA_PREFSRC:  {10, 0, 0, 42},
+		}),
+		// Policy routing table default route with an even lower metric
+		netlinkRouteMessage(syscall.AF_INET, 0, 100, map[uint16][]byte{
+			syscall.RTA_GATEWAY:  {172, 16, 0, 1},
+			syscall.RTA_PRIORITY: nativeUint32(1),
+		}),
+		// Non-default route (dst_len 24) must be ignored
+		netlinkRouteMessage(syscall.AF_INET, 24, syscall.RT_TABLE_MAIN, map[uint16][]byte{
+			syscall.RTA_GATEWAY: {192, 168, 2, 1},
+		}),
+		// IPv6 default route
+		netlinkRouteMessage(syscall.AF_INET6, 0, syscall.RT_TABLE_MAIN, map[uint16][]byte{
+			syscall.RTA_GATEWAY:  net.ParseIP("fe80::1"),
+			syscall.RTA_PRIORITY: nativeUint32(1),
+		}),
+	}
+
+	routes := parseNetlinkRoutes(msgs)
+	if len(routes) != 4 {
+		t.Fatalf("Expected 4 default routes, got %d: %+v", len(routes), routes)
+	}
+
+	best := selectDefaultRoute(routes)
+	if best == nil {
+		t.Fatal("Expected a default route to be selected")
+	}
+	if !best.gateway.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("Expected main-table IPv4 gateway 10.0.0.1 with lowest metric, got %v", best.gateway)
+	}
+	if best.ifindex != 2 || best.metric != 100 {
+		t.Errorf("Expected ifindex 2 and metric 100, got ifindex %d and metric %d", best.ifindex, best.metric)
+	}
+	if !best.src.Equal(net.IPv4(10, 0, 0, 42)) {
+		t.Errorf("Expected source 10.0.0.42, got %v", best.src)
+	}
+
+	if ip := localIPForRoute(best); !ip.Equal(net.IPv4(10, 0, 0, 42)) {
+		t.Errorf("Expected local IP from route source, got %v", ip)
+	}
+}
+
+// rtNexthop builds a struct rtnexthop with an RTA_GATEWAY attribute.
+func rtNexthop(ifindex uint32, gateway []byte) []byte {
+	attrLen := syscall.SizeofRtAttr + len(gateway)
+	hop := make([]byte, rtNexthopLen+rtaAlign(attrLen))
+	binary.NativeEndian.PutUint16(hop[0:2], uint16(rtNexthopLen+attrLen))
+	binary.NativeEndian.PutUint32(hop[4:8], ifindex)
+	binary.NativeEndian.PutUint16(hop[8:10], uint16(attrLen))
+	binary.NativeEndian.PutUint16(hop[10:12], syscall.RTA_GATEWAY)
+	copy(hop[12:], gateway)
+	return hop
+}
+
+// TestParseNetlinkMultipathRoutes tests that each next hop of a multipath
+// default route is returned as a route
+func TestParseNetlinkMultipathRoutes(t *testing.T) {
+	multipath := append(rtNexthop(2, []byte{10, 0, 0, 1}), rtNexthop(3, []byte{10, 0, 1, 1})...)
+	msgs := []syscall.NetlinkMessage{
+		netlinkRouteMessage(syscall.AF_INET, 0, syscall.RT_TABLE_MAIN, map[uint16][]byte{
+			syscall.RTA_MULTIPATH: multipath,
+			syscall.RTA_PRIORITY:  nativeUint32(50),
+		}),
+	}
+
+	routes := parseNetlinkRoutes(msgs)
+	if len(routes) != 2 {
+		t.Fatalf("Expected 2 routes from the next hops, got %d: %+v", len(routes), routes)
+	}
+	for i, want := range []struct {
+		gateway net.IP
+		ifindex int
+	}{{net.IPv4(10, 0, 0, 1), 2}, {net.IPv4(10, 0, 1, 1), 3}} {
+		if !routes[i].gateway.Equal(want.gateway) || routes[i].ifindex != want.ifindex || routes[i].metric != 50 {
+			t.Errorf("Expected next hop %v on ifindex %d with metric 50, got %+v", want.gateway, want.ifindex, routes[i])
+		}
+	}
+
+	// A truncated entry is ignored
+	if hops := parseNetlinkNexthops(multipath[:rtNexthopLen+2]); len(hops) != 0 {
+		t.Errorf("Expected no next hops from a truncated attribute, got %+v", hops)
+	}
+}
+
+// TestChooseDefaultRoute tests falling back to /proc/net/route when netlink
+// reports no IPv4 default route
+func TestChooseDefaultRoute(t *testing.T) {
+	ipv6 := []defaultRoute{{gateway: net.ParseIP("fe80::1"), table: routeTableMain}}
+	ipv4 := []defaultRoute{{gateway: net.IPv4(192, 168, 1, 1).To4(), iface: "eth0"}}
+	procCalls := 0
+	proc := func(routes []defaultRoute, err error) func() ([]defaultRoute, error) {
+		return func() ([]defaultRoute, error) {
+			procCalls++
+			return routes, err
+		}
+	}
+
+	route, err := chooseDefaultRoute(ipv4, nil, proc(nil, nil))
+	if err != nil || route == nil || !route.gateway.Equal(net.IPv4(192, 168, 1, 1)) || procCalls != 0 {
+		t.Errorf("Expected the netlink IPv4 route without reading /proc, got %+v, %v", route, err)
+	}
+
+	route, err = chooseDefaultRoute(ipv6, nil, proc(ipv4, nil))
+	if err != nil || route == nil || !route.gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("Expected the IPv4 route from /proc with only IPv6 routes via netlink, got %+v, %v", route, err)
+	}
+
+	route, err = chooseDefaultRoute(ipv6, nil, proc(nil, errors.New("no procfs")))
+	if err != nil || route == nil || route.gateway.To4() != nil {
+		t.Errorf("Expected the IPv6 route when /proc has none, got %+v, %v", route, err)
+	}
+
+	if _, err := chooseDefaultRoute(nil, errors.New("no netlink"), proc(nil, errors.New("no procfs"))); err == nil {
+		t.Error("Expected an error when neither source can be read")
+	}
+}
+
+func TestReadDefaultRoutesNetlink(t *testing.T) {
+	// This test queries the actual kernel routing table on Linux
+	routes, err := readDefaultRoutesNetlink()
+	if err != nil {
+		t.Skipf("netlink unavailable: %v", err)
+	}
+
+	for _, route := range routes {
+		if route.gateway == nil || route.gateway.IsUnspecified() {
+			t.Errorf("Expected default routes to have a gateway, got %+v", route)
+		}
+		t.Logf("Default route: gateway=%v iface=%s metric=%d table=%d", route.gateway, route.iface, route.metric, route.table)
+	}
+}
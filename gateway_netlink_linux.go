@@ -0,0 +1,173 @@
+//go:build linux
+
+package nattraversal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// rtMsgLen is the size of struct rtmsg that prefixes every route message.
+const rtMsgLen = syscall.SizeofRtMsg
+
+// rtNexthopLen is the size of struct rtnexthop, which prefixes each next hop
+// of an RTA_MULTIPATH attribute.
+const rtNexthopLen = 8
+
+// readDefaultRoutesNetlink dumps the kernel routing tables via an RTM_GETROUTE
+// netlink request and returns every IPv4 and IPv6 default route that has a
+// gateway, with its metric, table, outgoing interface and preferred source.
+func readDefaultRoutesNetlink() ([]defaultRoute, error) {
+	log.Debug("reading default routes via netlink")
+
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("netlink route dump failed: %w", err)
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse netlink messages: %w", err)
+	}
+
+	routes := parseNetlinkRoutes(msgs)
+	for i := range routes {
+		if routes[i].ifindex == 0 {
+			continue
+		}
+		if iface, err := net.InterfaceByIndex(routes[i].ifindex); err == nil {
+			routes[i].iface = iface.Name
+		}
+	}
+	return routes, nil
+}
+
+// parseNetlinkRoutes extracts default routes from RTM_NEWROUTE messages.
+// Only unicast routes with a zero-length destination and a gateway are
+// returned. A multipath route (RTA_MULTIPATH) is returned as one route per
+// next hop with a gateway, sharing the route's metric and table. Interface
+// names are not resolved; see readDefaultRoutesNetlink.
+func parseNetlinkRoutes(msgs []syscall.NetlinkMessage) []defaultRoute {
+	var routes []defaultRoute
+	for i := range msgs {
+		m := &msgs[i]
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < rtMsgLen {
+			continue
+		}
+
+		// struct rtmsg: family, dst_len, src_len, tos, table, protocol, scope, type, flags
+		family := m.Data[0]
+		dstLen := m.Data[1]
+		table := int(m.Data[4])
+		routeType := m.Data[7]
+
+		if family != syscall.AF_INET && family != syscall.AF_INET6 {
+			continue
+		}
+		if dstLen != 0 || routeType != syscall.RTN_UNICAST {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			log.WithError(err).Debug("skipping malformed netlink route message")
+			continue
+		}
+
+		route := defaultRoute{table: table}
+		var nexthops []defaultRoute
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_MULTIPATH:
+				nexthops = parseNetlinkNexthops(attr.Value)
+			case syscall.RTA_GATEWAY:
+				route.gateway = netlinkIP(attr.Value)
+			case syscall.RTA_PREFSRC:
+				route.src = netlinkIP(attr.Value)
+			case syscall.RTA_OIF:
+				if len(attr.Value) >= 4 {
+					route.ifindex = int(binary.NativeEndian.Uint32(attr.Value))
+				}
+			case syscall.RTA_PRIORITY:
+				if len(attr.Value) >= 4 {
+					route.metric = int(binary.NativeEndian.Uint32(attr.Value))
+				}
+			case syscall.RTA_TABLE:
+				// RTA_TABLE carries the full table ID when it does not fit in rtm_table.
+				if len(attr.Value) >= 4 {
+					route.table = int(binary.NativeEndian.Uint32(attr.Value))
+				}
+			}
+		}
+
+		if route.gateway == nil {
+			for _, hop := range nexthops {
+				if hop.gateway == nil || hop.gateway.IsUnspecified() {
+					continue
+				}
+				r := route
+				r.gateway, r.ifindex = hop.gateway, hop.ifindex
+				routes = append(routes, r)
+			}
+			continue
+		}
+		if route.gateway.IsUnspecified() {
+			continue
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// parseNetlinkNexthops parses the struct rtnexthop entries of an
+// RTA_MULTIPATH attribute and returns the gateway and outgoing interface of
+// each next hop. Parsing stops at the first malformed entry.
+func parseNetlinkNexthops(b []byte) []defaultRoute {
+	var hops []defaultRoute
+	for len(b) >= rtNexthopLen {
+		// struct rtnexthop: len (u16), flags, hops, ifindex (i32)
+		n := int(binary.NativeEndian.Uint16(b[0:2]))
+		if n < rtNexthopLen || n > len(b) {
+			break
+		}
+		hop := defaultRoute{ifindex: int(int32(binary.NativeEndian.Uint32(b[4:8])))}
+
+		attrs := b[rtNexthopLen:n]
+		for len(attrs) >= syscall.SizeofRtAttr {
+			attrLen := int(binary.NativeEndian.Uint16(attrs[0:2]))
+			if attrLen < syscall.SizeofRtAttr || attrLen > len(attrs) {
+				break
+			}
+			if binary.NativeEndian.Uint16(attrs[2:4]) == syscall.RTA_GATEWAY {
+				hop.gateway = netlinkIP(attrs[syscall.SizeofRtAttr:attrLen])
+			}
+			attrs = attrs[min(rtaAlign(attrLen), len(attrs)):]
+		}
+
+		hops = append(hops, hop)
+		b = b[min(rtaAlign(n), len(b)):]
+	}
+	return hops
+}
+
+// rtaAlign rounds n up to the netlink attribute alignment.
+func rtaAlign(n int) int {
+	return (n + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+}
+
+// netlinkIP converts a raw netlink address attribute to net.IP.
+// Returns nil if the attribute is not a valid IPv4 or IPv6 address.
+func netlinkIP(b []byte) net.IP {
+	switch len(b) {
+	case net.IPv4len:
+		return net.IPv4(b[0], b[1], b[2], b[3]).To4()
+	case net.IPv6len:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, b)
+		return ip
+	default:
+		return nil
+	}
+}
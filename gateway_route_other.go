@@ -0,0 +1,15 @@
+//go:build !linux
+
+package nattraversal
+
+// readDefaultRoute wraps the platform's readDefaultGateway for platforms that
+// only report the gateway address. Interface, source and metric are left unset,
+// so local address selection falls back to the dial heuristic.
+// Returns nil, nil if no default gateway is found.
+func readDefaultRoute() (*defaultRoute, error) {
+	gateway, err := readDefaultGateway()
+	if err != nil || gateway == nil {
+		return nil, err
+	}
+	return &defaultRoute{gateway: gateway}, nil
+}
@@ -83,3 +83,57 @@ func TestReadDefaultGateway(t *testing.T) {
 		}
 	})
 }
+
+// TestSelectDefaultRoute tests the cross-platform default route preference order.
+func TestSelectDefaultRoute(t *testing.T) {
+	t.Run("empty route list returns nil", func(t *testing.T) {
+		if route := selectDefaultRoute(nil); route != nil {
+			t.Errorf("Expected nil route, got %+v", route)
+		}
+	})
+
+	t.Run("lowest metric wins", func(t *testing.T) {
+		routes := []defaultRoute{
+			{gateway: net.IPv4(192, 168, 1, 1), metric: 600},
+			{gateway: net.IPv4(10, 0, 0, 1), metric: 100},
+		}
+		route := selectDefaultRoute(routes)
+		if !route.gateway.Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Errorf("Expected 10.0.0.1, got %v", route.gateway)
+		}
+	})
+
+	t.Run("IPv4 preferred over IPv6", func(t *testing.T) {
+		routes := []defaultRoute{
+			{gateway: net.ParseIP("fe80::1"), metric: 1},
+			{gateway: net.IPv4(192, 168, 1, 1), metric: 600},
+		}
+		route := selectDefaultRoute(routes)
+		if route.gateway.To4() == nil {
+			t.Errorf("Expected IPv4 gateway, got %v", route.gateway)
+		}
+	})
+
+	t.Run("main table preferred over other tables", func(t *testing.T) {
+		routes := []defaultRoute{
+			{gateway: net.IPv4(172, 16, 0, 1), metric: 1, table: 100},
+			{gateway: net.IPv4(192, 168, 1, 1), metric: 600, table: routeTableMain},
+		}
+		route := selectDefaultRoute(routes)
+		if !route.gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+			t.Errorf("Expected main-table gateway 192.168.1.1, got %v", route.gateway)
+		}
+	})
+}
+
+// TestDiscoverLocalIP tests that local address selection returns a usable IP.
+func TestDiscoverLocalIP(t *testing.T) {
+	ip, err := discoverLocalIP()
+	if err != nil {
+		t.Skipf("no route to determine local IP: %v", err)
+	}
+	if ip == nil || ip.IsUnspecified() {
+		t.Errorf("Expected a specific local IP, got %v", ip)
+	}
+	t.Logf("Local IP: %v", ip)
+}
@@ -0,0 +1,200 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// HairpinStatus describes whether the gateway forwards traffic from the LAN
+// to its own external address back into the LAN (NAT loopback).
+type HairpinStatus int
+
+const (
+	// HairpinUnknown means hairpin support has not been detected.
+	HairpinUnknown HairpinStatus = iota
+	// HairpinSupported means hosts on the LAN can reach the listener through
+	// its external address. It is also reported when no NAT is involved.
+	HairpinSupported
+	// HairpinUnsupported means hosts on the LAN must use the internal address.
+	HairpinUnsupported
+)
+
+// String returns a human-readable name for the hairpin status.
+func (s HairpinStatus) String() string {
+	switch s {
+	case HairpinUnknown:
+		return "unknown"
+	case HairpinSupported:
+		return "supported"
+	case HairpinUnsupported:
+		return "unsupported"
+	default:
+		return fmt.Sprintf("HairpinStatus(%d)", int(s))
+	}
+}
+
+// hairpinStatusFrom converts the hairpin outcome of a reachability check.
+func hairpinStatusFrom(ok bool) HairpinStatus {
+	if ok {
+		return HairpinSupported
+	}
+	return HairpinUnsupported
+}
+
+// detectHairpinTCP connects to externalAddr and sends a probe payload to
+// find out whether the gateway supports hairpinning. Hairpinning is only
+// reported as supported if l accepts the probe connection and receives the
+// payload, so a connection answered by another host does not count. It must
+// be called before l is handed to the application, since other connections
+// accepted meanwhile are closed.
+func detectHairpinTCP(ctx context.Context, l net.Listener, externalAddr string) HairpinStatus {
+	ctx, cancel := context.WithTimeout(ctx, hairpinDetectTimeout)
+	defer cancel()
+
+	tl, ok := l.(interface {
+		net.Listener
+		SetDeadline(t time.Time) error
+	})
+	if !ok {
+		log.WithField("addr", externalAddr).Debug("TCP hairpin detection needs a listener with deadlines")
+		return HairpinUnsupported
+	}
+
+	var filter probeFilter
+	payload, received, cancelProbe, err := filter.register()
+	if err != nil {
+		log.WithError(err).Debug("TCP hairpin detection failed")
+		return HairpinUnsupported
+	}
+	defer cancelProbe()
+
+	if err := sendTCPProbe(ctx, externalAddr, payload); err != nil {
+		log.WithError(err).WithField("addr", externalAddr).Debug("TCP hairpin connection failed")
+		return HairpinUnsupported
+	}
+
+	deadline, _ := ctx.Deadline()
+	tl.SetDeadline(deadline)
+	defer tl.SetDeadline(time.Time{})
+	for {
+		conn, err := tl.Accept()
+		if err != nil {
+			log.WithError(err).WithField("addr", externalAddr).Debug("TCP hairpin probe not accepted")
+			return HairpinUnsupported
+		}
+		filter.peekTCP(conn)
+		conn.Close()
+		select {
+		case <-received:
+			return HairpinSupported
+		default:
+		}
+	}
+}
+
+// detectHairpinUDP sends a probe datagram to externalAddr to find out
+// whether the gateway supports hairpinning, reading conn until it arrives.
+// It must be called before conn is handed to the application, since other
+// datagrams read meanwhile are discarded.
+func detectHairpinUDP(ctx context.Context, conn net.PacketConn, externalAddr string) HairpinStatus {
+	ctx, cancel := context.WithTimeout(ctx, hairpinDetectTimeout)
+	defer cancel()
+
+	var filter probeFilter
+	var wg sync.WaitGroup
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, len(probeMagic)+probeNonceSize)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					log.WithError(err).Debug("read failed during UDP hairpin detection")
+				}
+				return
+			}
+			filter.match(buf[:n])
+		}
+	}()
+
+	err := hairpinUDP(ctx, externalAddr, &filter)
+
+	// Stop the reader and restore blocking reads for the application
+	conn.SetReadDeadline(time.Now())
+	wg.Wait()
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		log.WithError(err).WithField("addr", externalAddr).Debug("UDP hairpin probe failed")
+		return HairpinUnsupported
+	}
+	return HairpinSupported
+}
+
+// logHairpinStatus records the detected hairpin support.
+func logHairpinStatus(log logEntry, status HairpinStatus, protocol, externalAddr string) {
+	log.WithFields(Fields{
+		"protocol": protocol,
+		"addr":     externalAddr,
+		"hairpin":  status.String(),
+	}).Debug("hairpin support detected")
+}
+
+// interfaceAddrs lists local interface addresses. It is a variable so tests
+// can simulate LAN configurations.
+var interfaceAddrs = net.InterfaceAddrs
+
+// lanAddrFor returns the local address a peer at ip should connect to if
+// it is this host, on the same LAN as internalIP, or behind the same NAT as
+// externalIP, and nil otherwise. If internalIP is unspecified, every
+// interface's network counts as the LAN and the address on the peer's
+// network is returned.
+func lanAddrFor(ip, internalIP, externalIP net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	bound := internalIP != nil && !internalIP.IsUnspecified()
+
+	if ip.IsLoopback() {
+		if bound {
+			return internalIP
+		}
+		return ip
+	}
+
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var fallback net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || (bound && !ipNet.IP.Equal(internalIP)) {
+			continue
+		}
+		if ipNet.Contains(ip) {
+			return ipNet.IP
+		}
+		if fallback == nil && (ipNet.IP.To4() == nil) == (ip.To4() == nil) {
+			fallback = ipNet.IP
+		}
+	}
+
+	// A peer sharing our external IP is behind the same NAT, possibly on
+	// another subnet of the same site
+	if externalIP != nil && ip.Equal(externalIP) {
+		if bound {
+			return internalIP
+		}
+		return fallback
+	}
+	return nil
+}
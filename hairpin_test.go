@@ -0,0 +1,189 @@
+package nattraversal
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestNATAddrAddressFor tests internal address substitution for LAN peers
+func TestNATAddrAddressFor(t *testing.T) {
+	original := interfaceAddrs
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.IPv4(192, 168, 1, 20), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.IPv4(10, 8, 0, 5), Mask: net.CIDRMask(24, 32)},
+		}, nil
+	}
+	defer func() { interfaceAddrs = original }()
+
+	peer := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+	}
+
+	allInterfaces := NewNATAddr("tcp", "0.0.0.0:8080", "203.0.113.5:9080")
+	bound := NewNATAddr("tcp", "192.168.1.20:8080", "203.0.113.5:9080")
+
+	tests := []struct {
+		name     string
+		addr     *NATAddr
+		remote   net.Addr
+		expected string
+	}{
+		{"LAN peer", allInterfaces, peer("192.168.1.50"), "192.168.1.20:8080"},
+		{"Peer on second interface", allInterfaces, peer("10.8.0.9"), "10.8.0.5:8080"},
+		{"Internet peer", allInterfaces, peer("198.51.100.1"), "203.0.113.5:9080"},
+		{"Peer behind same NAT", allInterfaces, peer("203.0.113.5"), "192.168.1.20:8080"},
+		{"Loopback peer", allInterfaces, peer("127.0.0.1"), "127.0.0.1:8080"},
+		{"UDP LAN peer", allInterfaces, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 50), Port: 5000}, "192.168.1.20:8080"},
+		{"Nil remote", allInterfaces, nil, "203.0.113.5:9080"},
+		{"Bound listener, LAN peer", bound, peer("192.168.1.50"), "192.168.1.20:8080"},
+		{"Bound listener, other interface", bound, peer("10.8.0.9"), "203.0.113.5:9080"},
+		{"Hairpin supported", allInterfaces.withHairpin(HairpinSupported), peer("192.168.1.50"), "203.0.113.5:9080"},
+		{"Hairpin unsupported", allInterfaces.withHairpin(HairpinUnsupported), peer("192.168.1.50"), "192.168.1.20:8080"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.addr.AddressFor(tt.remote); got != tt.expected {
+				t.Errorf("AddressFor(%v) = %s, expected %s", tt.remote, got, tt.expected)
+			}
+		})
+	}
+
+	t.Run("Hairpin support follows the external IP", func(t *testing.T) {
+		addr := allInterfaces.withHairpin(HairpinSupported)
+		if addr.withExternalAddr("203.0.113.5:9081").Hairpin() != HairpinSupported {
+			t.Error("Expected hairpin support kept after a port change")
+		}
+		if addr.withExternalAddr("198.51.100.7:9080").Hairpin() != HairpinUnknown {
+			t.Error("Expected hairpin support reset after an external IP change")
+		}
+	})
+}
+
+// TestDetectHairpin tests hairpin detection at listen time
+func TestDetectHairpin(t *testing.T) {
+	// The mock mapper maps to the same port on loopback, so the external
+	// address is reachable from this host like a gateway with hairpinning
+	hairpinMapper := NewMockPortMapper()
+	hairpinMapper.SetExternalIP("127.0.0.1")
+
+	// Here the external port is not forwarded anywhere
+	noHairpinMapper := NewMockPortMapper()
+	noHairpinMapper.SetExternalIP("127.0.0.1")
+	noHairpinMapper.SetNATType(RestrictedNAT)
+
+	lc := &ListenConfig{DetectHairpin: true}
+
+	t.Run("TCP supported", func(t *testing.T) {
+		useMockPortMapper(t, hairpinMapper)
+		listener, err := lc.Listen(context.Background(), freePorts(t, 1)[0])
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		defer listener.Close()
+
+		if listener.Hairpin() != HairpinSupported {
+			t.Errorf("Expected hairpin supported, got %v", listener.Hairpin())
+		}
+
+		// The detection connection must not be returned by Accept
+		conn, err := net.Dial("tcp", listener.Addr().(*NATAddr).InternalAddr())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		accepted, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("Accept failed: %v", err)
+		}
+		defer accepted.Close()
+		if accepted.RemoteAddr().String() != conn.LocalAddr().String() {
+			t.Errorf("Expected our connection from %s, got one from %s", conn.LocalAddr(), accepted.RemoteAddr())
+		}
+	})
+
+	t.Run("TCP unsupported", func(t *testing.T) {
+		useMockPortMapper(t, noHairpinMapper)
+		listener, err := lc.Listen(context.Background(), freePorts(t, 1)[0])
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		defer listener.Close()
+
+		if listener.Hairpin() != HairpinUnsupported {
+			t.Errorf("Expected hairpin unsupported, got %v", listener.Hairpin())
+		}
+	})
+
+	t.Run("TCP answered by another host", func(t *testing.T) {
+		// The external address leads to a server other than the listener
+		other, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer other.Close()
+		go func() {
+			for {
+				conn, err := other.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer l.Close()
+
+		if status := detectHairpinTCP(context.Background(), l, other.Addr().String()); status != HairpinUnsupported {
+			t.Errorf("Expected hairpin unsupported, got %v", status)
+		}
+	})
+
+	t.Run("UDP supported", func(t *testing.T) {
+		useMockPortMapper(t, hairpinMapper)
+		listener, err := lc.ListenPacket(context.Background(), freePorts(t, 1)[0])
+		if err != nil {
+			t.Fatalf("ListenPacket failed: %v", err)
+		}
+		defer listener.Close()
+
+		if listener.Hairpin() != HairpinSupported {
+			t.Errorf("Expected hairpin supported, got %v", listener.Hairpin())
+		}
+
+		// Reads block normally after detection
+		sender, err := net.Dial("udp", listener.Addr().(*NATAddr).InternalAddr())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer sender.Close()
+		time.AfterFunc(50*time.Millisecond, func() { sender.Write([]byte("hello")) })
+
+		buf := make([]byte, 64)
+		n, _, err := listener.PacketConn().ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Errorf("Expected application datagram, got %q, %v", buf[:n], err)
+		}
+	})
+
+	t.Run("Not detected by default", func(t *testing.T) {
+		useMockPortMapper(t, hairpinMapper)
+		listener, err := (&ListenConfig{}).ListenPacket(context.Background(), freePorts(t, 1)[0])
+		if err != nil {
+			t.Fatalf("ListenPacket failed: %v", err)
+		}
+		defer listener.Close()
+
+		if listener.Hairpin() != HairpinUnknown {
+			t.Errorf("Expected hairpin unknown, got %v", listener.Hairpin())
+		}
+	})
+}
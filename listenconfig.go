@@ -0,0 +1,121 @@
+package nattraversal
+
+import (
+	"context"
+
+	"github.com/go-i2p/go-nat-listener/clock"
+)
+
+// ListenConfig contains options for creating NAT listeners.
+// The zero value is valid: Listen on a zero ListenConfig behaves like ListenContext.
+type ListenConfig struct {
+	// Clock drives port mapping renewal and lease expiry.
+	// If nil, the system clock is used.
+	Clock clock.Clock
+
+	// Scheduler renews the listener's port mapping together with other
+	// mappings on a shared goroutine. If nil, the listener renews on its own.
+	// The caller starts and stops the scheduler.
+	Scheduler *RenewalScheduler
+
+	// GatewayPolicies rank the UPnP gateways found by DiscoverGateways on
+	// networks with several routers or a dual-WAN router. If set, or if
+	// RedundantGateways is set, listeners map through the discovered gateways
+	// instead of the default discovery order (direct, UPnP, NAT-PMP).
+	GatewayPolicies []GatewayPolicy
+
+	// RedundantGateways maps every port on all discovered gateways through a
+	// MultiMapper, so the listener stays reachable if one uplink fails.
+	RedundantGateways bool
+
+	// CascadeMapping also maps ports on the upstream gateway when the local
+	// gateway reports a private external IP (double NAT), so the listener is
+	// reachable through both routers.
+	CascadeMapping bool
+
+	// UpstreamDiscovery finds the upstream gateway for CascadeMapping. If nil,
+	// NAT-PMP is tried at the first host address of the /24 network containing
+	// the local gateway's external IP.
+	UpstreamDiscovery UpstreamDiscovery
+
+	// Prober checks from outside the NAT that the listener's external address
+	// is reachable when VerifyReachability is called. If nil, only the hairpin
+	// check is used.
+	Prober ReachabilityProber
+
+	// DetectHairpin checks whether the gateway supports hairpinning when a
+	// listener is created, by connecting or sending a probe datagram to the
+	// external address. This delays Listen by up to a second on gateways
+	// without hairpin support. The result is reported by the listener's
+	// Hairpin method and used by NATAddr.AddressFor.
+	DetectHairpin bool
+
+	// Connections enables tracking of the connections accepted by TCP
+	// listeners, reported by their Connections and ConnStats methods, and
+	// bounds them. If nil, accepted connections are not tracked.
+	Connections *ConnLimits
+
+	// DaemonSocket delegates the listeners' port mappings to the natd daemon
+	// listening on this socket, such as DefaultDaemonSocket(). The daemon
+	// must run as root or as the current user. If no daemon answers, or if
+	// DaemonSocket is empty, the gateway is discovered as usual; setting
+	// $NATD_SOCKET enables delegation for every listener of the process.
+	DaemonSocket string
+
+	// Logger receives the log messages of listeners created with lc and of
+	// their port renewal. If nil, the package logger set with SetLogger is
+	// used. Port mapper discovery and protocol messages always go to the
+	// package logger.
+	Logger Logger
+}
+
+// logger returns the log entry for listeners created with lc.
+func (lc *ListenConfig) logger() logEntry {
+	return newLogEntry(lc.Logger)
+}
+
+// portMapper discovers the port mapper used by listeners created with lc.
+func (lc *ListenConfig) portMapper(ctx context.Context) (PortMapper, error) {
+	var mapper PortMapper
+	var err error
+	switch {
+	case lc.DaemonSocket != "":
+		mapper, err = instrumentDiscovery(ctx, daemonDiscovery(lc.DaemonSocket))
+	case len(lc.GatewayPolicies) == 0 && !lc.RedundantGateways:
+		mapper, err = newPortMapper(ctx)
+	default:
+		mapper, err = gatewayMapper(ctx, lc.GatewayPolicies, lc.RedundantGateways)
+	}
+	if err != nil || !lc.CascadeMapping {
+		return mapper, err
+	}
+	return cascadeIfDoubleNAT(ctx, mapper, lc.UpstreamDiscovery), nil
+}
+
+// newRenewalManager creates a renewal manager configured with the listener options.
+func (lc *ListenConfig) newRenewalManager(mapper PortMapper, protocol string, internalPort, externalPort int) *RenewalManager {
+	renewal := NewRenewalManager(mapper, protocol, internalPort, externalPort)
+	renewal.log = lc.logger()
+	if lc.Clock != nil {
+		renewal.SetClock(lc.Clock)
+	}
+	if lc.Scheduler != nil {
+		renewal.SetScheduler(lc.Scheduler)
+	}
+	return renewal
+}
+
+// hairpinStatus returns the hairpin support of a new listener mapped through
+// mapper. Hairpinning is not needed without a NAT; otherwise detect is only
+// run if DetectHairpin is set.
+func (lc *ListenConfig) hairpinStatus(mapper PortMapper, protocol, externalAddr string, detect func() HairpinStatus) HairpinStatus {
+	if isDirectMapper(mapper) {
+		return HairpinSupported
+	}
+	if !lc.DetectHairpin {
+		return HairpinUnknown
+	}
+	status := detect()
+	logHairpinStatus(lc.logger(), status, protocol, externalAddr)
+	return status
+}
@@ -4,8 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
-
-	"github.com/go-i2p/logger"
+	"time"
 )
 
 // Listen creates a TCP listener with NAT traversal on the specified port.
@@ -15,9 +14,16 @@ func Listen(port int) (*NATListener, error) {
 }
 
 // ListenContext creates a TCP listener with NAT traversal on the specified port.
+// It is equivalent to calling Listen on a zero ListenConfig.
+func ListenContext(ctx context.Context, port int) (*NATListener, error) {
+	return (&ListenConfig{}).Listen(ctx, port)
+}
+
+// Listen creates a TCP listener with NAT traversal on the specified port.
 // The context can be used to cancel the discovery and mapping operations.
 // Once the listener is created, the context is no longer used - use Close() to stop the listener.
-func ListenContext(ctx context.Context, port int) (*NATListener, error) {
+func (lc *ListenConfig) Listen(ctx context.Context, port int) (*NATListener, error) {
+	log := lc.logger()
 	log.WithField("port", port).Debug("creating NAT TCP listener")
 
 	// Check context before starting
@@ -25,13 +31,34 @@ func ListenContext(ctx context.Context, port int) (*NATListener, error) {
 		return nil, fmt.Errorf("context cancelled before starting: %w", err)
 	}
 
-	mapper, externalPort, err := createTCPMappingContext(ctx, port)
+	mapper, mapping, err := lc.createMapping(ctx, "TCP", port)
 	if err != nil {
 		log.WithError(err).WithField("port", port).Error("failed to create TCP port mapping")
 		return nil, fmt.Errorf("failed to create port mapping: %w", err)
 	}
 
-	log.WithFields(logger.Fields{
+	natListener, err := lc.listenWithMapping(ctx, mapper, mapping, "tcp", nil, port)
+	if err != nil {
+		return nil, err
+	}
+	natListener.monitor = startNetworkMonitor(natListener.handleNetworkChange)
+
+	log.WithFields(Fields{
+		"internalAddr": natListener.addr.InternalAddr(),
+		"externalAddr": natListener.addr.ExternalAddr(),
+	}).Debug("NAT TCP listener ready")
+	return natListener, nil
+}
+
+// listenWithMapping binds the TCP socket for an established mapping and starts
+// its renewal. The socket is bound to localIP, or to all interfaces if localIP
+// is nil. The mapping is removed if the listener cannot be created.
+// Network change monitoring is left to the caller.
+func (lc *ListenConfig) listenWithMapping(ctx context.Context, mapper PortMapper, mapping MapPortResult, network string, localIP net.IP, port int) (*NATListener, error) {
+	log := lc.logger()
+	externalPort := mapping.ExternalPort
+
+	log.WithFields(Fields{
 		"internalPort": port,
 		"externalPort": externalPort,
 	}).Debug("TCP port mapping created")
@@ -42,7 +69,7 @@ func ListenContext(ctx context.Context, port int) (*NATListener, error) {
 		return nil, fmt.Errorf("context cancelled after mapping: %w", err)
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	listener, err := net.Listen(network, bindAddress(localIP, port))
 	if err != nil {
 		mapper.UnmapPort("TCP", externalPort)
 		log.WithError(err).WithField("port", port).Error("failed to bind TCP listener")
@@ -58,7 +85,7 @@ func ListenContext(ctx context.Context, port int) (*NATListener, error) {
 
 	// Get addresses for NATAddr
 	internalAddr := listener.Addr().String()
-	externalIP, err := mapper.GetExternalIP()
+	externalIP, err := externalIPContext(ctx, mapper)
 	if err != nil {
 		listener.Close()
 		mapper.UnmapPort("TCP", externalPort)
@@ -67,9 +94,13 @@ func ListenContext(ctx context.Context, port int) (*NATListener, error) {
 	}
 
 	externalAddr := fmt.Sprintf("%s:%d", externalIP, externalPort)
-	addr := NewNATAddr("tcp", internalAddr, externalAddr)
+	addr := NewNATAddr(network, internalAddr, externalAddr)
+	addr = addr.withHairpin(lc.hairpinStatus(mapper, "TCP", externalAddr, func() HairpinStatus {
+		return detectHairpinTCP(ctx, listener, externalAddr)
+	}))
 
-	renewal := NewRenewalManager(mapper, "TCP", port, externalPort)
+	renewal := lc.newRenewalManager(mapper, "TCP", port, externalPort)
+	renewal.SetLeaseLifetime(mapping.Lifetime)
 
 	natListener := &NATListener{
 		listener:     listener,
@@ -77,16 +108,22 @@ func ListenContext(ctx context.Context, port int) (*NATListener, error) {
 		externalPort: externalPort,
 		externalIP:   externalIP,
 		addr:         addr,
+		localIP:      localIP,
+		discover:     lc.portMapper,
+		prober:       lc.Prober,
+		conns:        newConnTable(lc.Connections, log),
+		log:          log,
+		created:      time.Now(),
 	}
+	natListener.ipHistory.record(externalIP, natListener.created)
 
 	// Set up callback to handle external port changes during renewal
 	renewal.SetPortChangeCallback(natListener.updateExternalPort)
+	renewal.SetStateChangeCallback(func(_, _ MappingState) { natListener.notifyReachability() })
 	renewal.Start()
+	liveListeners.addTCP(natListener)
 
-	log.WithFields(logger.Fields{
-		"internalAddr": internalAddr,
-		"externalAddr": externalAddr,
-	}).Debug("NAT TCP listener ready")
+	logNATStatus(log, ClassifyNAT(mapper, externalIP), "TCP")
 	return natListener, nil
 }
 
@@ -98,7 +135,14 @@ func ListenWithFallback(port int) (*NATListener, error) {
 	return ListenWithFallbackContext(context.Background(), port)
 }
 
-// ListenWithFallbackContext creates a TCP listener with NAT traversal on the specified port.
+// ListenWithFallbackContext creates a TCP listener with NAT traversal on the specified port,
+// falling back to a standard net.Listener if NAT traversal fails.
+// It is equivalent to calling ListenWithFallback on a zero ListenConfig.
+func ListenWithFallbackContext(ctx context.Context, port int) (*NATListener, error) {
+	return (&ListenConfig{}).ListenWithFallback(ctx, port)
+}
+
+// ListenWithFallback creates a TCP listener with NAT traversal on the specified port.
 // If NAT traversal fails (UPnP and NAT-PMP both unavailable), it falls back to a
 // standard net.Listener without NAT hole-punching.
 // The context can be used to cancel the discovery and mapping operations.
@@ -109,7 +153,8 @@ func ListenWithFallback(port int) (*NATListener, error) {
 //   - Addr() returns a NATAddr where internal and external addresses are the same
 //   - No port renewal is performed (the renewal manager is nil)
 //   - IsFallback() returns true
-func ListenWithFallbackContext(ctx context.Context, port int) (*NATListener, error) {
+func (lc *ListenConfig) ListenWithFallback(ctx context.Context, port int) (*NATListener, error) {
+	log := lc.logger()
 	log.WithField("port", port).Debug("creating NAT TCP listener with fallback")
 
 	// Check context before starting
@@ -118,7 +163,7 @@ func ListenWithFallbackContext(ctx context.Context, port int) (*NATListener, err
 	}
 
 	// Try NAT traversal first
-	natListener, err := ListenContext(ctx, port)
+	natListener, err := lc.Listen(ctx, port)
 	if err == nil {
 		return natListener, nil
 	}
@@ -141,17 +186,30 @@ func ListenWithFallbackContext(ctx context.Context, port int) (*NATListener, err
 	internalAddr := listener.Addr().String()
 	addr := NewNATAddr("tcp", internalAddr, internalAddr)
 
-	log.WithFields(logger.Fields{
+	log.WithFields(Fields{
 		"port":         port,
 		"internalAddr": internalAddr,
 	}).Info("TCP listener started in fallback mode (no NAT traversal)")
-
-	return &NATListener{
+	emit(Event{
+		Kind:         FallbackEngaged,
+		Mapper:       "none",
+		Protocol:     "TCP",
+		InternalPort: port,
+		ExternalPort: port,
+		Err:          err,
+	})
+
+	fallbackListener := &NATListener{
 		listener:     listener,
 		renewal:      nil, // No renewal for fallback
 		externalPort: port,
 		externalIP:   "", // Unknown external IP in fallback mode
 		addr:         addr,
 		fallback:     true,
-	}, nil
+		conns:        newConnTable(lc.Connections, log),
+		log:          log,
+		created:      time.Now(),
+	}
+	liveListeners.addTCP(fallbackListener)
+	return fallbackListener, nil
 }
@@ -0,0 +1,340 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// LocalAddrPortMapper is implemented by port mappers that can create mappings
+// for a specific local address instead of the address of the default route.
+// ListenAddr and ListenPacketAddr require it when binding to a specific address.
+type LocalAddrPortMapper interface {
+	PortMapper
+	// ForLocalAddr returns a mapper whose mappings forward to ip.
+	// It returns an error if the gateway is not reachable from ip.
+	ForLocalAddr(ip net.IP) (PortMapper, error)
+}
+
+// localAddrContextMapper is implemented by LocalAddrPortMappers that run
+// discovery to derive a mapper for ip, so that ctx can bound it.
+type localAddrContextMapper interface {
+	ForLocalAddrContext(ctx context.Context, ip net.IP) (PortMapper, error)
+}
+
+// ListenAddr creates a TCP listener with NAT traversal bound to a specific
+// local address, such as "192.168.1.20:8080". network must be "tcp" or "tcp4".
+// It is equivalent to calling ListenAddr on a zero ListenConfig.
+func ListenAddr(ctx context.Context, network, address string) (*NATListener, error) {
+	return (&ListenConfig{}).ListenAddr(ctx, network, address)
+}
+
+// ListenPacketAddr creates a UDP packet listener with NAT traversal bound to a
+// specific local address, such as "192.168.1.20:9000". network must be "udp"
+// or "udp4". It is equivalent to calling ListenPacketAddr on a zero ListenConfig.
+func ListenPacketAddr(ctx context.Context, network, address string) (*NATPacketListener, error) {
+	return (&ListenConfig{}).ListenPacketAddr(ctx, network, address)
+}
+
+// ListenAddr creates a TCP listener with NAT traversal bound to a specific
+// local address. The socket is bound to that address only, and the port
+// mapping forwards to it rather than to the address of the default route,
+// which matters on multi-homed hosts and hosts with container bridges.
+// The gateway must be on the address's subnet.
+// An unspecified host ("", "0.0.0.0") binds all interfaces like ListenContext.
+func (lc *ListenConfig) ListenAddr(ctx context.Context, network, address string) (*NATListener, error) {
+	log := lc.logger()
+	log.WithFields(Fields{
+		"network": network,
+		"address": address,
+	}).Debug("creating NAT TCP listener on address")
+
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("unsupported network %q: must be tcp or tcp4", network)
+	}
+
+	mapper, mapping, localIP, port, err := lc.mapLocalAddr(ctx, "TCP", address)
+	if err != nil {
+		return nil, err
+	}
+
+	natListener, err := lc.listenWithMapping(ctx, mapper, mapping, network, localIP, port)
+	if err != nil {
+		return nil, err
+	}
+	natListener.monitor = startNetworkMonitor(natListener.handleNetworkChange)
+
+	log.WithFields(Fields{
+		"internalAddr": natListener.addr.InternalAddr(),
+		"externalAddr": natListener.addr.ExternalAddr(),
+	}).Debug("NAT TCP listener ready")
+	return natListener, nil
+}
+
+// ListenPacketAddr creates a UDP packet listener with NAT traversal bound to a
+// specific local address. See ListenAddr.
+func (lc *ListenConfig) ListenPacketAddr(ctx context.Context, network, address string) (*NATPacketListener, error) {
+	log := lc.logger()
+	log.WithFields(Fields{
+		"network": network,
+		"address": address,
+	}).Debug("creating NAT UDP packet listener on address")
+
+	if network != "udp" && network != "udp4" {
+		return nil, fmt.Errorf("unsupported network %q: must be udp or udp4", network)
+	}
+
+	mapper, mapping, localIP, port, err := lc.mapLocalAddr(ctx, "UDP", address)
+	if err != nil {
+		return nil, err
+	}
+
+	packetListener, err := lc.listenPacketWithMapping(ctx, mapper, mapping, network, localIP, port)
+	if err != nil {
+		return nil, err
+	}
+	packetListener.monitor = startNetworkMonitor(packetListener.handleNetworkChange)
+
+	log.WithFields(Fields{
+		"internalAddr": packetListener.addr.InternalAddr(),
+		"externalAddr": packetListener.addr.ExternalAddr(),
+	}).Debug("NAT UDP packet listener ready")
+	return packetListener, nil
+}
+
+// mapLocalAddr parses address, discovers a port mapper for it, and maps the
+// port. localIP is nil if address does not name a specific host.
+func (lc *ListenConfig) mapLocalAddr(ctx context.Context, protocol, address string) (PortMapper, MapPortResult, net.IP, int, error) {
+	log := lc.logger()
+	localIP, port, err := parseListenAddr(address)
+	if err != nil {
+		return nil, MapPortResult{}, nil, 0, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, MapPortResult{}, nil, 0, fmt.Errorf("context cancelled before starting: %w", err)
+	}
+
+	mapper, err := lc.portMapper(ctx)
+	if err != nil {
+		log.WithError(err).WithField("address", address).Error("failed to create port mapper")
+		return nil, MapPortResult{}, nil, 0, fmt.Errorf("failed to create port mapper: %w", err)
+	}
+	if localIP != nil {
+		if mapper, err = localAddrMapper(ctx, mapper, localIP); err != nil {
+			log.WithError(err).WithField("address", address).Error("port mapper cannot map for local address")
+			return nil, MapPortResult{}, nil, 0, err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, MapPortResult{}, nil, 0, fmt.Errorf("context cancelled after discovery: %w", err)
+	}
+
+	mapping, err := mapListenerPort(ctx, mapper, protocol, port)
+	if err != nil {
+		log.WithError(err).WithFields(Fields{
+			"address":  address,
+			"protocol": protocol,
+		}).Error("port mapping for local address failed")
+		return nil, MapPortResult{}, nil, 0, fmt.Errorf("failed to create port mapping: %w", err)
+	}
+	return mapper, mapping, localIP, port, nil
+}
+
+// mapperForLocalAddr returns a mapper whose mappings forward to ip.
+func mapperForLocalAddr(mapper PortMapper, ip net.IP) (PortMapper, error) {
+	lm, ok := mapper.(LocalAddrPortMapper)
+	if !ok {
+		return nil, fmt.Errorf("port mapper %T cannot map ports for a specific local address", mapper)
+	}
+	return lm.ForLocalAddr(ip)
+}
+
+// localAddrMapper returns a mapper whose mappings forward to ip. If mapper
+// cannot map for ip, a gateway reachable from ip is discovered instead,
+// unless mapper runs its own discovery under ctx.
+func localAddrMapper(ctx context.Context, mapper PortMapper, ip net.IP) (PortMapper, error) {
+	if cm, ok := mapper.(localAddrContextMapper); ok {
+		return cm.ForLocalAddrContext(ctx, ip)
+	}
+	bound, err := mapperForLocalAddr(mapper, ip)
+	if err == nil {
+		return bound, nil
+	}
+
+	log.WithError(err).WithField("localIP", ip.String()).Debug("port mapper cannot map for local address, discovering a gateway for it")
+	found, derr := discoverForLocalAddr(ctx, ip)
+	if derr != nil {
+		return nil, fmt.Errorf("%w, and discovery for the address failed: %w", err, derr)
+	}
+	return found, nil
+}
+
+// discoverForLocalAddr discovers a port mapper for a local address. It is a
+// variable so tests can inject a mapper.
+var discoverForLocalAddr = discoverLocalAddrMapper
+
+// discoverLocalAddrMapper discovers a port mapper whose mappings forward to ip:
+// a direct mapper if ip is publicly routable, then a UPnP gateway reachable
+// from ip, then a NAT-PMP gateway on the subnet of ip.
+func discoverLocalAddrMapper(ctx context.Context, ip net.IP) (PortMapper, error) {
+	if isGloballyRoutableIP(ip) {
+		return &DirectPortMapper{publicIP: ip.String()}, nil
+	}
+
+	var errs []error
+	gateways, err := discoverGateways(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, g := range gateways {
+		mapper, err := mapperForLocalAddr(g.Mapper(), ip)
+		if err == nil {
+			log.WithFields(Fields{
+				"localIP": ip.String(),
+				"gateway": g.String(),
+			}).Debug("UPnP gateway discovered for local address")
+			return mapper, nil
+		}
+		errs = append(errs, err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("context cancelled after UPnP discovery: %w", err)
+	}
+
+	mapper, err := discoverNATPMPForLocalAddr(ctx, ip)
+	if err == nil {
+		return mapper, nil
+	}
+	errs = append(errs, err)
+	return nil, fmt.Errorf("no gateway found for %s: %w", ip, errors.Join(errs...))
+}
+
+// discoverNATPMPForLocalAddr looks for a NAT-PMP gateway for ip: the default
+// gateway if it is on the subnet of ip, otherwise the first host address of
+// that subnet.
+func discoverNATPMPForLocalAddr(ctx context.Context, ip net.IP) (PortMapper, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+	ipNet := localIPNet(addrs, ip)
+	if ipNet == nil {
+		return nil, fmt.Errorf("address %s is not assigned to a local interface", ip)
+	}
+
+	gateway, err := discoverGateway()
+	if err != nil || !ipNet.Contains(gateway) {
+		gateway = firstHostIP(ipNet)
+	}
+	if gateway == nil || gateway.Equal(ip) {
+		return nil, fmt.Errorf("no NAT-PMP gateway candidate on subnet %s", ipNet)
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, localAddrNATPMPTimeout)
+	defer cancel()
+	natpmp, err := newNATPMPMapperContext(probeCtx, gateway)
+	if err != nil {
+		return nil, err
+	}
+	return natpmp.ForLocalAddr(ip)
+}
+
+// firstHostIP returns the first host address of the IPv4 network ipNet, or
+// nil if it has none.
+func firstHostIP(ipNet *net.IPNet) net.IP {
+	network := ipNet.IP.Mask(ipNet.Mask).To4()
+	if network == nil {
+		return nil
+	}
+	host := net.IPv4(network[0], network[1], network[2], network[3]+1)
+	if !ipNet.Contains(host) {
+		return nil
+	}
+	return host
+}
+
+// parseListenAddr parses a "host:port" listen address. The host must be an
+// IPv4 address assigned to a local interface, or empty or unspecified to
+// listen on all interfaces, in which case the returned IP is nil.
+func parseListenAddr(address string) (net.IP, int, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid listen address %q: %w", address, err)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, 0, fmt.Errorf("invalid port in listen address %q (must be 1-65535)", address)
+	}
+
+	if host == "" {
+		return nil, port, nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("listen address %q must use an IP address", address)
+	}
+	if ip.To4() == nil {
+		return nil, 0, fmt.Errorf("listen address %q: only IPv4 addresses are supported", address)
+	}
+	if ip.IsUnspecified() {
+		return nil, port, nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+	if localIPNet(addrs, ip) == nil {
+		return nil, 0, fmt.Errorf("address %s is not assigned to a local interface", ip)
+	}
+	return ip.To4(), port, nil
+}
+
+// bindAddress returns the address to bind a socket on, or all interfaces if
+// localIP is nil.
+func bindAddress(localIP net.IP, port int) string {
+	if localIP == nil {
+		return fmt.Sprintf(":%d", port)
+	}
+	return fmt.Sprintf("%s:%d", localIP, port)
+}
+
+// validateGatewayReachable checks that gateway is on the subnet of the
+// interface address localIP, so mappings can be requested from that address.
+func validateGatewayReachable(localIP, gateway net.IP) error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+	return checkGatewayReachable(addrs, localIP, gateway)
+}
+
+// checkGatewayReachable checks that gateway is on the subnet of localIP
+// according to the given interface addresses.
+func checkGatewayReachable(addrs []net.Addr, localIP, gateway net.IP) error {
+	ipNet := localIPNet(addrs, localIP)
+	if ipNet == nil {
+		return fmt.Errorf("address %s is not assigned to a local interface", localIP)
+	}
+	if !ipNet.Contains(gateway) {
+		return fmt.Errorf("gateway %s is not reachable from %s (not on subnet %s)", gateway, localIP, ipNet)
+	}
+	return nil
+}
+
+// localIPNet returns the interface address equal to ip, or nil if ip is not
+// among addrs.
+func localIPNet(addrs []net.Addr, ip net.IP) *net.IPNet {
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return ipNet
+		}
+	}
+	return nil
+}
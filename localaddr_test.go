@@ -0,0 +1,324 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// localAddrMockMapper is a MockPortMapper that supports ForLocalAddr and
+// records the address it was asked to map for.
+type localAddrMockMapper struct {
+	*MockPortMapper
+	localIP net.IP
+}
+
+func (m *localAddrMockMapper) ForLocalAddr(ip net.IP) (PortMapper, error) {
+	m.localIP = ip
+	return m, nil
+}
+
+// useLocalAddrDiscovery replaces gateway discovery for local addresses for
+// the duration of the test.
+func useLocalAddrDiscovery(t *testing.T, discover func(ctx context.Context, ip net.IP) (PortMapper, error)) {
+	t.Helper()
+	original := discoverForLocalAddr
+	discoverForLocalAddr = discover
+	t.Cleanup(func() { discoverForLocalAddr = original })
+}
+
+// fakeUPnPClient records AddPortMapping requests.
+type fakeUPnPClient struct {
+	internalClient string
+}
+
+func (c *fakeUPnPClient) AddPortMapping(_ string, _ uint16, _ string, _ uint16, internalClient string, _ bool, _ string, _ uint32) error {
+	c.internalClient = internalClient
+	return nil
+}
+
+func (c *fakeUPnPClient) DeletePortMapping(_ string, _ uint16, _ string) error {
+	return nil
+}
+
+func (c *fakeUPnPClient) GetExternalIPAddress() (string, error) {
+	return "203.0.113.10", nil
+}
+
+// TestParseListenAddr tests validation of listen addresses
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		address string
+		wantIP  string
+		wantErr bool
+	}{
+		{"127.0.0.1:8080", "127.0.0.1", false},
+		{":8080", "", false},
+		{"0.0.0.0:8080", "", false},
+		{"[::1]:8080", "", true},
+		{"localhost:8080", "", true},
+		{"127.0.0.1:0", "", true},
+		{"127.0.0.1", "", true},
+		{"192.0.2.1:8080", "", true}, // TEST-NET-1, not assigned locally
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			ip, port, err := parseListenAddr(tt.address)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %q", tt.address)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error for %q: %v", tt.address, err)
+			}
+			if port != 8080 {
+				t.Errorf("Expected port 8080, got %d", port)
+			}
+			if tt.wantIP == "" && ip != nil {
+				t.Errorf("Expected nil IP for all interfaces, got %v", ip)
+			}
+			if tt.wantIP != "" && !ip.Equal(net.ParseIP(tt.wantIP)) {
+				t.Errorf("Expected IP %s, got %v", tt.wantIP, ip)
+			}
+		})
+	}
+}
+
+// TestCheckGatewayReachable tests the subnet check between a local address and a gateway
+func TestCheckGatewayReachable(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, bridge, _ := net.ParseCIDR("172.17.0.0/16")
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.IPv4(192, 168, 1, 20), Mask: lan.Mask},
+		&net.IPNet{IP: net.IPv4(172, 17, 0, 1), Mask: bridge.Mask},
+	}
+	gateway := net.IPv4(192, 168, 1, 1)
+
+	if err := checkGatewayReachable(addrs, net.IPv4(192, 168, 1, 20), gateway); err != nil {
+		t.Errorf("Expected gateway reachable from LAN address: %v", err)
+	}
+	if err := checkGatewayReachable(addrs, net.IPv4(172, 17, 0, 1), gateway); err == nil {
+		t.Error("Expected error for gateway outside the bridge subnet")
+	}
+	if err := checkGatewayReachable(addrs, net.IPv4(10, 0, 0, 5), gateway); err == nil {
+		t.Error("Expected error for address not assigned locally")
+	}
+}
+
+// TestUPnPMapperForLocalAddr tests that UPnP mappings forward to the requested address
+func TestUPnPMapperForLocalAddr(t *testing.T) {
+	client := &fakeUPnPClient{}
+	mapper := &UPnPMapper{client: client}
+
+	bound, err := mapper.ForLocalAddr(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("ForLocalAddr failed: %v", err)
+	}
+	if _, err := bound.MapPort("TCP", 8080, mappingDuration); err != nil {
+		t.Fatalf("MapPort failed: %v", err)
+	}
+	if client.internalClient != "127.0.0.1" {
+		t.Errorf("Expected internal client 127.0.0.1, got %q", client.internalClient)
+	}
+	if mapper.localIP != nil {
+		t.Error("ForLocalAddr should not modify the original mapper")
+	}
+}
+
+// TestListenAddr tests binding listeners to a specific local address
+func TestListenAddr(t *testing.T) {
+	t.Run("TCP listener binds and maps the address", func(t *testing.T) {
+		mapper := &localAddrMockMapper{MockPortMapper: NewMockPortMapper()}
+		useMockPortMapper(t, mapper)
+		port := freePorts(t, 1)[0]
+		address := "127.0.0.1:" + strconv.Itoa(port)
+
+		listener, err := ListenAddr(context.Background(), "tcp4", address)
+		if err != nil {
+			t.Fatalf("ListenAddr failed: %v", err)
+		}
+		defer listener.Close()
+
+		if got := listener.Addr().(*NATAddr).InternalAddr(); got != address {
+			t.Errorf("Expected internal address %s, got %s", address, got)
+		}
+		if !mapper.localIP.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("Expected mapping for 127.0.0.1, got %v", mapper.localIP)
+		}
+	})
+
+	t.Run("UDP listener binds and maps the address", func(t *testing.T) {
+		mapper := &localAddrMockMapper{MockPortMapper: NewMockPortMapper()}
+		useMockPortMapper(t, mapper)
+		port := freePorts(t, 1)[0]
+		address := "127.0.0.1:" + strconv.Itoa(port)
+
+		listener, err := ListenPacketAddr(context.Background(), "udp", address)
+		if err != nil {
+			t.Fatalf("ListenPacketAddr failed: %v", err)
+		}
+		defer listener.Close()
+
+		if got := listener.Addr().(*NATAddr).InternalAddr(); got != address {
+			t.Errorf("Expected internal address %s, got %s", address, got)
+		}
+	})
+
+	t.Run("Mapper without local address support discovers a gateway for it", func(t *testing.T) {
+		mock := NewMockPortMapper()
+		useMockPortMapper(t, mock)
+		discovered := &localAddrMockMapper{MockPortMapper: NewMockPortMapper()}
+		useLocalAddrDiscovery(t, func(ctx context.Context, ip net.IP) (PortMapper, error) {
+			return discovered.ForLocalAddr(ip)
+		})
+		port := freePorts(t, 1)[0]
+
+		listener, err := ListenAddr(context.Background(), "tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			t.Fatalf("ListenAddr failed: %v", err)
+		}
+		defer listener.Close()
+
+		if !discovered.localIP.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("Expected discovery for 127.0.0.1, got %v", discovered.localIP)
+		}
+		if active := len(discovered.GetActiveMappings()); active != 1 {
+			t.Errorf("Expected 1 mapping on the discovered gateway, got %d", active)
+		}
+		if active := len(mock.GetActiveMappings()); active != 0 {
+			t.Errorf("Expected no mappings on the original mapper, got %d", active)
+		}
+	})
+
+	t.Run("Mapper without local address support is rejected if discovery fails", func(t *testing.T) {
+		mock := NewMockPortMapper()
+		useMockPortMapper(t, mock)
+		useLocalAddrDiscovery(t, func(ctx context.Context, ip net.IP) (PortMapper, error) {
+			return nil, errors.New("no gateway")
+		})
+
+		if _, err := ListenAddr(context.Background(), "tcp", "127.0.0.1:8080"); err == nil {
+			t.Fatal("Expected error for mapper without ForLocalAddr")
+		}
+		if active := len(mock.GetActiveMappings()); active != 0 {
+			t.Errorf("Expected no mappings, got %d", active)
+		}
+	})
+
+	t.Run("Unsupported networks are rejected", func(t *testing.T) {
+		if _, err := ListenAddr(context.Background(), "tcp6", "127.0.0.1:8080"); err == nil {
+			t.Error("Expected error for tcp6")
+		}
+		if _, err := ListenPacketAddr(context.Background(), "tcp", "127.0.0.1:8080"); err == nil {
+			t.Error("Expected error for tcp network on packet listener")
+		}
+	})
+}
+
+// TestDirectPortMapperForLocalAddr tests that a direct mapper discovers a
+// gateway for private addresses
+func TestDirectPortMapperForLocalAddr(t *testing.T) {
+	direct := &DirectPortMapper{publicIP: "198.51.100.1"}
+
+	bound, err := direct.ForLocalAddr(net.IPv4(198, 51, 100, 7))
+	if err != nil {
+		t.Fatalf("ForLocalAddr failed for public address: %v", err)
+	}
+	if ip, _ := bound.GetExternalIP(); ip != "198.51.100.7" {
+		t.Errorf("Expected direct mapper for 198.51.100.7, got %s", ip)
+	}
+
+	discovered := &localAddrMockMapper{MockPortMapper: NewMockPortMapper()}
+	useLocalAddrDiscovery(t, func(ctx context.Context, ip net.IP) (PortMapper, error) {
+		return discovered.ForLocalAddr(ip)
+	})
+	bound, err = direct.ForLocalAddr(net.IPv4(192, 168, 1, 20))
+	if err != nil {
+		t.Fatalf("ForLocalAddr failed for private address: %v", err)
+	}
+	if bound != discovered || !discovered.localIP.Equal(net.IPv4(192, 168, 1, 20)) {
+		t.Errorf("Expected the discovered gateway for 192.168.1.20, got %#v", bound)
+	}
+
+	useLocalAddrDiscovery(t, func(ctx context.Context, ip net.IP) (PortMapper, error) {
+		return nil, errors.New("no gateway")
+	})
+	if _, err := direct.ForLocalAddr(net.IPv4(192, 168, 1, 20)); err == nil {
+		t.Error("Expected error when no gateway is found for a private address")
+	}
+
+	// Discovery runs under the caller's context
+	type ctxKey struct{}
+	var got interface{}
+	useLocalAddrDiscovery(t, func(ctx context.Context, ip net.IP) (PortMapper, error) {
+		got = ctx.Value(ctxKey{})
+		return nil, ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "caller"))
+	cancel()
+	if _, err := localAddrMapper(ctx, direct, net.IPv4(192, 168, 1, 20)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the caller's cancellation, got %v", err)
+	}
+	if got != "caller" {
+		t.Errorf("Expected discovery under the caller's context, got value %v", got)
+	}
+}
+
+// TestDiscoverLocalAddrMapper tests choosing the UPnP gateway reachable from
+// a local address
+func TestDiscoverLocalAddrMapper(t *testing.T) {
+	other := newFakeIGDClient("uuid:router-other", "192.0.2.1", "203.0.113.5")
+	loopback := newFakeIGDClient("uuid:router-loopback", "127.0.0.254", "198.51.100.9")
+
+	original := discoverGateways
+	discoverGateways = func(ctx context.Context) ([]*Gateway, error) {
+		return gatewaysFromClients(ctx, []upnpClient{other, loopback}), nil
+	}
+	defer func() { discoverGateways = original }()
+
+	mapper, err := discoverLocalAddrMapper(context.Background(), net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("discoverLocalAddrMapper failed: %v", err)
+	}
+	if _, err := mapper.MapPort("TCP", 8080, mappingDuration); err != nil {
+		t.Fatalf("MapPort failed: %v", err)
+	}
+	if loopback.internalClient != "127.0.0.1" {
+		t.Errorf("Expected mapping on the reachable gateway for 127.0.0.1, got %q", loopback.internalClient)
+	}
+	if other.internalClient != "" {
+		t.Errorf("Expected no mapping on the unreachable gateway, got %q", other.internalClient)
+	}
+}
+
+// TestFirstHostIP tests guessing the gateway of a subnet
+func TestFirstHostIP(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want string
+	}{
+		{"192.168.1.20/24", "192.168.1.1"},
+		{"10.1.2.3/8", "10.0.0.1"},
+		{"172.16.5.9/30", "172.16.5.9"},
+		{"192.168.1.20/32", ""},
+	}
+	for _, tt := range tests {
+		ip, ipNet, _ := net.ParseCIDR(tt.cidr)
+		ipNet.IP = ip
+		got := firstHostIP(ipNet)
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("firstHostIP(%s) = %v, want nil", tt.cidr, got)
+			}
+			continue
+		}
+		if !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("firstHostIP(%s) = %v, want %s", tt.cidr, got, tt.want)
+		}
+	}
+}
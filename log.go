@@ -1,5 +1,196 @@
 package nattraversal
 
-import "github.com/go-i2p/logger"
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync/atomic"
 
-var log = logger.GetGoI2PLogger()
+	"github.com/go-i2p/logger"
+)
+
+// Fields are the structured fields of a log message.
+type Fields map[string]interface{}
+
+// Logger receives the log messages of the package. Implementations must be
+// safe for concurrent use. Errors are passed in the "error" field.
+type Logger interface {
+	Debug(msg string, fields Fields)
+	Info(msg string, fields Fields)
+	Warn(msg string, fields Fields)
+	Error(msg string, fields Fields)
+}
+
+// loggerHolder wraps the package logger so it can be stored atomically.
+type loggerHolder struct {
+	logger Logger
+}
+
+// packageLogger is the logger set with SetLogger, nil for the default.
+var packageLogger atomic.Pointer[loggerHolder]
+
+// SetLogger routes the log messages of the package to l, except those of
+// listeners created with a ListenConfig that has its own Logger.
+// A nil logger restores the default, the go-i2p logger configured through
+// the DEBUG_I2P and WARNFAIL_I2P environment variables.
+func SetLogger(l Logger) {
+	if l == nil {
+		packageLogger.Store(nil)
+		return
+	}
+	packageLogger.Store(&loggerHolder{logger: l})
+}
+
+// defaultLogger is used until SetLogger is called.
+var defaultLogger = NewGoI2PLogger(nil)
+
+// currentLogger returns the package logger.
+func currentLogger() Logger {
+	if h := packageLogger.Load(); h != nil {
+		return h.logger
+	}
+	return defaultLogger
+}
+
+// logEntry accumulates the fields of a log message, in the style of a
+// logrus entry. Its zero value logs to the package logger.
+type logEntry struct {
+	logger Logger // nil for the package logger at the time of logging
+	fields Fields
+}
+
+// log is the package logger.
+var log logEntry
+
+// newLogEntry returns an entry that logs to l, or to the package logger if
+// l is nil.
+func newLogEntry(l Logger) logEntry {
+	return logEntry{logger: l}
+}
+
+// WithField returns a copy of the entry with the field added.
+func (e logEntry) WithField(key string, value interface{}) logEntry {
+	return e.WithFields(Fields{key: value})
+}
+
+// WithFields returns a copy of the entry with the fields added.
+func (e logEntry) WithFields(fields Fields) logEntry {
+	merged := make(Fields, len(e.fields)+len(fields))
+	for k, v := range e.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	e.fields = merged
+	return e
+}
+
+// WithError returns a copy of the entry with err in the "error" field.
+func (e logEntry) WithError(err error) logEntry {
+	return e.WithField("error", err)
+}
+
+// target returns the logger the entry logs to.
+func (e logEntry) target() Logger {
+	if e.logger != nil {
+		return e.logger
+	}
+	return currentLogger()
+}
+
+func (e logEntry) Debug(args ...interface{}) {
+	e.target().Debug(fmt.Sprint(args...), e.fields)
+}
+
+func (e logEntry) Info(args ...interface{}) {
+	e.target().Info(fmt.Sprint(args...), e.fields)
+}
+
+func (e logEntry) Warn(args ...interface{}) {
+	e.target().Warn(fmt.Sprint(args...), e.fields)
+}
+
+func (e logEntry) Error(args ...interface{}) {
+	e.target().Error(fmt.Sprint(args...), e.fields)
+}
+
+// goI2PLogger adapts a go-i2p logger.
+type goI2PLogger struct {
+	l *logger.Logger
+}
+
+// NewGoI2PLogger returns a Logger that logs to l, or to the shared go-i2p
+// logger if l is nil. Note that the go-i2p logger exits the process on
+// warnings and errors if WARNFAIL_I2P is set.
+func NewGoI2PLogger(l *logger.Logger) Logger {
+	if l == nil {
+		l = logger.GetGoI2PLogger()
+	}
+	return goI2PLogger{l: l}
+}
+
+func (g goI2PLogger) Debug(msg string, fields Fields) {
+	g.l.WithFields(logger.Fields(fields)).Debug(msg)
+}
+
+func (g goI2PLogger) Info(msg string, fields Fields) {
+	g.l.WithFields(logger.Fields(fields)).Info(msg)
+}
+
+func (g goI2PLogger) Warn(msg string, fields Fields) {
+	g.l.WithFields(logger.Fields(fields)).Warn(msg)
+}
+
+func (g goI2PLogger) Error(msg string, fields Fields) {
+	g.l.WithFields(logger.Fields(fields)).Error(msg)
+}
+
+// slogLogger adapts a log/slog logger.
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger returns a Logger that logs to l, or to slog.Default() if l
+// is nil. Fields become attributes, sorted by name.
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return slogLogger{l: l}
+}
+
+func (s slogLogger) log(level slog.Level, msg string, fields Fields) {
+	ctx := context.Background()
+	if !s.l.Enabled(ctx, level) {
+		return
+	}
+	s.l.LogAttrs(ctx, level, msg, slogAttrs(fields)...)
+}
+
+// slogAttrs converts fields to attributes sorted by name.
+func slogAttrs(fields Fields) []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(fields))
+	for k, v := range fields {
+		attrs = append(attrs, slog.Any(k, v))
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+func (s slogLogger) Debug(msg string, fields Fields) {
+	s.log(slog.LevelDebug, msg, fields)
+}
+
+func (s slogLogger) Info(msg string, fields Fields) {
+	s.log(slog.LevelInfo, msg, fields)
+}
+
+func (s slogLogger) Warn(msg string, fields Fields) {
+	s.log(slog.LevelWarn, msg, fields)
+}
+
+func (s slogLogger) Error(msg string, fields Fields) {
+	s.log(slog.LevelError, msg, fields)
+}
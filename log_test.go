@@ -0,0 +1,137 @@
+package nattraversal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-i2p/logger"
+)
+
+// logRecord is a message received by captureLogger.
+type logRecord struct {
+	level  string
+	msg    string
+	fields Fields
+}
+
+// captureLogger records every message.
+type captureLogger struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (c *captureLogger) add(level, msg string, fields Fields) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records = append(c.records, logRecord{level, msg, fields})
+}
+
+func (c *captureLogger) Debug(msg string, fields Fields) { c.add("debug", msg, fields) }
+func (c *captureLogger) Info(msg string, fields Fields)  { c.add("info", msg, fields) }
+func (c *captureLogger) Warn(msg string, fields Fields)  { c.add("warn", msg, fields) }
+func (c *captureLogger) Error(msg string, fields Fields) { c.add("error", msg, fields) }
+
+// find returns the first record with msg.
+func (c *captureLogger) find(msg string) (logRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.records {
+		if r.msg == msg {
+			return r, true
+		}
+	}
+	return logRecord{}, false
+}
+
+// TestSetLogger tests routing package messages to a custom logger
+func TestSetLogger(t *testing.T) {
+	capture := &captureLogger{}
+	SetLogger(capture)
+	defer SetLogger(nil)
+
+	err := errors.New("boom")
+	log.WithField("a", 1).WithFields(Fields{"b": "two"}).WithError(err).Warn("something ", "failed")
+
+	r, ok := capture.find("something failed")
+	if !ok {
+		t.Fatalf("Message not logged: %+v", capture.records)
+	}
+	if r.level != "warn" || r.fields["a"] != 1 || r.fields["b"] != "two" || r.fields["error"] != err {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+
+	// Entries do not share fields
+	base := log.WithField("shared", true)
+	base.WithField("first", 1).Debug("one")
+	base.Debug("two")
+	if r, _ := capture.find("two"); len(r.fields) != 1 {
+		t.Errorf("Expected only the shared field, got %v", r.fields)
+	}
+}
+
+// TestListenConfigLogger tests that listener messages go to the configured logger
+func TestListenConfigLogger(t *testing.T) {
+	pkg := &captureLogger{}
+	SetLogger(pkg)
+	defer SetLogger(nil)
+
+	mapper := NewMockPortMapper()
+	useMockPortMapper(t, mapper)
+
+	own := &captureLogger{}
+	listener, err := (&ListenConfig{Logger: own}).Listen(context.Background(), freePorts(t, 1)[0])
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	mapper.SetFailureRate(1.0)
+	listener.renewal.renew()
+
+	for _, msg := range []string{"NAT TCP listener ready", "port mapping renewal failed"} {
+		if _, ok := own.find(msg); !ok {
+			t.Errorf("Expected %q in the ListenConfig logger", msg)
+		}
+		if _, ok := pkg.find(msg); ok {
+			t.Errorf("Unexpected %q in the package logger", msg)
+		}
+	}
+}
+
+// TestSlogLogger tests the log/slog adapter
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	l.Debug("hidden", nil)
+	l.Warn("mapping failed", Fields{"port": 8080, "error": errors.New("timeout")})
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Error("Debug message logged above the handler level")
+	}
+	if !strings.Contains(out, `level=WARN msg="mapping failed" error=timeout port=8080`) {
+		t.Errorf("Unexpected slog output: %s", out)
+	}
+}
+
+// TestGoI2PLogger tests the go-i2p logger adapter
+func TestGoI2PLogger(t *testing.T) {
+	var buf bytes.Buffer
+	base := logger.New()
+	base.SetOutput(&buf)
+	base.SetLevel(logger.DebugLevel)
+	base.SetFormatter(&logger.TextFormatter{DisableTimestamp: true})
+
+	NewGoI2PLogger(base).Info("mapping created", Fields{"port": 8080})
+
+	out := buf.String()
+	if !strings.Contains(out, "level=info") || !strings.Contains(out, `msg="mapping created" port=8080`) {
+		t.Errorf("Unexpected go-i2p logger output: %s", out)
+	}
+}
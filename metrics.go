@@ -0,0 +1,196 @@
+package nattraversal
+
+import (
+	"expvar"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metric names reported to the MetricsSink.
+const (
+	// MetricMapperSelected counts port mapper discoveries by the mapper
+	// selected (label "mapper", "none" if discovery failed).
+	MetricMapperSelected = "natlistener_mapper_selected_total"
+	// MetricDiscoveryDuration is a histogram of port mapper discovery
+	// latency in seconds (label "mapper").
+	MetricDiscoveryDuration = "natlistener_discovery_duration_seconds"
+	// MetricRenewals counts mapping renewal attempts (labels "mapper",
+	// "protocol" and "result", which is "success" or "failure").
+	MetricRenewals = "natlistener_renewals_total"
+	// MetricRenewalDuration is a histogram of renewal latency in seconds
+	// (labels "mapper" and "protocol").
+	MetricRenewalDuration = "natlistener_renewal_duration_seconds"
+	// MetricAcceptedConnections counts connections accepted by NATListener
+	// (label "port", the internal port).
+	MetricAcceptedConnections = "natlistener_accepted_connections_total"
+	// MetricPacketBytes counts bytes read and written by NATPacketConn
+	// (labels "port", the internal port, and "direction", "read" or "write").
+	MetricPacketBytes = "natlistener_packet_bytes_total"
+)
+
+// Labels are the label names and values of a metric sample. Sinks must not
+// modify them.
+type Labels map[string]string
+
+// MetricsSink receives the metrics of the library. Implementations must be
+// safe for concurrent use and fast, since they are called from the data
+// path of packet connections.
+type MetricsSink interface {
+	// AddCounter adds delta to the counter name with the given labels.
+	AddCounter(name string, labels Labels, delta float64)
+	// ObserveHistogram records value in the histogram name with the given labels.
+	ObserveHistogram(name string, labels Labels, value float64)
+}
+
+// sinkHolder wraps the sink so it can be stored atomically.
+type sinkHolder struct {
+	sink MetricsSink
+}
+
+// metricsSink is the sink metrics are reported to, nil if none is set.
+var metricsSink atomic.Pointer[sinkHolder]
+
+// SetMetricsSink sets the sink every listener and mapper in the process
+// reports metrics to. A nil sink disables metrics, which is the default.
+func SetMetricsSink(sink MetricsSink) {
+	if sink == nil {
+		metricsSink.Store(nil)
+		return
+	}
+	metricsSink.Store(&sinkHolder{sink: sink})
+}
+
+// currentSink returns the configured sink, or nil.
+func currentSink() MetricsSink {
+	if h := metricsSink.Load(); h != nil {
+		return h.sink
+	}
+	return nil
+}
+
+// addCounter adds delta to a counter if a sink is set.
+func addCounter(name string, labels Labels, delta float64) {
+	if sink := currentSink(); sink != nil {
+		sink.AddCounter(name, labels, delta)
+	}
+}
+
+// observeDuration records d in seconds in a histogram if a sink is set.
+func observeDuration(name string, labels Labels, d time.Duration) {
+	if sink := currentSink(); sink != nil {
+		sink.ObserveHistogram(name, labels, d.Seconds())
+	}
+}
+
+// resultLabel returns the "result" label value for an operation outcome.
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// portLabel returns the port of addr as a label value.
+func portLabel(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return strconv.Itoa(a.Port)
+	case *net.UDPAddr:
+		return strconv.Itoa(a.Port)
+	case nil:
+		return ""
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// ExpvarSink is a MetricsSink that publishes metrics with the expvar
+// package, so they are served as JSON on /debug/vars. Each metric is an
+// expvar.Map keyed by its labels, formatted as sorted "name=value" pairs
+// separated by commas. A histogram sample is itself a map holding the
+// "count" and "sum" of observed values.
+type ExpvarSink struct {
+	prefix string
+	mu     sync.Mutex
+	vars   map[string]*expvar.Map
+}
+
+// NewExpvarSink returns an ExpvarSink that publishes metrics named with the
+// given prefix. Sinks with the same prefix share their variables, since
+// expvar names are global.
+func NewExpvarSink(prefix string) *ExpvarSink {
+	return &ExpvarSink{prefix: prefix, vars: make(map[string]*expvar.Map)}
+}
+
+// expvarPublishMu serialises publishing of expvar variables by all sinks.
+var expvarPublishMu sync.Mutex
+
+// metric returns the published map for name, publishing it if needed.
+// It returns nil if the name is taken by a variable of another type.
+func (s *ExpvarSink) metric(name string) *expvar.Map {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.vars[name]; ok {
+		return m
+	}
+
+	expvarPublishMu.Lock()
+	defer expvarPublishMu.Unlock()
+	fullName := s.prefix + name
+	var m *expvar.Map
+	switch v := expvar.Get(fullName).(type) {
+	case nil:
+		m = expvar.NewMap(fullName)
+	case *expvar.Map:
+		m = v
+	default:
+		log.WithField("name", fullName).Warn("expvar name already in use, metric not published")
+	}
+	s.vars[name] = m
+	return m
+}
+
+// AddCounter implements MetricsSink.
+func (s *ExpvarSink) AddCounter(name string, labels Labels, delta float64) {
+	if m := s.metric(name); m != nil {
+		m.AddFloat(labelKey(labels), delta)
+	}
+}
+
+// ObserveHistogram implements MetricsSink.
+func (s *ExpvarSink) ObserveHistogram(name string, labels Labels, value float64) {
+	m := s.metric(name)
+	if m == nil {
+		return
+	}
+	key := labelKey(labels)
+
+	s.mu.Lock()
+	sample, ok := m.Get(key).(*expvar.Map)
+	if !ok {
+		sample = new(expvar.Map).Init()
+		m.Set(key, sample)
+	}
+	s.mu.Unlock()
+
+	sample.AddFloat("count", 1)
+	sample.AddFloat("sum", value)
+}
+
+// labelKey formats labels as sorted "name=value" pairs separated by commas.
+func labelKey(labels Labels) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
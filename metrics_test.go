@@ -0,0 +1,174 @@
+package nattraversal
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// recordingSink keeps counter totals and histogram observation counts by
+// metric name and labels.
+type recordingSink struct {
+	mu           sync.Mutex
+	counters     map[string]float64
+	observations map[string]int
+}
+
+func newRecordingSink(t *testing.T) *recordingSink {
+	s := &recordingSink{counters: make(map[string]float64), observations: make(map[string]int)}
+	SetMetricsSink(s)
+	t.Cleanup(func() { SetMetricsSink(nil) })
+	return s
+}
+
+func (s *recordingSink) AddCounter(name string, labels Labels, delta float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[name+"{"+labelKey(labels)+"}"] += delta
+}
+
+func (s *recordingSink) ObserveHistogram(name string, labels Labels, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observations[name+"{"+labelKey(labels)+"}"]++
+}
+
+func (s *recordingSink) counter(key string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters[key]
+}
+
+func (s *recordingSink) observed(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.observations[key]
+}
+
+// TestListenerMetrics tests the metrics reported by listeners and renewal
+func TestListenerMetrics(t *testing.T) {
+	sink := newRecordingSink(t)
+	mapper := NewMockPortMapper()
+	useMockPortMapper(t, mapper)
+	ports := freePorts(t, 2)
+
+	t.Run("Accepted connections", func(t *testing.T) {
+		listener, err := (&ListenConfig{}).Listen(context.Background(), ports[0])
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		defer listener.Close()
+
+		for i := 0; i < 2; i++ {
+			conn, err := net.Dial("tcp", listener.Addr().(*NATAddr).InternalAddr())
+			if err != nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+			defer conn.Close()
+			accepted, err := listener.Accept()
+			if err != nil {
+				t.Fatalf("Accept failed: %v", err)
+			}
+			accepted.Close()
+		}
+
+		key := MetricAcceptedConnections + "{port=" + strconv.Itoa(ports[0]) + "}"
+		if got := sink.counter(key); got != 2 {
+			t.Errorf("Expected 2 accepted connections, got %v", got)
+		}
+
+		// Renewals are counted by result
+		listener.renewal.renew()
+		mapper.SetFailureRate(1.0)
+		listener.renewal.renew()
+		mapper.SetFailureRate(0)
+		for _, result := range []string{"success", "failure"} {
+			key := MetricRenewals + "{mapper=*nattraversal.MockPortMapper,protocol=TCP,result=" + result + "}"
+			if got := sink.counter(key); got < 1 {
+				t.Errorf("Expected a %s renewal to be counted", result)
+			}
+		}
+		if sink.observed(MetricRenewalDuration+"{mapper=*nattraversal.MockPortMapper,protocol=TCP}") < 2 {
+			t.Error("Expected renewal latency observations")
+		}
+	})
+
+	t.Run("Packet bytes", func(t *testing.T) {
+		listener, err := (&ListenConfig{}).ListenPacket(context.Background(), ports[1])
+		if err != nil {
+			t.Fatalf("ListenPacket failed: %v", err)
+		}
+		defer listener.Close()
+		conn := listener.PacketConn()
+
+		sender, err := net.Dial("udp", listener.Addr().(*NATAddr).InternalAddr())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer sender.Close()
+		sender.Write([]byte("hello"))
+
+		buf := make([]byte, 64)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom failed: %v", err)
+		}
+		if _, err := conn.WriteTo(buf[:n], from); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+
+		port := strconv.Itoa(ports[1])
+		if got := sink.counter(MetricPacketBytes + "{direction=read,port=" + port + "}"); got != 5 {
+			t.Errorf("Expected 5 bytes read, got %v", got)
+		}
+		if got := sink.counter(MetricPacketBytes + "{direction=write,port=" + port + "}"); got != 5 {
+			t.Errorf("Expected 5 bytes written, got %v", got)
+		}
+	})
+
+	t.Run("Discovery", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		NewPortMapperContext(ctx)
+
+		if got := sink.counter(MetricMapperSelected + "{mapper=none}"); got != 1 {
+			t.Errorf("Expected one failed discovery, got %v", got)
+		}
+		if sink.observed(MetricDiscoveryDuration+"{mapper=none}") != 1 {
+			t.Error("Expected a discovery latency observation")
+		}
+	})
+}
+
+// TestExpvarSink tests publishing metrics with expvar
+func TestExpvarSink(t *testing.T) {
+	sink := NewExpvarSink("test_")
+	labels := Labels{"mapper": "upnp", "protocol": "UDP"}
+	sink.AddCounter(MetricRenewals, labels, 1)
+	sink.AddCounter(MetricRenewals, labels, 2)
+	sink.ObserveHistogram(MetricRenewalDuration, labels, 0.5)
+	sink.ObserveHistogram(MetricRenewalDuration, labels, 1.5)
+
+	// A second sink with the same prefix shares the variables
+	NewExpvarSink("test_").AddCounter(MetricRenewals, labels, 1)
+
+	var counters map[string]float64
+	if err := json.Unmarshal([]byte(expvar.Get("test_"+MetricRenewals).String()), &counters); err != nil {
+		t.Fatalf("Invalid counter JSON: %v", err)
+	}
+	if counters["mapper=upnp,protocol=UDP"] != 4 {
+		t.Errorf("Unexpected counters: %v", counters)
+	}
+
+	var histograms map[string]map[string]float64
+	if err := json.Unmarshal([]byte(expvar.Get("test_"+MetricRenewalDuration).String()), &histograms); err != nil {
+		t.Fatalf("Invalid histogram JSON: %v", err)
+	}
+	if h := histograms["mapper=upnp,protocol=UDP"]; h["count"] != 2 || h["sum"] != 2 {
+		t.Errorf("Unexpected histogram: %v", histograms)
+	}
+}
@@ -4,10 +4,9 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"time"
-
-	"github.com/go-i2p/logger"
 )
 
 // MockPortMapper implements PortMapper interface for testing
@@ -119,7 +118,7 @@ func (m *MockPortMapper) MapPort(protocol string, internalPort int, duration tim
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	log.WithFields(logger.Fields{
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"internalPort": internalPort,
 		"duration":     duration.String(),
@@ -132,7 +131,7 @@ func (m *MockPortMapper) MapPort(protocol string, internalPort int, duration tim
 
 	// Simulate failure rate
 	if m.failureRate > 0 && m.shouldFail() {
-		log.WithFields(logger.Fields{
+		log.WithFields(Fields{
 			"protocol":     protocol,
 			"internalPort": internalPort,
 		}).Warn("mock: simulated random failure in MapPort")
@@ -141,7 +140,7 @@ func (m *MockPortMapper) MapPort(protocol string, internalPort int, duration tim
 
 	// Validate port range (matching real implementation behavior)
 	if internalPort < 1 || internalPort > 65535 {
-		log.WithFields(logger.Fields{
+		log.WithFields(Fields{
 			"protocol":     protocol,
 			"internalPort": internalPort,
 		}).Error("mock: invalid port number in MapPort")
@@ -162,7 +161,7 @@ func (m *MockPortMapper) MapPort(protocol string, internalPort int, duration tim
 
 	// Simulate port exhaustion
 	if m.portExhaustion {
-		log.WithFields(logger.Fields{
+		log.WithFields(Fields{
 			"protocol":     protocol,
 			"internalPort": internalPort,
 		}).Warn("mock: simulated port exhaustion in MapPort")
@@ -181,7 +180,7 @@ func (m *MockPortMapper) MapPort(protocol string, internalPort int, duration tim
 		Active:       true,
 	}
 
-	log.WithFields(logger.Fields{
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"internalPort": internalPort,
 		"externalPort": externalPort,
@@ -194,7 +193,7 @@ func (m *MockPortMapper) UnmapPort(protocol string, externalPort int) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	log.WithFields(logger.Fields{
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"externalPort": externalPort,
 	}).Debug("mock: UnmapPort called")
@@ -206,7 +205,7 @@ func (m *MockPortMapper) UnmapPort(protocol string, externalPort int) error {
 
 	// Simulate failure rate
 	if m.failureRate > 0 && m.shouldFail() {
-		log.WithFields(logger.Fields{
+		log.WithFields(Fields{
 			"protocol":     protocol,
 			"externalPort": externalPort,
 		}).Warn("mock: simulated random failure in UnmapPort")
@@ -215,7 +214,7 @@ func (m *MockPortMapper) UnmapPort(protocol string, externalPort int) error {
 
 	// Validate port range (matching real implementation behavior)
 	if externalPort < 1 || externalPort > 65535 {
-		log.WithFields(logger.Fields{
+		log.WithFields(Fields{
 			"protocol":     protocol,
 			"externalPort": externalPort,
 		}).Error("mock: invalid port number in UnmapPort")
@@ -228,7 +227,7 @@ func (m *MockPortMapper) UnmapPort(protocol string, externalPort int) error {
 		delete(m.mappings, key)
 	}
 
-	log.WithFields(logger.Fields{
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"externalPort": externalPort,
 	}).Debug("mock: port unmapped")
@@ -255,6 +254,29 @@ func (m *MockPortMapper) GetExternalIP() (string, error) {
 	return m.externalIP, nil
 }
 
+// ListMappings implements MappingLister with the active mappings.
+func (m *MockPortMapper) ListMappings() ([]MappingEntry, error) {
+	var entries []MappingEntry
+	for _, mapping := range m.GetActiveMappings() {
+		entries = append(entries, MappingEntry{
+			Protocol:       mapping.Protocol,
+			ExternalPort:   mapping.ExternalPort,
+			InternalClient: "127.0.0.1",
+			InternalPort:   mapping.InternalPort,
+			Description:    MappingDescription,
+			Enabled:        true,
+			Lease:          time.Until(mapping.ExpiresAt).Round(time.Second),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Protocol != entries[j].Protocol {
+			return entries[i].Protocol < entries[j].Protocol
+		}
+		return entries[i].ExternalPort < entries[j].ExternalPort
+	})
+	return entries, nil
+}
+
 // GetActiveMappings returns all active port mappings
 func (m *MockPortMapper) GetActiveMappings() map[string]*PortMapping {
 	m.mu.RLock()
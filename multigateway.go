@@ -0,0 +1,511 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/huin/goupnp/dcps/internetgateway2"
+)
+
+// Gateway describes a UPnP Internet gateway device found on the network.
+// Networks with several routers or a dual-WAN router can expose more than one.
+type Gateway struct {
+	UDN         string // unique device name of the IGD
+	ServiceType string // WAN connection service, e.g. urn:schemas-upnp-org:service:WANIPConnection:2
+	Address     net.IP // address of the gateway device, nil if unknown
+	ExternalIP  string // external IP reported by the gateway, empty if unavailable
+	LocalIP     net.IP // local address the gateway was discovered from, nil if unknown
+	Interface   string // local interface the gateway is reachable from, empty if unknown
+
+	client upnpClient
+}
+
+// Mapper returns a port mapper that creates mappings on this gateway for
+// its LocalIP, or for the default route's address if LocalIP is unknown.
+func (g *Gateway) Mapper() PortMapper {
+	return &UPnPMapper{client: g.client, localIP: g.LocalIP}
+}
+
+// String returns a short description of the gateway.
+func (g *Gateway) String() string {
+	return fmt.Sprintf("%s (%s, external %s)", g.UDN, g.Address, g.ExternalIP)
+}
+
+// DiscoverGateways enumerates every UPnP gateway on the network, querying the
+// WANIPConnection2, WANIPConnection1 and WANPPPConnection1 services. A device
+// offering several services is reported once, with the newest service.
+// NAT-PMP gateways are not included, as NAT-PMP only talks to the default gateway.
+func DiscoverGateways(ctx context.Context) ([]*Gateway, error) {
+	log.Debug("discovering all UPnP gateways")
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("context cancelled: %w", err)
+	}
+
+	var clients []upnpClient
+	if found, _, err := internetgateway2.NewWANIPConnection2ClientsCtx(ctx); err == nil {
+		for _, c := range found {
+			clients = append(clients, c)
+		}
+	} else {
+		log.WithError(err).Debug("WANIPConnection2 discovery failed")
+	}
+	if found, _, err := internetgateway2.NewWANIPConnection1ClientsCtx(ctx); err == nil {
+		for _, c := range found {
+			clients = append(clients, c)
+		}
+	} else {
+		log.WithError(err).Debug("WANIPConnection1 discovery failed")
+	}
+	if found, _, err := internetgateway2.NewWANPPPConnection1ClientsCtx(ctx); err == nil {
+		for _, c := range found {
+			clients = append(clients, c)
+		}
+	} else {
+		log.WithError(err).Debug("WANPPPConnection1 discovery failed")
+	}
+
+	gateways := gatewaysFromClients(ctx, clients)
+	if len(gateways) == 0 {
+		return nil, fmt.Errorf("no UPnP IGD devices found")
+	}
+
+	log.WithField("count", len(gateways)).Debug("UPnP gateways discovered")
+	return gateways, nil
+}
+
+// gatewaysFromClients describes each distinct device among clients, keeping
+// the first client of each device. External IP lookups give up when ctx is done.
+func gatewaysFromClients(ctx context.Context, clients []upnpClient) []*Gateway {
+	var gateways []*Gateway
+	seen := make(map[string]bool)
+	for _, client := range clients {
+		g := newGateway(ctx, client)
+		if g.UDN != "" {
+			if seen[g.UDN] {
+				continue
+			}
+			seen[g.UDN] = true
+		}
+		gateways = append(gateways, g)
+	}
+	return gateways
+}
+
+// newGateway describes the gateway behind client, giving up on its external
+// IP when ctx is done.
+func newGateway(ctx context.Context, client upnpClient) *Gateway {
+	g := &Gateway{client: client, Address: upnpGatewayIP(client)}
+
+	if sc, ok := client.(upnpServiceClient); ok {
+		if c := sc.GetServiceClient(); c != nil {
+			if c.RootDevice != nil {
+				g.UDN = c.RootDevice.Device.UDN
+			}
+			if c.Service != nil {
+				g.ServiceType = c.Service.ServiceType
+			}
+			g.LocalIP = c.LocalAddr()
+		}
+	}
+	if g.LocalIP == nil && g.Address != nil {
+		if ip, err := routeSourceIP(g.Address); err == nil {
+			g.LocalIP = ip
+		}
+	}
+	if g.LocalIP != nil {
+		g.Interface = interfaceNameForIP(g.LocalIP)
+	}
+
+	if ip, err := (&UPnPMapper{client: client}).getExternalIPAddress(ctx); err == nil {
+		g.ExternalIP = ip
+	} else {
+		log.WithError(err).WithField("udn", g.UDN).Debug("failed to get external IP of gateway")
+	}
+
+	log.WithFields(Fields{
+		"udn":        g.UDN,
+		"service":    g.ServiceType,
+		"address":    g.Address.String(),
+		"externalIP": g.ExternalIP,
+		"localIP":    g.LocalIP.String(),
+		"interface":  g.Interface,
+	}).Debug("UPnP gateway found")
+	return g
+}
+
+// interfaceNameForIP returns the name of the interface that has ip, or "".
+func interfaceNameForIP(ip net.IP) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		if localIPNet(addrs, ip) != nil {
+			return iface.Name
+		}
+	}
+	return ""
+}
+
+// preferDefaultGatewayClient returns the client served by the default gateway
+// if there is one, and the first client otherwise. Returns the zero value if
+// clients is empty.
+func preferDefaultGatewayClient[T upnpClient](clients []T) T {
+	var zero T
+	if len(clients) == 0 {
+		return zero
+	}
+	if len(clients) > 1 {
+		if gateway, err := discoverGateway(); err == nil {
+			for _, c := range clients {
+				if gateway.Equal(upnpGatewayIP(c)) {
+					return c
+				}
+			}
+		}
+	}
+	return clients[0]
+}
+
+// GatewayPolicy scores a gateway for selection; higher scores are preferred.
+type GatewayPolicy func(g *Gateway) int
+
+// MatchLocalSubnet prefers gateways reachable from the local address ip,
+// either because they were discovered from it or because they are on its subnet.
+func MatchLocalSubnet(ip net.IP) GatewayPolicy {
+	return func(g *Gateway) int {
+		if g.LocalIP != nil && g.LocalIP.Equal(ip) {
+			return 1
+		}
+		if g.Address != nil && validateGatewayReachable(ip, g.Address) == nil {
+			return 1
+		}
+		return 0
+	}
+}
+
+// PreferPublicExternalIP prefers gateways whose external IP is publicly
+// routable over those behind another NAT or carrier-grade NAT.
+func PreferPublicExternalIP() GatewayPolicy {
+	return func(g *Gateway) int {
+		if ip := net.ParseIP(g.ExternalIP); ip != nil && isGloballyRoutableIP(ip) {
+			return 1
+		}
+		return 0
+	}
+}
+
+// PreferUDN prefers the gateway with the given unique device name.
+func PreferUDN(udn string) GatewayPolicy {
+	return func(g *Gateway) int {
+		if g.UDN == udn {
+			return 1
+		}
+		return 0
+	}
+}
+
+// OrderGateways returns gateways sorted by the given policies. Earlier
+// policies take precedence over later ones, and ties keep discovery order.
+func OrderGateways(gateways []*Gateway, policies ...GatewayPolicy) []*Gateway {
+	type scored struct {
+		gateway *Gateway
+		scores  []int
+	}
+	entries := make([]scored, len(gateways))
+	for i, g := range gateways {
+		entries[i].gateway = g
+		for _, policy := range policies {
+			entries[i].scores = append(entries[i].scores, policy(g))
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		for k := range policies {
+			if entries[i].scores[k] != entries[j].scores[k] {
+				return entries[i].scores[k] > entries[j].scores[k]
+			}
+		}
+		return false
+	})
+
+	ordered := make([]*Gateway, len(entries))
+	for i, e := range entries {
+		ordered[i] = e.gateway
+	}
+	return ordered
+}
+
+// SelectGateway returns the gateway ranked first by the given policies, or
+// nil if gateways is empty.
+func SelectGateway(gateways []*Gateway, policies ...GatewayPolicy) *Gateway {
+	ordered := OrderGateways(gateways, policies...)
+	if len(ordered) == 0 {
+		return nil
+	}
+	return ordered[0]
+}
+
+// MultiMapper maps each port on several gateways for redundancy, for example
+// on both uplinks of a dual-WAN network. The first mapper whose mapping
+// succeeds is the primary: its external port and IP are reported to the
+// caller. Mapping succeeds as long as at least one gateway accepts it.
+type MultiMapper struct {
+	mappers []PortMapper
+
+	mu sync.Mutex
+	// mappings records the mappings created on the gateways, keyed by the
+	// protocol and the external port reported to the caller.
+	mappings map[multiMappingKey]*multiMapping
+	// primary is the index of the mapper whose port was reported last, or
+	// -1 before the first mapping.
+	primary int
+}
+
+// multiMapping is a mapping created through a MultiMapper.
+type multiMapping struct {
+	internalPort int
+	ports        []int // external port assigned by each mapper, 0 if it failed
+}
+
+// multiMappingKey identifies a mapping created through a MultiMapper.
+type multiMappingKey struct {
+	protocol string
+	port     int
+}
+
+// Ensure MultiMapper reports granted lease lifetimes, supports contexts and
+// can map for a specific address.
+var (
+	_ LeasePortMapper     = (*MultiMapper)(nil)
+	_ ContextPortMapper   = (*MultiMapper)(nil)
+	_ LocalAddrPortMapper = (*MultiMapper)(nil)
+)
+
+// NewMultiMapper creates a mapper that maps ports on every given mapper.
+func NewMultiMapper(mappers ...PortMapper) *MultiMapper {
+	return &MultiMapper{
+		mappers:  mappers,
+		mappings: make(map[multiMappingKey]*multiMapping),
+		primary:  -1,
+	}
+}
+
+// Mappers returns the underlying mappers, primary first.
+func (m *MultiMapper) Mappers() []PortMapper {
+	return append([]PortMapper(nil), m.mappers...)
+}
+
+// MapPort maps the port on every gateway. See MapPortWithLease.
+func (m *MultiMapper) MapPort(protocol string, internalPort int, duration time.Duration) (int, error) {
+	result, err := m.MapPortWithLease(protocol, internalPort, duration)
+	if err != nil {
+		return 0, err
+	}
+	return result.ExternalPort, nil
+}
+
+// MapPortWithLease maps the port on every gateway. The external port is the
+// one assigned by the first gateway that succeeded, which becomes the
+// gateway whose external IP is reported, and the lifetime is the
+// shortest lease granted, so renewal keeps every mapping alive.
+// Failures on some gateways are logged; an error is returned only if every
+// gateway failed.
+func (m *MultiMapper) MapPortWithLease(protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	return m.MapPortContext(context.Background(), protocol, internalPort, duration)
+}
+
+// MapPortContext maps the port on every gateway as MapPortWithLease does,
+// giving up on the remaining gateways when ctx is done.
+func (m *MultiMapper) MapPortContext(ctx context.Context, protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	ports := make([]int, len(m.mappers))
+	var result MapPortResult
+	var errs []error
+	succeeded := false
+	primary := -1
+
+	for i, mapper := range m.mappers {
+		r, err := mapPortContext(ctx, mapper, protocol, internalPort, duration)
+		if err != nil {
+			log.WithError(err).WithFields(Fields{
+				"protocol":     protocol,
+				"internalPort": internalPort,
+				"gateway":      i,
+			}).Warn("port mapping failed on redundant gateway")
+			errs = append(errs, err)
+			continue
+		}
+		ports[i] = r.ExternalPort
+		if !succeeded {
+			result.ExternalPort = r.ExternalPort
+			result.Lifetime = r.Lifetime
+			succeeded = true
+			primary = i
+		} else if r.Lifetime > 0 && (result.Lifetime == 0 || r.Lifetime < result.Lifetime) {
+			result.Lifetime = r.Lifetime
+		}
+	}
+
+	if !succeeded {
+		return MapPortResult{}, fmt.Errorf("port mapping failed on all %d gateways: %w", len(m.mappers), errors.Join(errs...))
+	}
+
+	key := multiMappingKey{protocol, result.ExternalPort}
+	m.mu.Lock()
+	// A renewal that was assigned another port replaces the old entry
+	for k, mapping := range m.mappings {
+		if k != key && k.protocol == protocol && mapping.internalPort == internalPort {
+			delete(m.mappings, k)
+		}
+	}
+	m.mappings[key] = &multiMapping{internalPort: internalPort, ports: ports}
+	m.primary = primary
+	m.mu.Unlock()
+
+	log.WithFields(Fields{
+		"protocol":     protocol,
+		"internalPort": internalPort,
+		"externalPort": result.ExternalPort,
+		"primary":      primary,
+		"gateways":     len(m.mappers) - len(errs),
+	}).Debug("port mapped on redundant gateways")
+	return result, nil
+}
+
+// UnmapPort removes the mapping from every gateway it was created on.
+func (m *MultiMapper) UnmapPort(protocol string, externalPort int) error {
+	return m.UnmapPortContext(context.Background(), protocol, externalPort)
+}
+
+// UnmapPortContext removes the mapping from every gateway it was created on,
+// giving up when ctx is done.
+func (m *MultiMapper) UnmapPortContext(ctx context.Context, protocol string, externalPort int) error {
+	key := multiMappingKey{protocol, externalPort}
+	m.mu.Lock()
+	mapping, ok := m.mappings[key]
+	delete(m.mappings, key)
+	m.mu.Unlock()
+
+	var errs []error
+	for i, mapper := range m.mappers {
+		port := externalPort
+		if ok {
+			if mapping.ports[i] == 0 {
+				continue
+			}
+			port = mapping.ports[i]
+		}
+		if err := unmapContext(ctx, mapper, protocol, port); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GetExternalIP returns the external IP of the gateway whose port was
+// reported by the last mapping, or of the first gateway that reports one
+// before any port is mapped.
+func (m *MultiMapper) GetExternalIP() (string, error) {
+	return m.GetExternalIPContext(context.Background())
+}
+
+// GetExternalIPContext returns the external IP as GetExternalIP does,
+// giving up when ctx is done.
+func (m *MultiMapper) GetExternalIPContext(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	primary := m.primary
+	m.mu.Unlock()
+	if primary >= 0 {
+		// Another gateway's IP would not match the reported port
+		ip, err := externalIPContext(ctx, m.mappers[primary])
+		if err != nil {
+			return "", fmt.Errorf("gateway holding the mapping reported no external IP: %w", err)
+		}
+		return ip, nil
+	}
+
+	var errs []error
+	for _, mapper := range m.mappers {
+		ip, err := externalIPContext(ctx, mapper)
+		if err == nil {
+			return ip, nil
+		}
+		errs = append(errs, err)
+	}
+	return "", fmt.Errorf("no gateway reported an external IP: %w", errors.Join(errs...))
+}
+
+// ExternalIPs returns the external IP of every gateway that reports one.
+func (m *MultiMapper) ExternalIPs() []string {
+	return m.ExternalIPsContext(context.Background())
+}
+
+// ExternalIPsContext returns the external IP of every gateway that reports
+// one before ctx is done.
+func (m *MultiMapper) ExternalIPsContext(ctx context.Context) []string {
+	var ips []string
+	for _, mapper := range m.mappers {
+		if ip, err := externalIPContext(ctx, mapper); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// ForLocalAddr returns a MultiMapper of the gateways that can map for ip.
+// Gateways unreachable from ip are dropped; it fails if none remain.
+func (m *MultiMapper) ForLocalAddr(ip net.IP) (PortMapper, error) {
+	var mappers []PortMapper
+	var errs []error
+	for _, mapper := range m.mappers {
+		bound, err := mapperForLocalAddr(mapper, ip)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		mappers = append(mappers, bound)
+	}
+	if len(mappers) == 0 {
+		return nil, fmt.Errorf("no gateway can map ports for %s: %w", ip, errors.Join(errs...))
+	}
+	return NewMultiMapper(mappers...), nil
+}
+
+// gatewayMapper discovers gateways and returns a mapper for the best one
+// according to policies, or a MultiMapper over all of them if redundant is set.
+func gatewayMapper(ctx context.Context, policies []GatewayPolicy, redundant bool) (PortMapper, error) {
+	gateways, err := discoverGateways(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ordered := OrderGateways(gateways, policies...)
+
+	log.WithFields(Fields{
+		"gateways":  len(ordered),
+		"selected":  ordered[0].String(),
+		"redundant": redundant,
+	}).Debug("gateway selected for port mapping")
+
+	if !redundant || len(ordered) == 1 {
+		return ordered[0].Mapper(), nil
+	}
+	mappers := make([]PortMapper, len(ordered))
+	for i, g := range ordered {
+		mappers[i] = g.Mapper()
+	}
+	return NewMultiMapper(mappers...), nil
+}
+
+// discoverGateways is the gateway enumeration used by listeners. It is a
+// variable so tests can inject gateways.
+var discoverGateways = DiscoverGateways
@@ -0,0 +1,262 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/huin/goupnp"
+)
+
+// fakeIGDClient is a fakeUPnPClient with IGD discovery metadata.
+type fakeIGDClient struct {
+	fakeUPnPClient
+	sc         *goupnp.ServiceClient
+	externalIP string
+}
+
+func newFakeIGDClient(udn, address, externalIP string) *fakeIGDClient {
+	return &fakeIGDClient{
+		sc: &goupnp.ServiceClient{
+			RootDevice: &goupnp.RootDevice{Device: goupnp.Device{UDN: udn}},
+			Location:   &url.URL{Scheme: "http", Host: address + ":5000", Path: "/rootDesc.xml"},
+			Service:    &goupnp.Service{ServiceType: "urn:schemas-upnp-org:service:WANIPConnection:1"},
+		},
+		externalIP: externalIP,
+	}
+}
+
+func (c *fakeIGDClient) GetServiceClient() *goupnp.ServiceClient {
+	return c.sc
+}
+
+func (c *fakeIGDClient) GetExternalIPAddress() (string, error) {
+	return c.externalIP, nil
+}
+
+// TestGatewaysFromClients tests describing and de-duplicating discovered IGDs
+func TestGatewaysFromClients(t *testing.T) {
+	primary := newFakeIGDClient("uuid:router-a", "192.168.1.1", "203.0.113.5")
+	sameDevice := newFakeIGDClient("uuid:router-a", "192.168.1.1", "203.0.113.5")
+	secondary := newFakeIGDClient("uuid:router-b", "192.168.2.1", "198.51.100.9")
+
+	gateways := gatewaysFromClients(context.Background(), []upnpClient{primary, sameDevice, secondary})
+	if len(gateways) != 2 {
+		t.Fatalf("Expected 2 distinct gateways, got %d", len(gateways))
+	}
+
+	g := gateways[0]
+	if g.UDN != "uuid:router-a" {
+		t.Errorf("Expected UDN uuid:router-a, got %q", g.UDN)
+	}
+	if !g.Address.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("Expected gateway address 192.168.1.1, got %v", g.Address)
+	}
+	if g.ExternalIP != "203.0.113.5" {
+		t.Errorf("Expected external IP 203.0.113.5, got %q", g.ExternalIP)
+	}
+	if g.ServiceType != "urn:schemas-upnp-org:service:WANIPConnection:1" {
+		t.Errorf("Unexpected service type %q", g.ServiceType)
+	}
+	if gateways[1].UDN != "uuid:router-b" {
+		t.Errorf("Expected second gateway uuid:router-b, got %q", gateways[1].UDN)
+	}
+}
+
+// TestOrderGateways tests gateway selection policies
+func TestOrderGateways(t *testing.T) {
+	inner := &Gateway{UDN: "uuid:inner", ExternalIP: "192.168.0.2", LocalIP: net.IPv4(192, 168, 1, 20)}
+	public := &Gateway{UDN: "uuid:public", ExternalIP: "203.0.113.5", LocalIP: net.IPv4(10, 0, 0, 20)}
+	cgnat := &Gateway{UDN: "uuid:cgnat", ExternalIP: "100.64.1.2", LocalIP: net.IPv4(10, 0, 0, 20)}
+	gateways := []*Gateway{inner, cgnat, public}
+
+	if got := SelectGateway(gateways, PreferPublicExternalIP()); got != public {
+		t.Errorf("Expected public gateway, got %v", got)
+	}
+	if got := SelectGateway(gateways, PreferUDN("uuid:cgnat")); got != cgnat {
+		t.Errorf("Expected gateway by UDN, got %v", got)
+	}
+	if got := SelectGateway(gateways, MatchLocalSubnet(net.IPv4(192, 168, 1, 20))); got != inner {
+		t.Errorf("Expected gateway reachable from local address, got %v", got)
+	}
+
+	// Earlier policies take precedence; ties keep discovery order
+	ordered := OrderGateways(gateways, MatchLocalSubnet(net.IPv4(10, 0, 0, 20)), PreferPublicExternalIP())
+	if ordered[0] != public || ordered[1] != cgnat || ordered[2] != inner {
+		t.Errorf("Unexpected order: %v", ordered)
+	}
+	if got := SelectGateway(gateways); got != inner {
+		t.Errorf("Expected discovery order without policies, got %v", got)
+	}
+	if SelectGateway(nil) != nil {
+		t.Error("Expected nil for no gateways")
+	}
+}
+
+// TestMultiMapper tests redundant mapping across gateways
+func TestMultiMapper(t *testing.T) {
+	t.Run("Maps on every gateway and tolerates failures", func(t *testing.T) {
+		first := NewMockPortMapper()
+		first.SetExternalIP("203.0.113.5")
+		failing := NewMockPortMapper()
+		failing.SetFailureRate(1.0)
+		third := NewMockPortMapper()
+
+		multi := NewMultiMapper(first, failing, third)
+		port, err := multi.MapPort("UDP", 9000, mappingDuration)
+		if err != nil {
+			t.Fatalf("Expected mapping to succeed with one failing gateway: %v", err)
+		}
+		if len(first.GetActiveMappings()) != 1 || len(third.GetActiveMappings()) != 1 {
+			t.Error("Expected mapping on every working gateway")
+		}
+		if ip, _ := multi.GetExternalIP(); ip != "203.0.113.5" {
+			t.Errorf("Expected primary external IP, got %s", ip)
+		}
+
+		if err := multi.UnmapPort("UDP", port); err != nil {
+			t.Errorf("UnmapPort failed: %v", err)
+		}
+		if len(first.GetActiveMappings()) != 0 || len(third.GetActiveMappings()) != 0 {
+			t.Error("Expected mappings removed from every gateway")
+		}
+	})
+
+	t.Run("Fails when every gateway fails", func(t *testing.T) {
+		a, b := NewMockPortMapper(), NewMockPortMapper()
+		a.SetFailureRate(1.0)
+		b.SetFailureRate(1.0)
+		if _, err := NewMultiMapper(a, b).MapPort("TCP", 8080, mappingDuration); err == nil {
+			t.Error("Expected error when all gateways fail")
+		}
+	})
+
+	t.Run("Reports the shortest lease", func(t *testing.T) {
+		long := &leaseClampingMapper{MockPortMapper: NewMockPortMapper(), maxLease: time.Hour}
+		short := &leaseClampingMapper{MockPortMapper: NewMockPortMapper(), maxLease: 10 * time.Minute}
+		result, err := NewMultiMapper(long, short).MapPortWithLease("TCP", 8080, mappingDuration)
+		if err != nil {
+			t.Fatalf("MapPortWithLease failed: %v", err)
+		}
+		if result.Lifetime != 10*time.Minute {
+			t.Errorf("Expected shortest lease 10m, got %v", result.Lifetime)
+		}
+	})
+
+	t.Run("Reports the IP of the gateway holding the reported port", func(t *testing.T) {
+		failing := &mapFailingMapper{MockPortMapper: NewMockPortMapper()}
+		failing.SetExternalIP("203.0.113.5")
+		second := NewMockPortMapper()
+		second.SetExternalIP("198.51.100.9")
+
+		multi := NewMultiMapper(failing, second)
+		if _, err := multi.MapPort("TCP", 8080, mappingDuration); err != nil {
+			t.Fatalf("MapPort failed: %v", err)
+		}
+		if ip, _ := multi.GetExternalIP(); ip != "198.51.100.9" {
+			t.Errorf("Expected the external IP of the gateway holding the mapping, got %s", ip)
+		}
+	})
+
+	t.Run("Renewal with another port replaces the old entry", func(t *testing.T) {
+		shifting := &shiftingMapper{MockPortMapper: NewMockPortMapper(), next: 40000}
+		multi := NewMultiMapper(shifting)
+		first, err := multi.MapPort("UDP", 9000, mappingDuration)
+		if err != nil {
+			t.Fatalf("MapPort failed: %v", err)
+		}
+		second, err := multi.MapPort("UDP", 9000, mappingDuration)
+		if err != nil {
+			t.Fatalf("Renewal failed: %v", err)
+		}
+		if first == second {
+			t.Fatalf("Expected the renewal to be assigned another port")
+		}
+		multi.mu.Lock()
+		_, stale := multi.mappings[multiMappingKey{"UDP", first}]
+		entries := len(multi.mappings)
+		multi.mu.Unlock()
+		if stale || entries != 1 {
+			t.Errorf("Expected only the renewed mapping to be recorded, got %d entries (old kept: %v)", entries, stale)
+		}
+	})
+}
+
+// mapFailingMapper refuses mappings but still reports its external IP.
+type mapFailingMapper struct {
+	*MockPortMapper
+}
+
+func (m *mapFailingMapper) MapPort(_ string, _ int, _ time.Duration) (int, error) {
+	return 0, errors.New("mapping refused")
+}
+
+// shiftingMapper assigns a new external port on every request, as NAT-PMP
+// gateways may on renewal.
+type shiftingMapper struct {
+	*MockPortMapper
+	next int
+}
+
+func (m *shiftingMapper) MapPort(_ string, _ int, _ time.Duration) (int, error) {
+	m.next++
+	return m.next, nil
+}
+
+// TestGatewayMapper tests mapper selection from discovered gateways
+func TestGatewayMapper(t *testing.T) {
+	a := newFakeIGDClient("uuid:router-a", "192.168.1.1", "203.0.113.5")
+	b := newFakeIGDClient("uuid:router-b", "192.168.2.1", "198.51.100.9")
+
+	original := discoverGateways
+	discoverGateways = func(ctx context.Context) ([]*Gateway, error) {
+		return gatewaysFromClients(context.Background(), []upnpClient{a, b}), nil
+	}
+	defer func() { discoverGateways = original }()
+
+	mapper, err := gatewayMapper(context.Background(), []GatewayPolicy{PreferUDN("uuid:router-b")}, false)
+	if err != nil {
+		t.Fatalf("gatewayMapper failed: %v", err)
+	}
+	if upnp, ok := mapper.(*UPnPMapper); !ok || upnp.client != b {
+		t.Errorf("Expected mapper for preferred gateway, got %#v", mapper)
+	}
+
+	mapper, err = gatewayMapper(context.Background(), nil, true)
+	if err != nil {
+		t.Fatalf("gatewayMapper failed: %v", err)
+	}
+	multi, ok := mapper.(*MultiMapper)
+	if !ok || len(multi.Mappers()) != 2 {
+		t.Fatalf("Expected MultiMapper over both gateways, got %#v", mapper)
+	}
+	if ips := multi.ExternalIPs(); len(ips) != 2 {
+		t.Errorf("Expected external IPs of both gateways, got %v", ips)
+	}
+}
+
+// TestGatewayMapperLocalIP tests that each gateway maps ports for the
+// address it was discovered from
+func TestGatewayMapperLocalIP(t *testing.T) {
+	a := newFakeIGDClient("uuid:router-a", "192.168.1.1", "203.0.113.5")
+	b := newFakeIGDClient("uuid:router-b", "10.0.0.1", "198.51.100.9")
+	gateways := []*Gateway{
+		{UDN: "uuid:router-a", LocalIP: net.IPv4(192, 168, 1, 20), client: a},
+		{UDN: "uuid:router-b", LocalIP: net.IPv4(10, 0, 0, 20), client: b},
+	}
+
+	for _, g := range gateways {
+		if _, err := g.Mapper().MapPort("TCP", 8080, time.Hour); err != nil {
+			t.Fatalf("MapPort on %s failed: %v", g.UDN, err)
+		}
+	}
+	if a.internalClient != "192.168.1.20" {
+		t.Errorf("Expected internal client 192.168.1.20 on router-a, got %q", a.internalClient)
+	}
+	if b.internalClient != "10.0.0.20" {
+		t.Errorf("Expected internal client 10.0.0.20 on router-b, got %q", b.internalClient)
+	}
+}
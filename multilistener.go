@@ -0,0 +1,345 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// NATListenerGroup is a set of TCP listeners whose ports were mapped together
+// through one port mapper. Renewals share one RenewalScheduler, and after a
+// network change every port is re-mapped through a single rediscovered mapper.
+type NATListenerGroup struct {
+	group     *listenerGroup
+	listeners []*NATListener
+	byPort    map[int]*NATListener
+}
+
+// NATPacketListenerGroup is a set of UDP packet listeners whose ports were
+// mapped together through one port mapper. Renewals share one
+// RenewalScheduler, and after a network change every port is re-mapped
+// through a single rediscovered mapper.
+type NATPacketListenerGroup struct {
+	group     *listenerGroup
+	listeners []*NATPacketListener
+	byPort    map[int]*NATPacketListener
+}
+
+// ListenRange creates TCP listeners with NAT traversal for every port from
+// first to last inclusive. Either all ports are mapped or none are.
+// It is equivalent to calling ListenRange on a zero ListenConfig.
+func ListenRange(ctx context.Context, first, last int) (*NATListenerGroup, error) {
+	return (&ListenConfig{}).ListenRange(ctx, first, last)
+}
+
+// ListenMulti creates TCP listeners with NAT traversal for each of the given
+// ports. Either all ports are mapped or none are.
+// It is equivalent to calling ListenMulti on a zero ListenConfig.
+func ListenMulti(ctx context.Context, ports []int) (*NATListenerGroup, error) {
+	return (&ListenConfig{}).ListenMulti(ctx, ports)
+}
+
+// ListenPacketRange creates UDP packet listeners with NAT traversal for every
+// port from first to last inclusive. Either all ports are mapped or none are.
+// It is equivalent to calling ListenPacketRange on a zero ListenConfig.
+func ListenPacketRange(ctx context.Context, first, last int) (*NATPacketListenerGroup, error) {
+	return (&ListenConfig{}).ListenPacketRange(ctx, first, last)
+}
+
+// ListenPacketMulti creates UDP packet listeners with NAT traversal for each
+// of the given ports. Either all ports are mapped or none are.
+// It is equivalent to calling ListenPacketMulti on a zero ListenConfig.
+func ListenPacketMulti(ctx context.Context, ports []int) (*NATPacketListenerGroup, error) {
+	return (&ListenConfig{}).ListenPacketMulti(ctx, ports)
+}
+
+// ListenRange creates TCP listeners with NAT traversal for every port from
+// first to last inclusive. See ListenMulti.
+func (lc *ListenConfig) ListenRange(ctx context.Context, first, last int) (*NATListenerGroup, error) {
+	ports, err := portRange(first, last)
+	if err != nil {
+		return nil, err
+	}
+	return lc.ListenMulti(ctx, ports)
+}
+
+// ListenMulti creates TCP listeners with NAT traversal for each of the given
+// ports, sharing one port mapper discovery. If any port cannot be mapped or
+// bound, every listener created so far is closed and its mapping removed.
+// If lc.Scheduler is nil, the group renews through its own scheduler, which
+// is stopped by Close.
+func (lc *ListenConfig) ListenMulti(ctx context.Context, ports []int) (*NATListenerGroup, error) {
+	group := &NATListenerGroup{byPort: make(map[int]*NATListener)}
+	g, err := lc.listenGroup(ctx, "TCP", ports, func(cfg *ListenConfig, mapper PortMapper, mapping MapPortResult, port int) (groupMember, error) {
+		listener, err := cfg.listenWithMapping(ctx, mapper, mapping, "tcp", nil, port)
+		if err != nil {
+			return nil, err
+		}
+		group.listeners = append(group.listeners, listener)
+		group.byPort[port] = listener
+		return listener, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	group.group = g
+	return group, nil
+}
+
+// ListenPacketRange creates UDP packet listeners with NAT traversal for every
+// port from first to last inclusive. See ListenPacketMulti.
+func (lc *ListenConfig) ListenPacketRange(ctx context.Context, first, last int) (*NATPacketListenerGroup, error) {
+	ports, err := portRange(first, last)
+	if err != nil {
+		return nil, err
+	}
+	return lc.ListenPacketMulti(ctx, ports)
+}
+
+// ListenPacketMulti creates UDP packet listeners with NAT traversal for each
+// of the given ports, sharing one port mapper discovery. If any port cannot
+// be mapped or bound, every listener created so far is closed and its mapping
+// removed. If lc.Scheduler is nil, the group renews through its own
+// scheduler, which is stopped by Close.
+func (lc *ListenConfig) ListenPacketMulti(ctx context.Context, ports []int) (*NATPacketListenerGroup, error) {
+	group := &NATPacketListenerGroup{byPort: make(map[int]*NATPacketListener)}
+	g, err := lc.listenGroup(ctx, "UDP", ports, func(cfg *ListenConfig, mapper PortMapper, mapping MapPortResult, port int) (groupMember, error) {
+		listener, err := cfg.listenPacketWithMapping(ctx, mapper, mapping, "udp", nil, port)
+		if err != nil {
+			return nil, err
+		}
+		group.listeners = append(group.listeners, listener)
+		group.byPort[port] = listener
+		return listener, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	group.group = g
+	return group, nil
+}
+
+// Listeners returns the group's listeners in the order their ports were given.
+func (g *NATListenerGroup) Listeners() []*NATListener {
+	return append([]*NATListener(nil), g.listeners...)
+}
+
+// Listener returns the listener for the given internal port, or nil if the
+// port is not part of the group.
+func (g *NATListenerGroup) Listener(port int) *NATListener {
+	return g.byPort[port]
+}
+
+// Close closes every listener in the group and removes their port mappings.
+func (g *NATListenerGroup) Close() error {
+	return g.group.close()
+}
+
+// Listeners returns the group's listeners in the order their ports were given.
+func (g *NATPacketListenerGroup) Listeners() []*NATPacketListener {
+	return append([]*NATPacketListener(nil), g.listeners...)
+}
+
+// Listener returns the listener for the given internal port, or nil if the
+// port is not part of the group.
+func (g *NATPacketListenerGroup) Listener(port int) *NATPacketListener {
+	return g.byPort[port]
+}
+
+// Close closes every listener in the group and removes their port mappings.
+func (g *NATPacketListenerGroup) Close() error {
+	return g.group.close()
+}
+
+// groupMember is a listener that belongs to a listenerGroup.
+type groupMember interface {
+	Close() error
+	remapTo(ctx context.Context, mapper PortMapper) error
+}
+
+// listenFunc creates one group member for an established mapping.
+type listenFunc func(cfg *ListenConfig, mapper PortMapper, mapping MapPortResult, port int) (groupMember, error)
+
+// listenerGroup holds what the members of a listener group share: the
+// renewal scheduler and the network change monitor.
+type listenerGroup struct {
+	protocol      string
+	discover      mapperDiscovery
+	scheduler     *RenewalScheduler
+	ownsScheduler bool
+
+	mu      sync.Mutex
+	members []groupMember
+	monitor *NetworkMonitor
+	closed  bool
+}
+
+// listenGroup discovers one port mapper and creates a member for each port.
+// On any failure, members created so far are closed, which removes their
+// mappings, and the error is returned.
+func (lc *ListenConfig) listenGroup(ctx context.Context, protocol string, ports []int, listen listenFunc) (*listenerGroup, error) {
+	log := lc.logger()
+	if err := validatePorts(ports); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(Fields{
+		"protocol": protocol,
+		"ports":    len(ports),
+	}).Debug("creating NAT listener group")
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("context cancelled before starting: %w", err)
+	}
+
+	mapper, err := lc.portMapper(ctx)
+	if err != nil {
+		log.WithError(err).WithField("protocol", protocol).Error("failed to create port mapper for listener group")
+		return nil, fmt.Errorf("failed to create port mapper: %w", err)
+	}
+
+	cfg := *lc
+	g := &listenerGroup{protocol: protocol, scheduler: cfg.Scheduler, discover: cfg.portMapper}
+	if g.scheduler == nil {
+		g.scheduler = NewRenewalScheduler(0)
+		g.scheduler.SetClock(cfg.Clock)
+		g.scheduler.Start()
+		g.ownsScheduler = true
+		cfg.Scheduler = g.scheduler
+	}
+
+	for _, port := range ports {
+		if err := ctx.Err(); err != nil {
+			g.close()
+			return nil, fmt.Errorf("context cancelled while mapping port %d: %w", port, err)
+		}
+
+		mapping, err := mapListenerPort(ctx, mapper, protocol, port)
+		if err != nil {
+			log.WithError(err).WithFields(Fields{
+				"protocol": protocol,
+				"port":     port,
+			}).Error("listener group port mapping failed, rolling back")
+			g.close()
+			return nil, fmt.Errorf("failed to map port %d: %w", port, err)
+		}
+
+		member, err := listen(&cfg, mapper, mapping, port)
+		if err != nil {
+			log.WithError(err).WithFields(Fields{
+				"protocol": protocol,
+				"port":     port,
+			}).Error("listener group member creation failed, rolling back")
+			g.close()
+			return nil, fmt.Errorf("port %d: %w", port, err)
+		}
+
+		g.mu.Lock()
+		g.members = append(g.members, member)
+		g.mu.Unlock()
+	}
+
+	monitor := startNetworkMonitor(g.handleNetworkChange)
+	g.mu.Lock()
+	g.monitor = monitor
+	g.mu.Unlock()
+
+	log.WithFields(Fields{
+		"protocol": protocol,
+		"ports":    len(ports),
+	}).Debug("NAT listener group ready")
+	return g, nil
+}
+
+// handleNetworkChange rediscovers the port mapper once and re-maps every
+// member through it.
+func (g *listenerGroup) handleNetworkChange(_, _ NetworkState) {
+	g.mu.Lock()
+	closed := g.closed
+	members := append([]groupMember(nil), g.members...)
+	g.mu.Unlock()
+
+	if closed {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), remapTimeout)
+	defer cancel()
+	mapper, err := g.discover(ctx)
+	if err != nil {
+		log.WithError(err).WithField("protocol", g.protocol).Warn("port mapper rediscovery failed after network change")
+		return
+	}
+
+	for _, member := range members {
+		if err := member.remapTo(ctx, mapper); err != nil {
+			log.WithError(err).WithField("protocol", g.protocol).Warn("failed to re-map group port after network change")
+		}
+	}
+}
+
+// close stops monitoring, closes every member, and stops the scheduler if
+// the group owns it.
+func (g *listenerGroup) close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	members := g.members
+	monitor := g.monitor
+	g.mu.Unlock()
+
+	log.WithFields(Fields{
+		"protocol": g.protocol,
+		"ports":    len(members),
+	}).Debug("closing NAT listener group")
+
+	if monitor != nil {
+		monitor.Stop()
+	}
+
+	var errs []error
+	for _, member := range members {
+		if err := member.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if g.ownsScheduler {
+		g.scheduler.Stop()
+	}
+	return errors.Join(errs...)
+}
+
+// portRange returns the ports from first to last inclusive.
+func portRange(first, last int) ([]int, error) {
+	if first < 1 || last > 65535 || first > last {
+		return nil, fmt.Errorf("invalid port range %d-%d", first, last)
+	}
+	ports := make([]int, 0, last-first+1)
+	for port := first; port <= last; port++ {
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// validatePorts checks that ports is non-empty and contains only valid,
+// distinct port numbers.
+func validatePorts(ports []int) error {
+	if len(ports) == 0 {
+		return fmt.Errorf("no ports specified")
+	}
+	seen := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+		if seen[port] {
+			return fmt.Errorf("duplicate port %d", port)
+		}
+		seen[port] = true
+	}
+	return nil
+}
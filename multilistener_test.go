@@ -0,0 +1,178 @@
+package nattraversal
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// useMockPortMapper makes listener groups discover the given mapper.
+func useMockPortMapper(t *testing.T, mapper PortMapper) {
+	t.Helper()
+	original := newPortMapper
+	newPortMapper = func(ctx context.Context) (PortMapper, error) {
+		return mapper, nil
+	}
+	t.Cleanup(func() { newPortMapper = original })
+}
+
+// freePorts returns n distinct ports that are currently free for UDP and TCP.
+func freePorts(t *testing.T, n int) []int {
+	t.Helper()
+	var ports []int
+	var holds []net.PacketConn
+	defer func() {
+		for _, c := range holds {
+			c.Close()
+		}
+	}()
+	for len(ports) < n {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to find free port: %v", err)
+		}
+		holds = append(holds, conn)
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		if l, err := net.Listen("tcp", ":"+strconv.Itoa(port)); err == nil {
+			l.Close()
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// TestListenPacketMulti tests mapping a set of UDP ports in one call
+func TestListenPacketMulti(t *testing.T) {
+	t.Run("Maps every port through one mapper", func(t *testing.T) {
+		mock := NewMockPortMapper()
+		useMockPortMapper(t, mock)
+		ports := freePorts(t, 3)
+
+		group, err := ListenPacketMulti(context.Background(), ports)
+		if err != nil {
+			t.Fatalf("ListenPacketMulti failed: %v", err)
+		}
+
+		if len(group.Listeners()) != len(ports) {
+			t.Errorf("Expected %d listeners, got %d", len(ports), len(group.Listeners()))
+		}
+		if active := len(mock.GetActiveMappings()); active != len(ports) {
+			t.Errorf("Expected %d active mappings, got %d", len(ports), active)
+		}
+		for _, port := range ports {
+			if group.Listener(port) == nil {
+				t.Errorf("Expected listener for port %d", port)
+			}
+		}
+		if group.Listener(1) != nil {
+			t.Error("Expected nil listener for a port outside the group")
+		}
+
+		if err := group.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+		if active := len(mock.GetActiveMappings()); active != 0 {
+			t.Errorf("Expected all mappings removed after Close, got %d", active)
+		}
+		if err := group.Close(); err != nil {
+			t.Errorf("Second Close should be a no-op, got %v", err)
+		}
+	})
+
+	t.Run("Rolls back on partial failure", func(t *testing.T) {
+		mock := NewMockPortMapper()
+		useMockPortMapper(t, mock)
+		ports := freePorts(t, 3)
+
+		// Occupy the last port so binding it fails after the others succeeded
+		busy, err := net.ListenPacket("udp", ":"+strconv.Itoa(ports[2]))
+		if err != nil {
+			t.Fatalf("Failed to occupy port: %v", err)
+		}
+		defer busy.Close()
+
+		group, err := ListenPacketMulti(context.Background(), ports)
+		if err == nil {
+			group.Close()
+			t.Fatal("Expected ListenPacketMulti to fail when a port is in use")
+		}
+		if active := len(mock.GetActiveMappings()); active != 0 {
+			t.Errorf("Expected no mappings left after rollback, got %d", active)
+		}
+
+		// The ports that were bound before the failure are released again
+		for _, port := range ports[:2] {
+			conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
+			if err != nil {
+				t.Errorf("Expected port %d to be released after rollback: %v", port, err)
+				continue
+			}
+			conn.Close()
+		}
+	})
+
+	t.Run("Rejects invalid port sets", func(t *testing.T) {
+		useMockPortMapper(t, NewMockPortMapper())
+		for _, ports := range [][]int{nil, {0}, {70000}, {5000, 5000}} {
+			if _, err := ListenPacketMulti(context.Background(), ports); err == nil {
+				t.Errorf("Expected error for ports %v", ports)
+			}
+		}
+		if _, err := ListenPacketRange(context.Background(), 6000, 5999); err == nil {
+			t.Error("Expected error for reversed port range")
+		}
+	})
+}
+
+// TestListenRange tests mapping a contiguous block of TCP ports
+func TestListenRange(t *testing.T) {
+	mock := NewMockPortMapper()
+	useMockPortMapper(t, mock)
+
+	scheduler := NewRenewalScheduler(2)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	// Find a contiguous block of free ports
+	var first int
+	for attempt := 0; attempt < 20 && first == 0; attempt++ {
+		base := freePorts(t, 1)[0]
+		if base+2 > 65535 {
+			continue
+		}
+		first = base
+		for port := base + 1; port <= base+2; port++ {
+			l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+			if err != nil {
+				first = 0
+				break
+			}
+			l.Close()
+		}
+	}
+	if first == 0 {
+		t.Skip("No contiguous block of free ports found")
+	}
+
+	lc := &ListenConfig{Scheduler: scheduler}
+	group, err := lc.ListenRange(context.Background(), first, first+2)
+	if err != nil {
+		t.Fatalf("ListenRange failed: %v", err)
+	}
+	defer group.Close()
+
+	if status := scheduler.Status(); status.Mappings != 3 {
+		t.Errorf("Expected 3 mappings on the shared scheduler, got %d", status.Mappings)
+	}
+	for i, listener := range group.Listeners() {
+		if listener.ExternalPort() == 0 {
+			t.Errorf("Expected external port for listener %d", i)
+		}
+	}
+
+	group.Close()
+	if status := scheduler.Status(); status.Mappings != 0 {
+		t.Errorf("Expected mappings removed from the shared scheduler, got %d", status.Mappings)
+	}
+}
@@ -1,6 +1,8 @@
 package nattraversal
 
-import "github.com/go-i2p/logger"
+import (
+	"net"
+)
 
 // NATAddr represents a network address with NAT traversal information.
 // Moved from: addr.go
@@ -8,11 +10,12 @@ type NATAddr struct {
 	network      string
 	internalAddr string
 	externalAddr string
+	hairpin      HairpinStatus
 }
 
 // NewNATAddr creates a new NATAddr with internal and external addresses.
 func NewNATAddr(network, internalAddr, externalAddr string) *NATAddr {
-	log.WithFields(logger.Fields{
+	log.WithFields(Fields{
 		"network":      network,
 		"internalAddr": internalAddr,
 		"externalAddr": externalAddr,
@@ -43,3 +46,71 @@ func (a *NATAddr) InternalAddr() string {
 func (a *NATAddr) ExternalAddr() string {
 	return a.externalAddr
 }
+
+// Hairpin reports whether hosts on the LAN can reach the external address.
+func (a *NATAddr) Hairpin() HairpinStatus {
+	return a.hairpin
+}
+
+// AddressFor returns the address a peer at remote should use to connect.
+// Peers on the same LAN or behind the same NAT get the internal address,
+// with the unspecified IP of a listener bound to all interfaces replaced
+// by the address on the peer's network, unless the gateway is known to
+// support hairpinning. All other peers get the external address.
+func (a *NATAddr) AddressFor(remote net.Addr) string {
+	if a.hairpin == HairpinSupported || a.internalAddr == a.externalAddr {
+		return a.externalAddr
+	}
+	host, port, err := net.SplitHostPort(a.internalAddr)
+	if err != nil {
+		return a.externalAddr
+	}
+	ip := lanAddrFor(addrIP(remote), net.ParseIP(host), hostIP(a.externalAddr))
+	if ip == nil {
+		return a.externalAddr
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+// withExternalAddr returns a copy of a with a new external address. Hairpin
+// support is kept only if the external IP is unchanged, since a new IP
+// usually means a new gateway.
+func (a *NATAddr) withExternalAddr(externalAddr string) *NATAddr {
+	addr := NewNATAddr(a.network, a.internalAddr, externalAddr)
+	if hostIP(externalAddr).Equal(hostIP(a.externalAddr)) {
+		addr.hairpin = a.hairpin
+	}
+	return addr
+}
+
+// withHairpin returns a copy of a with the given hairpin support.
+func (a *NATAddr) withHairpin(status HairpinStatus) *NATAddr {
+	addr := *a
+	addr.hairpin = status
+	return &addr
+}
+
+// hostIP returns the IP of a host:port address, or nil.
+func hostIP(hostport string) net.IP {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// addrIP returns the IP of a network address, or nil.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *NATAddr:
+		return hostIP(a.externalAddr)
+	case nil:
+		return nil
+	default:
+		return hostIP(addr.String())
+	}
+}
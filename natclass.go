@@ -0,0 +1,190 @@
+package nattraversal
+
+import (
+	"fmt"
+	"net"
+)
+
+// IPClass classifies an IP address by how it is routed on the internet.
+type IPClass int
+
+const (
+	// IPClassUnknown means the address is missing or could not be parsed.
+	IPClassUnknown IPClass = iota
+	// IPClassPublic means the address is globally routable.
+	IPClassPublic
+	// IPClassPrivate means the address is private, loopback or link-local,
+	// for example an RFC 1918 address assigned by an upstream router.
+	IPClassPrivate
+	// IPClassCGNAT means the address is in the carrier-grade NAT shared
+	// address space 100.64.0.0/10 (RFC 6598).
+	IPClassCGNAT
+)
+
+// String returns a human-readable name for the address class.
+func (c IPClass) String() string {
+	switch c {
+	case IPClassUnknown:
+		return "unknown"
+	case IPClassPublic:
+		return "public"
+	case IPClassPrivate:
+		return "private"
+	case IPClassCGNAT:
+		return "cgnat"
+	default:
+		return fmt.Sprintf("IPClass(%d)", int(c))
+	}
+}
+
+// ClassifyIP returns the class of ip.
+func ClassifyIP(ip net.IP) IPClass {
+	if ip == nil || ip.IsUnspecified() {
+		return IPClassUnknown
+	}
+	if isGloballyRoutableIP(ip) {
+		return IPClassPublic
+	}
+	if ip4 := ip.To4(); ip4 != nil && cgnatIPv4Net.Contains(ip4) {
+		return IPClassCGNAT
+	}
+	return IPClassPrivate
+}
+
+// classifyIPString parses s and returns its class.
+func classifyIPString(s string) IPClass {
+	return ClassifyIP(net.ParseIP(s))
+}
+
+// NATTopology describes the NAT layers between the host and the internet,
+// as inferred from the external address reported by the port mapper.
+type NATTopology int
+
+const (
+	// TopologyUnknown means no port mapper is in use or its external address
+	// could not be classified.
+	TopologyUnknown NATTopology = iota
+	// TopologyDirect means the host has a public address and no NAT.
+	TopologyDirect
+	// TopologySingleNAT means the gateway reports a public external address.
+	TopologySingleNAT
+	// TopologyDoubleNAT means the gateway reports a private external address,
+	// so another router sits between it and the internet.
+	TopologyDoubleNAT
+	// TopologyCGNAT means the gateway reports a carrier-grade NAT address, so
+	// the ISP translates addresses before traffic reaches the internet.
+	TopologyCGNAT
+)
+
+// String returns a human-readable name for the topology.
+func (t NATTopology) String() string {
+	switch t {
+	case TopologyUnknown:
+		return "unknown"
+	case TopologyDirect:
+		return "direct"
+	case TopologySingleNAT:
+		return "single-nat"
+	case TopologyDoubleNAT:
+		return "double-nat"
+	case TopologyCGNAT:
+		return "cgnat"
+	default:
+		return fmt.Sprintf("NATTopology(%d)", int(t))
+	}
+}
+
+// NATStatus describes the NAT topology of a listener's port mapping.
+type NATStatus struct {
+	Topology NATTopology
+	// ExternalIP is the external address advertised by the listener.
+	ExternalIP      string
+	ExternalIPClass IPClass
+	// Cascaded is true if the port is also mapped on the upstream gateway of
+	// a double NAT, see ListenConfig.CascadeMapping. InnerExternalIP is then
+	// the external address of the local gateway.
+	Cascaded        bool
+	InnerExternalIP string
+}
+
+// Reachable reports whether the advertised external address is public, so
+// that peers on the internet can connect to it.
+func (s NATStatus) Reachable() bool {
+	return s.ExternalIPClass == IPClassPublic
+}
+
+// Advice returns a description of what prevents inbound connections and how
+// to fix it, or an empty string if the topology allows them.
+func (s NATStatus) Advice() string {
+	switch s.Topology {
+	case TopologyDoubleNAT:
+		if s.Cascaded {
+			return ""
+		}
+		return fmt.Sprintf("the gateway's external address %s is private, so another router performs NAT upstream: "+
+			"put the upstream modem in bridge mode, forward the port on the upstream router, or enable ListenConfig.CascadeMapping", s.ExternalIP)
+	case TopologyCGNAT:
+		return fmt.Sprintf("the external address %s is in the carrier-grade NAT range 100.64.0.0/10: "+
+			"inbound connections require a public IPv4 address from the ISP, IPv6, or a relay", s.ExternalIP)
+	case TopologyUnknown:
+		if s.ExternalIP == "" {
+			return "no port mapping is in use, inbound connections only work if the host is directly reachable"
+		}
+		return fmt.Sprintf("the external address %q could not be classified", s.ExternalIP)
+	default:
+		return ""
+	}
+}
+
+// ClassifyNAT infers the NAT topology from the mapper in use and the
+// external IP it reported, as listeners do for NATStatus. It performs no
+// network I/O.
+func ClassifyNAT(mapper PortMapper, externalIP string) NATStatus {
+	status := NATStatus{
+		ExternalIP:      externalIP,
+		ExternalIPClass: classifyIPString(externalIP),
+	}
+
+	if cascaded, ok := mapper.(*CascadedMapper); ok {
+		status.Cascaded = true
+		status.InnerExternalIP = cascaded.innerExternalIP
+	}
+
+	switch status.ExternalIPClass {
+	case IPClassPublic:
+		switch {
+		case status.Cascaded:
+			status.Topology = TopologyDoubleNAT
+		case isDirectMapper(mapper):
+			status.Topology = TopologyDirect
+		default:
+			status.Topology = TopologySingleNAT
+		}
+	case IPClassPrivate:
+		status.Topology = TopologyDoubleNAT
+	case IPClassCGNAT:
+		status.Topology = TopologyCGNAT
+	}
+	return status
+}
+
+// isDirectMapper reports whether mapper maps ports without a gateway.
+func isDirectMapper(mapper PortMapper) bool {
+	_, ok := mapper.(*DirectPortMapper)
+	return ok
+}
+
+// logNATStatus warns if the NAT topology of a new mapping prevents inbound
+// connections, with advice on how to fix it.
+func logNATStatus(log logEntry, status NATStatus, protocol string) {
+	advice := status.Advice()
+	if advice == "" {
+		return
+	}
+	log.WithFields(Fields{
+		"protocol":   protocol,
+		"topology":   status.Topology.String(),
+		"externalIP": status.ExternalIP,
+		"advice":     advice,
+	}).Warn("mapped address is not reachable from the internet")
+}
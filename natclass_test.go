@@ -0,0 +1,290 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestClassifyIP tests external address classification
+func TestClassifyIP(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected IPClass
+	}{
+		{"203.0.113.100", IPClassPublic},
+		{"8.8.8.8", IPClassPublic},
+		{"192.168.0.2", IPClassPrivate},
+		{"10.1.2.3", IPClassPrivate},
+		{"172.16.5.4", IPClassPrivate},
+		{"169.254.1.1", IPClassPrivate},
+		{"100.64.0.1", IPClassCGNAT},
+		{"100.127.255.254", IPClassCGNAT},
+		{"100.128.0.1", IPClassPublic},
+		{"0.0.0.0", IPClassUnknown},
+		{"", IPClassUnknown},
+	}
+
+	for _, tt := range tests {
+		if got := classifyIPString(tt.ip); got != tt.expected {
+			t.Errorf("classifyIPString(%q) = %v, expected %v", tt.ip, got, tt.expected)
+		}
+	}
+}
+
+// TestNATStatusFor tests topology detection from the mapper's external IP
+func TestNATStatusFor(t *testing.T) {
+	mapper := NewMockPortMapper()
+
+	tests := []struct {
+		name       string
+		mapper     PortMapper
+		externalIP string
+		topology   NATTopology
+		reachable  bool
+		advice     bool
+	}{
+		{"Public gateway", mapper, "203.0.113.100", TopologySingleNAT, true, false},
+		{"Private gateway", mapper, "192.168.0.2", TopologyDoubleNAT, false, true},
+		{"Carrier-grade NAT", mapper, "100.64.12.34", TopologyCGNAT, false, true},
+		{"Direct", &DirectPortMapper{publicIP: "198.51.100.1"}, "198.51.100.1", TopologyDirect, true, false},
+		{"Unparseable", mapper, "not-an-ip", TopologyUnknown, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := ClassifyNAT(tt.mapper, tt.externalIP)
+			if status.Topology != tt.topology {
+				t.Errorf("Expected topology %v, got %v", tt.topology, status.Topology)
+			}
+			if status.Reachable() != tt.reachable {
+				t.Errorf("Expected Reachable() %v, got %v", tt.reachable, status.Reachable())
+			}
+			if (status.Advice() != "") != tt.advice {
+				t.Errorf("Unexpected advice %q", status.Advice())
+			}
+		})
+	}
+}
+
+// TestCascadedMapper tests mapping through a double NAT
+func TestCascadedMapper(t *testing.T) {
+	inner := NewMockPortMapper()
+	inner.SetExternalIP("192.168.0.2")
+	upstream := NewMockPortMapper()
+	upstream.SetExternalIP("203.0.113.7")
+
+	cascaded := NewCascadedMapper(inner, upstream)
+	port, err := cascaded.MapPort("TCP", 8080, mappingDuration)
+	if err != nil {
+		t.Fatalf("MapPort failed: %v", err)
+	}
+
+	innerMappings := inner.GetActiveMappings()
+	if len(innerMappings) != 1 {
+		t.Fatalf("Expected one mapping on the local gateway, got %d", len(innerMappings))
+	}
+	var innerPort int
+	for _, m := range innerMappings {
+		innerPort = m.ExternalPort
+	}
+	if len(upstream.GetActiveMappings()) != 1 {
+		t.Fatalf("Expected one mapping on the upstream gateway, got %d", len(upstream.GetActiveMappings()))
+	}
+	for _, m := range upstream.GetActiveMappings() {
+		if m.InternalPort != innerPort {
+			t.Errorf("Expected upstream mapping to forward to local gateway port %d, got %d", innerPort, m.InternalPort)
+		}
+		if m.ExternalPort != port {
+			t.Errorf("Expected reported port %d to be the upstream port, got %d", port, m.ExternalPort)
+		}
+	}
+
+	status := ClassifyNAT(cascaded, "203.0.113.7")
+	if status.Topology != TopologyDoubleNAT || !status.Cascaded || status.InnerExternalIP != "192.168.0.2" {
+		t.Errorf("Unexpected status for cascaded mapping: %+v", status)
+	}
+	if status.Advice() != "" {
+		t.Errorf("Expected no advice for cascaded mapping, got %q", status.Advice())
+	}
+
+	if err := cascaded.UnmapPort("TCP", port); err != nil {
+		t.Errorf("UnmapPort failed: %v", err)
+	}
+	if len(inner.GetActiveMappings()) != 0 || len(upstream.GetActiveMappings()) != 0 {
+		t.Error("Expected mappings removed from both gateways")
+	}
+
+	t.Run("Upstream failure removes local mapping", func(t *testing.T) {
+		failing := NewMockPortMapper()
+		failing.SetFailureRate(1.0)
+		if _, err := NewCascadedMapper(inner, failing).MapPort("TCP", 8081, mappingDuration); err == nil {
+			t.Fatal("Expected error when upstream mapping fails")
+		}
+		if len(inner.GetActiveMappings()) != 0 {
+			t.Error("Expected local mapping removed after upstream failure")
+		}
+	})
+
+	t.Run("Local mapping is removed after cancellation", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelling := &cancelingMapper{MockPortMapper: NewMockPortMapper(), cancel: cancel}
+		if _, err := NewCascadedMapper(inner, cancelling).MapPortContext(ctx, "TCP", 8082, mappingDuration); err == nil {
+			t.Fatal("Expected error when ctx is cancelled during the upstream mapping")
+		}
+		if len(inner.GetActiveMappings()) != 0 {
+			t.Error("Expected local mapping removed although ctx was cancelled")
+		}
+	})
+}
+
+// cancelingMapper cancels a context and fails while mapping, as a caller
+// giving up during the request would.
+type cancelingMapper struct {
+	*MockPortMapper
+	cancel context.CancelFunc
+}
+
+func (m *cancelingMapper) MapPort(_ string, _ int, _ time.Duration) (int, error) {
+	m.cancel()
+	return 0, errors.New("request abandoned")
+}
+
+// ipCountingMapper counts queries of its external IP.
+type ipCountingMapper struct {
+	*MockPortMapper
+	calls atomic.Int32
+}
+
+func (m *ipCountingMapper) GetExternalIP() (string, error) {
+	m.calls.Add(1)
+	return m.MockPortMapper.GetExternalIP()
+}
+
+// TestCascadeIfDoubleNAT tests that detecting a double NAT honours ctx and
+// queries the local gateway's external IP once
+func TestCascadeIfDoubleNAT(t *testing.T) {
+	inner := &ipCountingMapper{MockPortMapper: NewMockPortMapper()}
+	inner.SetExternalIP("192.168.0.2")
+	upstream := NewMockPortMapper()
+	discover := func(ctx context.Context, innerExternalIP net.IP) (PortMapper, error) {
+		return upstream, nil
+	}
+
+	cascaded, ok := cascadeIfDoubleNAT(context.Background(), inner, discover).(*CascadedMapper)
+	if !ok {
+		t.Fatal("Expected a cascaded mapper behind a double NAT")
+	}
+	if cascaded.innerExternalIP != "192.168.0.2" {
+		t.Errorf("Expected inner external IP 192.168.0.2, got %q", cascaded.innerExternalIP)
+	}
+	if calls := inner.calls.Load(); calls != 1 {
+		t.Errorf("Expected one external IP query, got %d", calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if mapper := cascadeIfDoubleNAT(ctx, inner, discover); mapper != inner {
+		t.Errorf("Expected the local mapper unchanged after cancellation, got %T", mapper)
+	}
+}
+
+// TestUpstreamGatewayCandidates tests the order of upstream gateway guesses
+func TestUpstreamGatewayCandidates(t *testing.T) {
+	innerExternalIP := net.IPv4(192, 168, 0, 2)
+	tests := []struct {
+		name string
+		hop  net.IP
+		err  error
+		want []string
+	}{
+		{"Default route of the local gateway first", net.IPv4(192, 168, 0, 254), nil, []string{"192.168.0.254", "192.168.0.1"}},
+		{"Trace failure falls back to .1", nil, errors.New("no reply"), []string{"192.168.0.1"}},
+		{"Public hop is ignored", net.IPv4(203, 0, 113, 1), nil, []string{"192.168.0.1"}},
+		{"Duplicate guess is probed once", net.IPv4(192, 168, 0, 1), nil, []string{"192.168.0.1"}},
+	}
+	original := upstreamHop
+	defer func() { upstreamHop = original }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamHop = func(ctx context.Context, dst net.IP, ttl int) (net.IP, error) {
+				if ttl != 2 {
+					t.Errorf("Expected trace to hop 2, got %d", ttl)
+				}
+				return tt.hop, tt.err
+			}
+			got := upstreamGatewayCandidates(context.Background(), innerExternalIP)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected candidates %v, got %v", tt.want, got)
+			}
+			for i, want := range tt.want {
+				if !got[i].Equal(net.ParseIP(want)) {
+					t.Errorf("Expected candidate %d to be %s, got %s", i, want, got[i])
+				}
+			}
+		})
+	}
+}
+
+// TestListenConfigCascadeMapping tests upstream mapping behind a double NAT
+func TestListenConfigCascadeMapping(t *testing.T) {
+	inner := NewMockPortMapper()
+	inner.SetExternalIP("192.168.0.2")
+	useMockPortMapper(t, inner)
+
+	upstream := NewMockPortMapper()
+	upstream.SetExternalIP("203.0.113.7")
+	var probed net.IP
+	lc := &ListenConfig{
+		CascadeMapping: true,
+		UpstreamDiscovery: func(ctx context.Context, innerExternalIP net.IP) (PortMapper, error) {
+			probed = innerExternalIP
+			return upstream, nil
+		},
+	}
+
+	port := freePorts(t, 1)[0]
+	listener, err := lc.ListenPacket(context.Background(), port)
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer listener.Close()
+
+	if !probed.Equal(net.IPv4(192, 168, 0, 2)) {
+		t.Errorf("Expected upstream discovery for 192.168.0.2, got %v", probed)
+	}
+	status := listener.NATStatus()
+	if !status.Cascaded || !status.Reachable() {
+		t.Errorf("Expected reachable cascaded status, got %+v", status)
+	}
+	if !strings.HasPrefix(listener.Addr().(*NATAddr).ExternalAddr(), "203.0.113.7:") {
+		t.Errorf("Expected upstream external address, got %s", listener.Addr().(*NATAddr).ExternalAddr())
+	}
+
+	t.Run("Falls back to local gateway without upstream", func(t *testing.T) {
+		lc := &ListenConfig{
+			CascadeMapping: true,
+			UpstreamDiscovery: func(ctx context.Context, innerExternalIP net.IP) (PortMapper, error) {
+				return nil, errors.New("no upstream gateway")
+			},
+		}
+		listener, err := lc.ListenPacket(context.Background(), freePorts(t, 1)[0])
+		if err != nil {
+			t.Fatalf("ListenPacket failed: %v", err)
+		}
+		defer listener.Close()
+
+		status := listener.NATStatus()
+		if status.Topology != TopologyDoubleNAT || status.Cascaded {
+			t.Errorf("Expected uncascaded double NAT, got %+v", status)
+		}
+		if status.Advice() == "" {
+			t.Error("Expected advice for double NAT")
+		}
+	})
+}
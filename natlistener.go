@@ -1,11 +1,12 @@
 package nattraversal
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
-
-	"github.com/go-i2p/logger"
+	"time"
 )
 
 // NATListener implements net.Listener with automatic NAT traversal.
@@ -13,82 +14,355 @@ import (
 type NATListener struct {
 	listener     net.Listener
 	renewal      *RenewalManager
+	monitor      *NetworkMonitor // nil if network change monitoring is unavailable
+	localIP      net.IP          // address the listener is bound to, nil for all interfaces
+	discover     mapperDiscovery // rediscovers the port mapper after a network change
+	prober       ReachabilityProber
+	probes       probeFilter // recognises reachability probe connections
+	verification VerificationResult
+	reach        reachabilityFeed
+	log          logEntry // logs to the Logger of the ListenConfig
 	externalPort int
 	externalIP   string
+	ipHistory    ipHistory
+	created      time.Time
 	addr         *NATAddr
 	closed       bool
 	fallback     bool // true if NAT traversal failed and we're using a standard listener
 	mu           sync.Mutex
+	// accepted delivers connections from the accept loop, started by the
+	// first Accept or VerifyReachability call; acceptStop is closed by Close
+	// to end it.
+	accepted   chan acceptResult
+	acceptStop chan struct{}
+	serving    connTracker // connections being served by Serve
+	conns      *connTable  // nil unless ListenConfig.Connections is set
+}
+
+// acceptResult is the outcome of an Accept call on the underlying listener.
+type acceptResult struct {
+	conn net.Conn
+	err  error
 }
 
 // updateExternalPort handles external port changes during renewal.
 // It updates the externalPort field and recreates the NATAddr with the new port.
 func (l *NATListener) updateExternalPort(newPort int) {
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	externalIP := l.externalIP
+	l.mu.Unlock()
+	l.updateExternalAddr(externalIP, newPort)
+}
+
+// updateExternalAddr updates the external IP and port and recreates the NATAddr.
+func (l *NATListener) updateExternalAddr(externalIP string, newPort int) {
+	defer l.notifyReachability()
+	l.mu.Lock()
 
-	oldPort := l.externalPort
+	oldIP, oldPort := l.externalIP, l.externalPort
+	renewal := l.renewal
+	l.externalIP = externalIP
 	l.externalPort = newPort
-	// Recreate NATAddr with the new external port
-	newExternalAddr := fmt.Sprintf("%s:%d", l.externalIP, newPort)
-	l.addr = NewNATAddr(l.addr.Network(), l.addr.InternalAddr(), newExternalAddr)
-	log.WithFields(logger.Fields{
+	l.ipHistory.record(externalIP, time.Now())
+	// Recreate NATAddr with the new external address
+	newExternalAddr := fmt.Sprintf("%s:%d", externalIP, newPort)
+	l.addr = l.addr.withExternalAddr(newExternalAddr)
+	// The last verification checked the old address
+	if oldIP != externalIP || oldPort != newPort {
+		l.verification = VerificationResult{}
+	}
+
+	l.log.WithFields(Fields{
+		"oldIP":   oldIP,
+		"newIP":   externalIP,
 		"oldPort": oldPort,
 		"newPort": newPort,
-	}).Debug("TCP listener external port updated")
+	}).Debug("TCP listener external address updated")
+	l.mu.Unlock()
+
+	if oldIP != externalIP && renewal != nil {
+		emit(Event{
+			Kind:          ExternalIPChanged,
+			Mapper:        MapperName(renewal.currentMapper()),
+			Protocol:      "TCP",
+			InternalPort:  renewal.internalPort,
+			ExternalPort:  newPort,
+			ExternalIP:    externalIP,
+			OldExternalIP: oldIP,
+		})
+	}
 }
 
-// Accept waits for and returns the next connection to the listener.
-func (l *NATListener) Accept() (net.Conn, error) {
+// handleNetworkChange re-establishes the port mapping after the default gateway
+// or local address changed, and updates the external address accordingly.
+func (l *NATListener) handleNetworkChange(_, _ NetworkState) {
 	l.mu.Lock()
 	closed := l.closed
+	renewal := l.renewal
+	localIP := l.localIP
+	discover := l.discover
 	l.mu.Unlock()
 
-	if closed {
-		return nil, fmt.Errorf("listener closed")
+	if closed || renewal == nil {
+		return
 	}
 
-	conn, err := l.listener.Accept()
+	externalIP, externalPort, err := remapAfterNetworkChange(renewal, discover, localIP)
 	if err != nil {
-		log.WithError(err).Debug("TCP listener accept error")
-		return nil, err
+		l.log.WithError(err).WithField("protocol", "TCP").Warn("failed to re-map port after network change")
+		return
+	}
+	l.updateExternalAddr(externalIP, externalPort)
+}
+
+// remapTo re-establishes the port mapping through a mapper discovered after a
+// network change, and updates the external address accordingly.
+func (l *NATListener) remapTo(ctx context.Context, mapper PortMapper) error {
+	l.mu.Lock()
+	closed := l.closed
+	renewal := l.renewal
+	l.mu.Unlock()
+
+	if closed || renewal == nil {
+		return nil
+	}
+
+	externalIP, externalPort, err := remapWithMapper(ctx, renewal, mapper)
+	if err != nil {
+		return err
+	}
+	l.updateExternalAddr(externalIP, externalPort)
+	return nil
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *NATListener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext waits for and returns the next connection to the listener,
+// or returns ctx.Err() when ctx is done. Unlike closing the listener,
+// cancellation leaves it open for further calls.
+func (l *NATListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, fmt.Errorf("listener closed")
+	}
+	accepted, stop := l.startAcceptLoop()
+	l.mu.Unlock()
+
+	for {
+		// Wait for a slot under MaxConns before taking a connection
+		if l.conns != nil {
+			if err := l.conns.acquire(ctx, stop); err != nil {
+				return nil, err
+			}
+		}
+
+		var result acceptResult
+		select {
+		case <-ctx.Done():
+			l.releaseConnSlot()
+			return nil, ctx.Err()
+		case <-stop:
+			l.releaseConnSlot()
+			return nil, fmt.Errorf("listener closed")
+		case result = <-accepted:
+		}
+
+		if result.err != nil {
+			l.releaseConnSlot()
+			l.log.WithError(result.err).Debug("TCP listener accept error")
+			return nil, result.err
+		}
+		conn := result.conn
+
+		var tracked net.Conn = conn
+		if l.conns != nil {
+			tc := l.conns.track(conn)
+			if tc == nil {
+				l.log.WithFields(Fields{
+					"remoteAddr":    conn.RemoteAddr().String(),
+					"maxConnsPerIP": l.conns.limits.MaxConnsPerIP,
+				}).Debug("per-IP connection limit reached, rejecting TCP connection")
+				conn.Close()
+				l.conns.release()
+				continue
+			}
+			tracked = tc
+		}
+
+		l.mu.Lock()
+		addr := l.addr
+		l.mu.Unlock()
+
+		l.log.WithFields(Fields{
+			"remoteAddr": conn.RemoteAddr().String(),
+			"localAddr":  addr.String(),
+		}).Debug("accepted new TCP connection")
+		if currentSink() != nil {
+			addCounter(MetricAcceptedConnections, Labels{"port": portLabel(l.listener.Addr())}, 1)
+		}
+
+		return &NATConn{
+			Conn:       tracked,
+			localAddr:  addr,
+			remoteAddr: conn.RemoteAddr(),
+		}, nil
+	}
+}
+
+// releaseConnSlot frees the slot taken for a connection that was not
+// accepted.
+func (l *NATListener) releaseConnSlot() {
+	if l.conns != nil {
+		l.conns.release()
+	}
+}
+
+// Connections describes the open connections accepted by the listener,
+// oldest first. It returns nil if the ListenConfig did not enable connection
+// tracking.
+func (l *NATListener) Connections() []ConnInfo {
+	if l.conns == nil {
+		return nil
+	}
+	return l.conns.snapshot()
+}
+
+// ConnStats counts the connections accepted by the listener. It returns the
+// zero value if the ListenConfig did not enable connection tracking.
+func (l *NATListener) ConnStats() ConnStats {
+	if l.conns == nil {
+		return ConnStats{}
+	}
+	return l.conns.stats()
+}
+
+// startAcceptLoop starts the accept loop unless it is running, and returns
+// its channels. The caller must hold l.mu.
+func (l *NATListener) startAcceptLoop() (chan acceptResult, chan struct{}) {
+	if l.accepted == nil {
+		l.accepted = make(chan acceptResult)
+		l.acceptStop = make(chan struct{})
+		go l.acceptLoop(l.accepted, l.acceptStop)
 	}
+	return l.accepted, l.acceptStop
+}
 
-	log.WithFields(logger.Fields{
-		"remoteAddr": conn.RemoteAddr().String(),
-		"localAddr":  l.addr.String(),
-	}).Debug("accepted new TCP connection")
+// acceptLoop accepts connections on the underlying listener and hands each
+// one to an AcceptContext caller, so that callers can give up waiting
+// without losing a connection. While reachability probes are in flight,
+// connections are checked for a probe payload first. It returns once the
+// listener is closed.
+func (l *NATListener) acceptLoop(accepted chan<- acceptResult, stop <-chan struct{}) {
+	for {
+		conn, err := l.listener.Accept()
+		if err == nil && l.probes.active() {
+			go l.deliverUnlessProbe(conn, accepted, stop)
+			continue
+		}
+		select {
+		case accepted <- acceptResult{conn: conn, err: err}:
+		case <-stop:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
 
-	return &NATConn{
-		Conn:       conn,
-		localAddr:  l.addr,
-		remoteAddr: conn.RemoteAddr(),
-	}, nil
+// deliverUnlessProbe closes conn if it is a reachability probe, and hands
+// it to an AcceptContext caller otherwise.
+func (l *NATListener) deliverUnlessProbe(conn net.Conn, accepted chan<- acceptResult, stop <-chan struct{}) {
+	peeked, probe := l.probes.peekTCP(conn)
+	if probe {
+		conn.Close()
+		return
+	}
+	select {
+	case accepted <- acceptResult{conn: peeked}:
+	case <-stop:
+		conn.Close()
+	}
 }
 
-// Close closes the listener and stops port renewal.
+// Close closes the listener and stops port renewal. Close gives up removing
+// the port mapping if the gateway does not respond within a few seconds.
+// Use Shutdown to wait for the connections being served and to choose the
+// deadline.
 func (l *NATListener) Close() error {
+	renewal, err := l.closeListener()
+	if renewal != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), closeUnmapTimeout)
+		defer cancel()
+		renewal.StopContext(ctx) // failures are logged and reported as an Unmapped event
+	}
+	return err
+}
+
+// Shutdown gracefully closes the listener: it stops accepting connections,
+// waits for the connections being served by Serve to return and, if
+// connections are tracked, for every accepted connection to be closed, then
+// removes the port mapping. When ctx is done Shutdown stops waiting: connections
+// still being served are left to the drain timeout of Serve, and the removal
+// of the mapping is given up, so that the process can exit.
+// It returns the errors of closing the listener, waiting and unmapping.
+func (l *NATListener) Shutdown(ctx context.Context) error {
+	renewal, closeErr := l.closeListener()
+
+	var waitErr, unmapErr error
+	err := l.serving.wait(ctx)
+	if err == nil && l.conns != nil {
+		err = l.conns.open.wait(ctx)
+	}
+	if err != nil {
+		waitErr = fmt.Errorf("waiting for connections: %w", err)
+	}
+	if renewal != nil {
+		if err := renewal.StopContext(ctx); err != nil {
+			unmapErr = fmt.Errorf("failed to unmap port: %w", err)
+		}
+	}
+	return errors.Join(closeErr, waitErr, unmapErr)
+}
+
+// closeListener stops accepting connections and monitoring the network, and
+// returns the renewal manager to stop, nil if there is none or the listener
+// was already closed. The mapping is not removed under l.mu, since the
+// gateway may take long to respond.
+func (l *NATListener) closeListener() (*RenewalManager, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	if l.closed {
-		return nil
+		return nil, nil
 	}
 	l.closed = true
 
-	log.WithFields(logger.Fields{
+	l.log.WithFields(Fields{
 		"addr":     l.addr.String(),
 		"fallback": l.fallback,
 	}).Debug("closing TCP listener")
 
-	if l.renewal != nil {
-		l.renewal.Stop()
+	liveListeners.removeTCP(l)
+	if l.monitor != nil {
+		l.monitor.Stop()
+	}
+	l.reach.close()
+	if l.acceptStop != nil {
+		close(l.acceptStop)
 	}
 	err := l.listener.Close()
 	if err != nil {
-		log.WithError(err).Error("error closing TCP listener")
+		l.log.WithError(err).Error("error closing TCP listener")
 	}
-	return err
+	return l.renewal, err
 }
 
 // Addr returns the listener's network address.
@@ -114,3 +388,117 @@ func (l *NATListener) IsFallback() bool {
 	defer l.mu.Unlock()
 	return l.fallback
 }
+
+// NATStatus reports the NAT topology of the listener's port mapping, inferred
+// from the external IP reported by the gateway. In fallback mode the topology
+// is TopologyUnknown.
+func (l *NATListener) NATStatus() NATStatus {
+	l.mu.Lock()
+	renewal := l.renewal
+	externalIP := l.externalIP
+	l.mu.Unlock()
+
+	if renewal == nil {
+		return NATStatus{}
+	}
+	return ClassifyNAT(renewal.currentMapper(), externalIP)
+}
+
+// VerifyReachability checks that the external address accepts connections,
+// first by connecting to it through the gateway's hairpin, then through the
+// ListenConfig.Prober if one was configured, and records the result (see
+// Verification). Probe connections are recognised by the payload they carry
+// and are not returned by Accept, except those of a prober that does not
+// implement TCPPayloadProber.
+// An error is returned only if there is no external address to verify.
+func (l *NATListener) VerifyReachability(ctx context.Context) (VerificationResult, error) {
+	l.mu.Lock()
+	closed, fallback := l.closed, l.fallback
+	externalAddr := l.addr.ExternalAddr()
+	prober := l.prober
+	if !closed && !fallback {
+		// Probe connections are recognised by the accept loop
+		l.startAcceptLoop()
+	}
+	l.mu.Unlock()
+
+	if closed {
+		return VerificationResult{}, fmt.Errorf("listener closed")
+	}
+	if fallback {
+		return VerificationResult{}, fmt.Errorf("no external address to verify in fallback mode")
+	}
+
+	result := verifyTCP(ctx, externalAddr, &l.probes, prober)
+
+	// A result for an address replaced meanwhile is not recorded
+	l.mu.Lock()
+	if l.addr.ExternalAddr() == externalAddr {
+		l.verification = result
+		l.addr = l.addr.withHairpin(hairpinStatusFrom(result.Hairpin))
+	}
+	l.mu.Unlock()
+	l.notifyReachability()
+	return result, nil
+}
+
+// Verification returns the result of the last VerifyReachability call.
+// Its Status is VerificationUnknown if reachability was never verified or
+// the external address changed since.
+func (l *NATListener) Verification() VerificationResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.verification
+}
+
+// Hairpin reports whether hosts on the LAN can reach the listener through its
+// external address, as detected at listen time (see ListenConfig.DetectHairpin)
+// or by the last VerifyReachability call.
+func (l *NATListener) Hairpin() HairpinStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.addr.Hairpin()
+}
+
+// Reachability reports whether peers on the internet can reach the listener,
+// combining the mapper in use, the class of the external IP, the health of
+// the mapping and the last VerifyReachability result.
+func (l *NATListener) Reachability() Reachability {
+	l.mu.Lock()
+	renewal := l.renewal
+	addr := l.addr
+	externalIP := l.externalIP
+	verification := l.verification
+	l.mu.Unlock()
+	return newReachability(renewal, addr, externalIP, verification)
+}
+
+// info describes the listener for Listeners.
+func (l *NATListener) info() ListenerInfo {
+	reach := l.Reachability()
+	l.mu.Lock()
+	addr, fallback, created, renewal := l.addr, l.fallback, l.created, l.renewal
+	history := l.ipHistory.snapshot()
+	l.mu.Unlock()
+	info := newListenerInfo("tcp", addr, fallback, created, history, renewal, reach)
+	if l.conns != nil {
+		stats := l.conns.stats()
+		info.Connections = &stats
+	}
+	return info
+}
+
+// SubscribeReachability returns a channel that receives the current
+// reachability and then every change, and a function to cancel the
+// subscription. A slow receiver only misses intermediate values; the
+// channel always holds the latest one. The channel is closed when the
+// subscription is cancelled or the listener is closed.
+func (l *NATListener) SubscribeReachability() (<-chan Reachability, func()) {
+	return l.reach.subscribe(l.Reachability())
+}
+
+// notifyReachability publishes the current reachability to subscribers.
+// It must be called without l.mu held.
+func (l *NATListener) notifyReachability() {
+	l.reach.publish(l.Reachability())
+}
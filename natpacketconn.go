@@ -12,6 +12,12 @@ import (
 type NATPacketConn struct {
 	net.PacketConn
 	localAddr *NATAddr
+	probes    *probeFilter // consumes reachability probe datagrams, may be nil
+
+	// readLabels and writeLabels are the labels of byte counter metrics,
+	// built once since they are reported for every packet.
+	readLabels  Labels
+	writeLabels Labels
 
 	// closeOnce ensures the underlying connection is closed exactly once,
 	// preventing double-close issues when both NATPacketConn.Close() and
@@ -20,18 +26,33 @@ type NATPacketConn struct {
 	closeErr  error
 }
 
+// setMetricLabels builds the metric labels for a connection bound to addr.
+func (c *NATPacketConn) setMetricLabels(addr net.Addr) {
+	port := portLabel(addr)
+	c.readLabels = Labels{"port": port, "direction": "read"}
+	c.writeLabels = Labels{"port": port, "direction": "write"}
+}
+
 // LocalAddr returns the local network address with NAT info.
 func (c *NATPacketConn) LocalAddr() net.Addr {
 	return c.localAddr
 }
 
 // ReadFrom reads a packet from the connection.
+// Datagrams sent by VerifyReachability are consumed and not returned.
 func (c *NATPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	n, addr, err = c.PacketConn.ReadFrom(p)
-	if err != nil {
-		log.WithError(err).Debug("NAT packet conn read error")
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil {
+			log.WithError(err).Debug("NAT packet conn read error")
+			return n, addr, err
+		}
+		if !c.probes.match(p[:n]) {
+			addCounter(MetricPacketBytes, c.readLabels, float64(n))
+			return n, addr, nil
+		}
+		log.WithField("from", addr.String()).Debug("reachability probe datagram received")
 	}
-	return n, addr, err
 }
 
 // WriteTo writes a packet to the connection.
@@ -40,6 +61,9 @@ func (c *NATPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	if err != nil {
 		log.WithError(err).WithField("addr", addr.String()).Error("NAT packet conn write error")
 	}
+	if n > 0 {
+		addCounter(MetricPacketBytes, c.writeLabels, float64(n))
+	}
 	return n, err
 }
 
@@ -1,11 +1,12 @@
 package nattraversal
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
-
-	"github.com/go-i2p/logger"
+	"time"
 )
 
 // NATPacketListener implements a packet listener with NAT traversal.
@@ -13,8 +14,18 @@ import (
 type NATPacketListener struct {
 	conn         net.PacketConn
 	renewal      *RenewalManager
+	monitor      *NetworkMonitor // nil if network change monitoring is unavailable
+	localIP      net.IP          // address the listener is bound to, nil for all interfaces
+	discover     mapperDiscovery // rediscovers the port mapper after a network change
+	prober       ReachabilityProber
+	verification VerificationResult
+	reach        reachabilityFeed
+	log          logEntry // logs to the Logger of the ListenConfig
+	probes       probeFilter
 	externalPort int
 	externalIP   string
+	ipHistory    ipHistory
+	created      time.Time
 	addr         *NATAddr
 	closed       bool
 	fallback     bool // true if NAT traversal failed and we're using a standard listener
@@ -27,22 +38,94 @@ type NATPacketListener struct {
 // It updates the externalPort field and recreates the NATAddr with the new port.
 func (l *NATPacketListener) updateExternalPort(newPort int) {
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	externalIP := l.externalIP
+	l.mu.Unlock()
+	l.updateExternalAddr(externalIP, newPort)
+}
+
+// updateExternalAddr updates the external IP and port and recreates the NATAddr.
+func (l *NATPacketListener) updateExternalAddr(externalIP string, newPort int) {
+	defer l.notifyReachability()
+	l.mu.Lock()
 
-	oldPort := l.externalPort
+	oldIP, oldPort := l.externalIP, l.externalPort
+	renewal := l.renewal
+	l.externalIP = externalIP
 	l.externalPort = newPort
-	// Recreate NATAddr with the new external port
-	newExternalAddr := fmt.Sprintf("%s:%d", l.externalIP, newPort)
-	l.addr = NewNATAddr(l.addr.Network(), l.addr.InternalAddr(), newExternalAddr)
+	l.ipHistory.record(externalIP, time.Now())
+	// Recreate NATAddr with the new external address
+	newExternalAddr := fmt.Sprintf("%s:%d", externalIP, newPort)
+	l.addr = l.addr.withExternalAddr(newExternalAddr)
+	// The last verification checked the old address
+	if oldIP != externalIP || oldPort != newPort {
+		l.verification = VerificationResult{}
+	}
 
 	// Update the cached packet conn's local address if it exists
 	if l.cachedPacketConn != nil {
 		l.cachedPacketConn.localAddr = l.addr
 	}
-	log.WithFields(logger.Fields{
+	l.log.WithFields(Fields{
+		"oldIP":   oldIP,
+		"newIP":   externalIP,
 		"oldPort": oldPort,
 		"newPort": newPort,
-	}).Debug("UDP packet listener external port updated")
+	}).Debug("UDP packet listener external address updated")
+	l.mu.Unlock()
+
+	if oldIP != externalIP && renewal != nil {
+		emit(Event{
+			Kind:          ExternalIPChanged,
+			Mapper:        MapperName(renewal.currentMapper()),
+			Protocol:      "UDP",
+			InternalPort:  renewal.internalPort,
+			ExternalPort:  newPort,
+			ExternalIP:    externalIP,
+			OldExternalIP: oldIP,
+		})
+	}
+}
+
+// handleNetworkChange re-establishes the port mapping after the default gateway
+// or local address changed, and updates the external address accordingly.
+func (l *NATPacketListener) handleNetworkChange(_, _ NetworkState) {
+	l.mu.Lock()
+	closed := l.closed
+	renewal := l.renewal
+	localIP := l.localIP
+	discover := l.discover
+	l.mu.Unlock()
+
+	if closed || renewal == nil {
+		return
+	}
+
+	externalIP, externalPort, err := remapAfterNetworkChange(renewal, discover, localIP)
+	if err != nil {
+		l.log.WithError(err).WithField("protocol", "UDP").Warn("failed to re-map port after network change")
+		return
+	}
+	l.updateExternalAddr(externalIP, externalPort)
+}
+
+// remapTo re-establishes the port mapping through a mapper discovered after a
+// network change, and updates the external address accordingly.
+func (l *NATPacketListener) remapTo(ctx context.Context, mapper PortMapper) error {
+	l.mu.Lock()
+	closed := l.closed
+	renewal := l.renewal
+	l.mu.Unlock()
+
+	if closed || renewal == nil {
+		return nil
+	}
+
+	externalIP, externalPort, err := remapWithMapper(ctx, renewal, mapper)
+	if err != nil {
+		return err
+	}
+	l.updateExternalAddr(externalIP, externalPort)
+	return nil
 }
 
 // Accept returns a packet connection (satisfies a hypothetical net.PacketListener interface).
@@ -64,33 +147,66 @@ func (l *NATPacketListener) Accept() (net.PacketConn, error) {
 // This method is idempotent - calling it multiple times is safe.
 // It coordinates with NATPacketConn.Close() to ensure the underlying
 // connection is only closed once, even if both are called.
+// Close gives up removing the port mapping if the gateway does not respond
+// within a few seconds.
 func (l *NATPacketListener) Close() error {
+	renewal, err := l.closeListener()
+	if renewal != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), closeUnmapTimeout)
+		defer cancel()
+		renewal.StopContext(ctx) // failures are logged and reported as an Unmapped event
+	}
+	return err
+}
+
+// Shutdown closes the packet listener and removes the port mapping, giving
+// up when ctx is done so that the process can exit. It returns the errors of
+// closing the connection and unmapping.
+func (l *NATPacketListener) Shutdown(ctx context.Context) error {
+	renewal, closeErr := l.closeListener()
+
+	var unmapErr error
+	if renewal != nil {
+		if err := renewal.StopContext(ctx); err != nil {
+			unmapErr = fmt.Errorf("failed to unmap port: %w", err)
+		}
+	}
+	return errors.Join(closeErr, unmapErr)
+}
+
+// closeListener closes the connection and stops monitoring the network, and
+// returns the renewal manager to stop, nil if there is none or the listener
+// was already closed. The mapping is not removed under l.mu, since the
+// gateway may take long to respond.
+func (l *NATPacketListener) closeListener() (*RenewalManager, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	if l.closed {
-		return nil
+		return nil, nil
 	}
 	l.closed = true
 
-	log.WithFields(logger.Fields{
+	l.log.WithFields(Fields{
 		"addr":     l.addr.String(),
 		"fallback": l.fallback,
 	}).Debug("closing UDP packet listener")
 
-	if l.renewal != nil {
-		l.renewal.Stop()
+	liveListeners.removeUDP(l)
+	if l.monitor != nil {
+		l.monitor.Stop()
 	}
+	l.reach.close()
 
 	// If a NATPacketConn was created, close through it to use sync.Once
 	// This ensures the underlying connection is closed exactly once,
 	// even if NATPacketConn.Close() was already called.
 	if l.cachedPacketConn != nil {
-		return l.cachedPacketConn.Close()
+		return l.renewal, l.cachedPacketConn.Close()
 	}
 
 	// No NATPacketConn was created, close the underlying conn directly
-	return l.conn.Close()
+	return l.renewal, l.conn.Close()
 }
 
 // Addr returns the listener's network address.
@@ -129,11 +245,117 @@ func (l *NATPacketListener) PacketConn() net.PacketConn {
 // Must be called with l.mu held.
 func (l *NATPacketListener) getOrCreatePacketConn() *NATPacketConn {
 	if l.cachedPacketConn == nil {
-		log.WithField("addr", l.addr.String()).Debug("creating NATPacketConn wrapper")
+		l.log.WithField("addr", l.addr.String()).Debug("creating NATPacketConn wrapper")
 		l.cachedPacketConn = &NATPacketConn{
 			PacketConn: l.conn,
 			localAddr:  l.addr,
+			probes:     &l.probes,
 		}
+		l.cachedPacketConn.setMetricLabels(l.conn.LocalAddr())
 	}
 	return l.cachedPacketConn
 }
+
+// NATStatus reports the NAT topology of the listener's port mapping, inferred
+// from the external IP reported by the gateway. In fallback mode the topology
+// is TopologyUnknown.
+func (l *NATPacketListener) NATStatus() NATStatus {
+	l.mu.Lock()
+	renewal := l.renewal
+	externalIP := l.externalIP
+	l.mu.Unlock()
+
+	if renewal == nil {
+		return NATStatus{}
+	}
+	return ClassifyNAT(renewal.currentMapper(), externalIP)
+}
+
+// VerifyReachability checks that the external address receives datagrams,
+// first through the gateway's hairpin, then through the ListenConfig.Prober
+// if one was configured, and records the result (see Verification).
+// Probe datagrams are consumed by the packet connection's ReadFrom, so the
+// application must be reading from PacketConn() while this runs.
+// An error is returned only if there is no external address to verify.
+func (l *NATPacketListener) VerifyReachability(ctx context.Context) (VerificationResult, error) {
+	l.mu.Lock()
+	closed, fallback := l.closed, l.fallback
+	externalAddr := l.addr.ExternalAddr()
+	prober := l.prober
+	l.mu.Unlock()
+
+	if closed {
+		return VerificationResult{}, fmt.Errorf("packet listener closed")
+	}
+	if fallback {
+		return VerificationResult{}, fmt.Errorf("no external address to verify in fallback mode")
+	}
+
+	result := verifyUDP(ctx, externalAddr, &l.probes, prober)
+
+	// A result for an address replaced meanwhile is not recorded
+	l.mu.Lock()
+	if l.addr.ExternalAddr() == externalAddr {
+		l.verification = result
+		l.addr = l.addr.withHairpin(hairpinStatusFrom(result.Hairpin))
+	}
+	l.mu.Unlock()
+	l.notifyReachability()
+	return result, nil
+}
+
+// Verification returns the result of the last VerifyReachability call.
+// Its Status is VerificationUnknown if reachability was never verified or
+// the external address changed since.
+func (l *NATPacketListener) Verification() VerificationResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.verification
+}
+
+// Hairpin reports whether hosts on the LAN can reach the listener through its
+// external address, as detected at listen time (see ListenConfig.DetectHairpin)
+// or by the last VerifyReachability call.
+func (l *NATPacketListener) Hairpin() HairpinStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.addr.Hairpin()
+}
+
+// Reachability reports whether peers on the internet can reach the listener,
+// combining the mapper in use, the class of the external IP, the health of
+// the mapping and the last VerifyReachability result.
+func (l *NATPacketListener) Reachability() Reachability {
+	l.mu.Lock()
+	renewal := l.renewal
+	addr := l.addr
+	externalIP := l.externalIP
+	verification := l.verification
+	l.mu.Unlock()
+	return newReachability(renewal, addr, externalIP, verification)
+}
+
+// info describes the listener for Listeners.
+func (l *NATPacketListener) info() ListenerInfo {
+	reach := l.Reachability()
+	l.mu.Lock()
+	addr, fallback, created, renewal := l.addr, l.fallback, l.created, l.renewal
+	history := l.ipHistory.snapshot()
+	l.mu.Unlock()
+	return newListenerInfo("udp", addr, fallback, created, history, renewal, reach)
+}
+
+// SubscribeReachability returns a channel that receives the current
+// reachability and then every change, and a function to cancel the
+// subscription. A slow receiver only misses intermediate values; the
+// channel always holds the latest one. The channel is closed when the
+// subscription is cancelled or the listener is closed.
+func (l *NATPacketListener) SubscribeReachability() (<-chan Reachability, func()) {
+	return l.reach.subscribe(l.Reachability())
+}
+
+// notifyReachability publishes the current reachability to subscribers.
+// It must be called without l.mu held.
+func (l *NATPacketListener) notifyReachability() {
+	l.reach.publish(l.Reachability())
+}
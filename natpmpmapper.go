@@ -1,19 +1,20 @@
 package nattraversal
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
 	"time"
 
-	"github.com/go-i2p/logger"
 	natpmp "github.com/jackpal/go-nat-pmp"
 )
 
 // NATPMPMapper implements PortMapper using NAT-PMP protocol.
 // Moved from: addr.go
 type NATPMPMapper struct {
-	client *natpmp.Client
+	client  *natpmp.Client
+	gateway net.IP
 }
 
 // NewNATPMPMapper discovers and creates a NAT-PMP mapper.
@@ -27,22 +28,72 @@ func NewNATPMPMapper() (*NATPMPMapper, error) {
 	}
 
 	log.WithField("gateway", gateway.String()).Debug("NAT-PMP gateway discovered")
-	client := natpmp.NewClient(gateway)
+	return newNATPMPMapperContext(context.Background(), gateway)
+}
+
+// newNATPMPMapperContext creates a NAT-PMP mapper for gateway after checking
+// that it answers, giving up at the deadline of ctx.
+func newNATPMPMapperContext(ctx context.Context, gateway net.IP) (*NATPMPMapper, error) {
+	n := &NATPMPMapper{client: natpmp.NewClient(gateway), gateway: gateway}
 
 	// Test connectivity — treat failure as non-fatal so NAT traversal can still work via other methods
-	_, err = client.GetExternalAddress()
+	_, err := n.clientFor(ctx).GetExternalAddress()
 	if err != nil {
-		log.WithError(err).WithField("gateway", gateway.String()).Warning("NAT-PMP connectivity test failed — will attempt fallback")
+		log.WithError(err).WithField("gateway", gateway.String()).Warn("NAT-PMP connectivity test failed — will attempt fallback")
 		return nil, fmt.Errorf("NAT-PMP connectivity test failed: %w", err)
 	}
 
 	log.WithField("gateway", gateway.String()).Debug("NAT-PMP mapper created successfully")
-	return &NATPMPMapper{client: client}, nil
+	return n, nil
+}
+
+// Ensure NATPMPMapper reports granted lease lifetimes, supports contexts and
+// can map for a specific address.
+var (
+	_ LeasePortMapper     = (*NATPMPMapper)(nil)
+	_ ContextPortMapper   = (*NATPMPMapper)(nil)
+	_ LocalAddrPortMapper = (*NATPMPMapper)(nil)
+)
+
+// ForLocalAddr returns n if ip is the address the system uses to reach the
+// gateway. NAT-PMP forwards mappings to the source address of the request,
+// so mappings for any other local address cannot be created.
+func (n *NATPMPMapper) ForLocalAddr(ip net.IP) (PortMapper, error) {
+	if n.gateway == nil {
+		return nil, fmt.Errorf("NAT-PMP gateway address unknown")
+	}
+	if err := validateGatewayReachable(ip, n.gateway); err != nil {
+		return nil, fmt.Errorf("NAT-PMP gateway unreachable from local address: %w", err)
+	}
+	src, err := routeSourceIP(n.gateway)
+	if err != nil {
+		return nil, err
+	}
+	if !src.Equal(ip) {
+		return nil, fmt.Errorf("NAT-PMP maps ports for %s, the address used to reach gateway %s, not %s", src, n.gateway, ip)
+	}
+	return n, nil
 }
 
 // MapPort creates a port mapping via NAT-PMP.
 func (n *NATPMPMapper) MapPort(protocol string, internalPort int, duration time.Duration) (int, error) {
-	log.WithFields(logger.Fields{
+	result, err := n.MapPortWithLease(protocol, internalPort, duration)
+	if err != nil {
+		return 0, err
+	}
+	return result.ExternalPort, nil
+}
+
+// MapPortWithLease creates a port mapping via NAT-PMP and reports the lifetime
+// granted by the gateway, which may be clamped below the requested duration.
+func (n *NATPMPMapper) MapPortWithLease(protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	return n.MapPortContext(context.Background(), protocol, internalPort, duration)
+}
+
+// MapPortContext creates a port mapping via NAT-PMP as MapPortWithLease
+// does, giving up when ctx is done.
+func (n *NATPMPMapper) MapPortContext(ctx context.Context, protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"internalPort": internalPort,
 		"duration":     duration.String(),
@@ -50,40 +101,52 @@ func (n *NATPMPMapper) MapPort(protocol string, internalPort int, duration time.
 
 	// Validate port range to prevent invalid mappings
 	if internalPort < 1 || internalPort > 65535 {
-		return 0, fmt.Errorf("invalid port number: %d (must be 1-65535)", internalPort)
+		return MapPortResult{}, fmt.Errorf("invalid port number: %d (must be 1-65535)", internalPort)
 	}
 
 	protocolStr := strings.ToUpper(protocol)
 	if protocolStr != "TCP" && protocolStr != "UDP" {
-		return 0, fmt.Errorf("unsupported protocol: %s", protocol)
+		return MapPortResult{}, fmt.Errorf("unsupported protocol: %s", protocol)
 	}
 
-	result, err := n.client.AddPortMapping(
-		protocolStr,
-		internalPort,
-		internalPort,
-		int(duration.Seconds()),
-	)
+	client := n.clientFor(ctx)
+	result, err := callContext(ctx, func() (*natpmp.AddPortMappingResult, error) {
+		return client.AddPortMapping(protocolStr, internalPort, internalPort, int(duration.Seconds()))
+	})
 	if err != nil {
-		log.WithError(err).WithFields(logger.Fields{
+		log.WithError(err).WithFields(Fields{
 			"protocol":     protocol,
 			"internalPort": internalPort,
 		}).Error("NAT-PMP port mapping failed")
-		return 0, fmt.Errorf("NAT-PMP port mapping failed: %w", err)
+		return MapPortResult{}, fmt.Errorf("NAT-PMP port mapping failed: %w", err)
 	}
 
 	externalPort := int(result.MappedExternalPort)
-	log.WithFields(logger.Fields{
+	lifetime := time.Duration(result.PortMappingLifetimeInSeconds) * time.Second
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"internalPort": internalPort,
 		"externalPort": externalPort,
+		"lifetime":     lifetime.String(),
 	}).Debug("NAT-PMP port mapped successfully")
-	return externalPort, nil
+	if lifetime < duration {
+		log.WithFields(Fields{
+			"requested": duration.String(),
+			"granted":   lifetime.String(),
+		}).Info("NAT-PMP gateway granted a shorter lease than requested")
+	}
+	return MapPortResult{ExternalPort: externalPort, Lifetime: lifetime}, nil
 }
 
 // UnmapPort removes a port mapping via NAT-PMP.
 func (n *NATPMPMapper) UnmapPort(protocol string, externalPort int) error {
-	log.WithFields(logger.Fields{
+	return n.UnmapPortContext(context.Background(), protocol, externalPort)
+}
+
+// UnmapPortContext removes a port mapping via NAT-PMP, giving up when ctx is
+// done.
+func (n *NATPMPMapper) UnmapPortContext(ctx context.Context, protocol string, externalPort int) error {
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"externalPort": externalPort,
 	}).Debug("unmapping port via NAT-PMP")
@@ -98,16 +161,19 @@ func (n *NATPMPMapper) UnmapPort(protocol string, externalPort int) error {
 		return fmt.Errorf("unsupported protocol: %s", protocol)
 	}
 
-	_, err := n.client.AddPortMapping(protocolStr, externalPort, 0, 0)
+	client := n.clientFor(ctx)
+	_, err := callContext(ctx, func() (*natpmp.AddPortMappingResult, error) {
+		return client.AddPortMapping(protocolStr, externalPort, 0, 0)
+	})
 	if err != nil {
-		log.WithError(err).WithFields(logger.Fields{
+		log.WithError(err).WithFields(Fields{
 			"protocol":     protocol,
 			"externalPort": externalPort,
 		}).Error("NAT-PMP port unmapping failed")
 		return fmt.Errorf("NAT-PMP port unmapping failed: %w", err)
 	}
 
-	log.WithFields(logger.Fields{
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"externalPort": externalPort,
 	}).Debug("NAT-PMP port unmapped successfully")
@@ -116,8 +182,14 @@ func (n *NATPMPMapper) UnmapPort(protocol string, externalPort int) error {
 
 // GetExternalIP returns the external IP address via NAT-PMP.
 func (n *NATPMPMapper) GetExternalIP() (string, error) {
+	return n.GetExternalIPContext(context.Background())
+}
+
+// GetExternalIPContext returns the external IP address via NAT-PMP, giving
+// up when ctx is done.
+func (n *NATPMPMapper) GetExternalIPContext(ctx context.Context) (string, error) {
 	log.Debug("getting external IP via NAT-PMP")
-	result, err := n.client.GetExternalAddress()
+	result, err := callContext(ctx, n.clientFor(ctx).GetExternalAddress)
 	if err != nil {
 		log.WithError(err).Error("NAT-PMP external IP lookup failed")
 		return "", fmt.Errorf("NAT-PMP external IP lookup failed: %w", err)
@@ -127,3 +199,13 @@ func (n *NATPMPMapper) GetExternalIP() (string, error) {
 	log.WithField("externalIP", ip.String()).Debug("NAT-PMP external IP retrieved")
 	return ip.String(), nil
 }
+
+// clientFor returns a client whose requests time out at the deadline of ctx,
+// since the NAT-PMP client otherwise retries for over a minute.
+func (n *NATPMPMapper) clientFor(ctx context.Context) *natpmp.Client {
+	deadline, ok := ctx.Deadline()
+	if !ok || n.gateway == nil {
+		return n.client
+	}
+	return natpmp.NewClientWithTimeout(n.gateway, time.Until(deadline))
+}
@@ -0,0 +1,232 @@
+package nattraversal
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// NetworkChangeKind identifies the kind of OS network change that was observed.
+type NetworkChangeKind int
+
+const (
+	// LinkChanged indicates an interface was added, removed, or changed state.
+	LinkChanged NetworkChangeKind = iota
+	// AddressChanged indicates an interface address was added or removed.
+	AddressChanged
+	// RouteChanged indicates a routing table entry was added or removed.
+	RouteChanged
+)
+
+// String returns a human-readable name for the change kind.
+func (k NetworkChangeKind) String() string {
+	switch k {
+	case LinkChanged:
+		return "link"
+	case AddressChanged:
+		return "address"
+	case RouteChanged:
+		return "route"
+	default:
+		return fmt.Sprintf("NetworkChangeKind(%d)", int(k))
+	}
+}
+
+// NetworkEventSource delivers raw network change notifications from the OS.
+// Implementations must close the Events channel when Close is called.
+type NetworkEventSource interface {
+	Events() <-chan NetworkChangeKind
+	Close() error
+}
+
+// NetworkState is a snapshot of the routing facts NAT traversal depends on.
+type NetworkState struct {
+	Gateway net.IP // default gateway, nil if none
+	LocalIP net.IP // local address used to reach the gateway, nil if unknown
+}
+
+// Equal reports whether two network states refer to the same gateway and local address.
+func (s NetworkState) Equal(other NetworkState) bool {
+	return s.Gateway.Equal(other.Gateway) && s.LocalIP.Equal(other.LocalIP)
+}
+
+// NetworkChangeCallback is called when the default gateway or local address changes.
+// It receives the previous and the current network state.
+type NetworkChangeCallback func(oldState, newState NetworkState)
+
+// newNetworkEventSource creates the platform event source used by listeners.
+// It is a variable so tests can inject a fake source.
+var newNetworkEventSource = newPlatformNetworkEventSource
+
+// currentNetworkState reads the current default gateway and local address.
+func currentNetworkState() (NetworkState, error) {
+	var state NetworkState
+
+	route, err := readDefaultRoute()
+	if err != nil {
+		return state, err
+	}
+	if route != nil {
+		state.Gateway = route.gateway
+		state.LocalIP = localIPForRoute(route)
+	}
+	return state, nil
+}
+
+// NetworkMonitor watches a NetworkEventSource and invokes a callback when the
+// default gateway or local address actually changes. Bursts of OS events
+// (common when a link comes up) are debounced into a single state check.
+type NetworkMonitor struct {
+	source   NetworkEventSource
+	onChange NetworkChangeCallback
+	debounce time.Duration
+	snapshot func() (NetworkState, error)
+
+	mu      sync.Mutex
+	state   NetworkState
+	started bool
+	done    chan struct{}
+}
+
+// NewNetworkMonitor creates a monitor for the given event source.
+// The callback is invoked from the monitor's goroutine.
+func NewNetworkMonitor(source NetworkEventSource, onChange NetworkChangeCallback) *NetworkMonitor {
+	return &NetworkMonitor{
+		source:   source,
+		onChange: onChange,
+		debounce: networkChangeDebounce,
+		snapshot: currentNetworkState,
+	}
+}
+
+// State returns the most recently observed network state.
+func (m *NetworkMonitor) State() NetworkState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Start records the current network state and begins watching for changes.
+// Calling Start on a running monitor has no effect.
+func (m *NetworkMonitor) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.started {
+		return
+	}
+	m.started = true
+	m.done = make(chan struct{})
+
+	state, err := m.snapshot()
+	if err != nil {
+		log.WithError(err).Debug("failed to read initial network state")
+	}
+	m.state = state
+
+	log.WithFields(Fields{
+		"gateway": state.Gateway.String(),
+		"localIP": state.LocalIP.String(),
+	}).Debug("starting network change monitor")
+
+	go m.watchLoop(m.source.Events(), m.done)
+}
+
+// Stop stops watching and closes the event source.
+// It does not wait for an in-progress callback to return.
+func (m *NetworkMonitor) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.started {
+		return
+	}
+	m.started = false
+	close(m.done)
+
+	if err := m.source.Close(); err != nil {
+		log.WithError(err).Debug("error closing network event source")
+	}
+	log.Debug("network change monitor stopped")
+}
+
+// watchLoop debounces source events and checks for state changes once the
+// source has been quiet for the debounce interval.
+func (m *NetworkMonitor) watchLoop(events <-chan NetworkChangeKind, done <-chan struct{}) {
+	var timer *time.Timer
+	var timerC <-chan time.Time
+
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case kind, ok := <-events:
+			if !ok {
+				return
+			}
+			log.WithField("kind", kind.String()).Debug("network change event received")
+			if timer == nil {
+				timer = time.NewTimer(m.debounce)
+				timerC = timer.C
+			} else {
+				timer.Reset(m.debounce)
+			}
+		case <-timerC:
+			timer = nil
+			timerC = nil
+			m.checkState()
+		case <-done:
+			return
+		}
+	}
+}
+
+// checkState compares the current network state with the last observed one
+// and invokes the callback if the gateway or local address changed.
+func (m *NetworkMonitor) checkState() {
+	state, err := m.snapshot()
+	if err != nil {
+		log.WithError(err).Warn("failed to read network state after change")
+		return
+	}
+
+	m.mu.Lock()
+	oldState := m.state
+	changed := !oldState.Equal(state)
+	m.state = state
+	m.mu.Unlock()
+
+	if !changed {
+		log.Debug("network events did not change gateway or local address")
+		return
+	}
+
+	log.WithFields(Fields{
+		"oldGateway": oldState.Gateway.String(),
+		"newGateway": state.Gateway.String(),
+		"oldLocalIP": oldState.LocalIP.String(),
+		"newLocalIP": state.LocalIP.String(),
+	}).Info("network change detected")
+
+	if m.onChange != nil {
+		m.onChange(oldState, state)
+	}
+}
+
+// startNetworkMonitor creates and starts a monitor using the platform event
+// source. Returns nil if the platform does not support change notifications.
+func startNetworkMonitor(onChange NetworkChangeCallback) *NetworkMonitor {
+	source, err := newNetworkEventSource()
+	if err != nil {
+		log.WithError(err).Debug("network change monitoring unavailable")
+		return nil
+	}
+	monitor := NewNetworkMonitor(source, onChange)
+	monitor.Start()
+	return monitor
+}
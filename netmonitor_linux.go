@@ -0,0 +1,117 @@
+//go:build linux
+
+package nattraversal
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// rtnetlink multicast groups (see linux/rtnetlink.h); the syscall package
+// does not export them.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+)
+
+// netlinkEventSource receives rtnetlink multicast notifications for link,
+// IPv4 address and IPv4 route changes.
+type netlinkEventSource struct {
+	file      *os.File
+	events    chan NetworkChangeKind
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// newPlatformNetworkEventSource subscribes to RTMGRP_LINK, RTMGRP_IPV4_IFADDR
+// and RTMGRP_IPV4_ROUTE on a NETLINK_ROUTE socket.
+func newPlatformNetworkEventSource() (NetworkEventSource, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv4Route,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+
+	// A non-blocking fd is registered with the runtime poller, so Close
+	// unblocks a pending Read.
+	s := &netlinkEventSource{
+		file:   os.NewFile(uintptr(fd), "netlink-route"),
+		events: make(chan NetworkChangeKind, 16),
+	}
+	go s.readLoop()
+
+	log.Debug("netlink network change subscription established")
+	return s, nil
+}
+
+// Events returns the channel of network change notifications.
+func (s *netlinkEventSource) Events() <-chan NetworkChangeKind {
+	return s.events
+}
+
+// Close closes the netlink socket. The Events channel is closed once the
+// reader goroutine exits.
+func (s *netlinkEventSource) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.file.Close()
+	})
+	return s.closeErr
+}
+
+// readLoop reads netlink datagrams and translates them to change kinds.
+// Notifications are dropped when the channel is full, since consumers
+// only need to know that something changed.
+func (s *netlinkEventSource) readLoop() {
+	defer close(s.events)
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, err := s.file.Read(buf)
+		if err != nil {
+			log.WithError(err).Debug("netlink event source stopped")
+			return
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			log.WithError(err).Debug("failed to parse netlink notification")
+			continue
+		}
+
+		for _, m := range msgs {
+			kind, ok := netlinkChangeKind(m.Header.Type)
+			if !ok {
+				continue
+			}
+			select {
+			case s.events <- kind:
+			default:
+			}
+		}
+	}
+}
+
+// netlinkChangeKind maps an rtnetlink message type to a NetworkChangeKind.
+func netlinkChangeKind(msgType uint16) (NetworkChangeKind, bool) {
+	switch msgType {
+	case syscall.RTM_NEWLINK, syscall.RTM_DELLINK:
+		return LinkChanged, true
+	case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+		return AddressChanged, true
+	case syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+		return RouteChanged, true
+	default:
+		return 0, false
+	}
+}
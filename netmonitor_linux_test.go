@@ -0,0 +1,46 @@
+//go:build linux
+
+package nattraversal
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestNetlinkChangeKind(t *testing.T) {
+	testCases := []struct {
+		msgType  uint16
+		expected NetworkChangeKind
+		ok       bool
+	}{
+		{syscall.RTM_NEWLINK, LinkChanged, true},
+		{syscall.RTM_DELLINK, LinkChanged, true},
+		{syscall.RTM_NEWADDR, AddressChanged, true},
+		{syscall.RTM_DELADDR, AddressChanged, true},
+		{syscall.RTM_NEWROUTE, RouteChanged, true},
+		{syscall.RTM_DELROUTE, RouteChanged, true},
+		{syscall.NLMSG_DONE, 0, false},
+	}
+
+	for _, tc := range testCases {
+		kind, ok := netlinkChangeKind(tc.msgType)
+		if ok != tc.ok || (ok && kind != tc.expected) {
+			t.Errorf("netlinkChangeKind(%d) = %v, %v; expected %v, %v", tc.msgType, kind, ok, tc.expected, tc.ok)
+		}
+	}
+}
+
+func TestNetlinkEventSourceClose(t *testing.T) {
+	source, err := newPlatformNetworkEventSource()
+	if err != nil {
+		t.Skipf("netlink subscription unavailable: %v", err)
+	}
+
+	if err := source.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	// The events channel is closed once the reader goroutine exits
+	for range source.Events() {
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package nattraversal
+
+import "fmt"
+
+// newPlatformNetworkEventSource is a stub for platforms without network
+// change notifications. Listeners on these platforms rely on periodic
+// renewal to notice network changes.
+func newPlatformNetworkEventSource() (NetworkEventSource, error) {
+	return nil, fmt.Errorf("network change monitoring not supported on this platform")
+}
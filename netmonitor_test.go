@@ -0,0 +1,175 @@
+package nattraversal
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNetworkEventSource is an injectable NetworkEventSource driven by tests.
+type fakeNetworkEventSource struct {
+	events    chan NetworkChangeKind
+	closeOnce sync.Once
+}
+
+func newFakeNetworkEventSource() *fakeNetworkEventSource {
+	return &fakeNetworkEventSource{events: make(chan NetworkChangeKind, 16)}
+}
+
+func (s *fakeNetworkEventSource) Events() <-chan NetworkChangeKind {
+	return s.events
+}
+
+func (s *fakeNetworkEventSource) Close() error {
+	s.closeOnce.Do(func() { close(s.events) })
+	return nil
+}
+
+// networkStateSequence returns a snapshot function that reports the given
+// states in order, repeating the last one.
+func networkStateSequence(states ...NetworkState) func() (NetworkState, error) {
+	var mu sync.Mutex
+	i := 0
+	return func() (NetworkState, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		state := states[i]
+		if i < len(states)-1 {
+			i++
+		}
+		return state, nil
+	}
+}
+
+// TestNetworkMonitor tests debouncing and change detection of NetworkMonitor.
+func TestNetworkMonitor(t *testing.T) {
+	home := NetworkState{Gateway: net.IPv4(192, 168, 1, 1), LocalIP: net.IPv4(192, 168, 1, 20)}
+	office := NetworkState{Gateway: net.IPv4(10, 0, 0, 1), LocalIP: net.IPv4(10, 0, 0, 20)}
+
+	t.Run("Burst of events triggers one callback", func(t *testing.T) {
+		source := newFakeNetworkEventSource()
+		changes := make(chan NetworkState, 4)
+
+		monitor := NewNetworkMonitor(source, func(oldState, newState NetworkState) {
+			if !oldState.Equal(home) {
+				t.Errorf("Expected old state %v, got %v", home, oldState)
+			}
+			changes <- newState
+		})
+		monitor.debounce = 20 * time.Millisecond
+		monitor.snapshot = networkStateSequence(home, office)
+		monitor.Start()
+		defer monitor.Stop()
+
+		source.events <- LinkChanged
+		source.events <- AddressChanged
+		source.events <- RouteChanged
+
+		select {
+		case state := <-changes:
+			if !state.Equal(office) {
+				t.Errorf("Expected new state %v, got %v", office, state)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected network change callback")
+		}
+
+		select {
+		case state := <-changes:
+			t.Errorf("Expected a single callback for a burst of events, got another: %v", state)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if !monitor.State().Equal(office) {
+			t.Errorf("Expected monitor state %v, got %v", office, monitor.State())
+		}
+	})
+
+	t.Run("Events without state change do not trigger callback", func(t *testing.T) {
+		source := newFakeNetworkEventSource()
+		called := make(chan struct{}, 1)
+
+		monitor := NewNetworkMonitor(source, func(_, _ NetworkState) {
+			called <- struct{}{}
+		})
+		monitor.debounce = 10 * time.Millisecond
+		monitor.snapshot = networkStateSequence(home)
+		monitor.Start()
+		defer monitor.Stop()
+
+		source.events <- AddressChanged
+
+		select {
+		case <-called:
+			t.Error("Callback should not be invoked when gateway and local IP are unchanged")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("Stop closes the source and is idempotent", func(t *testing.T) {
+		source := newFakeNetworkEventSource()
+		monitor := NewNetworkMonitor(source, nil)
+		monitor.snapshot = networkStateSequence(home)
+		monitor.Start()
+
+		monitor.Stop()
+		monitor.Stop()
+
+		if _, ok := <-source.events; ok {
+			t.Error("Expected event source to be closed after Stop")
+		}
+	})
+}
+
+// TestNATListenerNetworkChange tests that a listener re-maps and updates its
+// address when the network changes.
+func TestNATListenerNetworkChange(t *testing.T) {
+	oldMapper := NewMockPortMapper()
+	oldMapper.SetExternalIP("203.0.113.100")
+	oldMapper.MapPort("TCP", 8080, mappingDuration)
+
+	newMapper := NewMockPortMapper()
+	newMapper.SetExternalIP("198.51.100.7")
+	newMapper.SetNATType(RestrictedNAT)
+
+	originalNewPortMapper := newPortMapper
+	newPortMapper = func(ctx context.Context) (PortMapper, error) {
+		return newMapper, nil
+	}
+	defer func() { newPortMapper = originalNewPortMapper }()
+
+	renewal := NewRenewalManager(oldMapper, "TCP", 8080, 8080)
+	renewal.Start()
+	defer renewal.Stop()
+
+	listener := &NATListener{
+		renewal:      renewal,
+		externalPort: 8080,
+		externalIP:   "203.0.113.100",
+		addr:         NewNATAddr("tcp", "0.0.0.0:8080", "203.0.113.100:8080"),
+	}
+
+	listener.handleNetworkChange(NetworkState{}, NetworkState{})
+
+	expectedAddr := "198.51.100.7:9080"
+	if listener.Addr().String() != expectedAddr {
+		t.Errorf("Expected address %s after network change, got %s", expectedAddr, listener.Addr().String())
+	}
+	if renewal.ExternalPort() != 9080 {
+		t.Errorf("Expected renewal manager to track new port 9080, got %d", renewal.ExternalPort())
+	}
+	if len(newMapper.GetActiveMappings()) != 1 {
+		t.Errorf("Expected mapping on new gateway, got %d", len(newMapper.GetActiveMappings()))
+	}
+
+	// The old mapping is removed in the background
+	deadline := time.Now().Add(time.Second)
+	for len(oldMapper.GetActiveMappings()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(oldMapper.GetActiveMappings()) != 0 {
+		t.Error("Expected previous mapping to be removed from old gateway")
+	}
+}
@@ -4,8 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
-
-	"github.com/go-i2p/logger"
+	"time"
 )
 
 // ListenPacket creates a UDP packet listener with NAT traversal on the specified port.
@@ -15,9 +14,16 @@ func ListenPacket(port int) (*NATPacketListener, error) {
 }
 
 // ListenPacketContext creates a UDP packet listener with NAT traversal on the specified port.
+// It is equivalent to calling ListenPacket on a zero ListenConfig.
+func ListenPacketContext(ctx context.Context, port int) (*NATPacketListener, error) {
+	return (&ListenConfig{}).ListenPacket(ctx, port)
+}
+
+// ListenPacket creates a UDP packet listener with NAT traversal on the specified port.
 // The context can be used to cancel the discovery and mapping operations.
 // Once the listener is created, the context is no longer used - use Close() to stop the listener.
-func ListenPacketContext(ctx context.Context, port int) (*NATPacketListener, error) {
+func (lc *ListenConfig) ListenPacket(ctx context.Context, port int) (*NATPacketListener, error) {
+	log := lc.logger()
 	log.WithField("port", port).Debug("creating NAT UDP packet listener")
 
 	// Check context before starting
@@ -25,13 +31,34 @@ func ListenPacketContext(ctx context.Context, port int) (*NATPacketListener, err
 		return nil, fmt.Errorf("context cancelled before starting: %w", err)
 	}
 
-	mapper, externalPort, err := createUDPMappingContext(ctx, port)
+	mapper, mapping, err := lc.createMapping(ctx, "UDP", port)
 	if err != nil {
 		log.WithError(err).WithField("port", port).Error("failed to create UDP port mapping")
 		return nil, fmt.Errorf("failed to create port mapping: %w", err)
 	}
 
-	log.WithFields(logger.Fields{
+	packetListener, err := lc.listenPacketWithMapping(ctx, mapper, mapping, "udp", nil, port)
+	if err != nil {
+		return nil, err
+	}
+	packetListener.monitor = startNetworkMonitor(packetListener.handleNetworkChange)
+
+	log.WithFields(Fields{
+		"internalAddr": packetListener.addr.InternalAddr(),
+		"externalAddr": packetListener.addr.ExternalAddr(),
+	}).Debug("NAT UDP packet listener ready")
+	return packetListener, nil
+}
+
+// listenPacketWithMapping binds the UDP socket for an established mapping and starts
+// its renewal. The socket is bound to localIP, or to all interfaces if localIP
+// is nil. The mapping is removed if the listener cannot be created.
+// Network change monitoring is left to the caller.
+func (lc *ListenConfig) listenPacketWithMapping(ctx context.Context, mapper PortMapper, mapping MapPortResult, network string, localIP net.IP, port int) (*NATPacketListener, error) {
+	log := lc.logger()
+	externalPort := mapping.ExternalPort
+
+	log.WithFields(Fields{
 		"internalPort": port,
 		"externalPort": externalPort,
 	}).Debug("UDP port mapping created")
@@ -42,7 +69,7 @@ func ListenPacketContext(ctx context.Context, port int) (*NATPacketListener, err
 		return nil, fmt.Errorf("context cancelled after mapping: %w", err)
 	}
 
-	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	conn, err := net.ListenPacket(network, bindAddress(localIP, port))
 	if err != nil {
 		mapper.UnmapPort("UDP", externalPort)
 		log.WithError(err).WithField("port", port).Error("failed to bind UDP packet conn")
@@ -58,7 +85,7 @@ func ListenPacketContext(ctx context.Context, port int) (*NATPacketListener, err
 
 	// Get addresses for NATAddr
 	internalAddr := conn.LocalAddr().String()
-	externalIP, err := mapper.GetExternalIP()
+	externalIP, err := externalIPContext(ctx, mapper)
 	if err != nil {
 		conn.Close()
 		mapper.UnmapPort("UDP", externalPort)
@@ -67,9 +94,13 @@ func ListenPacketContext(ctx context.Context, port int) (*NATPacketListener, err
 	}
 
 	externalAddr := fmt.Sprintf("%s:%d", externalIP, externalPort)
-	addr := NewNATAddr("udp", internalAddr, externalAddr)
+	addr := NewNATAddr(network, internalAddr, externalAddr)
+	addr = addr.withHairpin(lc.hairpinStatus(mapper, "UDP", externalAddr, func() HairpinStatus {
+		return detectHairpinUDP(ctx, conn, externalAddr)
+	}))
 
-	renewal := NewRenewalManager(mapper, "UDP", port, externalPort)
+	renewal := lc.newRenewalManager(mapper, "UDP", port, externalPort)
+	renewal.SetLeaseLifetime(mapping.Lifetime)
 
 	packetListener := &NATPacketListener{
 		conn:         conn,
@@ -77,16 +108,21 @@ func ListenPacketContext(ctx context.Context, port int) (*NATPacketListener, err
 		externalPort: externalPort,
 		externalIP:   externalIP,
 		addr:         addr,
+		localIP:      localIP,
+		discover:     lc.portMapper,
+		prober:       lc.Prober,
+		log:          log,
+		created:      time.Now(),
 	}
+	packetListener.ipHistory.record(externalIP, packetListener.created)
 
 	// Set up callback to handle external port changes during renewal
 	renewal.SetPortChangeCallback(packetListener.updateExternalPort)
+	renewal.SetStateChangeCallback(func(_, _ MappingState) { packetListener.notifyReachability() })
 	renewal.Start()
+	liveListeners.addUDP(packetListener)
 
-	log.WithFields(logger.Fields{
-		"internalAddr": internalAddr,
-		"externalAddr": externalAddr,
-	}).Debug("NAT UDP packet listener ready")
+	logNATStatus(log, ClassifyNAT(mapper, externalIP), "UDP")
 	return packetListener, nil
 }
 
@@ -98,7 +134,14 @@ func ListenPacketWithFallback(port int) (*NATPacketListener, error) {
 	return ListenPacketWithFallbackContext(context.Background(), port)
 }
 
-// ListenPacketWithFallbackContext creates a UDP packet listener with NAT traversal on the specified port.
+// ListenPacketWithFallbackContext creates a UDP packet listener with NAT traversal on the specified port,
+// falling back to a standard net.PacketConn if NAT traversal fails.
+// It is equivalent to calling ListenPacketWithFallback on a zero ListenConfig.
+func ListenPacketWithFallbackContext(ctx context.Context, port int) (*NATPacketListener, error) {
+	return (&ListenConfig{}).ListenPacketWithFallback(ctx, port)
+}
+
+// ListenPacketWithFallback creates a UDP packet listener with NAT traversal on the specified port.
 // If NAT traversal fails (UPnP and NAT-PMP both unavailable), it falls back to a
 // standard net.PacketConn without NAT hole-punching.
 // The context can be used to cancel the discovery and mapping operations.
@@ -109,7 +152,8 @@ func ListenPacketWithFallback(port int) (*NATPacketListener, error) {
 //   - Addr() returns a NATAddr where internal and external addresses are the same
 //   - No port renewal is performed (the renewal manager is nil)
 //   - IsFallback() returns true
-func ListenPacketWithFallbackContext(ctx context.Context, port int) (*NATPacketListener, error) {
+func (lc *ListenConfig) ListenPacketWithFallback(ctx context.Context, port int) (*NATPacketListener, error) {
+	log := lc.logger()
 	log.WithField("port", port).Debug("creating NAT UDP packet listener with fallback")
 
 	// Check context before starting
@@ -118,7 +162,7 @@ func ListenPacketWithFallbackContext(ctx context.Context, port int) (*NATPacketL
 	}
 
 	// Try NAT traversal first
-	natPacketListener, err := ListenPacketContext(ctx, port)
+	natPacketListener, err := lc.ListenPacket(ctx, port)
 	if err == nil {
 		return natPacketListener, nil
 	}
@@ -141,17 +185,29 @@ func ListenPacketWithFallbackContext(ctx context.Context, port int) (*NATPacketL
 	internalAddr := conn.LocalAddr().String()
 	addr := NewNATAddr("udp", internalAddr, internalAddr)
 
-	log.WithFields(logger.Fields{
+	log.WithFields(Fields{
 		"port":         port,
 		"internalAddr": internalAddr,
 	}).Info("UDP packet listener started in fallback mode (no NAT traversal)")
-
-	return &NATPacketListener{
+	emit(Event{
+		Kind:         FallbackEngaged,
+		Mapper:       "none",
+		Protocol:     "UDP",
+		InternalPort: port,
+		ExternalPort: port,
+		Err:          err,
+	})
+
+	fallbackListener := &NATPacketListener{
 		conn:         conn,
 		renewal:      nil, // No renewal for fallback
 		externalPort: port,
 		externalIP:   "", // Unknown external IP in fallback mode
 		addr:         addr,
 		fallback:     true,
-	}, nil
+		log:          log,
+		created:      time.Now(),
+	}
+	liveListeners.addUDP(fallbackListener)
+	return fallbackListener, nil
 }
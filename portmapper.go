@@ -5,6 +5,8 @@ package nattraversal
 import (
 	"context"
 	"fmt"
+	"os"
+	"time"
 )
 
 // NewPortMapper creates a port mapper, trying direct connectivity first,
@@ -14,10 +16,71 @@ func NewPortMapper() (PortMapper, error) {
 	return NewPortMapperContext(context.Background())
 }
 
-// NewPortMapperContext creates a port mapper with context support, trying direct
-// connectivity first, then UPnP, then NAT-PMP.
+// NewPortMapperContext creates a port mapper with context support. If the
+// process opted into natd delegation by setting $NATD_SOCKET and a daemon
+// answers on that socket, mappings are delegated to it through a
+// DaemonMapper; otherwise direct connectivity is tried first, then UPnP,
+// then NAT-PMP.
 // The context is passed through to the discovery process, allowing cancellation during slow network operations.
+// DiscoveryStarted and MapperSelected events are emitted around discovery,
+// and the selected mapper and discovery latency are reported as metrics.
 func NewPortMapperContext(ctx context.Context) (PortMapper, error) {
+	return instrumentDiscovery(ctx, discoverPortMapper)
+}
+
+// NewGatewayPortMapperContext is like NewPortMapperContext but ignores a
+// running natd daemon. It is used by the daemon itself.
+func NewGatewayPortMapperContext(ctx context.Context) (PortMapper, error) {
+	return instrumentDiscovery(ctx, discoverGatewayMapper)
+}
+
+// instrumentDiscovery runs discover with events and metrics.
+func instrumentDiscovery(ctx context.Context, discover mapperDiscovery) (PortMapper, error) {
+	start := time.Now()
+	emit(Event{Kind: DiscoveryStarted})
+
+	mapper, err := discover(ctx)
+	elapsed := time.Since(start)
+	name := MapperName(mapper)
+	emit(Event{
+		Kind:     MapperSelected,
+		Mapper:   name,
+		Duration: elapsed,
+		Err:      err,
+	})
+
+	labels := Labels{"mapper": name}
+	addCounter(MetricMapperSelected, labels, 1)
+	observeDuration(MetricDiscoveryDuration, labels, elapsed)
+	return mapper, err
+}
+
+// discoverPortMapper delegates to the natd daemon named by $NATD_SOCKET if
+// the variable is set, and discovers the gateway otherwise.
+func discoverPortMapper(ctx context.Context) (PortMapper, error) {
+	return daemonDiscovery(os.Getenv(DaemonSocketEnv))(ctx)
+}
+
+// daemonDiscovery returns a discovery that delegates to a natd daemon
+// listening on socket if one answers, and discovers the gateway otherwise.
+// An empty socket disables delegation.
+func daemonDiscovery(socket string) mapperDiscovery {
+	return func(ctx context.Context) (PortMapper, error) {
+		if socket == "" {
+			return discoverGatewayMapper(ctx)
+		}
+		daemon, err := sharedDaemonMapper(ctx, socket)
+		if err == nil {
+			log.WithField("socket", daemon.socket).Debug("natd daemon port mapper selected")
+			return daemon, nil
+		}
+		log.WithError(err).Debug("no natd daemon, discovering the gateway")
+		return discoverGatewayMapper(ctx)
+	}
+}
+
+// discoverGatewayMapper tries direct connectivity, UPnP and NAT-PMP in turn.
+func discoverGatewayMapper(ctx context.Context) (PortMapper, error) {
 	log.Debug("discovering port mapper")
 
 	// Check context before starting
@@ -58,3 +121,110 @@ func NewPortMapperContext(ctx context.Context) (PortMapper, error) {
 	log.Debug("NAT-PMP port mapper selected")
 	return natpmp, nil
 }
+
+// mapPortWithLease creates a mapping and reports the granted lease lifetime.
+// Mappers that do not implement LeasePortMapper are assumed to grant the
+// requested duration.
+func mapPortWithLease(mapper PortMapper, protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	if lm, ok := mapper.(LeasePortMapper); ok {
+		return lm.MapPortWithLease(protocol, internalPort, duration)
+	}
+
+	externalPort, err := mapper.MapPort(protocol, internalPort, duration)
+	if err != nil {
+		return MapPortResult{}, err
+	}
+	return MapPortResult{ExternalPort: externalPort, Lifetime: duration}, nil
+}
+
+// mapPortContext creates a mapping as mapPortWithLease does, giving up when
+// ctx is done. Requests of mappers that do not implement ContextPortMapper
+// then complete in the background.
+func mapPortContext(ctx context.Context, mapper PortMapper, protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	if cm, ok := mapper.(ContextPortMapper); ok {
+		return cm.MapPortContext(ctx, protocol, internalPort, duration)
+	}
+	return callContext(ctx, func() (MapPortResult, error) {
+		return mapPortWithLease(mapper, protocol, internalPort, duration)
+	})
+}
+
+// unmapContext removes a mapping, giving up when ctx is done. Requests of
+// mappers that do not implement ContextPortMapper then complete in the
+// background.
+func unmapContext(ctx context.Context, mapper PortMapper, protocol string, externalPort int) error {
+	if cm, ok := mapper.(ContextPortMapper); ok {
+		return cm.UnmapPortContext(ctx, protocol, externalPort)
+	}
+	_, err := callContext(ctx, func() (struct{}, error) {
+		return struct{}{}, mapper.UnmapPort(protocol, externalPort)
+	})
+	return err
+}
+
+// externalIPContext returns the external IP of mapper, giving up when ctx is
+// done. Requests of mappers that do not implement ContextPortMapper then
+// complete in the background.
+func externalIPContext(ctx context.Context, mapper PortMapper) (string, error) {
+	if cm, ok := mapper.(ContextPortMapper); ok {
+		return cm.GetExternalIPContext(ctx)
+	}
+	return callContext(ctx, mapper.GetExternalIP)
+}
+
+// callContext runs f in a goroutine and returns its result, or ctx.Err() if
+// ctx is done first.
+func callContext[T any](ctx context.Context, f func() (T, error)) (T, error) {
+	if err := ctx.Err(); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := f()
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// AsContextPortMapper returns mapper as a ContextPortMapper. The built-in
+// mappers are returned unchanged. Other mappers are adapted: their requests
+// run in the background and the adapter returns ctx.Err() as soon as ctx is
+// done, while the request itself runs to completion.
+func AsContextPortMapper(mapper PortMapper) ContextPortMapper {
+	if cm, ok := mapper.(ContextPortMapper); ok {
+		return cm
+	}
+	return &contextAdapter{PortMapper: mapper}
+}
+
+// contextAdapter adds context support to a PortMapper.
+type contextAdapter struct {
+	PortMapper
+}
+
+// MapPortContext implements the ContextPortMapper interface.
+func (a *contextAdapter) MapPortContext(ctx context.Context, protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	return mapPortContext(ctx, a.PortMapper, protocol, internalPort, duration)
+}
+
+// UnmapPortContext implements the ContextPortMapper interface.
+func (a *contextAdapter) UnmapPortContext(ctx context.Context, protocol string, externalPort int) error {
+	return unmapContext(ctx, a.PortMapper, protocol, externalPort)
+}
+
+// GetExternalIPContext implements the ContextPortMapper interface.
+func (a *contextAdapter) GetExternalIPContext(ctx context.Context) (string, error) {
+	return externalIPContext(ctx, a.PortMapper)
+}
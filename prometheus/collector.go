@@ -0,0 +1,241 @@
+// Package prometheus exposes the metrics of go-nat-listener in the
+// Prometheus text exposition format, without depending on the Prometheus
+// client library. Register a Collector with nattraversal.SetMetricsSink and
+// serve it on the scrape path:
+//
+//	collector := prometheus.NewCollector(nil)
+//	nattraversal.SetMetricsSink(collector)
+//	http.Handle("/metrics", collector)
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	nattraversal "github.com/go-i2p/go-nat-listener"
+)
+
+// DefaultBuckets are the histogram upper bounds in seconds used when
+// NewCollector is given none. They cover fast local gateways up to the
+// discovery timeouts.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// help describes the metrics reported by nattraversal.
+var help = map[string]string{
+	nattraversal.MetricMapperSelected:      "Port mapper discoveries by selected mapper.",
+	nattraversal.MetricDiscoveryDuration:   "Port mapper discovery latency in seconds.",
+	nattraversal.MetricRenewals:            "Port mapping renewal attempts by result.",
+	nattraversal.MetricRenewalDuration:     "Port mapping renewal latency in seconds.",
+	nattraversal.MetricAcceptedConnections: "Connections accepted by NAT listeners.",
+	nattraversal.MetricPacketBytes:         "Bytes read and written by NAT packet connections.",
+}
+
+// Collector is a nattraversal.MetricsSink that keeps counters and
+// histograms in memory and writes them in the Prometheus text format.
+type Collector struct {
+	buckets    []float64
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// histogram holds the observations of one label set.
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewCollector creates a Collector whose histograms use the given bucket
+// upper bounds, or DefaultBuckets if buckets is empty.
+func NewCollector(buckets []float64) *Collector {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &Collector{
+		buckets:    sorted,
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// AddCounter implements nattraversal.MetricsSink.
+func (c *Collector) AddCounter(name string, labels nattraversal.Labels, delta float64) {
+	key := formatLabels(labels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	samples, ok := c.counters[name]
+	if !ok {
+		samples = make(map[string]float64)
+		c.counters[name] = samples
+	}
+	samples[key] += delta
+}
+
+// ObserveHistogram implements nattraversal.MetricsSink.
+func (c *Collector) ObserveHistogram(name string, labels nattraversal.Labels, value float64) {
+	key := formatLabels(labels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	samples, ok := c.histograms[name]
+	if !ok {
+		samples = make(map[string]*histogram)
+		c.histograms[name] = samples
+	}
+	h, ok := samples[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(c.buckets))}
+		samples[key] = h
+	}
+
+	if i := sort.SearchFloat64s(c.buckets, value); i < len(c.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format,
+// sorted by name and labels.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+
+	c.mu.Lock()
+	for _, name := range sortedKeys(c.counters) {
+		writeHeader(cw, name, "counter")
+		samples := c.counters[name]
+		for _, key := range sortedKeys(samples) {
+			fmt.Fprintf(cw, "%s%s %s\n", name, braces(key), formatValue(samples[key]))
+		}
+	}
+	for _, name := range sortedKeys(c.histograms) {
+		writeHeader(cw, name, "histogram")
+		samples := c.histograms[name]
+		for _, key := range sortedKeys(samples) {
+			c.writeHistogram(cw, name, key, samples[key])
+		}
+	}
+	c.mu.Unlock()
+
+	if err := bw.Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return cw.n, cw.err
+}
+
+// writeHistogram writes the bucket, sum and count series of one label set.
+func (c *Collector) writeHistogram(w io.Writer, name, key string, h *histogram) {
+	var cumulative uint64
+	for i, bound := range c.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(key, `le="`+formatValue(bound)+`"`)), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(key, `le="+Inf"`)), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(key), formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(key), h.count)
+}
+
+// ServeHTTP serves the metrics for scraping.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric.
+func writeHeader(w io.Writer, name, typ string) {
+	if text, ok := help[name]; ok {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, text)
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// formatLabels formats labels as sorted name="value" pairs separated by
+// commas, escaping the values.
+func formatLabels(labels nattraversal.Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabelValue(labels[name]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// labelEscaper escapes label values as required by the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// joinLabels appends a formatted pair to formatted labels.
+func joinLabels(labels, pair string) string {
+	if labels == "" {
+		return pair
+	}
+	return labels + "," + pair
+}
+
+// braces wraps formatted labels in braces, or returns "" if there are none.
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// formatValue formats a sample value as the text format expects.
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// countingWriter counts written bytes and remembers the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,65 @@
+package prometheus
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	nattraversal "github.com/go-i2p/go-nat-listener"
+)
+
+func TestCollectorExposition(t *testing.T) {
+	c := NewCollector([]float64{1, 0.1})
+	c.AddCounter(nattraversal.MetricRenewals, nattraversal.Labels{"result": "success", "mapper": "upnp"}, 2)
+	c.AddCounter(nattraversal.MetricRenewals, nattraversal.Labels{"result": "failure", "mapper": "upnp"}, 1)
+	c.AddCounter("custom_total", nil, 1)
+	c.ObserveHistogram(nattraversal.MetricDiscoveryDuration, nattraversal.Labels{"mapper": "nat-pmp"}, 0.05)
+	c.ObserveHistogram(nattraversal.MetricDiscoveryDuration, nattraversal.Labels{"mapper": "nat-pmp"}, 0.5)
+	c.ObserveHistogram(nattraversal.MetricDiscoveryDuration, nattraversal.Labels{"mapper": "nat-pmp"}, 2)
+
+	var b strings.Builder
+	n, err := c.WriteTo(&b)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if int(n) != b.Len() {
+		t.Errorf("WriteTo reported %d bytes, wrote %d", n, b.Len())
+	}
+
+	expected := `# TYPE custom_total counter
+custom_total 1
+# HELP natlistener_renewals_total Port mapping renewal attempts by result.
+# TYPE natlistener_renewals_total counter
+natlistener_renewals_total{mapper="upnp",result="failure"} 1
+natlistener_renewals_total{mapper="upnp",result="success"} 2
+# HELP natlistener_discovery_duration_seconds Port mapper discovery latency in seconds.
+# TYPE natlistener_discovery_duration_seconds histogram
+natlistener_discovery_duration_seconds_bucket{mapper="nat-pmp",le="0.1"} 1
+natlistener_discovery_duration_seconds_bucket{mapper="nat-pmp",le="1"} 2
+natlistener_discovery_duration_seconds_bucket{mapper="nat-pmp",le="+Inf"} 3
+natlistener_discovery_duration_seconds_sum{mapper="nat-pmp"} 2.55
+natlistener_discovery_duration_seconds_count{mapper="nat-pmp"} 3
+`
+	if b.String() != expected {
+		t.Errorf("Unexpected exposition:\n%s\nexpected:\n%s", b.String(), expected)
+	}
+}
+
+func TestCollectorEscapesLabels(t *testing.T) {
+	c := NewCollector(nil)
+	c.AddCounter("escaped_total", nattraversal.Labels{"v": "a\"b\\c\nd"}, 1)
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), `escaped_total{v="a\"b\\c\nd"} 1`) {
+		t.Errorf("Label value not escaped:\n%s", rec.Body.String())
+	}
+}
+
+func TestCollectorAsSink(t *testing.T) {
+	var _ nattraversal.MetricsSink = NewCollector(nil)
+}
@@ -0,0 +1,222 @@
+package nattraversal
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ReachabilityStatus summarises whether peers on the internet can connect
+// to a listener.
+type ReachabilityStatus int
+
+const (
+	// ReachabilityUnknown means there is not enough information to decide,
+	// for example because the external IP could not be classified.
+	ReachabilityUnknown ReachabilityStatus = iota
+	// ReachabilityReachable means the listener has a working mapping on a
+	// public IP, or VerifyReachability confirmed that its external address
+	// is reachable.
+	ReachabilityReachable
+	// ReachabilityFirewalled means inbound connections are not expected to
+	// work: there is no port mapping, the mapping was lost, the external IP
+	// is behind another NAT, or verification failed.
+	ReachabilityFirewalled
+	// ReachabilitySymmetricNAT means inbound connections failed and the NAT
+	// assigns a different external port per destination, so hole punching
+	// will not work either. It requires a prober implementing
+	// SymmetricNATProber.
+	ReachabilitySymmetricNAT
+)
+
+// String returns a human-readable name for the reachability status.
+func (s ReachabilityStatus) String() string {
+	switch s {
+	case ReachabilityUnknown:
+		return "unknown"
+	case ReachabilityReachable:
+		return "reachable"
+	case ReachabilityFirewalled:
+		return "firewalled"
+	case ReachabilitySymmetricNAT:
+		return "symmetric-nat"
+	default:
+		return fmt.Sprintf("ReachabilityStatus(%d)", int(s))
+	}
+}
+
+// Reachability combines what a listener knows about its reachability.
+type Reachability struct {
+	Status ReachabilityStatus
+	// Mapper names the port mapper in use, see MapperName. It is "none" in
+	// fallback mode.
+	Mapper          string
+	ExternalAddr    string
+	ExternalIPClass IPClass
+	Topology        NATTopology
+	// MappingState is the health of the port mapping as seen by renewal.
+	// It is meaningless in fallback mode.
+	MappingState MappingState
+	// Verification is the verdict of the last VerifyReachability call.
+	Verification VerificationStatus
+	Hairpin      HairpinStatus
+	// Symmetric reports whether the last verification found a symmetric NAT.
+	Symmetric bool
+}
+
+// MapperName returns a short name for the type of mapper: "upnp", "nat-pmp",
+// "direct", "multi", "cascaded", "daemon", or "none" for a nil mapper.
+// Mappers adapted by AsContextPortMapper are named after the mapper they wrap.
+func MapperName(mapper PortMapper) string {
+	switch m := mapper.(type) {
+	case nil:
+		return "none"
+	case *UPnPMapper:
+		return "upnp"
+	case *NATPMPMapper:
+		return "nat-pmp"
+	case *DirectPortMapper:
+		return "direct"
+	case *MultiMapper:
+		return "multi"
+	case *CascadedMapper:
+		return "cascaded"
+	case *DaemonMapper:
+		return "daemon"
+	case *contextAdapter:
+		return MapperName(m.PortMapper)
+	default:
+		return fmt.Sprintf("%T", mapper)
+	}
+}
+
+// newReachability builds the reachability of a listener from its state.
+// A nil renewal manager means the listener is in fallback mode.
+func newReachability(renewal *RenewalManager, addr *NATAddr, externalIP string, verification VerificationResult) Reachability {
+	r := Reachability{
+		Mapper:       "none",
+		Verification: verification.Status,
+		Symmetric:    verification.SymmetricNAT,
+		Hairpin:      addr.Hairpin(),
+	}
+	if renewal != nil {
+		mapper := renewal.currentMapper()
+		status := ClassifyNAT(mapper, externalIP)
+		r.Mapper = MapperName(mapper)
+		r.ExternalAddr = addr.ExternalAddr()
+		r.ExternalIPClass = status.ExternalIPClass
+		r.Topology = status.Topology
+		r.MappingState = renewal.State()
+	}
+	r.Status = r.deriveStatus(renewal != nil)
+	return r
+}
+
+// deriveStatus decides the overall status. Verification failures and lost
+// mappings take precedence, then a successful verification, then the class
+// of the external IP.
+func (r Reachability) deriveStatus(mapped bool) ReachabilityStatus {
+	switch {
+	case r.Verification == VerificationUnreachable && r.Symmetric:
+		return ReachabilitySymmetricNAT
+	case r.Verification == VerificationUnreachable:
+		return ReachabilityFirewalled
+	case !mapped, r.MappingState == MappingLost:
+		return ReachabilityFirewalled
+	case r.Verification == VerificationReachable:
+		return ReachabilityReachable
+	}
+
+	switch r.Topology {
+	case TopologyDirect, TopologySingleNAT:
+		return ReachabilityReachable
+	case TopologyDoubleNAT:
+		if r.ExternalIPClass == IPClassPublic {
+			// Cascaded through the upstream gateway
+			return ReachabilityReachable
+		}
+		return ReachabilityFirewalled
+	case TopologyCGNAT:
+		return ReachabilityFirewalled
+	default:
+		return ReachabilityUnknown
+	}
+}
+
+// reachabilityFeed delivers reachability changes to subscribers. Each
+// subscriber channel holds only the latest value, so slow subscribers skip
+// intermediate states instead of blocking the listener.
+type reachabilityFeed struct {
+	mu     sync.Mutex
+	last   Reachability
+	subs   map[chan Reachability]struct{}
+	closed bool
+}
+
+// subscribe returns a channel that receives current, and then every change.
+func (f *reachabilityFeed) subscribe(current Reachability) (<-chan Reachability, func()) {
+	ch := make(chan Reachability, 1)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	f.publishLocked(current)
+	if f.subs == nil {
+		f.subs = make(map[chan Reachability]struct{})
+	}
+	f.subs[ch] = struct{}{}
+	ch <- current
+
+	cancel := func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.subs[ch]; ok {
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// publish sends r to every subscriber if it differs from the last value.
+func (f *reachabilityFeed) publish(r Reachability) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.publishLocked(r)
+	}
+}
+
+// publishLocked is publish with f.mu held.
+func (f *reachabilityFeed) publishLocked(r Reachability) {
+	if r == f.last {
+		return
+	}
+	f.last = r
+	for ch := range f.subs {
+		// Replace an unread value with the latest one
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- r
+	}
+
+	log.WithField("status", r.Status.String()).Debug("reachability changed")
+}
+
+// close closes every subscriber channel.
+func (f *reachabilityFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	for ch := range f.subs {
+		close(ch)
+	}
+	f.subs = nil
+}
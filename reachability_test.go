@@ -0,0 +1,241 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestReachabilityDeriveStatus tests how listener state maps to a status
+func TestReachabilityDeriveStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		r        Reachability
+		mapped   bool
+		expected ReachabilityStatus
+	}{
+		{"Public mapping", Reachability{Topology: TopologySingleNAT, ExternalIPClass: IPClassPublic}, true, ReachabilityReachable},
+		{"Direct", Reachability{Topology: TopologyDirect, ExternalIPClass: IPClassPublic}, true, ReachabilityReachable},
+		{"Fallback", Reachability{}, false, ReachabilityFirewalled},
+		{"Double NAT", Reachability{Topology: TopologyDoubleNAT, ExternalIPClass: IPClassPrivate}, true, ReachabilityFirewalled},
+		{"Cascaded double NAT", Reachability{Topology: TopologyDoubleNAT, ExternalIPClass: IPClassPublic}, true, ReachabilityReachable},
+		{"CGNAT", Reachability{Topology: TopologyCGNAT, ExternalIPClass: IPClassCGNAT}, true, ReachabilityFirewalled},
+		{"Lost mapping", Reachability{Topology: TopologySingleNAT, MappingState: MappingLost}, true, ReachabilityFirewalled},
+		{"Degraded mapping", Reachability{Topology: TopologySingleNAT, MappingState: MappingDegraded}, true, ReachabilityReachable},
+		{"Verification failed", Reachability{Topology: TopologySingleNAT, Verification: VerificationUnreachable}, true, ReachabilityFirewalled},
+		{"Symmetric NAT", Reachability{Topology: TopologySingleNAT, Verification: VerificationUnreachable, Symmetric: true}, true, ReachabilitySymmetricNAT},
+		{"Verified behind double NAT", Reachability{Topology: TopologyDoubleNAT, Verification: VerificationReachable}, true, ReachabilityReachable},
+		{"Unclassified", Reachability{Topology: TopologyUnknown}, true, ReachabilityUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.deriveStatus(tt.mapped); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// receiveReachability waits for the next value on ch.
+func receiveReachability(t *testing.T, ch <-chan Reachability) Reachability {
+	t.Helper()
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			t.Fatal("Reachability channel closed unexpectedly")
+		}
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("Expected reachability update")
+		return Reachability{}
+	}
+}
+
+// TestSubscribeReachability tests reachability change notifications
+func TestSubscribeReachability(t *testing.T) {
+	mapper := NewMockPortMapper()
+	useMockPortMapper(t, mapper)
+
+	listener, err := (&ListenConfig{}).Listen(context.Background(), freePorts(t, 1)[0])
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	updates, cancel := listener.SubscribeReachability()
+	defer cancel()
+
+	initial := receiveReachability(t, updates)
+	if initial.Status != ReachabilityReachable || initial.Mapper != "*nattraversal.MockPortMapper" || initial.MappingState != MappingActive {
+		t.Errorf("Unexpected initial reachability: %+v", initial)
+	}
+
+	// A failed renewal degrades the mapping
+	mapper.SetFailureRate(1.0)
+	listener.renewal.renew()
+	degraded := receiveReachability(t, updates)
+	if degraded.MappingState != MappingDegraded {
+		t.Errorf("Expected degraded mapping, got %+v", degraded)
+	}
+
+	// A new external IP is published
+	listener.updateExternalAddr("192.168.0.2", listener.ExternalPort())
+	doubleNAT := receiveReachability(t, updates)
+	if doubleNAT.Status != ReachabilityFirewalled || doubleNAT.Topology != TopologyDoubleNAT {
+		t.Errorf("Expected firewalled double NAT, got %+v", doubleNAT)
+	}
+
+	listener.Close()
+	if _, ok := <-updates; ok {
+		t.Error("Expected subscription channel closed with the listener")
+	}
+}
+
+// TestVerificationClearedOnAddressChange tests that a verification of the
+// old external address is not reported for the new one
+func TestVerificationClearedOnAddressChange(t *testing.T) {
+	useMockPortMapper(t, &DirectPortMapper{publicIP: "127.0.0.1"})
+
+	tcp, err := (&ListenConfig{}).Listen(context.Background(), freePorts(t, 1)[0])
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer tcp.Close()
+	udp, err := (&ListenConfig{}).ListenPacket(context.Background(), freePorts(t, 1)[0])
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer udp.Close()
+
+	tcp.VerifyReachability(context.Background())
+	tcp.updateExternalAddr("127.0.0.1", tcp.ExternalPort())
+	if tcp.Verification().Status == VerificationUnknown {
+		t.Error("Expected verification kept while the address is unchanged")
+	}
+	tcp.updateExternalAddr("127.0.0.1", tcp.ExternalPort()+1)
+	if status := tcp.Verification().Status; status != VerificationUnknown {
+		t.Errorf("Expected TCP verification cleared after a port change, got %v", status)
+	}
+	if status := tcp.Reachability().Verification; status != VerificationUnknown {
+		t.Errorf("Expected reachability without the stale verification, got %v", status)
+	}
+
+	udp.VerifyReachability(context.Background())
+	if udp.Verification().Status == VerificationUnknown {
+		t.Fatal("Expected UDP verification to be recorded")
+	}
+	udp.updateExternalAddr("127.0.0.2", udp.ExternalPort())
+	if status := udp.Verification().Status; status != VerificationUnknown {
+		t.Errorf("Expected UDP verification cleared after an IP change, got %v", status)
+	}
+}
+
+// TestFallbackReachability tests that a listener without port mapping is firewalled
+func TestFallbackReachability(t *testing.T) {
+	original := newPortMapper
+	newPortMapper = func(ctx context.Context) (PortMapper, error) {
+		return nil, errors.New("no gateway")
+	}
+	defer func() { newPortMapper = original }()
+
+	listener, err := (&ListenConfig{}).ListenPacketWithFallback(context.Background(), freePorts(t, 1)[0])
+	if err != nil {
+		t.Fatalf("ListenPacketWithFallback failed: %v", err)
+	}
+	defer listener.Close()
+
+	r := listener.Reachability()
+	if r.Status != ReachabilityFirewalled || r.Mapper != "none" {
+		t.Errorf("Expected firewalled without mapper, got %+v", r)
+	}
+}
+
+// symmetricProber fails every probe and reports a symmetric NAT.
+type symmetricProber struct{}
+
+func (symmetricProber) ProbeTCP(ctx context.Context, addr string) error {
+	return errors.New("connection refused")
+}
+
+func (symmetricProber) ProbeUDP(ctx context.Context, addr string, payload []byte) error {
+	return errors.New("not sent")
+}
+
+func (symmetricProber) ProbeSymmetricNAT(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+// TestVerifyReachabilitySymmetricNAT tests that failed verification reports a symmetric NAT
+func TestVerifyReachabilitySymmetricNAT(t *testing.T) {
+	mapper := NewMockPortMapper()
+	mapper.SetExternalIP("127.0.0.1")
+	mapper.SetNATType(RestrictedNAT)
+	useMockPortMapper(t, mapper)
+
+	listener, err := (&ListenConfig{Prober: symmetricProber{}}).Listen(context.Background(), freePorts(t, 1)[0])
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	result, _ := listener.VerifyReachability(context.Background())
+	if !result.SymmetricNAT {
+		t.Errorf("Expected symmetric NAT in verification result, got %+v", result)
+	}
+	if status := listener.Reachability().Status; status != ReachabilitySymmetricNAT {
+		t.Errorf("Expected symmetric NAT reachability, got %v", status)
+	}
+}
+
+// TestEchoProberSymmetricNAT tests symmetric NAT detection with address requests
+func TestEchoProberSymmetricNAT(t *testing.T) {
+	server := &EchoServer{}
+	defer server.Close()
+	var servers []string
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		go server.ServePacket(conn)
+		servers = append(servers, conn.LocalAddr().String())
+	}
+
+	prober := &EchoProber{PacketServers: servers}
+	symmetric, err := prober.ProbeSymmetricNAT(context.Background())
+	if err != nil {
+		t.Fatalf("ProbeSymmetricNAT failed: %v", err)
+	}
+	if symmetric {
+		t.Error("Expected no symmetric NAT on loopback")
+	}
+
+	// A server behind a symmetric NAT sees another source port
+	liar, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer liar.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			_, addr, err := liar.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			liar.WriteTo([]byte("NATADDR 203.0.113.9:1"), addr)
+		}
+	}()
+
+	prober.PacketServers = []string{servers[0], liar.LocalAddr().String()}
+	symmetric, err = prober.ProbeSymmetricNAT(context.Background())
+	if err != nil {
+		t.Fatalf("ProbeSymmetricNAT failed: %v", err)
+	}
+	if !symmetric {
+		t.Error("Expected symmetric NAT when servers observe different addresses")
+	}
+}
@@ -0,0 +1,168 @@
+package nattraversal
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxIPHistory bounds the external IP history kept per listener
+const maxIPHistory = 16
+
+// ExternalIPChange records the external IP of a listener from a point in time.
+type ExternalIPChange struct {
+	Time time.Time `json:"time"`
+	IP   string    `json:"ip"`
+}
+
+// ipHistory records the external IPs of a listener, oldest first. It is
+// guarded by the listener's mutex.
+type ipHistory struct {
+	changes []ExternalIPChange
+}
+
+// record appends ip if it differs from the current one, dropping the oldest
+// entry beyond maxIPHistory.
+func (h *ipHistory) record(ip string, at time.Time) {
+	if ip == "" {
+		return
+	}
+	if n := len(h.changes); n > 0 && h.changes[n-1].IP == ip {
+		return
+	}
+	h.changes = append(h.changes, ExternalIPChange{Time: at, IP: ip})
+	if len(h.changes) > maxIPHistory {
+		h.changes = append([]ExternalIPChange(nil), h.changes[len(h.changes)-maxIPHistory:]...)
+	}
+}
+
+// snapshot returns a copy of the history.
+func (h *ipHistory) snapshot() []ExternalIPChange {
+	return append([]ExternalIPChange(nil), h.changes...)
+}
+
+// ListenerInfo describes an open listener, as shown by DebugHandler.
+type ListenerInfo struct {
+	// Network is "tcp" or "udp".
+	Network      string `json:"network"`
+	InternalAddr string `json:"internal_addr"`
+	ExternalAddr string `json:"external_addr"`
+	// Mapper names the port mapper in use, see MapperName.
+	Mapper   string    `json:"mapper"`
+	Fallback bool      `json:"fallback"`
+	Created  time.Time `json:"created"`
+	// Reachability is the Status of the listener's Reachability.
+	Reachability string `json:"reachability"`
+	// MappingState, LeaseLifetime and LeaseExpiry describe the port mapping
+	// and are empty in fallback mode. LeaseExpiry is zero if the lease does
+	// not expire.
+	MappingState  string        `json:"mapping_state,omitempty"`
+	LeaseLifetime time.Duration `json:"lease_lifetime,omitempty"`
+	LeaseExpiry   time.Time     `json:"lease_expiry"`
+	// LastRenewal is when the mapping was last renewed or a renewal last
+	// failed with LastRenewalError, zero before the first renewal.
+	LastRenewal      time.Time `json:"last_renewal"`
+	LastRenewalError string    `json:"last_renewal_error,omitempty"`
+	// ExternalIPHistory lists the external IPs of the listener, oldest first.
+	ExternalIPHistory []ExternalIPChange `json:"external_ip_history,omitempty"`
+	// Connections counts the connections of a TCP listener that tracks them,
+	// see ListenConfig.Connections.
+	Connections *ConnStats `json:"connections,omitempty"`
+}
+
+// newListenerInfo describes a listener from its state.
+func newListenerInfo(network string, addr *NATAddr, fallback bool, created time.Time, history []ExternalIPChange, renewal *RenewalManager, reach Reachability) ListenerInfo {
+	info := ListenerInfo{
+		Network:           network,
+		InternalAddr:      addr.InternalAddr(),
+		ExternalAddr:      addr.ExternalAddr(),
+		Mapper:            reach.Mapper,
+		Fallback:          fallback,
+		Created:           created,
+		Reachability:      reach.Status.String(),
+		ExternalIPHistory: history,
+	}
+	if renewal != nil {
+		info.MappingState = renewal.State().String()
+		info.LeaseLifetime = renewal.LeaseLifetime()
+		info.LeaseExpiry = renewal.LeaseExpiry()
+		var err error
+		info.LastRenewal, err = renewal.LastRenewal()
+		if err != nil {
+			info.LastRenewalError = err.Error()
+		}
+	}
+	return info
+}
+
+// listenerRegistry tracks the open listeners.
+type listenerRegistry struct {
+	mu  sync.Mutex
+	tcp map[*NATListener]struct{}
+	udp map[*NATPacketListener]struct{}
+}
+
+// liveListeners holds every listener created by the package until it is closed.
+var liveListeners listenerRegistry
+
+func (r *listenerRegistry) addTCP(l *NATListener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tcp == nil {
+		r.tcp = make(map[*NATListener]struct{})
+	}
+	r.tcp[l] = struct{}{}
+}
+
+func (r *listenerRegistry) removeTCP(l *NATListener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tcp, l)
+}
+
+func (r *listenerRegistry) addUDP(l *NATPacketListener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.udp == nil {
+		r.udp = make(map[*NATPacketListener]struct{})
+	}
+	r.udp[l] = struct{}{}
+}
+
+func (r *listenerRegistry) removeUDP(l *NATPacketListener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.udp, l)
+}
+
+// Listeners describes every open NATListener and NATPacketListener created
+// by the package, sorted by network and internal address.
+func Listeners() []ListenerInfo {
+	liveListeners.mu.Lock()
+	tcp := make([]*NATListener, 0, len(liveListeners.tcp))
+	for l := range liveListeners.tcp {
+		tcp = append(tcp, l)
+	}
+	udp := make([]*NATPacketListener, 0, len(liveListeners.udp))
+	for l := range liveListeners.udp {
+		udp = append(udp, l)
+	}
+	liveListeners.mu.Unlock()
+
+	// Listener locks are taken after the registry lock is released, since
+	// Close holds the listener lock while unregistering
+	infos := make([]ListenerInfo, 0, len(tcp)+len(udp))
+	for _, l := range tcp {
+		infos = append(infos, l.info())
+	}
+	for _, l := range udp {
+		infos = append(infos, l.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Network != infos[j].Network {
+			return infos[i].Network < infos[j].Network
+		}
+		return infos[i].InternalAddr < infos[j].InternalAddr
+	})
+	return infos
+}
@@ -1,33 +1,78 @@
 package nattraversal
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
 	"sync"
 	"time"
 
-	"github.com/go-i2p/logger"
+	"github.com/go-i2p/go-nat-listener/clock"
 )
 
 // PortChangeCallback is called when the external port changes during renewal.
 // The callback receives the new external port number.
 type PortChangeCallback func(newExternalPort int)
 
+// MappingState describes the health of a port mapping maintained by a RenewalManager.
+type MappingState int
+
+const (
+	// MappingActive means the most recent mapping or renewal succeeded.
+	MappingActive MappingState = iota
+	// MappingDegraded means renewals are failing but the lease has not expired yet.
+	MappingDegraded
+	// MappingLost means the lease expired without a successful renewal, so the
+	// mapping is most likely gone and the application is no longer reachable.
+	MappingLost
+)
+
+// String returns a human-readable name for the mapping state.
+func (s MappingState) String() string {
+	switch s {
+	case MappingActive:
+		return "active"
+	case MappingDegraded:
+		return "degraded"
+	case MappingLost:
+		return "lost"
+	default:
+		return fmt.Sprintf("MappingState(%d)", int(s))
+	}
+}
+
+// StateChangeCallback is called when the mapping state changes.
+// The callback receives the previous and the new state.
+type StateChangeCallback func(oldState, newState MappingState)
+
 // RenewalManager handles automatic port mapping renewal.
 // Moved from: renew.go
 type RenewalManager struct {
-	mapper       PortMapper
-	protocol     string
-	internalPort int
-	externalPort int
-	ticker       *time.Ticker
-	done         chan struct{}
-	mu           sync.Mutex
-	started      bool
-	onPortChange PortChangeCallback
+	mapper        PortMapper
+	protocol      string
+	internalPort  int
+	externalPort  int
+	lifetime      time.Duration // lease lifetime granted by the gateway, 0 if it does not expire
+	leaseExpiry   time.Time     // when the current lease runs out, zero if it does not expire
+	state         MappingState
+	failures      int // consecutive renewal failures
+	lastRenewal   time.Time
+	lastErr       error // error of the last renewal, nil if it succeeded
+	done          chan struct{}
+	reschedule    chan struct{} // signals the renewal loop to recompute its next deadline
+	mu            sync.Mutex
+	started       bool
+	onPortChange  PortChangeCallback
+	onStateChange StateChangeCallback
+	clock         clock.Clock
+	scheduler     *RenewalScheduler // renews through a shared scheduler instead of renewLoop if set
+	log           logEntry          // logs to the Logger of the ListenConfig, if any
 }
 
 // NewRenewalManager creates a renewal manager for a port mapping.
 func NewRenewalManager(mapper PortMapper, protocol string, internalPort, externalPort int) *RenewalManager {
-	log.WithFields(logger.Fields{
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"internalPort": internalPort,
 		"externalPort": externalPort,
@@ -37,10 +82,38 @@ func NewRenewalManager(mapper PortMapper, protocol string, internalPort, externa
 		protocol:     protocol,
 		internalPort: internalPort,
 		externalPort: externalPort,
+		lifetime:     mappingDuration,
+		leaseExpiry:  leaseExpiryFrom(time.Now(), mappingDuration),
+		state:        MappingActive,
+		clock:        clock.Real(),
 		// done channel will be created when Start() is called
 	}
 }
 
+// SetClock replaces the clock that drives renewal timers and lease expiry.
+// It must be called before Start; tests use it with clocktest.Fake to drive
+// renewals, retries and expiry without waiting in real time.
+// A nil clock restores the system clock.
+func (r *RenewalManager) SetClock(c clock.Clock) {
+	if c == nil {
+		c = clock.Real()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clock = c
+	r.leaseExpiry = leaseExpiryFrom(c.Now(), r.lifetime)
+}
+
+// SetScheduler makes the manager renew through a shared RenewalScheduler
+// instead of its own goroutine. It must be called before Start.
+// A nil scheduler restores the per-manager renewal loop.
+func (r *RenewalManager) SetScheduler(s *RenewalScheduler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scheduler = s
+}
+
 // SetPortChangeCallback sets a callback function that will be invoked when
 // the external port changes during renewal. This can happen if the NAT device
 // assigns a different port during renewal (rare but possible).
@@ -48,12 +121,12 @@ func (r *RenewalManager) SetPortChangeCallback(callback PortChangeCallback) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if callback != nil {
-		log.WithFields(logger.Fields{
+		r.log.WithFields(Fields{
 			"protocol": r.protocol,
 			"port":     r.externalPort,
 		}).Debug("port change callback registered")
 	} else {
-		log.WithFields(logger.Fields{
+		r.log.WithFields(Fields{
 			"protocol": r.protocol,
 			"port":     r.externalPort,
 		}).Debug("port change callback cleared")
@@ -61,6 +134,38 @@ func (r *RenewalManager) SetPortChangeCallback(callback PortChangeCallback) {
 	r.onPortChange = callback
 }
 
+// SetStateChangeCallback sets a callback function that will be invoked when
+// the mapping state changes, for example from MappingActive to MappingDegraded
+// after a failed renewal, or to MappingLost once the lease has expired.
+func (r *RenewalManager) SetStateChangeCallback(callback StateChangeCallback) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onStateChange = callback
+}
+
+// State returns the current health of the port mapping.
+func (r *RenewalManager) State() MappingState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// LeaseExpiry returns when the current lease runs out if it is not renewed.
+// The zero time means the mapping does not expire.
+func (r *RenewalManager) LeaseExpiry() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leaseExpiry
+}
+
+// LastRenewal returns when the mapping was last renewed, or a renewal last
+// failed with the returned error. The time is zero before the first renewal.
+func (r *RenewalManager) LastRenewal() (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastRenewal, r.lastErr
+}
+
 // ExternalPort returns the current external port number.
 // This may change if the NAT device assigns a different port during renewal.
 func (r *RenewalManager) ExternalPort() int {
@@ -69,6 +174,70 @@ func (r *RenewalManager) ExternalPort() int {
 	return r.externalPort
 }
 
+// currentMapper returns the mapper the mapping is maintained through.
+func (r *RenewalManager) currentMapper() PortMapper {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mapper
+}
+
+// SetLeaseLifetime records the lease lifetime granted by the gateway for the
+// current mapping, which is assumed to have just been created or refreshed.
+// Renewal is scheduled at a fraction of this lifetime; if the manager is
+// running, the pending renewal is rescheduled immediately.
+// A lifetime of zero means the mapping does not expire.
+func (r *RenewalManager) SetLeaseLifetime(lifetime time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setLifetimeLocked(lifetime)
+	r.leaseExpiry = leaseExpiryFrom(r.clock.Now(), lifetime)
+}
+
+// leaseExpiryFrom returns when a lease granted at now with the given lifetime
+// runs out, or the zero time if the lease does not expire.
+// The monotonic reading is stripped so comparisons use the wall clock, which
+// keeps advancing while the system is suspended.
+func leaseExpiryFrom(now time.Time, lifetime time.Duration) time.Time {
+	if lifetime <= 0 {
+		return time.Time{}
+	}
+	return now.Round(0).Add(lifetime)
+}
+
+// LeaseLifetime returns the lease lifetime most recently granted by the gateway.
+func (r *RenewalManager) LeaseLifetime() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lifetime
+}
+
+// setLifetimeLocked updates the lease lifetime and wakes the renewal loop if
+// it changed. Must be called with r.mu held.
+func (r *RenewalManager) setLifetimeLocked(lifetime time.Duration) {
+	if lifetime == r.lifetime {
+		return
+	}
+	r.log.WithFields(Fields{
+		"protocol":    r.protocol,
+		"port":        r.externalPort,
+		"oldLifetime": r.lifetime.String(),
+		"newLifetime": lifetime.String(),
+	}).Debug("lease lifetime updated")
+	r.lifetime = lifetime
+
+	if !r.started {
+		return
+	}
+	if r.scheduler != nil {
+		r.scheduler.reschedule(r)
+		return
+	}
+	select {
+	case r.reschedule <- struct{}{}:
+	default:
+	}
+}
+
 // Start begins the renewal process in a background goroutine.
 // Multiple Start/Stop cycles are safe - each cycle creates fresh channels
 // and the goroutine captures local references to avoid data races.
@@ -77,7 +246,7 @@ func (r *RenewalManager) Start() {
 	defer r.mu.Unlock()
 
 	if r.started {
-		log.WithFields(logger.Fields{
+		r.log.WithFields(Fields{
 			"protocol": r.protocol,
 			"port":     r.externalPort,
 		}).Debug("renewal manager already started, ignoring")
@@ -86,97 +255,324 @@ func (r *RenewalManager) Start() {
 
 	r.started = true
 	r.done = make(chan struct{})
-	r.ticker = time.NewTicker(renewalInterval)
+	r.reschedule = make(chan struct{}, 1)
 
-	log.WithFields(logger.Fields{
-		"protocol":        r.protocol,
-		"internalPort":    r.internalPort,
-		"externalPort":    r.externalPort,
-		"renewalInterval": renewalInterval.String(),
+	r.log.WithFields(Fields{
+		"protocol":      r.protocol,
+		"internalPort":  r.internalPort,
+		"externalPort":  r.externalPort,
+		"leaseLifetime": r.lifetime.String(),
 	}).Debug("starting port renewal")
 
+	if r.scheduler != nil {
+		r.scheduler.add(r)
+		return
+	}
+
 	// Capture local references to avoid data race between goroutine reads
 	// and subsequent Start() writes after Stop() is called.
 	done := r.done
-	ticker := r.ticker
-	go r.renewLoop(ticker.C, done)
+	reschedule := r.reschedule
+	go r.renewLoop(done, reschedule)
 }
 
 // Stop terminates the renewal process and unmaps the port.
 func (r *RenewalManager) Stop() {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	r.StopContext(context.Background())
+}
 
+// StopContext terminates the renewal process and unmaps the port, giving up
+// when ctx is done, as unmapping with a ContextPortMapper does. It returns
+// the unmap error. Stopping a stopped manager returns nil.
+func (r *RenewalManager) StopContext(ctx context.Context) error {
+	r.mu.Lock()
 	if !r.started {
-		log.WithFields(logger.Fields{
+		r.log.WithFields(Fields{
 			"protocol": r.protocol,
 			"port":     r.externalPort,
 		}).Debug("renewal manager already stopped, ignoring")
-		return
+		r.mu.Unlock()
+		return nil
 	}
 
-	log.WithFields(logger.Fields{
+	r.log.WithFields(Fields{
 		"protocol": r.protocol,
 		"port":     r.externalPort,
 	}).Debug("stopping port renewal manager")
 
 	r.started = false
 	close(r.done)
-	r.ticker.Stop()
+	if r.scheduler != nil {
+		r.scheduler.remove(r)
+	}
+	mapper, externalPort := r.mapper, r.externalPort
+	r.mu.Unlock()
 
-	// Unmap the port
-	err := r.mapper.UnmapPort(r.protocol, r.externalPort)
+	// Unmap the port without holding r.mu, since the gateway may be slow
+	err := unmapContext(ctx, mapper, r.protocol, externalPort)
 	if err != nil {
-		log.WithError(err).WithFields(logger.Fields{
+		r.log.WithError(err).WithFields(Fields{
 			"protocol": r.protocol,
-			"port":     r.externalPort,
+			"port":     externalPort,
 		}).Warn("failed to unmap port during shutdown")
 	} else {
-		log.WithFields(logger.Fields{
+		r.log.WithFields(Fields{
 			"protocol": r.protocol,
-			"port":     r.externalPort,
+			"port":     externalPort,
 		}).Debug("port unmapped successfully during shutdown")
 	}
+	emit(Event{
+		Kind:         Unmapped,
+		Mapper:       MapperName(mapper),
+		Protocol:     r.protocol,
+		InternalPort: r.internalPort,
+		ExternalPort: externalPort,
+		Err:          err,
+	})
+	return err
 }
 
-// renewLoop runs the renewal ticker in a goroutine.
-// It receives the ticker channel and done channel as parameters to avoid
+// renewLoop waits for the next renewal deadline and refreshes the mapping.
+// It receives the done and reschedule channels as parameters to avoid
 // data races when Start() is called after Stop() on the same instance.
-func (r *RenewalManager) renewLoop(tickerC <-chan time.Time, done <-chan struct{}) {
+//
+// Timers do not advance while the system is suspended, so a watchdog timer
+// periodically compares the wall clock against the renewal deadline and
+// against its own interval. If the deadline was missed or the wall clock
+// jumped (e.g. after resume from sleep), the mapping is renewed immediately.
+func (r *RenewalManager) renewLoop(done, reschedule <-chan struct{}) {
+	r.mu.Lock()
+	clk := r.clock
+	r.mu.Unlock()
+
+	delay := r.nextDelay()
+	renewAt := clk.Now().Round(0).Add(delay)
+	timer := clk.NewTimer(delay)
+	defer timer.Stop()
+
+	lastCheck := clk.Now()
+	watchdog := clk.NewTimer(suspendCheckInterval)
+	defer watchdog.Stop()
+
+	schedule := func() {
+		delay := r.nextDelay()
+		renewAt = clk.Now().Round(0).Add(delay)
+		timer.Reset(delay)
+	}
+
 	for {
 		select {
-		case <-tickerC:
+		case <-timer.C():
 			r.renew()
+			schedule()
+		case <-reschedule:
+			schedule()
+		case <-watchdog.C():
+			now := clk.Now()
+			jumped := wallClockJumped(lastCheck, now, suspendCheckInterval)
+			missed := !now.Round(0).Before(renewAt)
+			lastCheck = now
+			watchdog.Reset(suspendCheckInterval)
+
+			if jumped || missed {
+				r.log.WithFields(Fields{
+					"protocol":       r.protocol,
+					"port":           r.ExternalPort(),
+					"clockJumped":    jumped,
+					"missedDeadline": missed,
+				}).Info("system resume or clock jump detected, renewing port mapping immediately")
+				r.renew()
+				schedule()
+			}
 		case <-done:
 			return
 		}
 	}
 }
 
+// wallClockJumped reports whether the wall clock moved noticeably more (or
+// less) than interval between two watchdog checks. Timers measure monotonic
+// time, which stops while the system is suspended, so a large difference
+// means the system slept or the clock was stepped.
+func wallClockJumped(lastCheck, now time.Time, interval time.Duration) bool {
+	elapsed := now.Round(0).Sub(lastCheck.Round(0))
+	drift := elapsed - interval
+	return drift > suspendTolerance || drift < -suspendTolerance
+}
+
+// nextDelay returns the delay until the next renewal attempt: the regular
+// lease-based delay after a success, or a retry backoff after a failure.
+func (r *RenewalManager) nextDelay() time.Duration {
+	r.mu.Lock()
+	failures := r.failures
+	r.mu.Unlock()
+
+	if failures > 0 {
+		return r.nextRetryDelay()
+	}
+	return r.nextRenewalDelay()
+}
+
+// nextRenewalDelay returns the delay until the next renewal for the current lease.
+func (r *RenewalManager) nextRenewalDelay() time.Duration {
+	r.mu.Lock()
+	lifetime := r.lifetime
+	r.mu.Unlock()
+
+	delay := renewalDelay(lifetime, rand.Float64())
+	r.log.WithFields(Fields{
+		"protocol":      r.protocol,
+		"leaseLifetime": lifetime.String(),
+		"delay":         delay.String(),
+	}).Debug("next port mapping renewal scheduled")
+	return delay
+}
+
+// nextRetryDelay returns the delay before retrying a failed renewal.
+// While the lease is still valid, retries are not scheduled past its expiry.
+func (r *RenewalManager) nextRetryDelay() time.Duration {
+	r.mu.Lock()
+	failures := r.failures
+	expiry := r.leaseExpiry
+	now := r.clock.Now()
+	r.mu.Unlock()
+
+	var remaining time.Duration
+	if !expiry.IsZero() {
+		remaining = expiry.Sub(now.Round(0))
+	}
+
+	delay := retryDelay(failures, remaining, rand.Float64())
+	r.log.WithFields(Fields{
+		"protocol": r.protocol,
+		"failures": failures,
+		"delay":    delay.String(),
+	}).Debug("port mapping renewal retry scheduled")
+	return delay
+}
+
+// retryDelay computes the backoff before retry number failures (starting at 1).
+// The delay doubles from renewalRetryBase up to renewalRetryMax, with ±renewalJitter
+// applied. If the lease is still valid (remaining > 0), the delay is capped so a
+// final attempt happens before it expires; r is a uniform random value in [0, 1).
+func retryDelay(failures int, remaining time.Duration, r float64) time.Duration {
+	delay := renewalRetryMax
+	if failures < 1 {
+		failures = 1
+	}
+	// Avoid overflow: once the shift exceeds the cap the maximum applies
+	if shift := failures - 1; shift < 16 {
+		if d := renewalRetryBase << shift; d < delay {
+			delay = d
+		}
+	}
+
+	delay += time.Duration(float64(delay) * renewalJitter * (2*r - 1))
+	if remaining > 0 && delay > remaining {
+		delay = remaining
+	}
+	if delay < minRetryDelay {
+		delay = minRetryDelay
+	}
+	return delay
+}
+
+// renewalDelay computes when to renew a lease with the given lifetime.
+// Leases are renewed at renewalLeaseFraction of their lifetime, but never
+// later than renewalInterval, so short leases granted by the gateway are
+// refreshed well before they expire. Leases that do not expire (lifetime 0)
+// are refreshed every renewalInterval. A jitter of ±renewalJitter spreads
+// renewals of many mappings; r is a uniform random value in [0, 1).
+func renewalDelay(lifetime time.Duration, r float64) time.Duration {
+	delay := renewalInterval
+	if lifetime > 0 {
+		if fraction := time.Duration(float64(lifetime) * renewalLeaseFraction); fraction < delay {
+			delay = fraction
+		}
+	}
+
+	delay += time.Duration(float64(delay) * renewalJitter * (2*r - 1))
+	if delay < minRenewalDelay {
+		delay = minRenewalDelay
+	}
+	return delay
+}
+
 // renew attempts to refresh the port mapping.
 // If the NAT device assigns a different external port during renewal,
 // the callback (if set) will be invoked with the new port number.
-func (r *RenewalManager) renew() {
-	log.WithFields(logger.Fields{
+// On failure the mapping becomes MappingDegraded, or MappingLost once the
+// lease has expired, and the error is returned so the caller can retry.
+func (r *RenewalManager) renew() error {
+	// The network monitor may replace the mapping while the request is in
+	// flight, so the mapping being renewed is snapshotted here
+	r.mu.Lock()
+	mapper, port := r.mapper, r.externalPort
+	r.mu.Unlock()
+
+	r.log.WithFields(Fields{
 		"protocol": r.protocol,
-		"port":     r.externalPort,
+		"port":     port,
 	}).Debug("attempting port mapping renewal")
 
-	newPort, err := r.mapper.MapPort(r.protocol, r.internalPort, mappingDuration)
+	ctx, cancel := r.requestContext()
+	defer cancel()
+	start := time.Now()
+	result, err := mapPortContext(ctx, mapper, r.protocol, r.internalPort, mappingDuration)
+	elapsed := time.Since(start)
+	r.recordRenewal(mapper, elapsed, err)
 	if err != nil {
-		log.WithError(err).WithFields(logger.Fields{
+		r.mu.Lock()
+		if r.replacedLocked(mapper, port) {
+			r.mu.Unlock()
+			return nil
+		}
+		r.lastRenewal, r.lastErr = r.clock.Now(), err
+		r.failures++
+		failures := r.failures
+		newState := MappingDegraded
+		if !r.leaseExpiry.IsZero() && !r.clock.Now().Round(0).Before(r.leaseExpiry) {
+			newState = MappingLost
+		}
+		notify := r.setStateLocked(newState)
+		r.mu.Unlock()
+
+		r.log.WithError(err).WithFields(Fields{
 			"protocol": r.protocol,
-			"port":     r.externalPort,
+			"port":     port,
+			"failures": failures,
+			"state":    newState.String(),
 		}).Warn("port mapping renewal failed")
-		return
+		notify()
+		emit(Event{
+			Kind:         RenewalFailed,
+			Mapper:       MapperName(mapper),
+			Protocol:     r.protocol,
+			InternalPort: r.internalPort,
+			ExternalPort: port,
+			Duration:     elapsed,
+			Err:          err,
+		})
+		return err
 	}
 
+	newPort := result.ExternalPort
+
 	r.mu.Lock()
-	oldPort := r.externalPort
+	if r.replacedLocked(mapper, port) {
+		r.mu.Unlock()
+		return nil
+	}
+	r.lastRenewal, r.lastErr = r.clock.Now(), nil
+	r.setLifetimeLocked(result.Lifetime)
+	r.leaseExpiry = leaseExpiryFrom(r.clock.Now(), result.Lifetime)
+	r.failures = 0
+	notify := r.setStateLocked(MappingActive)
+	oldPort := port
 	callback := r.onPortChange
 	if newPort != oldPort {
 		r.externalPort = newPort
-		log.WithFields(logger.Fields{
+		r.log.WithFields(Fields{
 			"protocol": r.protocol,
 			"oldPort":  oldPort,
 			"newPort":  newPort,
@@ -184,13 +580,167 @@ func (r *RenewalManager) renew() {
 	}
 	r.mu.Unlock()
 
-	// Invoke callback outside the lock to prevent deadlocks
-	if newPort != oldPort && callback != nil {
-		callback(newPort)
+	// Invoke callbacks outside the lock to prevent deadlocks
+	notify()
+	emit(Event{
+		Kind:         Renewed,
+		Mapper:       MapperName(mapper),
+		Protocol:     r.protocol,
+		InternalPort: r.internalPort,
+		ExternalPort: newPort,
+		Duration:     elapsed,
+		Lifetime:     result.Lifetime,
+	})
+	if newPort != oldPort {
+		emit(Event{
+			Kind:            PortChanged,
+			Mapper:          MapperName(mapper),
+			Protocol:        r.protocol,
+			InternalPort:    r.internalPort,
+			ExternalPort:    newPort,
+			OldExternalPort: oldPort,
+		})
+		if callback != nil {
+			callback(newPort)
+		}
 	}
 
-	log.WithFields(logger.Fields{
+	r.log.WithFields(Fields{
 		"protocol": r.protocol,
 		"port":     newPort,
 	}).Debug("port mapping renewed successfully")
+	return nil
+}
+
+// replacedLocked reports whether the mapping renewed through mapper on port
+// was replaced by replaceMapping during the renewal, in which case the
+// outcome of the renewal no longer applies. Must be called with r.mu held.
+func (r *RenewalManager) replacedLocked(mapper PortMapper, port int) bool {
+	if r.externalPort == port && sameMapper(r.mapper, mapper) {
+		return false
+	}
+	r.log.WithFields(Fields{
+		"protocol": r.protocol,
+		"oldPort":  port,
+		"newPort":  r.externalPort,
+	}).Debug("mapping replaced during renewal, ignoring renewal result")
+	return true
+}
+
+// requestContext returns the context of a renewal request, which ends after
+// renewalRequestTimeout or when the manager is stopped.
+func (r *RenewalManager) requestContext() (context.Context, context.CancelFunc) {
+	r.mu.Lock()
+	done := r.done
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), renewalRequestTimeout)
+	if done != nil {
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+// recordRenewal reports the outcome and latency of a renewal attempt.
+func (r *RenewalManager) recordRenewal(mapper PortMapper, elapsed time.Duration, err error) {
+	if currentSink() == nil {
+		return
+	}
+	name := MapperName(mapper)
+	addCounter(MetricRenewals, Labels{"mapper": name, "protocol": r.protocol, "result": resultLabel(err)}, 1)
+	observeDuration(MetricRenewalDuration, Labels{"mapper": name, "protocol": r.protocol}, elapsed)
+}
+
+// setStateLocked transitions to newState and returns a function that invokes
+// the state change callback, to be called after r.mu is released.
+// Must be called with r.mu held.
+func (r *RenewalManager) setStateLocked(newState MappingState) func() {
+	oldState := r.state
+	if oldState == newState {
+		return func() {}
+	}
+	r.state = newState
+
+	r.log.WithFields(Fields{
+		"protocol": r.protocol,
+		"port":     r.externalPort,
+		"oldState": oldState.String(),
+		"newState": newState.String(),
+	}).Info("port mapping state changed")
+
+	callback := r.onStateChange
+	if callback == nil {
+		return func() {}
+	}
+	return func() { callback(oldState, newState) }
+}
+
+// replaceMapping swaps in a mapping that was re-established through a different
+// mapper, for example on a new gateway after a network change. The previous
+// mapping is removed in the background on a best-effort basis, since the old
+// gateway is often no longer reachable.
+// Returns an error if the manager has been stopped; the caller then owns the
+// new mapping and must remove it.
+func (r *RenewalManager) replaceMapping(mapper PortMapper, result MapPortResult) error {
+	r.mu.Lock()
+	if !r.started {
+		r.mu.Unlock()
+		return fmt.Errorf("renewal manager stopped")
+	}
+	oldMapper, oldPort := r.mapper, r.externalPort
+	r.mapper = mapper
+	r.externalPort = result.ExternalPort
+	r.setLifetimeLocked(result.Lifetime)
+	r.leaseExpiry = leaseExpiryFrom(r.clock.Now(), result.Lifetime)
+	r.failures = 0
+	notify := r.setStateLocked(MappingActive)
+	r.mu.Unlock()
+
+	notify()
+	if result.ExternalPort != oldPort {
+		emit(Event{
+			Kind:            PortChanged,
+			Mapper:          MapperName(mapper),
+			Protocol:        r.protocol,
+			InternalPort:    r.internalPort,
+			ExternalPort:    result.ExternalPort,
+			OldExternalPort: oldPort,
+		})
+	}
+
+	r.log.WithFields(Fields{
+		"protocol": r.protocol,
+		"oldPort":  oldPort,
+		"newPort":  result.ExternalPort,
+	}).Debug("renewal manager switched to new mapping")
+
+	// Re-mapping through the same mapper may return the same mapping, as a
+	// shared DaemonMapper does, which must then be kept
+	if oldPort == result.ExternalPort && sameMapper(oldMapper, mapper) {
+		return nil
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), remapTimeout)
+		defer cancel()
+		if err := unmapContext(ctx, oldMapper, r.protocol, oldPort); err != nil {
+			r.log.WithError(err).WithFields(Fields{
+				"protocol": r.protocol,
+				"port":     oldPort,
+			}).Debug("failed to remove previous mapping after network change")
+		}
+	}()
+	return nil
+}
+
+// sameMapper reports whether a and b are the same mapper. Mappers of types
+// that cannot be compared are never the same.
+func sameMapper(a, b PortMapper) bool {
+	t := reflect.TypeOf(a)
+	return t != nil && t == reflect.TypeOf(b) && t.Comparable() && a == b
 }
@@ -0,0 +1,257 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/go-nat-listener/clock/clocktest"
+)
+
+// countingMapper counts MapPort calls made through a MockPortMapper.
+type countingMapper struct {
+	*MockPortMapper
+	calls atomic.Int32
+}
+
+func (m *countingMapper) MapPort(protocol string, internalPort int, duration time.Duration) (int, error) {
+	m.calls.Add(1)
+	return m.MockPortMapper.MapPort(protocol, internalPort, duration)
+}
+
+// TestWallClockJumped tests detection of wall clock divergence between watchdog checks
+func TestWallClockJumped(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    bool
+	}{
+		{"on time", suspendCheckInterval, false},
+		{"slightly late", suspendCheckInterval + suspendTolerance/2, false},
+		{"suspended", suspendCheckInterval + time.Hour, true},
+		{"clock stepped back", -time.Hour, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wallClockJumped(base, base.Add(tt.elapsed), suspendCheckInterval); got != tt.want {
+				t.Errorf("wallClockJumped after %v = %v, want %v", tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRenewalManagerSuspendResume tests that renewal happens immediately after
+// the system resumes from a suspend that outlasted the renewal deadline
+func TestRenewalManagerSuspendResume(t *testing.T) {
+	t.Run("Resume after suspend renews immediately", func(t *testing.T) {
+		clk := clocktest.NewFake(time.Time{})
+		mapper := &countingMapper{MockPortMapper: NewMockPortMapper()}
+		renewal := NewRenewalManager(mapper, "TCP", 8080, 8080)
+		renewal.SetClock(clk)
+
+		renewal.Start()
+		defer renewal.Stop()
+		clk.BlockUntil(2)
+
+		// Sleep through the renewal deadline and the lease expiry
+		clk.Jump(2 * mappingDuration)
+		clk.Advance(suspendCheckInterval)
+
+		deadline := time.Now().Add(time.Second)
+		for mapper.calls.Load() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if mapper.calls.Load() != 1 {
+			t.Fatalf("Expected one renewal after resume, got %d", mapper.calls.Load())
+		}
+
+		clk.BlockUntil(2)
+		if renewal.State() != MappingActive {
+			t.Errorf("Expected active state after resume renewal, got %v", renewal.State())
+		}
+		if expiry := renewal.LeaseExpiry(); !expiry.After(clk.Now()) {
+			t.Errorf("Expected lease expiry %v to be after resume time %v", expiry, clk.Now())
+		}
+	})
+
+	t.Run("Watchdog without clock jump does not renew", func(t *testing.T) {
+		clk := clocktest.NewFake(time.Time{})
+		mapper := &countingMapper{MockPortMapper: NewMockPortMapper()}
+		renewal := NewRenewalManager(mapper, "TCP", 8080, 8080)
+		renewal.SetClock(clk)
+
+		renewal.Start()
+		defer renewal.Stop()
+		clk.BlockUntil(2)
+
+		for i := 0; i < 3; i++ {
+			clk.Advance(suspendCheckInterval)
+			clk.BlockUntil(2)
+		}
+		if calls := mapper.calls.Load(); calls != 0 {
+			t.Errorf("Expected no renewal before the deadline, got %d", calls)
+		}
+	})
+}
+
+// advanceInSteps advances the fake clock by total in watchdog-sized steps,
+// waiting for the renewal loop to re-arm its timers after each step.
+func advanceInSteps(clk *clocktest.Fake, total time.Duration) {
+	for elapsed := time.Duration(0); elapsed < total; elapsed += suspendCheckInterval {
+		clk.Advance(suspendCheckInterval)
+		clk.BlockUntil(2)
+	}
+}
+
+// TestRenewalManagerFakeClock drives the real renewal loop with a fake clock
+func TestRenewalManagerFakeClock(t *testing.T) {
+	t.Run("Renews at the lease fraction", func(t *testing.T) {
+		clk := clocktest.NewFake(time.Time{})
+		mapper := &countingMapper{MockPortMapper: NewMockPortMapper()}
+		renewal := NewRenewalManager(mapper, "TCP", 8080, 8080)
+		renewal.SetClock(clk)
+
+		initialExpiry := renewal.LeaseExpiry()
+		renewal.Start()
+		defer renewal.Stop()
+		clk.BlockUntil(2)
+
+		// The first renewal is due within renewalInterval ± jitter
+		advanceInSteps(clk, 40*time.Minute)
+		if calls := mapper.calls.Load(); calls != 0 {
+			t.Fatalf("Expected no renewal before the jittered deadline, got %d", calls)
+		}
+		advanceInSteps(clk, 10*time.Minute)
+		if calls := mapper.calls.Load(); calls != 1 {
+			t.Fatalf("Expected one renewal, got %d", calls)
+		}
+		if expiry := renewal.LeaseExpiry(); !expiry.After(initialExpiry) {
+			t.Errorf("Expected lease expiry to be extended past %v, got %v", initialExpiry, expiry)
+		}
+	})
+
+	t.Run("Failures back off until the lease is lost", func(t *testing.T) {
+		clk := clocktest.NewFake(time.Time{})
+		mapper := &countingMapper{MockPortMapper: NewMockPortMapper()}
+		mapper.SetFailureRate(1.0)
+		renewal := NewRenewalManager(mapper, "TCP", 8080, 8080)
+		renewal.SetClock(clk)
+
+		states := make(chan MappingState, 8)
+		renewal.SetStateChangeCallback(func(_, newState MappingState) {
+			states <- newState
+		})
+
+		renewal.Start()
+		defer renewal.Stop()
+		clk.BlockUntil(2)
+
+		// Past the jittered deadline plus at least one retry
+		advanceInSteps(clk, 52*time.Minute)
+		if renewal.State() != MappingDegraded {
+			t.Fatalf("Expected degraded state after failed renewal, got %v", renewal.State())
+		}
+		retries := mapper.calls.Load()
+		if retries < 2 {
+			t.Errorf("Expected failed renewal to be retried, got %d attempts", retries)
+		}
+
+		advanceInSteps(clk, mappingDuration)
+		if renewal.State() != MappingLost {
+			t.Fatalf("Expected lost state after lease expiry, got %v", renewal.State())
+		}
+
+		// Backoff is capped, so retries continue but do not pile up
+		maxAttempts := retries + int32((mappingDuration)/minRetryDelay)
+		if calls := mapper.calls.Load(); calls <= retries || calls >= maxAttempts {
+			t.Errorf("Expected backoff-limited retries, got %d attempts", calls)
+		}
+
+		if got := <-states; got != MappingDegraded {
+			t.Errorf("Expected first transition to degraded, got %v", got)
+		}
+		if got := <-states; got != MappingLost {
+			t.Errorf("Expected second transition to lost, got %v", got)
+		}
+	})
+}
+
+// TestRenewalManagerStopCancelsRenewal tests that Stop cancels a renewal
+// waiting for the gateway
+func TestRenewalManagerStopCancelsRenewal(t *testing.T) {
+	mapper := &slowMapper{MockPortMapper: NewMockPortMapper(), delay: 10 * time.Second}
+	renewal := NewRenewalManager(mapper, "TCP", 8080, 8080)
+	renewal.Start()
+
+	renewed := make(chan error, 1)
+	go func() { renewed <- renewal.renew() }()
+	time.Sleep(20 * time.Millisecond)
+	renewal.Stop()
+
+	select {
+	case err := <-renewed:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected the renewal to be cancelled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop did not cancel the renewal")
+	}
+}
+
+// TestRenewalManagerRemapDuringRenewal tests that a mapping replaced after a
+// network change while a renewal is in flight is not overwritten by the
+// renewal's result. Run with -race to check the accesses to the mapping.
+func TestRenewalManagerRemapDuringRenewal(t *testing.T) {
+	clk := clocktest.NewFake(time.Time{})
+	oldMapper := &blockingMapper{
+		MockPortMapper: NewMockPortMapper(),
+		port:           8080,
+		entered:        make(chan struct{}, 1),
+		release:        make(chan struct{}),
+	}
+	// The old gateway would move the mapping to another port on renewal
+	oldMapper.SetNATType(RestrictedNAT)
+	renewal := NewRenewalManager(oldMapper, "TCP", 8080, 8080)
+	renewal.SetClock(clk)
+
+	portChanges := make(chan int, 1)
+	renewal.SetPortChangeCallback(func(port int) { portChanges <- port })
+	renewal.Start()
+	defer renewal.Stop()
+	clk.BlockUntil(2)
+
+	clk.Advance(2 * renewalInterval)
+	select {
+	case <-oldMapper.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Renewal did not start")
+	}
+
+	// The network monitor re-maps on a new gateway while the renewal waits
+	newMapper := NewMockPortMapper()
+	if _, port, err := remapWithMapper(context.Background(), renewal, newMapper); err != nil || port != 8080 {
+		t.Fatalf("remapWithMapper returned port %d, %v", port, err)
+	}
+	close(oldMapper.release)
+	clk.BlockUntil(2)
+
+	if port := renewal.ExternalPort(); port != 8080 {
+		t.Errorf("Expected the re-mapped port 8080 to be kept, got %d", port)
+	}
+	if renewal.currentMapper() != PortMapper(newMapper) {
+		t.Errorf("Expected the new mapper to be kept, got %T", renewal.currentMapper())
+	}
+	if renewal.State() != MappingActive {
+		t.Errorf("Expected active state, got %v", renewal.State())
+	}
+	select {
+	case port := <-portChanges:
+		t.Errorf("Unexpected port change to %d from the stale renewal", port)
+	default:
+	}
+}
@@ -0,0 +1,393 @@
+package nattraversal
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/go-i2p/go-nat-listener/clock"
+)
+
+// RenewalScheduler renews many port mappings from a single scheduling
+// goroutine instead of one goroutine and timer per RenewalManager.
+// Each mapping keeps its own lease-based, jittered deadline in a timer heap,
+// and due mappings are renewed by a fixed pool of maxConcurrent workers, so
+// services with hundreds of mappings do not flood the router.
+//
+// Attach a RenewalManager with SetScheduler (or ListenConfig.Scheduler)
+// before starting it.
+type RenewalScheduler struct {
+	clock         clock.Clock
+	maxConcurrent int
+	wake          chan struct{}
+
+	mu       sync.Mutex
+	queue    renewalQueue
+	entries  map[*RenewalManager]*scheduledRenewal
+	pending  []*scheduledRenewal // entries whose next deadline must be computed
+	ready    []*scheduledRenewal // due entries waiting for a worker
+	inFlight int
+	started  bool
+	work     chan struct{} // wakes idle workers of the current run
+	done     chan struct{}
+}
+
+// SchedulerStatus is an aggregate snapshot of the mappings managed by a RenewalScheduler.
+type SchedulerStatus struct {
+	Mappings    int       // mappings registered with the scheduler
+	Active      int       // mappings in MappingActive
+	Degraded    int       // mappings in MappingDegraded
+	Lost        int       // mappings in MappingLost
+	InFlight    int       // renewal requests currently in progress
+	NextRenewal time.Time // earliest scheduled renewal, zero if none is queued
+}
+
+// scheduledRenewal is a mapping's entry in the scheduler's timer heap.
+type scheduledRenewal struct {
+	manager  *RenewalManager
+	deadline time.Time // wall clock time of the next renewal
+	index    int       // position in the heap, -1 if not queued
+	running  bool      // a renewal is waiting for or held by a worker
+}
+
+// NewRenewalScheduler creates a scheduler that runs at most maxConcurrent
+// renewals at the same time. A value <= 0 uses defaultMaxConcurrentRenewals.
+func NewRenewalScheduler(maxConcurrent int) *RenewalScheduler {
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentRenewals
+	}
+	log.WithField("maxConcurrent", maxConcurrent).Debug("creating renewal scheduler")
+	return &RenewalScheduler{
+		clock:         clock.Real(),
+		maxConcurrent: maxConcurrent,
+		wake:          make(chan struct{}, 1),
+		entries:       make(map[*RenewalManager]*scheduledRenewal),
+	}
+}
+
+// SetClock replaces the clock that drives renewal deadlines. It must be
+// called before Start. A nil clock restores the system clock.
+func (s *RenewalScheduler) SetClock(c clock.Clock) {
+	if c == nil {
+		c = clock.Real()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = c
+}
+
+// Start begins scheduling renewals. Mappings attached before Start are
+// scheduled once it runs. Calling Start on a running scheduler has no effect.
+func (s *RenewalScheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		return
+	}
+	s.started = true
+	s.work = make(chan struct{}, s.maxConcurrent)
+	s.done = make(chan struct{})
+
+	log.WithFields(Fields{
+		"mappings":      len(s.entries),
+		"maxConcurrent": s.maxConcurrent,
+	}).Debug("starting renewal scheduler")
+
+	go s.run(s.clock, s.work, s.done)
+	for i := 0; i < s.maxConcurrent; i++ {
+		go s.worker(s.work, s.done)
+	}
+}
+
+// Stop stops scheduling renewals. Renewals already in progress complete, but
+// no new ones are started. Attached mappings are not unmapped; stop their
+// RenewalManagers to remove them.
+func (s *RenewalScheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.started {
+		return
+	}
+	s.started = false
+	close(s.done)
+	log.Debug("renewal scheduler stopped")
+}
+
+// Status returns an aggregate snapshot of the scheduled mappings.
+func (s *RenewalScheduler) Status() SchedulerStatus {
+	s.mu.Lock()
+	status := SchedulerStatus{
+		Mappings: len(s.entries),
+		InFlight: s.inFlight,
+	}
+	if len(s.queue) > 0 {
+		status.NextRenewal = s.queue[0].deadline
+	}
+	managers := make([]*RenewalManager, 0, len(s.entries))
+	for m := range s.entries {
+		managers = append(managers, m)
+	}
+	s.mu.Unlock()
+
+	// Manager state is read without s.mu held, since managers call into the
+	// scheduler while holding their own lock
+	for _, m := range managers {
+		switch m.State() {
+		case MappingActive:
+			status.Active++
+		case MappingDegraded:
+			status.Degraded++
+		case MappingLost:
+			status.Lost++
+		}
+	}
+	return status
+}
+
+// add registers a manager and schedules its first renewal.
+func (s *RenewalScheduler) add(r *RenewalManager) {
+	s.mu.Lock()
+	if _, ok := s.entries[r]; ok {
+		s.mu.Unlock()
+		return
+	}
+	e := &scheduledRenewal{manager: r, index: -1}
+	s.entries[r] = e
+	s.pending = append(s.pending, e)
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+// remove unregisters a manager. A renewal already in progress completes
+// but is not rescheduled.
+func (s *RenewalScheduler) remove(r *RenewalManager) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[r]
+	if !ok {
+		return
+	}
+	delete(s.entries, r)
+	if e.index >= 0 {
+		heap.Remove(&s.queue, e.index)
+	}
+}
+
+// reschedule recomputes a manager's deadline, for example after the gateway
+// granted a different lease lifetime.
+func (s *RenewalScheduler) reschedule(r *RenewalManager) {
+	s.mu.Lock()
+	e, ok := s.entries[r]
+	if !ok || e.running || e.index < 0 {
+		// Not queued: the deadline is computed when it is queued again
+		s.mu.Unlock()
+		return
+	}
+	heap.Remove(&s.queue, e.index)
+	s.pending = append(s.pending, e)
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+// signal wakes the scheduling goroutine without blocking.
+func (s *RenewalScheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run is the scheduling goroutine. It sleeps until the earliest deadline,
+// hands due mappings to renewal workers, and uses the same watchdog as
+// RenewalManager to catch deadlines missed during a system suspend.
+func (s *RenewalScheduler) run(clk clock.Clock, work chan<- struct{}, done <-chan struct{}) {
+	timer := clk.NewTimer(s.schedulePending(clk))
+	defer timer.Stop()
+
+	lastCheck := clk.Now()
+	watchdog := clk.NewTimer(suspendCheckInterval)
+	defer watchdog.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			s.dispatch(clk.Now(), false, work)
+		case <-s.wake:
+		case <-watchdog.C():
+			now := clk.Now()
+			jumped := wallClockJumped(lastCheck, now, suspendCheckInterval)
+			lastCheck = now
+			watchdog.Reset(suspendCheckInterval)
+			if jumped {
+				log.Info("system resume or clock jump detected, renewing all scheduled port mappings")
+			}
+			s.dispatch(now, jumped, work)
+		case <-done:
+			return
+		}
+		timer.Reset(s.schedulePending(clk))
+	}
+}
+
+// schedulePending queues entries that need a new deadline and returns how
+// long to wait until the earliest one.
+func (s *RenewalScheduler) schedulePending(clk clock.Clock) time.Duration {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	for _, e := range pending {
+		// nextDelay takes the manager's lock, so s.mu must not be held
+		delay := e.manager.nextDelay()
+
+		s.mu.Lock()
+		if s.entries[e.manager] == e && e.index < 0 && !e.running {
+			e.deadline = clk.Now().Round(0).Add(delay)
+			heap.Push(&s.queue, e)
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return renewalInterval
+	}
+	wait := s.queue[0].deadline.Sub(clk.Now().Round(0))
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// dispatch hands every entry due at now, or every queued entry if all is
+// set, to the workers without waiting for them.
+func (s *RenewalScheduler) dispatch(now time.Time, all bool, work chan<- struct{}) {
+	now = now.Round(0)
+
+	s.mu.Lock()
+	count := 0
+	for len(s.queue) > 0 && (all || !s.queue[0].deadline.After(now)) {
+		e := heap.Pop(&s.queue).(*scheduledRenewal)
+		e.running = true
+		s.ready = append(s.ready, e)
+		count++
+	}
+	s.mu.Unlock()
+
+	if count == 0 {
+		return
+	}
+	log.WithField("count", count).Debug("dispatching scheduled port mapping renewals")
+	for i := 0; i < count; i++ {
+		select {
+		case work <- struct{}{}:
+		default:
+			// Every worker already has a wakeup pending and drains the ready list
+			return
+		}
+	}
+}
+
+// worker renews ready entries until done is closed. Entries still ready when
+// the scheduler stops are requeued without renewing.
+func (s *RenewalScheduler) worker(work <-chan struct{}, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			for e := s.nextReady(); e != nil; e = s.nextReady() {
+				s.finish(e, false)
+			}
+			return
+		default:
+		}
+
+		if e := s.nextReady(); e != nil {
+			s.renewEntry(e)
+			continue
+		}
+		select {
+		case <-work:
+		case <-done:
+		}
+	}
+}
+
+// nextReady removes and returns the oldest ready entry, or nil if none is ready.
+func (s *RenewalScheduler) nextReady() *scheduledRenewal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ready) == 0 {
+		return nil
+	}
+	e := s.ready[0]
+	s.ready[0] = nil
+	s.ready = s.ready[1:]
+	return e
+}
+
+// renewEntry renews the mapping and queues the entry for its next deadline.
+func (s *RenewalScheduler) renewEntry(e *scheduledRenewal) {
+	s.mu.Lock()
+	registered := s.entries[e.manager] == e
+	if registered {
+		s.inFlight++
+	}
+	s.mu.Unlock()
+
+	if registered {
+		e.manager.renew()
+	}
+	s.finish(e, registered)
+}
+
+// finish marks a renewal as complete and queues the entry for its next
+// deadline if the manager is still registered.
+func (s *RenewalScheduler) finish(e *scheduledRenewal, counted bool) {
+	s.mu.Lock()
+	if counted {
+		s.inFlight--
+	}
+	e.running = false
+	if s.entries[e.manager] == e {
+		s.pending = append(s.pending, e)
+	}
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+// renewalQueue is a min-heap of scheduled renewals ordered by deadline.
+type renewalQueue []*scheduledRenewal
+
+func (q renewalQueue) Len() int { return len(q) }
+
+func (q renewalQueue) Less(i, j int) bool { return q[i].deadline.Before(q[j].deadline) }
+
+func (q renewalQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *renewalQueue) Push(x any) {
+	e := x.(*scheduledRenewal)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *renewalQueue) Pop() any {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*q = old[:n-1]
+	return e
+}
@@ -0,0 +1,166 @@
+package nattraversal
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/go-nat-listener/clock/clocktest"
+)
+
+// gatedMapper blocks MapPort until the gate is closed.
+type gatedMapper struct {
+	*MockPortMapper
+	gate  chan struct{}
+	calls atomic.Int32
+}
+
+func (m *gatedMapper) MapPort(protocol string, internalPort int, duration time.Duration) (int, error) {
+	m.calls.Add(1)
+	<-m.gate
+	return m.MockPortMapper.MapPort(protocol, internalPort, duration)
+}
+
+// waitForCalls polls until calls reports n or the test times out.
+func waitForCalls(t *testing.T, calls *atomic.Int32, n int32) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for calls.Load() < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := calls.Load(); got != n {
+		t.Fatalf("Expected %d renewal requests, got %d", n, got)
+	}
+}
+
+// startScheduledManagers creates and starts count managers attached to the scheduler.
+func startScheduledManagers(t *testing.T, scheduler *RenewalScheduler, mapper PortMapper, count int) []*RenewalManager {
+	t.Helper()
+	managers := make([]*RenewalManager, count)
+	for i := range managers {
+		port := 10000 + i
+		managers[i] = NewRenewalManager(mapper, "UDP", port, port)
+		managers[i].SetScheduler(scheduler)
+		managers[i].Start()
+	}
+	t.Cleanup(func() {
+		for _, m := range managers {
+			m.Stop()
+		}
+	})
+	return managers
+}
+
+// TestRenewalScheduler tests shared scheduling of many mappings
+func TestRenewalScheduler(t *testing.T) {
+	t.Run("Renews every mapping once per lease", func(t *testing.T) {
+		clk := clocktest.NewFake(time.Time{})
+		scheduler := NewRenewalScheduler(4)
+		scheduler.SetClock(clk)
+		scheduler.Start()
+		defer scheduler.Stop()
+
+		mapper := &countingMapper{MockPortMapper: NewMockPortMapper()}
+		startScheduledManagers(t, scheduler, mapper, 20)
+		clk.BlockUntil(2)
+
+		status := scheduler.Status()
+		if status.Mappings != 20 || status.Active != 20 {
+			t.Errorf("Expected 20 active mappings, got %+v", status)
+		}
+
+		advanceInSteps(clk, 40*time.Minute)
+		if calls := mapper.calls.Load(); calls != 0 {
+			t.Fatalf("Expected no renewal before the jittered deadline, got %d", calls)
+		}
+		advanceInSteps(clk, 10*time.Minute)
+		waitForCalls(t, &mapper.calls, 20)
+	})
+
+	t.Run("Caps concurrent renewals", func(t *testing.T) {
+		clk := clocktest.NewFake(time.Time{})
+		scheduler := NewRenewalScheduler(2)
+		scheduler.SetClock(clk)
+		scheduler.Start()
+		defer scheduler.Stop()
+
+		mapper := &gatedMapper{MockPortMapper: NewMockPortMapper(), gate: make(chan struct{})}
+		startScheduledManagers(t, scheduler, mapper, 5)
+		clk.BlockUntil(2)
+
+		advanceInSteps(clk, 50*time.Minute)
+		waitForCalls(t, &mapper.calls, 2)
+
+		time.Sleep(50 * time.Millisecond)
+		if calls := mapper.calls.Load(); calls != 2 {
+			t.Errorf("Expected at most 2 concurrent renewals, got %d", calls)
+		}
+		if inFlight := scheduler.Status().InFlight; inFlight != 2 {
+			t.Errorf("Expected 2 renewals in flight, got %d", inFlight)
+		}
+
+		close(mapper.gate)
+		waitForCalls(t, &mapper.calls, 5)
+	})
+
+	t.Run("Renews due mappings on a fixed pool of workers", func(t *testing.T) {
+		clk := clocktest.NewFake(time.Time{})
+		scheduler := NewRenewalScheduler(2)
+		scheduler.SetClock(clk)
+		scheduler.Start()
+		defer scheduler.Stop()
+
+		mapper := &gatedMapper{MockPortMapper: NewMockPortMapper(), gate: make(chan struct{})}
+		startScheduledManagers(t, scheduler, mapper, 100)
+		clk.BlockUntil(2)
+		baseline := runtime.NumGoroutine()
+
+		advanceInSteps(clk, 50*time.Minute)
+		waitForCalls(t, &mapper.calls, 2)
+		// Each in-flight request may run on a helper goroutine, but the 98
+		// waiting renewals must not hold one each
+		if extra := runtime.NumGoroutine() - baseline; extra > 10 {
+			t.Errorf("Expected goroutines only for in-flight renewals, got %d more", extra)
+		}
+
+		close(mapper.gate)
+		waitForCalls(t, &mapper.calls, 100)
+	})
+
+	t.Run("Stopped managers are removed", func(t *testing.T) {
+		clk := clocktest.NewFake(time.Time{})
+		scheduler := NewRenewalScheduler(0)
+		scheduler.SetClock(clk)
+		scheduler.Start()
+		defer scheduler.Stop()
+
+		mapper := &countingMapper{MockPortMapper: NewMockPortMapper()}
+		managers := startScheduledManagers(t, scheduler, mapper, 3)
+		clk.BlockUntil(2)
+
+		managers[0].Stop()
+		if status := scheduler.Status(); status.Mappings != 2 {
+			t.Errorf("Expected 2 mappings after stopping one manager, got %d", status.Mappings)
+		}
+
+		advanceInSteps(clk, 50*time.Minute)
+		waitForCalls(t, &mapper.calls, 2)
+	})
+
+	t.Run("Resume after suspend renews all mappings", func(t *testing.T) {
+		clk := clocktest.NewFake(time.Time{})
+		scheduler := NewRenewalScheduler(4)
+		scheduler.SetClock(clk)
+		scheduler.Start()
+		defer scheduler.Stop()
+
+		mapper := &countingMapper{MockPortMapper: NewMockPortMapper()}
+		startScheduledManagers(t, scheduler, mapper, 5)
+		clk.BlockUntil(2)
+
+		clk.Jump(10 * time.Minute)
+		clk.Advance(suspendCheckInterval)
+		waitForCalls(t, &mapper.calls, 5)
+	})
+}
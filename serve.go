@@ -0,0 +1,284 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ConnHandler serves a connection accepted by NATListener.Serve.
+type ConnHandler interface {
+	// ServeConn handles conn until it returns, after which Serve closes
+	// conn. ctx is cancelled if the connection is still being served when
+	// the drain timeout runs out, and conn is closed a second later if
+	// ServeConn has not returned by then.
+	ServeConn(ctx context.Context, conn net.Conn)
+}
+
+// ConnHandlerFunc adapts a function to the ConnHandler interface.
+type ConnHandlerFunc func(ctx context.Context, conn net.Conn)
+
+// ServeConn calls f(ctx, conn).
+func (f ConnHandlerFunc) ServeConn(ctx context.Context, conn net.Conn) {
+	f(ctx, conn)
+}
+
+// ServeOptions configures NATListener.Serve. The zero value uses the defaults.
+type ServeOptions struct {
+	// MaxWorkers bounds the number of connections served at once. Further
+	// connections wait in the listen backlog. Defaults to 256.
+	MaxWorkers int
+	// DrainTimeout bounds how long Serve waits for connections being served
+	// once it stops accepting, before cancelling their contexts. Defaults
+	// to 30 seconds; a negative value cancels them immediately. Connections
+	// whose handlers ignore the cancellation are closed a second later, and
+	// Serve returns a second after that even if handlers are still running.
+	DrainTimeout time.Duration
+	// OnPanic is called with the value recovered from a panicking handler.
+	// The panic is logged with its stack whether or not OnPanic is set.
+	OnPanic func(conn net.Conn, recovered interface{})
+}
+
+// workers returns the size of the worker pool.
+func (o *ServeOptions) workers() int {
+	if o == nil || o.MaxWorkers <= 0 {
+		return defaultServeWorkers
+	}
+	return o.MaxWorkers
+}
+
+// drainTimeout returns the drain timeout.
+func (o *ServeOptions) drainTimeout() time.Duration {
+	if o == nil || o.DrainTimeout == 0 {
+		return defaultServeDrainTimeout
+	}
+	return o.DrainTimeout
+}
+
+// Serve accepts connections and serves each one with handler in its own
+// goroutine, at most opts.MaxWorkers at a time. A panic in handler is
+// recovered and only ends its connection.
+//
+// Other accept errors, such as running out of file descriptors, are logged
+// and retried after a delay that doubles up to one second, as net/http does.
+// Serve stops accepting only when ctx is done or the listener is closed,
+// then waits for the connections being served to finish, up to the drain
+// timeout, after which their contexts are cancelled and then the remaining
+// connections closed, and returns nil. The
+// listener is not closed when ctx is done. Connection contexts carry the
+// values of ctx. opts may be nil.
+func (l *NATListener) Serve(ctx context.Context, handler ConnHandler, opts *ServeOptions) error {
+	// Connection contexts outlive ctx so that in-flight connections drain
+	connCtx, cancelConns := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelConns()
+
+	workers := make(chan struct{}, opts.workers())
+	var wg sync.WaitGroup
+	var served servedConns
+	var retryDelay time.Duration
+
+accept:
+	for {
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+			break accept
+		}
+
+		conn, err := l.AcceptContext(ctx)
+		if err != nil {
+			<-workers
+			if ctx.Err() != nil || l.isClosed() || errors.Is(err, net.ErrClosed) {
+				break
+			}
+			if retryDelay == 0 {
+				retryDelay = serveAcceptRetryBase
+			} else if retryDelay *= 2; retryDelay > serveAcceptRetryMax {
+				retryDelay = serveAcceptRetryMax
+			}
+			l.log.WithError(err).WithField("retryDelay", retryDelay.String()).Warn("TCP accept failed, retrying")
+			timer := time.NewTimer(retryDelay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				break accept
+			}
+			continue
+		}
+		retryDelay = 0
+
+		wg.Add(1)
+		l.serving.add()
+		served.add(conn)
+		go func() {
+			defer wg.Done()
+			defer l.serving.done()
+			defer func() { <-workers }()
+			defer served.remove(conn)
+			l.serveConn(connCtx, handler, conn, opts)
+		}()
+	}
+
+	l.drain(&wg, opts.drainTimeout(), cancelConns, &served)
+	return nil
+}
+
+// serveConn runs handler on conn, recovering from a panic, and closes conn.
+func (l *NATListener) serveConn(ctx context.Context, handler ConnHandler, conn net.Conn, opts *ServeOptions) {
+	defer conn.Close()
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		l.log.WithFields(Fields{
+			"remoteAddr": conn.RemoteAddr().String(),
+			"panic":      fmt.Sprint(recovered),
+			"stack":      string(debug.Stack()),
+		}).Error("TCP connection handler panicked")
+		if opts != nil && opts.OnPanic != nil {
+			opts.OnPanic(conn, recovered)
+		}
+	}()
+	handler.ServeConn(ctx, conn)
+}
+
+// drain waits for the connections being served, cancelling their contexts
+// after timeout. Connections still being served serveCancelGrace after that
+// are closed, and drain gives up waiting for their handlers after another
+// serveCancelGrace, so a handler that ignores both cannot block it.
+func (l *NATListener) drain(wg *sync.WaitGroup, timeout time.Duration, cancel context.CancelFunc, served *servedConns) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	if timeout > 0 && waitUntil(done, timeout) {
+		return
+	}
+
+	l.log.WithField("timeout", timeout.String()).Debug("drain timeout reached, cancelling connections")
+	cancel()
+	if waitUntil(done, serveCancelGrace) {
+		return
+	}
+
+	n := served.closeAll()
+	l.log.WithField("connections", n).Debug("handlers ignored cancellation, closing their connections")
+	if !waitUntil(done, serveCancelGrace) {
+		l.log.WithField("handlers", served.len()).Warn("handlers still running after their connections were closed, no longer waiting")
+	}
+}
+
+// waitUntil waits up to timeout for done to be closed and reports whether
+// it was.
+func waitUntil(done <-chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// servedConns is the set of connections being served by Serve, so that
+// drain can close those whose handlers ignore cancellation.
+type servedConns struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (s *servedConns) add(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+}
+
+func (s *servedConns) remove(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *servedConns) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// closeAll closes the connections being served and returns their number.
+// Their handlers remove them when they return.
+func (s *servedConns) closeAll() int {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// isClosed reports whether Close has been called.
+func (l *NATListener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// connTracker counts the connections being served, so that Shutdown can wait
+// for them.
+type connTracker struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // closed when n drops to zero, nil while it is zero
+}
+
+func (t *connTracker) add() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.n == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.n++
+}
+
+func (t *connTracker) done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n--
+	if t.n == 0 {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// wait waits until no connection is being served or ctx is done.
+func (t *connTracker) wait(ctx context.Context) error {
+	t.mu.Lock()
+	idle := t.idle
+	t.mu.Unlock()
+	if idle == nil {
+		return nil
+	}
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,342 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newServeListener creates a listener mapped through a mock mapper.
+func newServeListener(t *testing.T) *NATListener {
+	t.Helper()
+	useMockPortMapper(t, NewMockPortMapper())
+	listener, err := Listen(freePorts(t, 1)[0])
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// dial connects to the listener's internal address.
+func dial(t *testing.T, listener *NATListener) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", listener.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// TestAcceptContext tests that cancellation unblocks Accept without closing the listener
+func TestAcceptContext(t *testing.T) {
+	listener := newServeListener(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := listener.AcceptContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the context error, got %v", err)
+	}
+
+	dial(t, listener)
+	conn, err := listener.AcceptContext(context.Background())
+	if err != nil {
+		t.Fatalf("AcceptContext after cancellation failed: %v", err)
+	}
+	conn.Close()
+
+	// Close unblocks pending calls
+	errs := make(chan error, 1)
+	go func() {
+		_, err := listener.AcceptContext(context.Background())
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	listener.Close()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("Expected an error after Close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("AcceptContext not unblocked by Close")
+	}
+}
+
+// TestServe tests the worker pool bound and panic recovery
+func TestServe(t *testing.T) {
+	listener := newServeListener(t)
+
+	var active, peak, panics atomic.Int32
+	release := make(chan struct{})
+	handler := ConnHandlerFunc(func(ctx context.Context, conn net.Conn) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		buf := make([]byte, 1)
+		conn.Read(buf)
+		if buf[0] == 'p' {
+			panic("boom")
+		}
+		<-release
+	})
+	opts := &ServeOptions{
+		MaxWorkers: 2,
+		OnPanic:    func(net.Conn, interface{}) { panics.Add(1) },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- listener.Serve(ctx, handler, opts) }()
+
+	dial(t, listener).Write([]byte("p"))
+	for i := 0; i < 4; i++ {
+		dial(t, listener).Write([]byte("x"))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if p := peak.Load(); p != 2 {
+		t.Errorf("Expected 2 concurrent handlers, got %d", p)
+	}
+	if panics.Load() != 1 {
+		t.Errorf("Expected one recovered panic, got %d", panics.Load())
+	}
+
+	// Serve waits for the connections being served after cancellation
+	cancel()
+	select {
+	case <-served:
+		t.Fatal("Serve returned before connections drained")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected nil after cancellation, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+
+	// The listener is still open
+	if listener.isClosed() {
+		t.Error("Serve closed the listener")
+	}
+}
+
+// TestServeDrainTimeout tests that Close drains and then cancels connection contexts
+func TestServeDrainTimeout(t *testing.T) {
+	listener := newServeListener(t)
+
+	started := make(chan struct{})
+	handler := ConnHandlerFunc(func(ctx context.Context, _ net.Conn) {
+		close(started)
+		<-ctx.Done()
+	})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- listener.Serve(context.Background(), handler, &ServeOptions{DrainTimeout: 50 * time.Millisecond})
+	}()
+	dial(t, listener)
+	<-started
+
+	start := time.Now()
+	listener.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected nil after Close, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("Serve returned after %v, before the drain timeout", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not cancel the connection after the drain timeout")
+	}
+}
+
+// TestServeDrainIgnoredCancellation tests that Serve closes the connections
+// of handlers that ignore their context, and returns even if a handler
+// never does
+func TestServeDrainIgnoredCancellation(t *testing.T) {
+	listener := newServeListener(t)
+
+	stuck := make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+	var calls atomic.Int32
+	started := make(chan struct{}, 2)
+	readerDone := make(chan error, 1)
+	handler := ConnHandlerFunc(func(_ context.Context, conn net.Conn) {
+		first := calls.Add(1) == 1
+		started <- struct{}{}
+		if first {
+			// Blocks until the connection is closed
+			_, err := conn.Read(make([]byte, 1))
+			readerDone <- err
+			return
+		}
+		<-stuck
+	})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- listener.Serve(context.Background(), handler, &ServeOptions{DrainTimeout: -1})
+	}()
+	dial(t, listener)
+	<-started
+	dial(t, listener)
+	<-started
+
+	start := time.Now()
+	listener.Close()
+	select {
+	case err := <-readerDone:
+		if err == nil {
+			t.Error("Expected the connection to be closed under the reading handler")
+		}
+	case <-time.After(2*serveCancelGrace + time.Second):
+		t.Fatal("Connection of a handler ignoring cancellation was not closed")
+	}
+	select {
+	case <-served:
+		if elapsed := time.Since(start); elapsed < 2*serveCancelGrace {
+			t.Errorf("Serve returned after %v, before giving the handlers a chance", elapsed)
+		}
+	case <-time.After(2*serveCancelGrace + time.Second):
+		t.Fatal("Serve blocked on a handler ignoring cancellation")
+	}
+}
+
+// blockingUnmapper is a mock mapper whose UnmapPort blocks until released.
+type blockingUnmapper struct {
+	*MockPortMapper
+	release chan struct{}
+}
+
+func (m *blockingUnmapper) UnmapPort(protocol string, externalPort int) error {
+	<-m.release
+	return m.MockPortMapper.UnmapPort(protocol, externalPort)
+}
+
+// TestShutdown tests that Shutdown waits for served connections, then unmaps
+// without waiting past its deadline for an unresponsive gateway
+func TestShutdown(t *testing.T) {
+	mapper := &blockingUnmapper{MockPortMapper: NewMockPortMapper(), release: make(chan struct{})}
+	useMockPortMapper(t, mapper)
+	listener, err := Listen(freePorts(t, 1)[0])
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	finish := make(chan struct{})
+	served := make(chan struct{})
+	handler := ConnHandlerFunc(func(context.Context, net.Conn) {
+		close(served)
+		<-finish
+	})
+	go listener.Serve(context.Background(), handler, nil)
+	dial(t, listener)
+	<-served
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- listener.Shutdown(ctx) }()
+
+	// Shutdown waits for the connection before unmapping
+	time.Sleep(30 * time.Millisecond)
+	if len(mapper.GetActiveMappings()) != 1 {
+		t.Error("Port unmapped while a connection was being served")
+	}
+	close(finish)
+
+	select {
+	case err := <-shutdown:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the unmap to time out, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown blocked on the gateway")
+	}
+	if _, err := net.Dial("tcp", listener.listener.Addr().String()); err == nil {
+		t.Error("Listener still accepting after Shutdown")
+	}
+
+	// The unmap completes in the background
+	close(mapper.release)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(mapper.GetActiveMappings()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Port not unmapped in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := listener.Shutdown(context.Background()); err != nil {
+		t.Errorf("Second Shutdown failed: %v", err)
+	}
+}
+
+// flakyListener fails Accept a number of times before accepting.
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, errors.New("accept: too many open files")
+	}
+	return l.Listener.Accept()
+}
+
+// TestServeRetriesAcceptErrors tests that Serve keeps serving after accept
+// errors other than the listener being closed
+func TestServeRetriesAcceptErrors(t *testing.T) {
+	listener := newServeListener(t)
+	flaky := &flakyListener{Listener: listener.listener}
+	flaky.failures.Store(3)
+	listener.listener = flaky
+
+	var served atomic.Int32
+	handler := ConnHandlerFunc(func(ctx context.Context, conn net.Conn) {
+		served.Add(1)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- listener.Serve(ctx, handler, nil) }()
+
+	dial(t, listener)
+	deadline := time.Now().Add(2 * time.Second)
+	for served.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if served.Load() != 1 {
+		t.Fatal("Expected the connection to be served after accept errors")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Serve returned after accept errors: %v", err)
+	default:
+	}
+
+	listener.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected nil after Close, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+}
@@ -0,0 +1,114 @@
+//go:build linux
+
+package nattraversal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Fields of struct sock_extended_err (see linux/errqueue.h).
+const (
+	sockExtendedErrLen = 16
+	soEEOriginICMP     = 2
+	icmpTimeExceeded   = 11
+)
+
+// traceHopPort is the destination port of trace datagrams, the first port
+// used by traceroute.
+const traceHopPort = 33434
+
+// traceHop returns the address of the router ttl hops away on the path to
+// dst, from the ICMP time exceeded message it returns for a UDP datagram
+// sent with that TTL. The message is read from the socket error queue
+// (IP_RECVERR), so no raw socket or privileges are needed.
+func traceHop(ctx context.Context, dst net.IP, ttl int) (net.IP, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace socket: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVERR, 1)
+		if sockErr == nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("failed to set trace socket options: %w", sockErr)
+	}
+
+	if _, err := conn.WriteToUDP([]byte{0}, &net.UDPAddr{IP: dst, Port: traceHopPort}); err != nil {
+		return nil, fmt.Errorf("failed to send trace datagram: %w", err)
+	}
+
+	buf := make([]byte, 64)
+	oob := make([]byte, 512)
+	var hop net.IP
+	var hopErr error
+	err = raw.Read(func(fd uintptr) bool {
+		_, oobn, _, _, err := syscall.Recvmsg(int(fd), buf, oob, syscall.MSG_ERRQUEUE)
+		if errors.Is(err, syscall.EAGAIN) {
+			return false
+		}
+		if err != nil {
+			hopErr = err
+			return true
+		}
+		hop, hopErr = parseTimeExceeded(oob[:oobn])
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no reply from hop %d: %w", ttl, err)
+	}
+	if hopErr != nil {
+		return nil, hopErr
+	}
+	return hop, nil
+}
+
+// parseTimeExceeded returns the sender of the ICMP time exceeded message
+// reported in the IP_RECVERR control message of oob.
+func parseTimeExceeded(oob []byte) (net.IP, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse control message: %w", err)
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.IPPROTO_IP || m.Header.Type != syscall.IP_RECVERR {
+			continue
+		}
+		// The offending router's sockaddr_in follows sock_extended_err
+		if len(m.Data) < sockExtendedErrLen+syscall.SizeofSockaddrInet4 {
+			return nil, fmt.Errorf("short extended error of %d bytes", len(m.Data))
+		}
+		origin, icmpType := m.Data[4], m.Data[5]
+		if origin != soEEOriginICMP || icmpType != icmpTimeExceeded {
+			return nil, fmt.Errorf("unexpected error (origin %d, type %d) instead of time exceeded", origin, icmpType)
+		}
+		offender := m.Data[sockExtendedErrLen:]
+		if family := binary.NativeEndian.Uint16(offender[0:2]); family != syscall.AF_INET {
+			return nil, fmt.Errorf("unexpected address family %d of hop", family)
+		}
+		return net.IPv4(offender[4], offender[5], offender[6], offender[7]), nil
+	}
+	return nil, fmt.Errorf("no extended error in control message")
+}
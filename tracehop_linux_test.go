@@ -0,0 +1,48 @@
+//go:build linux
+
+package nattraversal
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// extendedErrMessage builds an IP_RECVERR control message for an ICMP error
+// of icmpType sent by offender.
+func extendedErrMessage(icmpType byte, offender net.IP) []byte {
+	data := make([]byte, sockExtendedErrLen+syscall.SizeofSockaddrInet4)
+	data[4] = soEEOriginICMP
+	data[5] = icmpType
+	binary.NativeEndian.PutUint16(data[sockExtendedErrLen:], syscall.AF_INET)
+	copy(data[sockExtendedErrLen+4:], offender.To4())
+
+	oob := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_IP
+	h.Type = syscall.IP_RECVERR
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(oob[syscall.CmsgLen(0):], data)
+	return oob
+}
+
+// TestParseTimeExceeded tests reading the hop address from the socket error queue
+func TestParseTimeExceeded(t *testing.T) {
+	hop, err := parseTimeExceeded(extendedErrMessage(icmpTimeExceeded, net.IPv4(192, 168, 0, 1)))
+	if err != nil {
+		t.Fatalf("parseTimeExceeded failed: %v", err)
+	}
+	if !hop.Equal(net.IPv4(192, 168, 0, 1)) {
+		t.Errorf("Expected hop 192.168.0.1, got %v", hop)
+	}
+
+	// Port unreachable means the datagram reached its destination
+	if _, err := parseTimeExceeded(extendedErrMessage(3, net.IPv4(8, 8, 8, 8))); err == nil {
+		t.Error("Expected error for a message other than time exceeded")
+	}
+	if _, err := parseTimeExceeded(nil); err == nil {
+		t.Error("Expected error without a control message")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// traceHop is unsupported on platforms without IP_RECVERR, so upstream
+// gateway discovery relies on guessing the address.
+func traceHop(_ context.Context, _ net.IP, _ int) (net.IP, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -1,6 +1,9 @@
 package nattraversal
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // PortMapper defines the interface for NAT traversal protocols.
 type PortMapper interface {
@@ -8,3 +11,50 @@ type PortMapper interface {
 	UnmapPort(protocol string, externalPort int) error
 	GetExternalIP() (string, error)
 }
+
+// MapPortResult describes a port mapping granted by the gateway.
+type MapPortResult struct {
+	ExternalPort int
+	// Lifetime is the lease duration actually granted by the gateway, which
+	// may be shorter than requested. Zero means the mapping does not expire.
+	Lifetime time.Duration
+}
+
+// LeasePortMapper is implemented by port mappers that can report the lease
+// lifetime granted by the gateway. RenewalManager uses it to schedule renewals
+// before the lease expires.
+type LeasePortMapper interface {
+	PortMapper
+	MapPortWithLease(protocol string, internalPort int, duration time.Duration) (MapPortResult, error)
+}
+
+// ContextPortMapper is implemented by port mappers whose gateway requests
+// can be cancelled and bounded by a context. All built-in mappers implement
+// it; AsContextPortMapper adapts any other PortMapper.
+type ContextPortMapper interface {
+	PortMapper
+	// MapPortContext creates a mapping and reports the granted lease
+	// lifetime, as LeasePortMapper.MapPortWithLease does.
+	MapPortContext(ctx context.Context, protocol string, internalPort int, duration time.Duration) (MapPortResult, error)
+	UnmapPortContext(ctx context.Context, protocol string, externalPort int) error
+	GetExternalIPContext(ctx context.Context) (string, error)
+}
+
+// MappingEntry is a port mapping reported by a gateway.
+type MappingEntry struct {
+	Protocol       string
+	ExternalPort   int
+	InternalClient string
+	InternalPort   int
+	Description    string
+	Enabled        bool
+	// Lease is the lease duration reported by the gateway, zero if the
+	// mapping does not expire.
+	Lease time.Duration
+}
+
+// MappingLister is implemented by port mappers that can list the mappings
+// on the gateway, including those of other hosts and applications.
+type MappingLister interface {
+	ListMappings() ([]MappingEntry, error)
+}
@@ -2,12 +2,14 @@ package nattraversal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"time"
 
-	"github.com/go-i2p/logger"
+	"github.com/huin/goupnp"
 	"github.com/huin/goupnp/dcps/internetgateway2"
+	"github.com/huin/goupnp/soap"
 )
 
 // upnpClient defines the interface for UPnP IGD client operations.
@@ -31,10 +33,41 @@ type upnpClient interface {
 	GetExternalIPAddress() (string, error)
 }
 
+// upnpContextClient is implemented by the goupnp clients, whose requests
+// can be cancelled with a context.
+type upnpContextClient interface {
+	AddPortMappingCtx(
+		ctx context.Context,
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+		NewInternalPort uint16,
+		NewInternalClient string,
+		NewEnabled bool,
+		NewPortMappingDescription string,
+		NewLeaseDuration uint32,
+	) error
+	DeletePortMappingCtx(
+		ctx context.Context,
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+	) error
+	GetExternalIPAddressCtx(ctx context.Context) (string, error)
+}
+
+// Ensure the clients of the supported services can be cancelled.
+var (
+	_ upnpContextClient = (*internetgateway2.WANIPConnection2)(nil)
+	_ upnpContextClient = (*internetgateway2.WANIPConnection1)(nil)
+	_ upnpContextClient = (*internetgateway2.WANPPPConnection1)(nil)
+)
+
 // UPnPMapper implements PortMapper using UPnP IGD protocol.
 // Supports WANIPConnection1, WANIPConnection2, and WANPPPConnection1 services.
 type UPnPMapper struct {
-	client upnpClient
+	client  upnpClient
+	localIP net.IP // internal client for mappings, nil to use the default route's address
 }
 
 // NewUPnPMapper discovers and creates a UPnP mapper.
@@ -93,6 +126,7 @@ func NewUPnPMapperContext(ctx context.Context) (*UPnPMapper, error) {
 }
 
 // discoverWANIPConnection2Ctx attempts to find WANIPConnection2 clients with context support.
+// If several devices respond, the one serving the default gateway is preferred.
 func discoverWANIPConnection2Ctx(ctx context.Context) (upnpClient, error) {
 	clients, _, err := internetgateway2.NewWANIPConnection2ClientsCtx(ctx)
 	if err != nil {
@@ -101,10 +135,11 @@ func discoverWANIPConnection2Ctx(ctx context.Context) (upnpClient, error) {
 	if len(clients) == 0 {
 		return nil, fmt.Errorf("no WANIPConnection2 devices found")
 	}
-	return clients[0], nil
+	return preferDefaultGatewayClient(clients), nil
 }
 
 // discoverWANIPConnection1Ctx attempts to find WANIPConnection1 clients with context support.
+// If several devices respond, the one serving the default gateway is preferred.
 func discoverWANIPConnection1Ctx(ctx context.Context) (upnpClient, error) {
 	clients, _, err := internetgateway2.NewWANIPConnection1ClientsCtx(ctx)
 	if err != nil {
@@ -113,10 +148,11 @@ func discoverWANIPConnection1Ctx(ctx context.Context) (upnpClient, error) {
 	if len(clients) == 0 {
 		return nil, fmt.Errorf("no WANIPConnection1 devices found")
 	}
-	return clients[0], nil
+	return preferDefaultGatewayClient(clients), nil
 }
 
 // discoverWANPPPConnection1Ctx attempts to find WANPPPConnection1 clients with context support.
+// If several devices respond, the one serving the default gateway is preferred.
 func discoverWANPPPConnection1Ctx(ctx context.Context) (upnpClient, error) {
 	clients, _, err := internetgateway2.NewWANPPPConnection1ClientsCtx(ctx)
 	if err != nil {
@@ -125,12 +161,95 @@ func discoverWANPPPConnection1Ctx(ctx context.Context) (upnpClient, error) {
 	if len(clients) == 0 {
 		return nil, fmt.Errorf("no WANPPPConnection1 devices found")
 	}
-	return clients[0], nil
+	return preferDefaultGatewayClient(clients), nil
+}
+
+// upnpServiceClient is implemented by the generated goupnp clients and
+// exposes the discovery metadata of the IGD.
+type upnpServiceClient interface {
+	GetServiceClient() *goupnp.ServiceClient
+}
+
+// upnpGatewayIP returns the address of the IGD serving client, taken from its
+// description URL, or nil if it is unknown.
+func upnpGatewayIP(client upnpClient) net.IP {
+	sc, ok := client.(upnpServiceClient)
+	if !ok {
+		return nil
+	}
+	c := sc.GetServiceClient()
+	if c == nil || c.Location == nil {
+		return nil
+	}
+	return net.ParseIP(c.Location.Hostname())
+}
+
+// Ensure UPnPMapper reports granted lease lifetimes, supports contexts, can
+// map for a specific address and can list the gateway's mappings.
+var (
+	_ LeasePortMapper     = (*UPnPMapper)(nil)
+	_ ContextPortMapper   = (*UPnPMapper)(nil)
+	_ LocalAddrPortMapper = (*UPnPMapper)(nil)
+	_ MappingLister       = (*UPnPMapper)(nil)
+)
+
+// MappingDescription is the description of UPnP mappings created by this
+// package, which identifies them in the gateway's mapping table.
+const MappingDescription = "nattraversal"
+
+// maxListedMappings bounds ListMappings on gateways that never report the
+// end of their mapping table.
+const maxListedMappings = 1024
+
+// upnpListClient is implemented by the goupnp clients that can enumerate
+// port mappings.
+type upnpListClient interface {
+	GetGenericPortMappingEntry(NewPortMappingIndex uint16) (
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+		NewInternalPort uint16,
+		NewInternalClient string,
+		NewEnabled bool,
+		NewPortMappingDescription string,
+		NewLeaseDuration uint32,
+		err error,
+	)
+}
+
+// ForLocalAddr returns a mapper that forwards mappings to ip instead of the
+// address of the default route. It fails if the IGD is not on the subnet of ip.
+func (u *UPnPMapper) ForLocalAddr(ip net.IP) (PortMapper, error) {
+	if gateway := upnpGatewayIP(u.client); gateway != nil {
+		if err := validateGatewayReachable(ip, gateway); err != nil {
+			return nil, fmt.Errorf("UPnP gateway unreachable from local address: %w", err)
+		}
+	} else {
+		log.WithField("localIP", ip.String()).Debug("UPnP gateway address unknown, skipping reachability check")
+	}
+	return &UPnPMapper{client: u.client, localIP: ip}, nil
 }
 
 // MapPort creates a port mapping via UPnP.
 func (u *UPnPMapper) MapPort(protocol string, internalPort int, duration time.Duration) (int, error) {
-	log.WithFields(logger.Fields{
+	result, err := u.MapPortWithLease(protocol, internalPort, duration)
+	if err != nil {
+		return 0, err
+	}
+	return result.ExternalPort, nil
+}
+
+// MapPortWithLease creates a port mapping via UPnP. The IGD AddPortMapping
+// action does not report the granted lease, so the requested duration is
+// returned as the lifetime.
+func (u *UPnPMapper) MapPortWithLease(protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	return u.MapPortContext(context.Background(), protocol, internalPort, duration)
+}
+
+// MapPortContext creates a port mapping via UPnP as MapPortWithLease does,
+// cancelling the request when ctx is done.
+func (u *UPnPMapper) MapPortContext(ctx context.Context, protocol string, internalPort int, duration time.Duration) (MapPortResult, error) {
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"internalPort": internalPort,
 		"duration":     duration.String(),
@@ -138,47 +257,44 @@ func (u *UPnPMapper) MapPort(protocol string, internalPort int, duration time.Du
 
 	// Validate port range before uint16 cast to prevent silent overflow
 	if internalPort < 1 || internalPort > 65535 {
-		return 0, fmt.Errorf("invalid port number: %d (must be 1-65535)", internalPort)
+		return MapPortResult{}, fmt.Errorf("invalid port number: %d (must be 1-65535)", internalPort)
 	}
 
 	localIP, err := u.getLocalIP()
 	if err != nil {
 		log.WithError(err).Error("failed to get local IP for UPnP port mapping")
-		return 0, fmt.Errorf("failed to get local IP: %w", err)
+		return MapPortResult{}, fmt.Errorf("failed to get local IP: %w", err)
 	}
 
 	leaseDuration := uint32(duration.Seconds())
 
-	err = u.client.AddPortMapping(
-		"",                   // remote host (any)
-		uint16(internalPort), // external port (same as internal)
-		protocol,             // TCP or UDP
-		uint16(internalPort), // internal port
-		localIP,              // internal client
-		true,                 // enabled
-		"nattraversal",       // description
-		leaseDuration,        // lease duration
-	)
+	err = u.addPortMapping(ctx, uint16(internalPort), protocol, localIP, leaseDuration)
 	if err != nil {
-		log.WithError(err).WithFields(logger.Fields{
+		log.WithError(err).WithFields(Fields{
 			"protocol":     protocol,
 			"internalPort": internalPort,
 		}).Error("UPnP port mapping failed")
-		return 0, fmt.Errorf("UPnP port mapping failed: %w", err)
+		return MapPortResult{}, fmt.Errorf("UPnP port mapping failed: %w", err)
 	}
 
-	log.WithFields(logger.Fields{
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"internalPort": internalPort,
 		"externalPort": internalPort,
 		"localIP":      localIP,
 	}).Debug("UPnP port mapped successfully")
-	return internalPort, nil
+	return MapPortResult{ExternalPort: internalPort, Lifetime: duration}, nil
 }
 
 // UnmapPort removes a port mapping via UPnP.
 func (u *UPnPMapper) UnmapPort(protocol string, externalPort int) error {
-	log.WithFields(logger.Fields{
+	return u.UnmapPortContext(context.Background(), protocol, externalPort)
+}
+
+// UnmapPortContext removes a port mapping via UPnP, cancelling the request
+// when ctx is done.
+func (u *UPnPMapper) UnmapPortContext(ctx context.Context, protocol string, externalPort int) error {
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"externalPort": externalPort,
 	}).Debug("unmapping port via UPnP")
@@ -188,16 +304,16 @@ func (u *UPnPMapper) UnmapPort(protocol string, externalPort int) error {
 		return fmt.Errorf("invalid port number: %d (must be 1-65535)", externalPort)
 	}
 
-	err := u.client.DeletePortMapping("", uint16(externalPort), protocol)
+	err := u.deletePortMapping(ctx, uint16(externalPort), protocol)
 	if err != nil {
-		log.WithError(err).WithFields(logger.Fields{
+		log.WithError(err).WithFields(Fields{
 			"protocol":     protocol,
 			"externalPort": externalPort,
 		}).Error("UPnP port unmapping failed")
 		return fmt.Errorf("UPnP port unmapping failed: %w", err)
 	}
 
-	log.WithFields(logger.Fields{
+	log.WithFields(Fields{
 		"protocol":     protocol,
 		"externalPort": externalPort,
 	}).Debug("UPnP port unmapped successfully")
@@ -206,8 +322,14 @@ func (u *UPnPMapper) UnmapPort(protocol string, externalPort int) error {
 
 // GetExternalIP returns the external IP address via UPnP.
 func (u *UPnPMapper) GetExternalIP() (string, error) {
+	return u.GetExternalIPContext(context.Background())
+}
+
+// GetExternalIPContext returns the external IP address via UPnP, cancelling
+// the request when ctx is done.
+func (u *UPnPMapper) GetExternalIPContext(ctx context.Context) (string, error) {
 	log.Debug("getting external IP via UPnP")
-	ip, err := u.client.GetExternalIPAddress()
+	ip, err := u.getExternalIPAddress(ctx)
 	if err != nil {
 		log.WithError(err).Error("UPnP external IP lookup failed")
 		return "", fmt.Errorf("UPnP external IP lookup failed: %w", err)
@@ -216,21 +338,107 @@ func (u *UPnPMapper) GetExternalIP() (string, error) {
 	return ip, nil
 }
 
+// addPortMapping maps externalPort to the same port on localIP. Clients
+// without context support are abandoned when ctx is done.
+func (u *UPnPMapper) addPortMapping(ctx context.Context, port uint16, protocol, localIP string, lease uint32) error {
+	if cc, ok := u.client.(upnpContextClient); ok {
+		return cc.AddPortMappingCtx(ctx,
+			"",                 // remote host (any)
+			port,               // external port (same as internal)
+			protocol,           // TCP or UDP
+			port,               // internal port
+			localIP,            // internal client
+			true,               // enabled
+			MappingDescription, // description
+			lease,              // lease duration
+		)
+	}
+	_, err := callContext(ctx, func() (struct{}, error) {
+		return struct{}{}, u.client.AddPortMapping("", port, protocol, port, localIP, true, MappingDescription, lease)
+	})
+	return err
+}
+
+// deletePortMapping removes the mapping of externalPort. Clients without
+// context support are abandoned when ctx is done.
+func (u *UPnPMapper) deletePortMapping(ctx context.Context, externalPort uint16, protocol string) error {
+	if cc, ok := u.client.(upnpContextClient); ok {
+		return cc.DeletePortMappingCtx(ctx, "", externalPort, protocol)
+	}
+	_, err := callContext(ctx, func() (struct{}, error) {
+		return struct{}{}, u.client.DeletePortMapping("", externalPort, protocol)
+	})
+	return err
+}
+
+// getExternalIPAddress asks the IGD for its external IP. Clients without
+// context support are abandoned when ctx is done.
+func (u *UPnPMapper) getExternalIPAddress(ctx context.Context) (string, error) {
+	if cc, ok := u.client.(upnpContextClient); ok {
+		return cc.GetExternalIPAddressCtx(ctx)
+	}
+	return callContext(ctx, u.client.GetExternalIPAddress)
+}
+
 // getLocalIP discovers the local IP address for port mapping.
+// The address is taken from the preferred default route where possible.
+// If the mapper was created for a specific local address, that address is used.
 func (u *UPnPMapper) getLocalIP() (string, error) {
+	if u.localIP != nil {
+		return u.localIP.String(), nil
+	}
 	log.Debug("discovering local IP for UPnP port mapping")
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+	ip, err := discoverLocalIP()
 	if err != nil {
-		log.WithError(err).Error("failed to dial for local IP discovery")
+		log.WithError(err).Error("failed to discover local IP")
 		return "", err
 	}
-	defer conn.Close()
+	log.WithField("localIP", ip.String()).Debug("local IP discovered for UPnP")
+	return ip.String(), nil
+}
 
-	// Use safe type assertion to prevent potential panic
-	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+// ListMappings returns the port mappings in the gateway's table.
+// The table is read entry by entry until the gateway reports the end of it
+// with SpecifiedArrayIndexInvalid. Any other error fails the listing rather
+// than returning a truncated table.
+func (u *UPnPMapper) ListMappings() ([]MappingEntry, error) {
+	lc, ok := u.client.(upnpListClient)
 	if !ok {
-		return "", fmt.Errorf("unexpected local address type: %T", conn.LocalAddr())
+		return nil, fmt.Errorf("UPnP client %T cannot list port mappings", u.client)
+	}
+
+	var entries []MappingEntry
+	for i := 0; i < maxListedMappings; i++ {
+		_, externalPort, protocol, internalPort, client, enabled, description, lease, err := lc.GetGenericPortMappingEntry(uint16(i))
+		if err != nil {
+			// The end of the table is reported as an error (SpecifiedArrayIndexInvalid)
+			if !isEndOfMappingTable(err) {
+				return nil, fmt.Errorf("UPnP port mapping listing failed at entry %d: %w", i, err)
+			}
+			break
+		}
+		entries = append(entries, MappingEntry{
+			Protocol:       protocol,
+			ExternalPort:   int(externalPort),
+			InternalClient: client,
+			InternalPort:   int(internalPort),
+			Description:    description,
+			Enabled:        enabled,
+			Lease:          time.Duration(lease) * time.Second,
+		})
+	}
+
+	log.WithField("count", len(entries)).Debug("UPnP port mappings listed")
+	return entries, nil
+}
+
+// isEndOfMappingTable reports whether err is the SpecifiedArrayIndexInvalid
+// (713) SOAP fault a gateway returns for an index past the end of its
+// mapping table.
+func isEndOfMappingTable(err error) bool {
+	var fault *soap.SOAPFaultError
+	if !errors.As(err, &fault) {
+		return false
 	}
-	log.WithField("localIP", localAddr.IP.String()).Debug("local IP discovered for UPnP")
-	return localAddr.IP.String(), nil
+	return fault.Detail.UPnPError.Errorcode == 713
 }
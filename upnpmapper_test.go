@@ -0,0 +1,174 @@
+package nattraversal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/huin/goupnp/soap"
+)
+
+// fakeListClient is a fakeUPnPClient with a port mapping table.
+type fakeListClient struct {
+	fakeUPnPClient
+	entries []MappingEntry
+	err     error // returned for the index past the end of the table
+	failAt  int   // index of an entry that fails with failErr, if set
+	failErr error
+}
+
+func (c *fakeListClient) GetGenericPortMappingEntry(index uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	if c.failErr != nil && int(index) == c.failAt {
+		return "", 0, "", 0, "", false, "", 0, c.failErr
+	}
+	if int(index) >= len(c.entries) {
+		return "", 0, "", 0, "", false, "", 0, c.err
+	}
+	e := c.entries[index]
+	return "", uint16(e.ExternalPort), e.Protocol, uint16(e.InternalPort), e.InternalClient, e.Enabled, e.Description, uint32(e.Lease / time.Second), nil
+}
+
+// arrayIndexFault returns the fault gateways report past the end of the table.
+func arrayIndexFault() error {
+	fault := &soap.SOAPFaultError{}
+	fault.Detail.UPnPError.Errorcode = 713
+	return fault
+}
+
+// TestUPnPListMappings tests reading the gateway's mapping table
+func TestUPnPListMappings(t *testing.T) {
+	client := &fakeListClient{
+		entries: []MappingEntry{
+			{Protocol: "TCP", ExternalPort: 8080, InternalClient: "192.168.1.2", InternalPort: 8080, Description: MappingDescription, Enabled: true, Lease: time.Hour},
+			{Protocol: "UDP", ExternalPort: 9000, InternalClient: "192.168.1.3", InternalPort: 9001, Description: "other"},
+		},
+		err: arrayIndexFault(),
+	}
+	mapper := &UPnPMapper{client: client}
+
+	entries, err := mapper.ListMappings()
+	if err != nil {
+		t.Fatalf("ListMappings failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0] != client.entries[0] || entries[1] != client.entries[1] {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+
+	// A failure past the first entry does not truncate the table
+	client.failAt, client.failErr = 1, errors.New("connection reset")
+	if entries, err := mapper.ListMappings(); err == nil {
+		t.Errorf("Expected an error for a failed entry, got %d entries", len(entries))
+	}
+	noSuchEntry := &soap.SOAPFaultError{}
+	noSuchEntry.Detail.UPnPError.Errorcode = 714
+	client.failErr = noSuchEntry
+	if _, err := mapper.ListMappings(); err == nil {
+		t.Error("Expected only SpecifiedArrayIndexInvalid to end the table")
+	}
+	client.failErr = nil
+
+	// An empty table is not an error
+	client.entries = nil
+	if entries, err := mapper.ListMappings(); err != nil || len(entries) != 0 {
+		t.Errorf("Expected an empty table, got %v, %v", entries, err)
+	}
+
+	// Other failures on the first entry are
+	client.err = errors.New("connection refused")
+	if _, err := mapper.ListMappings(); err == nil {
+		t.Error("Expected an error when the gateway cannot be read")
+	}
+
+	// Clients without listing support
+	if _, err := (&UPnPMapper{client: &fakeUPnPClient{}}).ListMappings(); err == nil {
+		t.Error("Expected an error for a client that cannot list mappings")
+	}
+}
+
+// fakeContextClient is a fakeUPnPClient whose requests block until their
+// context is done.
+type fakeContextClient struct {
+	fakeUPnPClient
+}
+
+func (c *fakeContextClient) AddPortMappingCtx(ctx context.Context, _ string, _ uint16, _ string, _ uint16, _ string, _ bool, _ string, _ uint32) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (c *fakeContextClient) DeletePortMappingCtx(ctx context.Context, _ string, _ uint16, _ string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (c *fakeContextClient) GetExternalIPAddressCtx(ctx context.Context) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+// TestUPnPMapperContext tests that requests are bounded by their context
+func TestUPnPMapperContext(t *testing.T) {
+	mapper := &UPnPMapper{client: &fakeContextClient{}, localIP: net.ParseIP("192.168.1.2")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := mapper.MapPortContext(ctx, "TCP", 8080, time.Hour); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected MapPortContext to time out, got %v", err)
+	}
+	if err := mapper.UnmapPortContext(ctx, "TCP", 8080); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected UnmapPortContext to time out, got %v", err)
+	}
+	if _, err := mapper.GetExternalIPContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected GetExternalIPContext to time out, got %v", err)
+	}
+
+	// Clients without context support still succeed
+	mapper = &UPnPMapper{client: &fakeUPnPClient{}, localIP: net.ParseIP("192.168.1.2")}
+	if ip, err := mapper.GetExternalIPContext(context.Background()); err != nil || ip != "203.0.113.10" {
+		t.Errorf("Unexpected external IP %q, %v", ip, err)
+	}
+}
+
+// slowMapper is a mapper without context support whose requests take delay.
+type slowMapper struct {
+	*MockPortMapper
+	delay time.Duration
+}
+
+func (m *slowMapper) MapPort(protocol string, internalPort int, duration time.Duration) (int, error) {
+	time.Sleep(m.delay)
+	return m.MockPortMapper.MapPort(protocol, internalPort, duration)
+}
+
+// TestAsContextPortMapper tests adapting mappers without context support
+func TestAsContextPortMapper(t *testing.T) {
+	upnp := &UPnPMapper{client: &fakeUPnPClient{}}
+	if AsContextPortMapper(upnp) != ContextPortMapper(upnp) {
+		t.Error("Built-in mapper was wrapped")
+	}
+
+	slow := &slowMapper{MockPortMapper: NewMockPortMapper(), delay: 200 * time.Millisecond}
+	adapted := AsContextPortMapper(slow)
+	if name := MapperName(adapted); name != MapperName(slow) {
+		t.Errorf("Adapter named %q", name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := adapted.MapPortContext(ctx, "TCP", 8080, time.Hour); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the adapter to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("Adapter waited %v for the mapper", elapsed)
+	}
+
+	result, err := adapted.MapPortContext(context.Background(), "TCP", 8081, time.Hour)
+	if err != nil || result.ExternalPort != 8081 || result.Lifetime != time.Hour {
+		t.Errorf("Unexpected mapping %+v, %v", result, err)
+	}
+	if ip, err := adapted.GetExternalIPContext(context.Background()); err != nil || ip != "203.0.113.100" {
+		t.Errorf("Unexpected external IP %q, %v", ip, err)
+	}
+}
@@ -2,92 +2,162 @@ package nattraversal
 
 import (
 	"context"
-
-	"github.com/go-i2p/logger"
+	"fmt"
+	"net"
+	"time"
 )
 
 // createTCPMapping establishes a TCP port mapping.
 // Moved from: listener.go
-func createTCPMapping(port int) (PortMapper, int, error) {
+func createTCPMapping(port int) (PortMapper, MapPortResult, error) {
 	return createTCPMappingContext(context.Background(), port)
 }
 
 // createTCPMappingContext establishes a TCP port mapping with context support.
 // The context is checked before and after the discovery and mapping operations.
-func createTCPMappingContext(ctx context.Context, port int) (PortMapper, int, error) {
-	log.WithField("port", port).Debug("creating TCP port mapping")
+func createTCPMappingContext(ctx context.Context, port int) (PortMapper, MapPortResult, error) {
+	return (&ListenConfig{}).createMapping(ctx, "TCP", port)
+}
+
+// createUDPMapping establishes a UDP port mapping.
+// Moved from: packetlistener.go
+func createUDPMapping(port int) (PortMapper, MapPortResult, error) {
+	return createUDPMappingContext(context.Background(), port)
+}
+
+// createUDPMappingContext establishes a UDP port mapping with context support.
+// The context is checked before and after the discovery and mapping operations.
+func createUDPMappingContext(ctx context.Context, port int) (PortMapper, MapPortResult, error) {
+	return (&ListenConfig{}).createMapping(ctx, "UDP", port)
+}
+
+// createMapping discovers a port mapper as configured by lc and establishes a
+// mapping for port. The context is checked before and after the discovery and
+// mapping operations.
+func (lc *ListenConfig) createMapping(ctx context.Context, protocol string, port int) (PortMapper, MapPortResult, error) {
+	log := lc.logger()
+	log.WithFields(Fields{
+		"port":     port,
+		"protocol": protocol,
+	}).Debug("creating port mapping")
 
 	if err := ctx.Err(); err != nil {
-		return nil, 0, err
+		return nil, MapPortResult{}, err
 	}
 
-	mapper, err := NewPortMapperContext(ctx)
+	mapper, err := lc.portMapper(ctx)
 	if err != nil {
-		log.WithError(err).WithField("port", port).Error("failed to create port mapper for TCP")
-		return nil, 0, err
+		log.WithError(err).WithFields(Fields{
+			"port":     port,
+			"protocol": protocol,
+		}).Error("failed to create port mapper")
+		return nil, MapPortResult{}, err
 	}
 
 	if err := ctx.Err(); err != nil {
-		return nil, 0, err
+		return nil, MapPortResult{}, err
 	}
 
-	externalPort, err := mapper.MapPort("TCP", port, mappingDuration)
+	result, err := mapListenerPort(ctx, mapper, protocol, port)
 	if err != nil {
-		log.WithError(err).WithFields(logger.Fields{
+		log.WithError(err).WithFields(Fields{
 			"port":     port,
-			"protocol": "TCP",
-		}).Error("TCP port mapping failed")
-		return nil, 0, err
+			"protocol": protocol,
+		}).Error("port mapping failed")
+		return nil, MapPortResult{}, err
 	}
 
-	log.WithFields(logger.Fields{
-		"internalPort": port,
-		"externalPort": externalPort,
-		"protocol":     "TCP",
-	}).Debug("TCP port mapping established")
-	return mapper, externalPort, nil
+	log.WithFields(Fields{
+		"internalPort":  port,
+		"externalPort":  result.ExternalPort,
+		"leaseLifetime": result.Lifetime.String(),
+		"protocol":      protocol,
+	}).Debug("port mapping established")
+	return mapper, result, nil
 }
 
-// createUDPMapping establishes a UDP port mapping.
-// Moved from: packetlistener.go
-func createUDPMapping(port int) (PortMapper, int, error) {
-	return createUDPMappingContext(context.Background(), port)
+// mapListenerPort creates the mapping for a listener's internal port and
+// emits a Mapped event with the outcome.
+func mapListenerPort(ctx context.Context, mapper PortMapper, protocol string, port int) (MapPortResult, error) {
+	start := time.Now()
+	result, err := mapPortContext(ctx, mapper, protocol, port, mappingDuration)
+	emit(Event{
+		Kind:         Mapped,
+		Mapper:       MapperName(mapper),
+		Protocol:     protocol,
+		InternalPort: port,
+		ExternalPort: result.ExternalPort,
+		Duration:     time.Since(start),
+		Lifetime:     result.Lifetime,
+		Err:          err,
+	})
+	return result, err
 }
 
-// createUDPMappingContext establishes a UDP port mapping with context support.
-// The context is checked before and after the discovery and mapping operations.
-func createUDPMappingContext(ctx context.Context, port int) (PortMapper, int, error) {
-	log.WithField("port", port).Debug("creating UDP port mapping")
-
-	if err := ctx.Err(); err != nil {
-		return nil, 0, err
+// mapperDiscovery discovers a port mapper.
+type mapperDiscovery func(ctx context.Context) (PortMapper, error)
+
+// newPortMapper is the discovery function used by listeners. It is a variable
+// so tests can inject a mock mapper.
+var newPortMapper mapperDiscovery = NewPortMapperContext
+
+// remapAfterNetworkChange rediscovers a port mapper, re-creates the mapping for the
+// renewal manager's internal port, and hands the new mapping to the renewal manager.
+// The mapper is rediscovered with discover, or newPortMapper if it is nil.
+// If localIP is set, the mapping is created for that address as with ListenAddr.
+// It returns the new external IP and port.
+func remapAfterNetworkChange(renewal *RenewalManager, discover mapperDiscovery, localIP net.IP) (string, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remapTimeout)
+	defer cancel()
+
+	renewal.log.WithFields(Fields{
+		"protocol":     renewal.protocol,
+		"internalPort": renewal.internalPort,
+	}).Debug("re-mapping port after network change")
+
+	if discover == nil {
+		discover = newPortMapper
 	}
-
-	mapper, err := NewPortMapperContext(ctx)
+	mapper, err := discover(ctx)
 	if err != nil {
-		log.WithError(err).WithField("port", port).Error("failed to create port mapper for UDP")
-		return nil, 0, err
+		return "", 0, fmt.Errorf("port mapper rediscovery failed: %w", err)
 	}
+	if localIP != nil {
+		if mapper, err = localAddrMapper(ctx, mapper, localIP); err != nil {
+			return "", 0, err
+		}
+	}
+	return remapWithMapper(ctx, renewal, mapper)
+}
 
-	if err := ctx.Err(); err != nil {
-		return nil, 0, err
+// remapWithMapper re-creates the mapping for the renewal manager's internal port
+// through mapper and hands the new mapping to the renewal manager.
+// It returns the new external IP and port.
+func remapWithMapper(ctx context.Context, renewal *RenewalManager, mapper PortMapper) (string, int, error) {
+	result, err := mapListenerPort(ctx, mapper, renewal.protocol, renewal.internalPort)
+	if err != nil {
+		return "", 0, fmt.Errorf("re-mapping failed: %w", err)
 	}
+	externalPort := result.ExternalPort
 
-	externalPort, err := mapper.MapPort("UDP", port, mappingDuration)
+	externalIP, err := externalIPContext(ctx, mapper)
 	if err != nil {
-		log.WithError(err).WithFields(logger.Fields{
-			"port":     port,
-			"protocol": "UDP",
-		}).Error("UDP port mapping failed")
-		return nil, 0, err
+		mapper.UnmapPort(renewal.protocol, externalPort)
+		return "", 0, fmt.Errorf("failed to get external IP: %w", err)
+	}
+
+	if err := renewal.replaceMapping(mapper, result); err != nil {
+		mapper.UnmapPort(renewal.protocol, externalPort)
+		return "", 0, err
 	}
 
-	log.WithFields(logger.Fields{
-		"internalPort": port,
+	renewal.log.WithFields(Fields{
+		"protocol":     renewal.protocol,
+		"internalPort": renewal.internalPort,
+		"externalIP":   externalIP,
 		"externalPort": externalPort,
-		"protocol":     "UDP",
-	}).Debug("UDP port mapping established")
-	return mapper, externalPort, nil
+	}).Info("port re-mapped after network change")
+	return externalIP, externalPort, nil
 }
 
 // Gateway discovery functions have been moved to platform-specific files:
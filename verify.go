@@ -0,0 +1,383 @@
+package nattraversal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// VerificationStatus is the verdict of a reachability verification.
+type VerificationStatus int
+
+const (
+	// VerificationUnknown means reachability has not been verified.
+	VerificationUnknown VerificationStatus = iota
+	// VerificationReachable means the external address was reached.
+	VerificationReachable
+	// VerificationUnreachable means neither the hairpin check nor the
+	// prober could reach the external address.
+	VerificationUnreachable
+)
+
+// String returns a human-readable name for the verification status.
+func (s VerificationStatus) String() string {
+	switch s {
+	case VerificationUnknown:
+		return "unknown"
+	case VerificationReachable:
+		return "reachable"
+	case VerificationUnreachable:
+		return "unreachable"
+	default:
+		return fmt.Sprintf("VerificationStatus(%d)", int(s))
+	}
+}
+
+// VerificationMethod identifies how the external address was reached.
+type VerificationMethod string
+
+const (
+	// VerifiedByHairpin means the host reached its own external address
+	// through the gateway's hairpin (NAT loopback) support.
+	VerifiedByHairpin VerificationMethod = "hairpin"
+	// VerifiedByProber means a ReachabilityProber outside the NAT reached
+	// the external address.
+	VerifiedByProber VerificationMethod = "prober"
+)
+
+// VerificationResult records the outcome of VerifyReachability.
+type VerificationResult struct {
+	Status VerificationStatus
+	// Method is how the address was reached; empty unless Status is
+	// VerificationReachable.
+	Method VerificationMethod
+	// Addr is the external address that was checked.
+	Addr string
+	// Hairpin reports whether the hairpin check succeeded.
+	Hairpin bool
+	// SymmetricNAT reports whether the NAT assigns a different external port
+	// per destination. It is only checked if the address was unreachable and
+	// the prober implements SymmetricNATProber.
+	SymmetricNAT bool
+	// Err describes why the address could not be reached.
+	Err       error
+	CheckedAt time.Time
+}
+
+// ReachabilityProber asks a host outside the NAT to reach an address.
+// EchoProber implements it using an EchoServer.
+type ReachabilityProber interface {
+	// ProbeTCP returns nil if a TCP connection to addr could be established.
+	ProbeTCP(ctx context.Context, addr string) error
+	// ProbeUDP asks for a datagram carrying payload to be sent to addr.
+	// Delivery is confirmed by the listener, not the prober.
+	ProbeUDP(ctx context.Context, addr string, payload []byte) error
+}
+
+// TCPPayloadProber is implemented by probers that can send a payload over
+// the TCP probe connection. The listener recognises the payload, which
+// proves that it accepted the probe, and keeps the connection from the
+// application. EchoProber implements it.
+type TCPPayloadProber interface {
+	ProbeTCPPayload(ctx context.Context, addr string, payload []byte) error
+}
+
+// SymmetricNATProber is implemented by probers that can tell whether the
+// NAT maps outgoing UDP traffic to a different external port for each
+// destination. Peers cannot punch holes through such a NAT.
+type SymmetricNATProber interface {
+	ProbeSymmetricNAT(ctx context.Context) (bool, error)
+}
+
+// probeMagic prefixes probe datagrams and the first bytes sent over probe
+// connections, followed by a random nonce.
+var probeMagic = []byte("NATPROBE")
+
+const probeNonceSize = 16
+
+// probeFilter tracks probes in flight and recognises probe datagrams and
+// connections so they are not delivered to the application.
+type probeFilter struct {
+	mu      sync.Mutex
+	pending map[string]chan struct{}
+}
+
+// register creates a probe payload and returns a channel that is closed
+// when the payload is received, and a function to stop waiting for it.
+func (f *probeFilter) register() ([]byte, <-chan struct{}, func(), error) {
+	payload := make([]byte, len(probeMagic)+probeNonceSize)
+	copy(payload, probeMagic)
+	if _, err := rand.Read(payload[len(probeMagic):]); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to generate probe nonce: %w", err)
+	}
+	nonce := string(payload[len(probeMagic):])
+	received := make(chan struct{})
+
+	f.mu.Lock()
+	if f.pending == nil {
+		f.pending = make(map[string]chan struct{})
+	}
+	f.pending[nonce] = received
+	f.mu.Unlock()
+
+	cancel := func() {
+		f.mu.Lock()
+		delete(f.pending, nonce)
+		f.mu.Unlock()
+	}
+	return payload, received, cancel, nil
+}
+
+// match reports whether p is a probe datagram, and signals the probe it
+// belongs to. Probe datagrams with unknown nonces, such as retransmissions
+// of completed probes, are matched as well so they are dropped.
+func (f *probeFilter) match(p []byte) bool {
+	if f == nil || len(p) != len(probeMagic)+probeNonceSize || !bytes.HasPrefix(p, probeMagic) {
+		return false
+	}
+	nonce := string(p[len(probeMagic):])
+
+	f.mu.Lock()
+	received, ok := f.pending[nonce]
+	delete(f.pending, nonce)
+	f.mu.Unlock()
+
+	if ok {
+		close(received)
+	}
+	return true
+}
+
+// active reports whether any probe is waiting to be received.
+func (f *probeFilter) active() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.pending) > 0
+}
+
+// peekTCP reads the first bytes of conn for up to probePeekTimeout and
+// reports whether they are a probe payload, signalling the probe it belongs
+// to. Otherwise it returns conn with the bytes read replayed to the reader.
+func (f *probeFilter) peekTCP(conn net.Conn) (net.Conn, bool) {
+	buf := make([]byte, len(probeMagic)+probeNonceSize)
+	conn.SetReadDeadline(time.Now().Add(probePeekTimeout))
+	n, _ := io.ReadFull(conn, buf)
+	conn.SetReadDeadline(time.Time{})
+
+	if f.match(buf[:n]) {
+		return nil, true
+	}
+	if n == 0 {
+		return conn, false
+	}
+	return &prefixConn{Conn: conn, prefix: buf[:n]}, false
+}
+
+// prefixConn replays bytes already read from Conn before reading from it.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+// Read returns the replayed bytes first, then reads from the connection.
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// verifyTCP checks that externalAddr accepts TCP connections, first by
+// connecting through the gateway's hairpin, then through prober if set.
+// With a prober, its verdict is authoritative since hairpin success does
+// not rule out filtering by the ISP. Probe connections carry a payload that
+// filter must see arrive on the listener, so a connection answered by
+// another host does not count. A prober that does not implement
+// TCPPayloadProber is trusted on its word.
+func verifyTCP(ctx context.Context, externalAddr string, filter *probeFilter, prober ReachabilityProber) VerificationResult {
+	result := VerificationResult{Addr: externalAddr}
+
+	hairpinErr := hairpinTCP(ctx, externalAddr, filter)
+	result.Hairpin = hairpinErr == nil
+
+	return finishVerification(ctx, result, hairpinErr, prober, func(ctx context.Context) error {
+		pp, ok := prober.(TCPPayloadProber)
+		if !ok {
+			return prober.ProbeTCP(ctx, externalAddr)
+		}
+		payload, received, cancel, err := filter.register()
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		if err := pp.ProbeTCPPayload(ctx, externalAddr, payload); err != nil {
+			return err
+		}
+		return waitForProbe(ctx, received)
+	})
+}
+
+// verifyUDP checks that externalAddr receives UDP datagrams, first by
+// sending a probe through the gateway's hairpin, then through prober if
+// set. Probes are recognised by filter when the application reads from
+// the listener's packet connection, so verification only succeeds while
+// the application is reading.
+func verifyUDP(ctx context.Context, externalAddr string, filter *probeFilter, prober ReachabilityProber) VerificationResult {
+	result := VerificationResult{Addr: externalAddr}
+
+	hairpinErr := hairpinUDP(ctx, externalAddr, filter)
+	result.Hairpin = hairpinErr == nil
+
+	return finishVerification(ctx, result, hairpinErr, prober, func(ctx context.Context) error {
+		payload, received, cancel, err := filter.register()
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		if err := prober.ProbeUDP(ctx, externalAddr, payload); err != nil {
+			return err
+		}
+		return waitForProbe(ctx, received)
+	})
+}
+
+// finishVerification completes result from the hairpin outcome and, if
+// prober is set, the outcome of probe.
+func finishVerification(ctx context.Context, result VerificationResult, hairpinErr error, prober ReachabilityProber, probe func(ctx context.Context) error) VerificationResult {
+	err := hairpinErr
+	if hairpinErr != nil {
+		err = fmt.Errorf("hairpin check failed: %w", hairpinErr)
+	}
+	result.Status = VerificationUnreachable
+	if result.Hairpin {
+		result.Status = VerificationReachable
+		result.Method = VerifiedByHairpin
+	}
+
+	if prober != nil {
+		probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		probeErr := probe(probeCtx)
+		cancel()
+		if probeErr == nil {
+			result.Status = VerificationReachable
+			result.Method = VerifiedByProber
+			err = nil
+		} else {
+			result.Status = VerificationUnreachable
+			result.Method = ""
+			err = errors.Join(err, fmt.Errorf("probe failed: %w", probeErr))
+		}
+	}
+
+	if result.Status == VerificationUnreachable {
+		if sp, ok := prober.(SymmetricNATProber); ok {
+			probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+			symmetric, symErr := sp.ProbeSymmetricNAT(probeCtx)
+			cancel()
+			if symErr != nil {
+				log.WithError(symErr).Debug("symmetric NAT probe failed")
+			}
+			result.SymmetricNAT = symmetric
+		}
+		result.Err = err
+	}
+	result.CheckedAt = time.Now()
+
+	log.WithFields(Fields{
+		"addr":      result.Addr,
+		"status":    result.Status.String(),
+		"method":    string(result.Method),
+		"hairpin":   result.Hairpin,
+		"symmetric": result.SymmetricNAT,
+	}).Debug("reachability verification finished")
+	return result
+}
+
+// hairpinTCP connects to externalAddr and sends a probe payload, then waits
+// for filter to see it arrive on the listener.
+func hairpinTCP(ctx context.Context, externalAddr string, filter *probeFilter) error {
+	payload, received, cancel, err := filter.register()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	ctx, cancelTimeout := context.WithTimeout(ctx, hairpinTimeout)
+	defer cancelTimeout()
+
+	if err := sendTCPProbe(ctx, externalAddr, payload); err != nil {
+		return err
+	}
+	return waitForProbe(ctx, received)
+}
+
+// sendTCPProbe connects to addr and writes payload.
+func sendTCPProbe(ctx context.Context, addr string, payload []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+	_, err = conn.Write(payload)
+	return err
+}
+
+// hairpinUDP sends a probe datagram to externalAddr from a separate socket
+// and waits for filter to see it arrive, retransmitting a few times.
+func hairpinUDP(ctx context.Context, externalAddr string, filter *probeFilter) error {
+	raddr, err := net.ResolveUDPAddr("udp", externalAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	payload, received, cancel, err := filter.register()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	ctx, cancelTimeout := context.WithTimeout(ctx, hairpinTimeout)
+	defer cancelTimeout()
+
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := conn.WriteToUDP(payload, raddr); err != nil {
+			return err
+		}
+		select {
+		case <-received:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("probe datagram not received: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitForProbe waits until received is closed or ctx is done.
+func waitForProbe(ctx context.Context, received <-chan struct{}) error {
+	select {
+	case <-received:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("probe not received: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,333 @@
+package nattraversal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startEchoServer runs an EchoServer on a loopback port for the test.
+func startEchoServer(t *testing.T) *EchoProber {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen for echo server: %v", err)
+	}
+	server := &EchoServer{Timeout: time.Second}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return NewEchoProber(l.Addr().String())
+}
+
+// TestVerifyReachabilityTCP tests hairpin and prober verification of a TCP listener
+func TestVerifyReachabilityTCP(t *testing.T) {
+	// A direct mapper on loopback makes the external address reachable
+	useMockPortMapper(t, &DirectPortMapper{publicIP: "127.0.0.1"})
+	prober := startEchoServer(t)
+
+	t.Run("Hairpin", func(t *testing.T) {
+		listener, err := (&ListenConfig{}).Listen(context.Background(), freePorts(t, 1)[0])
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		defer listener.Close()
+
+		if listener.Verification().Status != VerificationUnknown {
+			t.Error("Expected unknown verification before VerifyReachability")
+		}
+		result, err := listener.VerifyReachability(context.Background())
+		if err != nil {
+			t.Fatalf("VerifyReachability failed: %v", err)
+		}
+		if result.Status != VerificationReachable || result.Method != VerifiedByHairpin || !result.Hairpin {
+			t.Errorf("Expected reachable by hairpin, got %+v", result)
+		}
+		if listener.Verification().Status != VerificationReachable {
+			t.Error("Expected verification result to be recorded on the listener")
+		}
+	})
+
+	t.Run("Prober", func(t *testing.T) {
+		listener, err := (&ListenConfig{Prober: prober}).Listen(context.Background(), freePorts(t, 1)[0])
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		defer listener.Close()
+
+		result, _ := listener.VerifyReachability(context.Background())
+		if result.Status != VerificationReachable || result.Method != VerifiedByProber {
+			t.Errorf("Expected reachable by prober, got %+v", result)
+		}
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		// The mock mapper reports an external port nothing listens on
+		mapper := NewMockPortMapper()
+		mapper.SetExternalIP("127.0.0.1")
+		mapper.SetNATType(RestrictedNAT)
+		useMockPortMapper(t, mapper)
+
+		listener, err := (&ListenConfig{Prober: prober}).Listen(context.Background(), freePorts(t, 1)[0])
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		defer listener.Close()
+
+		result, _ := listener.VerifyReachability(context.Background())
+		if result.Status != VerificationUnreachable || result.Hairpin || result.Err == nil {
+			t.Errorf("Expected unreachable with an error, got %+v", result)
+		}
+	})
+}
+
+// TestVerifyTCPRequiresProbePayload tests that a connection accepted by
+// another host than the listener does not count as reachable
+func TestVerifyTCPRequiresProbePayload(t *testing.T) {
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer other.Close()
+	go func() {
+		for {
+			conn, err := other.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	var filter probeFilter
+	result := verifyTCP(context.Background(), other.Addr().String(), &filter, nil)
+	if result.Status != VerificationUnreachable || result.Hairpin {
+		t.Errorf("Expected unreachable without hairpin, got %+v", result)
+	}
+}
+
+// TestVerifyReachabilityTCPHidesProbes tests that probe connections are not
+// returned by Accept while application connections pass through intact
+func TestVerifyReachabilityTCPHidesProbes(t *testing.T) {
+	useMockPortMapper(t, &DirectPortMapper{publicIP: "127.0.0.1"})
+	prober := startEchoServer(t)
+
+	listener, err := (&ListenConfig{Prober: prober}).Listen(context.Background(), freePorts(t, 1)[0])
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	result, err := listener.VerifyReachability(context.Background())
+	if err != nil {
+		t.Fatalf("VerifyReachability failed: %v", err)
+	}
+	if result.Status != VerificationReachable || result.Method != VerifiedByProber || !result.Hairpin {
+		t.Errorf("Expected reachable by prober with hairpin, got %+v", result)
+	}
+
+	client, err := net.Dial("tcp", listener.Addr().(*NATAddr).ExternalAddr())
+	if err != nil {
+		t.Fatalf("Failed to dial listener: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("hello"))
+
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		buf := make([]byte, 5)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if n, _ := io.ReadFull(conn, buf); string(buf[:n]) != "hello" {
+			t.Errorf("Expected only the application connection, read %q", buf[:n])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected application connection")
+	}
+}
+
+// TestProbeFilterPeekTCP tests that peeked bytes of other connections are
+// replayed to the reader
+func TestProbeFilterPeekTCP(t *testing.T) {
+	var filter probeFilter
+	payload, received, cancel, err := filter.register()
+	if err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	defer cancel()
+
+	server, client := net.Pipe()
+	go client.Write(payload)
+	if _, probe := filter.peekTCP(server); !probe {
+		t.Error("Expected probe payload to be recognised")
+	}
+	select {
+	case <-received:
+	default:
+		t.Error("Expected probe to be signalled")
+	}
+
+	server, client = net.Pipe()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1"))
+		client.Close()
+	}()
+	conn, probe := filter.peekTCP(server)
+	if probe {
+		t.Fatal("Expected application data not to be a probe")
+	}
+	data, _ := io.ReadAll(conn)
+	if string(data) != "GET / HTTP/1.1" {
+		t.Errorf("Expected peeked bytes to be replayed, got %q", data)
+	}
+}
+
+// TestVerifyReachabilityUDP tests that probe datagrams verify a UDP listener
+// without reaching the application
+func TestVerifyReachabilityUDP(t *testing.T) {
+	useMockPortMapper(t, &DirectPortMapper{publicIP: "127.0.0.1"})
+	prober := startEchoServer(t)
+
+	listener, err := (&ListenConfig{Prober: prober}).ListenPacket(context.Background(), freePorts(t, 1)[0])
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := listener.PacketConn().ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	result, err := listener.VerifyReachability(context.Background())
+	if err != nil {
+		t.Fatalf("VerifyReachability failed: %v", err)
+	}
+	if result.Status != VerificationReachable || result.Method != VerifiedByProber || !result.Hairpin {
+		t.Errorf("Expected reachable by prober with hairpin, got %+v", result)
+	}
+
+	// Application datagrams still pass through
+	sender, err := net.Dial("udp", listener.Addr().(*NATAddr).ExternalAddr())
+	if err != nil {
+		t.Fatalf("Failed to dial listener: %v", err)
+	}
+	defer sender.Close()
+	sender.Write([]byte("hello"))
+
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, []byte("hello")) {
+			t.Errorf("Expected only application data, got %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected application datagram")
+	}
+}
+
+// TestEchoServerRejectsThirdPartyTargets tests that the echo server only
+// probes the requesting host by default
+func TestEchoServerRejectsThirdPartyTargets(t *testing.T) {
+	prober := startEchoServer(t)
+
+	err := prober.ProbeTCP(context.Background(), "192.0.2.1:80")
+	if err == nil || !strings.Contains(err.Error(), "not the client's address") {
+		t.Errorf("Expected third-party target to be rejected, got %v", err)
+	}
+}
+
+// TestEchoServerCapsProbes tests that probes beyond MaxProbes wait for a free slot
+func TestEchoServerCapsProbes(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen for echo server: %v", err)
+	}
+	server := &EchoServer{Timeout: time.Second, MaxProbes: 1}
+	go server.Serve(l)
+	defer server.Close()
+	prober := NewEchoProber(l.Addr().String())
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen for target: %v", err)
+	}
+	defer target.Close()
+
+	// A client that never sends its request holds the only slot
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to echo server: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := prober.ProbeTCP(ctx, target.Addr().String()); err == nil {
+		t.Fatal("Expected probe to wait while the slot is held")
+	}
+
+	idle.Close()
+	if err := prober.ProbeTCP(context.Background(), target.Addr().String()); err != nil {
+		t.Errorf("Expected probe to run once the slot is free, got %v", err)
+	}
+}
+
+// TestEchoServerAddressRequestSize tests that address requests must be at
+// least as large as the answer
+func TestEchoServerAddressRequestSize(t *testing.T) {
+	server := &EchoServer{}
+	defer server.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.ServePacket(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	buf := make([]byte, 128)
+
+	client.Write([]byte(echoAddrRequest))
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := client.Read(buf); err == nil {
+		t.Errorf("Expected no answer to an unpadded request, got %q", buf[:n])
+	}
+
+	request := make([]byte, echoAddrRequestLen)
+	copy(request, echoAddrRequest)
+	client.Write(request)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected answer to a padded request: %v", err)
+	}
+	if n > len(request) {
+		t.Errorf("Expected answer of at most %d bytes, got %d", len(request), n)
+	}
+	if want := echoAddrRequest + " " + client.LocalAddr().String(); string(buf[:n]) != want {
+		t.Errorf("Expected answer %q, got %q", want, buf[:n])
+	}
+}